@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"goxcms/database"
+	handlers "goxcms/handler"
+	"goxcms/model"
+	"goxcms/plugin_system"
+	"goxcms/utils"
+	"io"
+	"os"
+	"os/user"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/term"
+	"gorm.io/gorm"
+)
+
+const usage = `Usage: goxcms [command]
+
+Without a command the server is started.
+
+Commands:
+  serve                                   start the web server
+  migrate up [namespace...]               apply pending migrations
+  migrate down <namespace> [steps]        roll back the last migrations of a namespace (default 1)
+  migrate status [namespace...]           list migrations and whether they are applied
+  user create [flags] <username>          create a user, flags: -email, -role, -first-name, -last-name
+  user set-password <username>            change the password of a user
+  user set-role <username> <role>         change the role of a user
+  plugin list                             list plugins and whether they are enabled
+  plugin enable <name>                    enable a plugin
+  plugin disable <name>                   disable a plugin
+  sitemap generate                        write static/sitemap.xml
+  cache clear                             empty the response cache
+  settings get [key]                      print the website settings, or a single one
+  settings set <key> <value>              change a website setting
+
+Passwords are read from standard input, so they can be piped in scripts:
+  echo "$PASSWORD" | goxcms user set-password admin
+`
+
+// runCommand runs a command line command and returns the exit code.
+func runCommand(db *gorm.DB, args []string) int {
+	switch args[0] {
+	case "serve":
+		return serve(db)
+	case "migrate":
+		return migrateCommand(db, args[1:])
+	case "user":
+		return userCommand(db, args[1:])
+	case "plugin":
+		return pluginCommand(db, args[1:])
+	case "sitemap":
+		return sitemapCommand(db, args[1:])
+	case "cache":
+		return cacheCommand(db, args[1:])
+	case "settings":
+		return settingsCommand(db, args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	}
+
+	return usageError("Unknown command %q", args[0])
+}
+
+func usageError(format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, format+"\n\n%s", append(args, usage)...)
+	return 2
+}
+
+// audit records a change made from the command line in the audit log, with
+// the operating system user as the actor.
+func audit(db *gorm.DB, action, targetType string, targetID interface{}, before, after interface{}) {
+	event := model.AuditEvent{
+		ActorName:  os.Getenv("USER"),
+		Source:     model.AuditSourceCLI,
+		Action:     action,
+		TargetType: targetType,
+	}
+	if current, err := user.Current(); err == nil {
+		event.ActorName = current.Username
+	}
+	if targetID != nil {
+		event.TargetID = fmt.Sprint(targetID)
+	}
+	handlers.RecordAuditEvent(db, event, before, after)
+}
+
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	return 1
+}
+
+func migrateCommand(db *gorm.DB, args []string) int {
+	if len(args) == 0 {
+		return usageError("migrate needs a subcommand")
+	}
+
+	switch args[0] {
+	case "up":
+		if err := database.MigrateUp(db, args[1:]...); err != nil {
+			return fail(err)
+		}
+		fmt.Println("Database is up to date")
+		return 0
+
+	case "down":
+		if len(args) < 2 {
+			return usageError("migrate down needs a namespace, for example: goxcms migrate down core")
+		}
+		steps := 1
+		if len(args) > 2 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < 1 {
+				return usageError("Invalid number of steps %q", args[2])
+			}
+			steps = n
+		}
+		if err := database.MigrateDown(db, args[1], steps); err != nil {
+			return fail(err)
+		}
+		return 0
+
+	case "status":
+		statuses, err := database.Status(db, args[1:]...)
+		if err != nil {
+			return fail(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAMESPACE\tVERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", status.Namespace, status.Version, status.Name, applied)
+		}
+		w.Flush()
+		return 0
+	}
+
+	return usageError("Unknown migrate command %q", args[0])
+}
+
+func userCommand(db *gorm.DB, args []string) int {
+	if len(args) == 0 {
+		return usageError("user needs a subcommand")
+	}
+
+	/// users need their roles, which are otherwise only created when the server starts
+	utils.CreateDefaultRoles(db)
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+		email := flags.String("email", "", "email address")
+		roleName := flags.String("role", model.RoleUser, "role name")
+		firstName := flags.String("first-name", "", "first name, defaults to the username")
+		lastName := flags.String("last-name", "", "last name, defaults to the username")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if flags.NArg() != 1 {
+			return usageError("user create needs exactly one username")
+		}
+
+		role, err := findRole(db, *roleName)
+		if err != nil {
+			return fail(err)
+		}
+
+		user := model.User{
+			Username:  flags.Arg(0),
+			RoleID:    role.ID,
+			FirstName: *firstName,
+			LastName:  *lastName,
+		}
+		if user.FirstName == "" {
+			user.FirstName = user.Username
+		}
+		if user.LastName == "" {
+			user.LastName = user.Username
+		}
+		if *email != "" {
+			user.Email = email
+		}
+
+		if err := db.Where("username = ?", user.Username).First(&model.User{}).Error; err == nil {
+			return fail(fmt.Errorf("user %s already exists", user.Username))
+		}
+
+		password, err := readPassword()
+		if err != nil {
+			return fail(err)
+		}
+		user.Password = password
+
+		if err := validator.New().Struct(&user); err != nil {
+			return fail(fmt.Errorf("validation failed: %s", handlers.FormatValidationError(err)))
+		}
+
+		if user.Password, err = handlers.HashPassword(password); err != nil {
+			return fail(err)
+		}
+		if err := db.Create(&user).Error; err != nil {
+			return fail(err)
+		}
+		audit(db, "user.create", "user", user.ID, nil, user)
+		fmt.Printf("User %s created with role %s\n", user.Username, role.Name)
+		return 0
+
+	case "set-password":
+		if len(args) != 2 {
+			return usageError("user set-password needs a username")
+		}
+		user, err := findUser(db, args[1])
+		if err != nil {
+			return fail(err)
+		}
+		password, err := readPassword()
+		if err != nil {
+			return fail(err)
+		}
+		if len(password) < 6 {
+			return fail(fmt.Errorf("the password must be at least 6 characters"))
+		}
+		hashed, err := handlers.HashPassword(password)
+		if err != nil {
+			return fail(err)
+		}
+		if err := db.Model(&user).Update("password", hashed).Error; err != nil {
+			return fail(err)
+		}
+		if err := handlers.RevokeUserSessions(db, user.ID); err != nil {
+			return fail(err)
+		}
+		audit(db, "user.password", "user", user.ID, nil, nil)
+		fmt.Printf("Password of %s changed, existing logins were ended\n", user.Username)
+		return 0
+
+	case "set-role":
+		if len(args) != 3 {
+			return usageError("user set-role needs a username and a role")
+		}
+		user, err := findUser(db, args[1])
+		if err != nil {
+			return fail(err)
+		}
+		role, err := findRole(db, args[2])
+		if err != nil {
+			return fail(err)
+		}
+		before := user
+		if err := db.Model(&user).Update("role_id", role.ID).Error; err != nil {
+			return fail(err)
+		}
+		audit(db, "user.role", "user", user.ID, before, user)
+		fmt.Printf("%s now has the role %s\n", user.Username, role.Name)
+		return 0
+	}
+
+	return usageError("Unknown user command %q", args[0])
+}
+
+func findUser(db *gorm.DB, username string) (model.User, error) {
+	var user model.User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		return user, fmt.Errorf("user %s not found", username)
+	}
+	return user, nil
+}
+
+func findRole(db *gorm.DB, name string) (model.Role, error) {
+	var role model.Role
+	if err := db.Where("LOWER(name) = ?", strings.ToLower(name)).First(&role).Error; err != nil {
+		var roles []model.Role
+		db.Order("id").Find(&roles)
+		names := make([]string, 0, len(roles))
+		for _, r := range roles {
+			names = append(names, r.Name)
+		}
+		return role, fmt.Errorf("role %s not found, available roles: %s", name, strings.Join(names, ", "))
+	}
+	return role, nil
+}
+
+// readPassword reads the password without echoing it when standard input is
+// a terminal, and reads one line otherwise, so it can be piped in.
+func readPassword() (string, error) {
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		input, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if len(input) == 0 {
+			return "", fmt.Errorf("no password given")
+		}
+		return string(input), nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("no password given on standard input")
+	}
+	return password, nil
+}
+
+func pluginCommand(db *gorm.DB, args []string) int {
+	if len(args) == 0 {
+		return usageError("plugin needs a subcommand")
+	}
+
+	/// make sure every compiled in plugin has its row in the database
+	for _, plugin := range plugin_system.PluginList() {
+		plugin_system.RegisterPlugin(plugin, db)
+	}
+
+	switch args[0] {
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tVERSION\tAUTHOR\tENABLED")
+		for _, plugin := range plugin_system.GetPlugins() {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\n", plugin.Name(), plugin.Version(), plugin.Author(), plugin.Enabled(db))
+		}
+		w.Flush()
+		return 0
+
+	case "enable", "disable":
+		if len(args) != 2 {
+			return usageError("plugin %s needs a plugin name", args[0])
+		}
+		enabled := args[0] == "enable"
+		if err := plugin_system.SetPluginEnabled(args[1], enabled, db); err != nil {
+			return fail(err)
+		}
+		audit(db, "plugin."+args[0], "plugin", args[1], nil, map[string]bool{"enabled": enabled})
+		fmt.Printf("Plugin %s %sd, running servers follow within a few seconds\n", args[1], args[0])
+		return 0
+	}
+
+	return usageError("Unknown plugin command %q", args[0])
+}
+
+func sitemapCommand(db *gorm.DB, args []string) int {
+	if len(args) != 1 || args[0] != "generate" {
+		return usageError("Usage: goxcms sitemap generate")
+	}
+	utils.GenerateSiteMap(db)
+	return 0
+}
+
+func cacheCommand(db *gorm.DB, args []string) int {
+	if len(args) != 1 || args[0] != "clear" {
+		return usageError("Usage: goxcms cache clear")
+	}
+	if err := utils.ClearCache(); err != nil {
+		return fail(err)
+	}
+	audit(db, "cache.clear", "cache", nil, nil, nil)
+	fmt.Println("Response cache cleared")
+	return 0
+}
+
+// settingFields maps the JSON names of the website settings to their struct
+// fields. Bookkeeping fields are left out.
+func settingFields() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(model.BasicWebsiteInfo{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		switch name {
+		case "", "-", "id", "created_at", "updated_at":
+			continue
+		}
+		fields[name] = i
+	}
+	return fields
+}
+
+// settingChoices lists the values of the settings that only take a few, as
+// the settings form offers them.
+var settingChoices = map[string][]string{
+	"account_deletion":  model.AccountDeletionPolicies,
+	"registration_mode": model.RegistrationModes,
+}
+
+func containsChoice(choices []string, value string) bool {
+	for _, choice := range choices {
+		if choice == value {
+			return true
+		}
+	}
+	return false
+}
+
+func settingsCommand(db *gorm.DB, args []string) int {
+	if len(args) == 0 {
+		return usageError("settings needs a subcommand")
+	}
+
+	utils.CreateBasicWebsiteInfo(db)
+
+	var info model.BasicWebsiteInfo
+	if err := db.First(&info).Error; err != nil {
+		return fail(err)
+	}
+
+	fields := settingFields()
+	value := reflect.ValueOf(&info).Elem()
+
+	switch args[0] {
+	case "get":
+		if len(args) == 2 {
+			index, ok := fields[args[1]]
+			if !ok {
+				return fail(fmt.Errorf("unknown setting %s", args[1]))
+			}
+			fmt.Println(value.Field(index).Interface())
+			return 0
+		}
+
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, name := range names {
+			encoded, _ := json.Marshal(value.Field(fields[name]).Interface())
+			fmt.Fprintf(w, "%s\t%s\n", name, encoded)
+		}
+		w.Flush()
+		return 0
+
+	case "set":
+		if len(args) != 3 {
+			return usageError("settings set needs a key and a value")
+		}
+		index, ok := fields[args[1]]
+		if !ok {
+			return fail(fmt.Errorf("unknown setting %s", args[1]))
+		}
+
+		before := info
+		field := value.Field(index)
+		switch field.Kind() {
+		case reflect.Bool:
+			b, err := strconv.ParseBool(args[2])
+			if err != nil {
+				return fail(fmt.Errorf("%s must be true or false", args[1]))
+			}
+			field.SetBool(b)
+		case reflect.String:
+			if choices, ok := settingChoices[args[1]]; ok && !containsChoice(choices, args[2]) {
+				return fail(fmt.Errorf("%s must be one of: %s", args[1], strings.Join(choices, ", ")))
+			}
+			field.SetString(args[2])
+		default:
+			return fail(fmt.Errorf("%s cannot be changed from the command line", args[1]))
+		}
+
+		column := db.NamingStrategy.ColumnName("", reflect.TypeOf(info).Field(index).Name)
+		if err := db.Model(&info).Update(column, field.Interface()).Error; err != nil {
+			return fail(err)
+		}
+		audit(db, "settings.update", "settings", info.ID, before, info)
+		fmt.Printf("%s set to %v\n", args[1], field.Interface())
+		return 0
+	}
+
+	return usageError("Unknown settings command %q", args[0])
+}
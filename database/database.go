@@ -10,12 +10,11 @@ import (
 	"gorm.io/gorm/logger"
 	"gorm.io/plugin/dbresolver"
 
-	"goxcms/model" // Update with your actual project path
-
 	"github.com/spf13/viper"
 )
 
-// initDB initializes and returns a *gorm.DB instance.
+// InitDB connects to the configured database. The schema is managed by the
+// migrations in this package, see MigrateUp.
 func InitDB() *gorm.DB {
 	var db *gorm.DB
 	var err error
@@ -49,27 +48,6 @@ func InitDB() *gorm.DB {
 		Policy:   dbresolver.RandomPolicy{},
 	}))
 
-	err = db.AutoMigrate(
-		&model.User{},
-		&model.Post{},
-		&model.Category{},
-		&model.Tag{},
-		&model.Menu{},
-		&model.MenuItem{},
-		&model.BasicWebsiteInfo{},
-		&model.CustomPage{},
-		&model.File{},
-		&model.Comment{},
-		&model.Role{},
-		&model.Plugin{},
-	)
-
-	if err != nil {
-		log.Fatalf("Failed to auto migrate: %v", err)
-	}
-
-	addForeignKeyConstraints(db)
-
 	return db
 }
 
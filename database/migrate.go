@@ -0,0 +1,213 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CoreNamespace holds the migrations of the CMS itself. Plugins register
+// their migrations under their own name.
+const CoreNamespace = "core"
+
+// Migration is one versioned schema change. Versions are applied in
+// increasing order and only have to be unique within a namespace.
+//
+// Steps that call AutoMigrate on a model from the model package see the
+// current struct, not the one at the time the migration was written, so they
+// must stay safe to run against a schema that already has newer columns.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied migration.
+type SchemaMigration struct {
+	Namespace string    `gorm:"primaryKey;size:100"`
+	Version   uint      `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"size:255"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// MigrationStatus is a registered migration and whether it has been applied.
+type MigrationStatus struct {
+	Namespace string
+	Version   uint
+	Name      string
+	AppliedAt *time.Time
+}
+
+var (
+	migrationsMu sync.RWMutex
+	migrations   = map[string][]Migration{}
+)
+
+// RegisterMigrations adds migrations to a namespace. Plugins call it from an
+// init function so their migrations are known before the server starts.
+func RegisterMigrations(namespace string, list ...Migration) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+
+	for _, migration := range list {
+		for _, existing := range migrations[namespace] {
+			if existing.Version == migration.Version {
+				panic(fmt.Sprintf("migration %s/%d registered twice", namespace, migration.Version))
+			}
+		}
+		migrations[namespace] = append(migrations[namespace], migration)
+	}
+	sort.Slice(migrations[namespace], func(i, j int) bool {
+		return migrations[namespace][i].Version < migrations[namespace][j].Version
+	})
+}
+
+// Namespaces returns the namespaces with registered migrations, core first.
+func Namespaces() []string {
+	migrationsMu.RLock()
+	defer migrationsMu.RUnlock()
+
+	names := make([]string, 0, len(migrations))
+	for namespace := range migrations {
+		if namespace != CoreNamespace {
+			names = append(names, namespace)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := migrations[CoreNamespace]; ok {
+		names = append([]string{CoreNamespace}, names...)
+	}
+	return names
+}
+
+func registered(namespace string) []Migration {
+	migrationsMu.RLock()
+	defer migrationsMu.RUnlock()
+	return append([]Migration(nil), migrations[namespace]...)
+}
+
+func applied(db *gorm.DB, namespace string) (map[uint]SchemaMigration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, err
+	}
+
+	var rows []SchemaMigration
+	if err := db.Where("namespace = ?", namespace).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	done := make(map[uint]SchemaMigration, len(rows))
+	for _, row := range rows {
+		done[row.Version] = row
+	}
+	return done, nil
+}
+
+// MigrateUp applies every pending migration of the given namespaces, or of
+// all namespaces when none are given. Each migration runs in its own
+// transaction; MySQL commits schema changes implicitly, so a failed
+// migration there may leave part of its changes behind.
+func MigrateUp(db *gorm.DB, namespaces ...string) error {
+	if len(namespaces) == 0 {
+		namespaces = Namespaces()
+	}
+
+	for _, namespace := range namespaces {
+		done, err := applied(db, namespace)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range registered(namespace) {
+			if _, ok := done[migration.Version]; ok {
+				continue
+			}
+
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if migration.Up != nil {
+					if err := migration.Up(tx); err != nil {
+						return err
+					}
+				}
+				return tx.Create(&SchemaMigration{
+					Namespace: namespace,
+					Version:   migration.Version,
+					Name:      migration.Name,
+					AppliedAt: time.Now(),
+				}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %s/%d %s failed: %w", namespace, migration.Version, migration.Name, err)
+			}
+			log.Printf("Applied migration %s/%d %s", namespace, migration.Version, migration.Name)
+		}
+	}
+	return nil
+}
+
+// MigrateDown rolls back the last steps applied migrations of a namespace,
+// newest first.
+func MigrateDown(db *gorm.DB, namespace string, steps int) error {
+	done, err := applied(db, namespace)
+	if err != nil {
+		return err
+	}
+
+	list := registered(namespace)
+	for i := len(list) - 1; i >= 0 && steps > 0; i-- {
+		migration := list[i]
+		if _, ok := done[migration.Version]; !ok {
+			continue
+		}
+		if migration.Down == nil {
+			return fmt.Errorf("migration %s/%d %s cannot be rolled back", namespace, migration.Version, migration.Name)
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Down(tx); err != nil {
+				return err
+			}
+			return tx.Where("namespace = ? AND version = ?", namespace, migration.Version).Delete(&SchemaMigration{}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("rollback of %s/%d %s failed: %w", namespace, migration.Version, migration.Name, err)
+		}
+		log.Printf("Rolled back migration %s/%d %s", namespace, migration.Version, migration.Name)
+		steps--
+	}
+	return nil
+}
+
+// Status lists the registered migrations of the given namespaces, or of all
+// namespaces when none are given.
+func Status(db *gorm.DB, namespaces ...string) ([]MigrationStatus, error) {
+	if len(namespaces) == 0 {
+		namespaces = Namespaces()
+	}
+
+	var statuses []MigrationStatus
+	for _, namespace := range namespaces {
+		done, err := applied(db, namespace)
+		if err != nil {
+			return nil, err
+		}
+		for _, migration := range registered(namespace) {
+			status := MigrationStatus{Namespace: namespace, Version: migration.Version, Name: migration.Name}
+			if row, ok := done[migration.Version]; ok {
+				appliedAt := row.AppliedAt
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
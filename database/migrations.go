@@ -0,0 +1,301 @@
+package database
+
+import (
+	"goxcms/model"
+
+	"gorm.io/gorm"
+)
+
+// Core migrations. Append new ones at the end with the next version.
+func init() {
+	RegisterMigrations(CoreNamespace,
+		Migration{
+			Version: 1,
+			Name:    "create core tables",
+			Up: func(tx *gorm.DB) error {
+				err := tx.AutoMigrate(
+					&model.User{},
+					&model.Post{},
+					&model.Category{},
+					&model.Tag{},
+					&model.Menu{},
+					&model.MenuItem{},
+					&model.BasicWebsiteInfo{},
+					&model.CustomPage{},
+					&model.File{},
+					&model.Comment{},
+					&model.Role{},
+					&model.Permission{},
+					&model.Plugin{},
+				)
+				if err != nil {
+					return err
+				}
+				addForeignKeyConstraints(tx)
+				return nil
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(
+					"post_categories", "post_tags", "role_permissions",
+					&model.Plugin{},
+					&model.Permission{},
+					&model.Role{},
+					&model.Comment{},
+					&model.File{},
+					&model.CustomPage{},
+					&model.BasicWebsiteInfo{},
+					&model.MenuItem{},
+					&model.Menu{},
+					&model.Tag{},
+					&model.Category{},
+					&model.Post{},
+					&model.User{},
+				)
+			},
+		},
+		Migration{
+			Version: 2,
+			Name:    "create revision tables",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.PostRevision{}, &model.CustomPageRevision{})
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&model.PostRevision{}, &model.CustomPageRevision{})
+			},
+		},
+		Migration{
+			Version: 3,
+			Name:    "add user tokens and email verification",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.User{}, &model.UserToken{})
+			},
+			Down: func(tx *gorm.DB) error {
+				if err := tx.Migrator().DropTable(&model.UserToken{}); err != nil {
+					return err
+				}
+				return tx.Migrator().DropColumn(&model.User{}, "email_verified_at")
+			},
+		},
+		Migration{
+			Version: 4,
+			Name:    "add two-factor authentication",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.User{}, &model.UserToken{}, &model.RecoveryCode{}, &model.BasicWebsiteInfo{})
+			},
+			Down: func(tx *gorm.DB) error {
+				if err := tx.Migrator().DropTable(&model.RecoveryCode{}); err != nil {
+					return err
+				}
+				for _, column := range []string{"two_factor_enabled", "two_factor_secret", "two_factor_last_step"} {
+					if err := tx.Migrator().DropColumn(&model.User{}, column); err != nil {
+						return err
+					}
+				}
+				if err := tx.Migrator().DropColumn(&model.UserToken{}, "attempts"); err != nil {
+					return err
+				}
+				return tx.Migrator().DropColumn(&model.BasicWebsiteInfo{}, "require_admin_two_factor")
+			},
+		},
+		Migration{
+			Version: 5,
+			Name:    "create user sessions",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.UserSession{})
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&model.UserSession{})
+			},
+		},
+		Migration{
+			Version: 6,
+			Name:    "create api tokens",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.APIToken{})
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&model.APIToken{})
+			},
+		},
+		Migration{
+			Version: 7,
+			Name:    "create user identities",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.UserIdentity{})
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&model.UserIdentity{})
+			},
+		},
+		Migration{
+			Version: 8,
+			Name:    "create security events and storage entries",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.SecurityEvent{}, &storageEntry{})
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&model.SecurityEvent{}, &storageEntry{})
+			},
+		},
+		Migration{
+			Version: 9,
+			Name:    "create audit events",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.AuditEvent{})
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&model.AuditEvent{})
+			},
+		},
+		Migration{
+			Version: 10,
+			Name:    "add user profiles",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.User{})
+			},
+			Down: func(tx *gorm.DB) error {
+				for _, column := range []string{"bio", "avatar_file_id", "website_url", "twitter_url", "git_hub_url", "linked_in_url", "private_profile"} {
+					if err := tx.Migrator().DropColumn(&model.User{}, column); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		Migration{
+			Version: 11,
+			Name:    "add account deletion policy",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.BasicWebsiteInfo{})
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropColumn(&model.BasicWebsiteInfo{}, "account_deletion")
+			},
+		},
+		Migration{
+			Version: 12,
+			Name:    "add registration modes and invitations",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.BasicWebsiteInfo{}, &model.User{}, &model.Invitation{})
+			},
+			Down: func(tx *gorm.DB) error {
+				if err := tx.Migrator().DropTable(&model.Invitation{}); err != nil {
+					return err
+				}
+				if err := tx.Migrator().DropColumn(&model.User{}, "pending_approval"); err != nil {
+					return err
+				}
+				for _, column := range []string{"registration_mode", "registration_domains"} {
+					if err := tx.Migrator().DropColumn(&model.BasicWebsiteInfo{}, column); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		Migration{
+			Version: 13,
+			Name:    "add comment threads",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.Comment{})
+			},
+			Down: func(tx *gorm.DB) error {
+				for _, column := range []string{"parent_id", "edited_at", "notified_at"} {
+					if err := tx.Migrator().DropColumn(&model.Comment{}, column); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		Migration{
+			Version: 14,
+			Name:    "add comment spam scores",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.Comment{}, &model.SpamWord{})
+			},
+			Down: func(tx *gorm.DB) error {
+				if err := tx.Migrator().DropTable(&model.SpamWord{}); err != nil {
+					return err
+				}
+				for _, column := range []string{"spam_score", "spam_reasons", "spam_class", "ip"} {
+					if err := tx.Migrator().DropColumn(&model.Comment{}, column); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		Migration{
+			Version: 15,
+			Name:    "add guest comments",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.BasicWebsiteInfo{}, &model.Comment{})
+			},
+			Down: func(tx *gorm.DB) error {
+				for _, column := range []string{"guest_name", "guest_email", "guest_website"} {
+					if err := tx.Migrator().DropColumn(&model.Comment{}, column); err != nil {
+						return err
+					}
+				}
+				return tx.Migrator().DropColumn(&model.BasicWebsiteInfo{}, "guest_comments")
+			},
+		},
+		Migration{
+			Version: 16,
+			Name:    "add category hierarchy",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.Category{}, &model.MenuItem{})
+			},
+			Down: func(tx *gorm.DB) error {
+				if err := tx.Migrator().DropColumn(&model.MenuItem{}, "category_id"); err != nil {
+					return err
+				}
+				for _, column := range []string{"parent_id", "position", "description", "include_subcategories"} {
+					if err := tx.Migrator().DropColumn(&model.Category{}, column); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		Migration{
+			Version: 17,
+			Name:    "add tag redirects",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&model.TagRedirect{})
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&model.TagRedirect{})
+			},
+		},
+		Migration{
+			Version: 18,
+			Name:    "count failed logins in login attempts",
+			Up: func(tx *gorm.DB) error {
+				if err := tx.AutoMigrate(&model.LoginAttempt{}); err != nil {
+					return err
+				}
+				return tx.Migrator().DropTable(&storageEntry{})
+			},
+			Down: func(tx *gorm.DB) error {
+				if err := tx.AutoMigrate(&storageEntry{}); err != nil {
+					return err
+				}
+				return tx.Migrator().DropTable(&model.LoginAttempt{})
+			},
+		},
+	)
+}
+
+// storageEntry is a key of the database storage the login throttle used
+// before version 18.
+type storageEntry struct {
+	Key       string `gorm:"column:storage_key;primaryKey;size:255"`
+	Value     []byte `gorm:"not null"`
+	ExpiresAt int64  `gorm:"index;not null;default:0"` // unix seconds, 0 for never
+}
+
+func (storageEntry) TableName() string {
+	return "storage_entries"
+}
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"goxcms/hooks"
+	"goxcms/mail"
+	"goxcms/model"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+var errInvalidToken = errors.New("the link is invalid or has expired")
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueUserToken creates a new token for the user and returns the secret to
+// put in the email. Earlier unused tokens with the same purpose stop working.
+func issueUserToken(db *gorm.DB, user model.User, purpose, email string, ttl time.Duration) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(secret)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, purpose).Delete(&model.UserToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&model.UserToken{
+			UserID:    user.ID,
+			Purpose:   purpose,
+			TokenHash: hashToken(token),
+			Email:     email,
+			ExpiresAt: time.Now().Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// findUserToken returns the token if it is unused and not expired, without
+// using it up.
+func findUserToken(db *gorm.DB, token, purpose string) (model.UserToken, error) {
+	var userToken model.UserToken
+	if token == "" {
+		return userToken, errInvalidToken
+	}
+	err := db.Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), purpose, time.Now()).
+		First(&userToken).Error
+	if err != nil {
+		return userToken, errInvalidToken
+	}
+	return userToken, nil
+}
+
+// consumeUserToken marks the token as used. Only one of two concurrent
+// requests with the same token succeeds.
+func consumeUserToken(tx *gorm.DB, token, purpose string) (model.UserToken, error) {
+	userToken, err := findUserToken(tx, token, purpose)
+	if err != nil {
+		return userToken, err
+	}
+
+	now := time.Now()
+	result := tx.Model(&model.UserToken{}).
+		Where("id = ? AND used_at IS NULL", userToken.ID).
+		Update("used_at", now)
+	if result.Error != nil {
+		return userToken, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return userToken, errInvalidToken
+	}
+	userToken.UsedAt = &now
+	return userToken, nil
+}
+
+// emailLink returns an absolute link to path on this site.
+func emailLink(path string, query url.Values) string {
+	return strings.TrimRight(viper.GetString("app.url"), "/") + path + "?" + query.Encode()
+}
+
+func siteName(c *fiber.Ctx) string {
+	if settings, ok := c.Locals("Settings").(map[string]string); ok && settings["Name"] != "" {
+		return settings["Name"]
+	}
+	return viper.GetString("app.name")
+}
+
+// sendVerificationEmail mails a confirmation link for the user's current
+// email address.
+func sendVerificationEmail(c *fiber.Ctx, db *gorm.DB, user model.User) error {
+	if user.Email == nil || *user.Email == "" {
+		return errors.New("no email address set")
+	}
+
+	ttl := time.Duration(viper.GetInt("mail.verification_hours")) * time.Hour
+	token, err := issueUserToken(db, user, model.TokenEmailVerification, *user.Email, ttl)
+	if err != nil {
+		return err
+	}
+
+	mail.Queue(*user.Email, "Confirm your email address", "verify_email", map[string]interface{}{
+		"SiteName": siteName(c),
+		"User":     user,
+		"Link":     emailLink("/verify-email", url.Values{"token": {token}}),
+		"Hours":    viper.GetInt("mail.verification_hours"),
+	})
+	return nil
+}
+
+func ForgotPasswordPage(c *fiber.Ctx) error {
+	if c.Locals("isLoggedin") == true {
+		return c.Redirect("/")
+	}
+
+	return c.Render("forgot_password", fiber.Map{
+		"Title":    "Forgot Password",
+		"Settings": c.Locals("Settings"),
+	}, "main")
+}
+
+func ForgotPassword(c *fiber.Ctx, db *gorm.DB) error {
+	email := strings.TrimSpace(c.FormValue("email"))
+	if email == "" {
+		ShowToastError(c, "Please enter your email address")
+		return c.SendString("Please enter your email address")
+	}
+
+	/// the answer is the same whether or not the address is known, so it cannot be used to find accounts
+	const sent = "If an account uses this email address, a link to reset the password is on its way."
+
+	var user model.User
+	if err := db.Where("LOWER(email) = ?", strings.ToLower(email)).First(&user).Error; err != nil {
+		return c.SendString(sent)
+	}
+
+	ttl := time.Duration(viper.GetInt("mail.reset_minutes")) * time.Minute
+	token, err := issueUserToken(db, user, model.TokenPasswordReset, *user.Email, ttl)
+	if err != nil {
+		ShowToastError(c, "Failed to create the reset link")
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to create the reset link")
+	}
+
+	mail.Queue(*user.Email, "Reset your password", "password_reset", map[string]interface{}{
+		"SiteName": siteName(c),
+		"User":     user,
+		"Link":     emailLink("/reset-password", url.Values{"token": {token}}),
+		"Minutes":  viper.GetInt("mail.reset_minutes"),
+	})
+
+	return c.SendString(sent)
+}
+
+func ResetPasswordPage(c *fiber.Ctx, db *gorm.DB) error {
+	token := c.Query("token")
+	_, err := findUserToken(db, token, model.TokenPasswordReset)
+
+	return c.Render("reset_password", fiber.Map{
+		"Title":    "Reset Password",
+		"Token":    token,
+		"Invalid":  err != nil,
+		"Settings": c.Locals("Settings"),
+	}, "main")
+}
+
+func ResetPassword(c *fiber.Ctx, db *gorm.DB) error {
+	password := c.FormValue("password")
+	if len(password) < 6 {
+		ShowToastError(c, "Password must be at least 6 characters long")
+		return c.Status(fiber.StatusBadRequest).SendString("Password must be at least 6 characters long")
+	}
+	if password != c.FormValue("password_confirm") {
+		ShowToastError(c, "Passwords do not match")
+		return c.Status(fiber.StatusBadRequest).SendString("Passwords do not match")
+	}
+
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		ShowToastError(c, "Failed to hash password")
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to hash password")
+	}
+
+	var user model.User
+	err = db.Transaction(func(tx *gorm.DB) error {
+		userToken, err := consumeUserToken(tx, c.FormValue("token"), model.TokenPasswordReset)
+		if err != nil {
+			return err
+		}
+		if err := tx.First(&user, userToken.UserID).Error; err != nil {
+			return errInvalidToken
+		}
+		if err := tx.Model(&user).Update("password", hashedPassword).Error; err != nil {
+			return err
+		}
+		/// whoever knew the old password is logged out too
+		return RevokeUserSessions(tx, user.ID)
+	})
+	if errors.Is(err, errInvalidToken) {
+		ShowToastError(c, "The reset link is invalid or has expired")
+		return c.Status(fiber.StatusBadRequest).SendString("The reset link is invalid or has expired, please request a new one.")
+	}
+	if err != nil {
+		ShowToastError(c, "Failed to reset the password")
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to reset the password")
+	}
+
+	hooks.DoAction(hooks.UserPasswordReset, user)
+
+	ShowToast(c, "Your password has been changed, please log in")
+	c.Set("HX-Redirect", "/login")
+	return c.SendString("Password changed")
+}
+
+func VerifyEmail(c *fiber.Ctx, db *gorm.DB) error {
+	var user model.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		userToken, err := consumeUserToken(tx, c.Query("token"), model.TokenEmailVerification)
+		if err != nil {
+			return err
+		}
+		/// the link only confirms the address it was sent to
+		if err := tx.First(&user, userToken.UserID).Error; err != nil || user.Email == nil || !strings.EqualFold(*user.Email, userToken.Email) {
+			return errInvalidToken
+		}
+		if err := tx.Model(&user).Update("email_verified_at", userToken.UsedAt).Error; err != nil {
+			return err
+		}
+		/// with a domain allowlist the verified address activates the account
+		if mode, domains := registrationSettings(tx); user.PendingApproval && mode == model.RegistrationDomain && emailDomainAllowed(*user.Email, domains) {
+			return tx.Model(&user).Update("pending_approval", false).Error
+		}
+		return nil
+	})
+	if err == nil {
+		hooks.DoAction(hooks.UserEmailVerified, user)
+	}
+
+	return c.Render("verify_email", fiber.Map{
+		"Title":    "Email Verification",
+		"Verified": err == nil,
+		"Settings": c.Locals("Settings"),
+	}, "main")
+}
+
+func ResendVerificationEmail(c *fiber.Ctx, db *gorm.DB) error {
+	user, ok := c.Locals("user").(model.User)
+	if !ok {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	if user.Email == nil || *user.Email == "" {
+		return ShowToastError(c, "Your account has no email address")
+	}
+	if user.EmailVerified() {
+		return ShowToast(c, "Your email address is already verified")
+	}
+
+	if err := sendVerificationEmail(c, db, user); err != nil {
+		return ShowToastError(c, "Failed to send the verification email")
+	}
+	return ShowToast(c, "A verification email has been sent to "+*user.Email)
+}
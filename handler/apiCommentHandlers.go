@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"goxcms/hooks"
+	"goxcms/model"
+	"goxcms/spam"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var apiCommentListing = apiListing{
+	table:       "comments",
+	sorts:       []string{"created_at", "updated_at"},
+	defaultSort: "-created_at",
+	filters: map[string]apiFilter{
+		"post_id":   {column: "post_id", kind: "uint"},
+		"user_id":   {column: "user_id", kind: "uint"},
+		"status":    {column: "status", kind: "string"},
+		"parent_id": {column: "parent_id", kind: "uint"},
+	},
+	search: "content",
+}
+
+// apiCommentInput is the body of the comment create and update requests.
+// Only moderators can change the status.
+type apiCommentInput struct {
+	PostID   uint    `json:"post_id"`
+	ParentID *uint   `json:"parent_id"`
+	Content  *string `json:"content"`
+	Status   *string `json:"status"`
+}
+
+// preloadCommentAuthor loads the public fields of a comment's author, leaving
+// out the email address.
+func preloadCommentAuthor(tx *gorm.DB) *gorm.DB {
+	return tx.Select("id", "username", "first_name", "last_name", "created_at")
+}
+
+// apiVisibleComments limits a comment query to what the user may read.
+// Moderators see every comment; everybody else sees the approved comments
+// and their own, on posts they can read.
+func apiVisibleComments(c *fiber.Ctx, db *gorm.DB) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if HasPermission(c, model.PermCommentModerate) {
+			return tx
+		}
+		posts := db.Model(&model.Post{}).Select("posts.id").Scopes(apiVisiblePosts(c, db))
+		return tx.Where("(comments.status = ? OR comments.user_id = ?) AND comments.post_id IN (?)", model.CommentApproved, currentUserID(c), posts)
+	}
+}
+
+func APIListComments(c *fiber.Ctx, db *gorm.DB) error {
+	var comments []model.Comment
+	return sendAPIList(c, db.Model(&model.Comment{}).Preload("User", preloadCommentAuthor).Scopes(apiVisibleComments(c, db)), apiCommentListing, &comments)
+}
+
+func APIGetComment(c *fiber.Ctx, db *gorm.DB) error {
+	var comment model.Comment
+	if err := db.Preload("User", preloadCommentAuthor).Scopes(apiVisibleComments(c, db)).First(&comment, apiID(c, "id")).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "comment not found")
+	}
+	return apiData(c, fiber.StatusOK, comment)
+}
+
+func APICreateComment(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermCommentCreate) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to write comments")
+	}
+
+	var input apiCommentInput
+	if _, err := apiBody(c, &input); err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	var post model.Post
+	if err := db.First(&post, input.PostID).Error; err != nil || !apiCanReadPost(c, post) {
+		return apiError(c, fiber.StatusUnprocessableEntity, "post not found")
+	}
+	if input.Content == nil || strings.TrimSpace(*input.Content) == "" {
+		return apiError(c, fiber.StatusUnprocessableEntity, "content is required")
+	}
+	var parentID *uint
+	if input.ParentID != nil {
+		var err error
+		if parentID, err = replyParent(db, post.ID, *input.ParentID); err != nil {
+			return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+		}
+	}
+
+	/// comments from the API wait for approval like those from the site
+	comment := model.Comment{
+		Content:  sanitizeHTML(*input.Content),
+		UserID:   currentUserID(c),
+		PostID:   post.ID,
+		ParentID: parentID,
+		Status:   model.CommentPending,
+		IP:       c.IP(),
+	}
+	applySpamCheck(&comment, spam.Check(db, spam.Submission{Comment: comment, IP: comment.IP}))
+	if err := db.Omit("User").Create(&comment).Error; err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to create the comment")
+	}
+	db.Scopes(preloadCommentAuthor).First(&comment.User, comment.UserID)
+
+	hooks.DoAction(hooks.CommentCreated, comment)
+	if comment.Status == model.CommentSpam {
+		hooks.DoAction(hooks.CommentSpam, comment)
+	}
+
+	return apiData(c, fiber.StatusCreated, comment)
+}
+
+func APIUpdateComment(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermCommentModerate) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to moderate comments")
+	}
+
+	var comment model.Comment
+	if err := db.Preload("User", preloadCommentAuthor).First(&comment, apiID(c, "id")).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "comment not found")
+	}
+
+	var input apiCommentInput
+	if _, err := apiBody(c, &input); err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	before := comment
+	if input.Content != nil {
+		if strings.TrimSpace(*input.Content) == "" {
+			return apiError(c, fiber.StatusUnprocessableEntity, "content is required")
+		}
+		comment.Content = sanitizeHTML(*input.Content)
+	}
+
+	oldStatus := comment.Status
+	if input.Status != nil {
+		if !model.ValidCommentStatus(*input.Status) {
+			return apiError(c, fiber.StatusUnprocessableEntity, "status must be one of "+strings.Join(model.CommentStatuses, ", "))
+		}
+		comment.Status = *input.Status
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		/// the spam filter learned the old text, which has to come out of its counts before it is replaced
+		if comment.Content != before.Content {
+			if err := spam.Forget(tx, before); err != nil {
+				return err
+			}
+			comment.SpamClass = ""
+		}
+		return tx.Model(&comment).Omit("User").Select("content", "status").Updates(&comment).Error
+	})
+	if err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to update the comment")
+	}
+	Audit(c, db, "comment.update", "comment", comment.ID, before, comment)
+
+	commentStatusChanged(db, comment, oldStatus)
+
+	return apiData(c, fiber.StatusOK, comment)
+}
+
+func APIDeleteComment(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermCommentModerate) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to moderate comments")
+	}
+
+	var comment model.Comment
+	if err := db.First(&comment, apiID(c, "id")).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "comment not found")
+	}
+
+	if err := deleteComment(db, comment); err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to delete the comment")
+	}
+	Audit(c, db, "comment.delete", "comment", comment.ID, comment, nil)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
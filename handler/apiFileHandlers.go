@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"goxcms/model"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var apiFileListing = apiListing{
+	table:       "files",
+	sorts:       []string{"created_at", "name"},
+	defaultSort: "-created_at",
+	filters: map[string]apiFilter{
+		"extension": {column: "extension", kind: "string"},
+	},
+	search: "name",
+}
+
+func APIListFiles(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermMediaUpload) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to use the media library")
+	}
+
+	var files []model.File
+	return sendAPIList(c, db.Model(&model.File{}), apiFileListing, &files)
+}
+
+func APIGetFile(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermMediaUpload) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to use the media library")
+	}
+
+	var file model.File
+	if err := db.First(&file, apiID(c, "id")).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "file not found")
+	}
+	return apiData(c, fiber.StatusOK, file)
+}
+
+// APIUploadFile takes a multipart/form-data request with the file in the
+// "file" field, like the upload form of the admin panel.
+func APIUploadFile(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermMediaUpload) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to upload files")
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, "the request has no file field")
+	}
+
+	file, err := storeUpload(c, db, header)
+	if err != nil {
+		return apiFail(c, err)
+	}
+	Audit(c, db, "file.upload", "file", file.ID, nil, file)
+	return apiData(c, fiber.StatusCreated, file)
+}
+
+func APIDeleteFile(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermMediaDelete) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to delete files")
+	}
+
+	var file model.File
+	if err := db.First(&file, apiID(c, "id")).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "file not found")
+	}
+
+	if _, err := removeUpload(db, file.Name); err != nil {
+		return apiFail(c, err)
+	}
+	Audit(c, db, "file.delete", "file", file.ID, file, nil)
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Page sizes of the list endpoints of the JSON API.
+const (
+	apiDefaultLimit = 20
+	apiMaxLimit     = 100
+)
+
+func apiError(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).JSON(fiber.Map{"error": message})
+}
+
+func apiData(c *fiber.Ctx, status int, data interface{}) error {
+	return c.Status(status).JSON(fiber.Map{"data": data})
+}
+
+// apiBody parses the JSON request body into out. It returns the names of the
+// fields the body contains, so updates can tell a field set to null from one
+// that was left out.
+func apiBody(c *fiber.Ctx, out interface{}) (map[string]bool, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(c.Body(), &fields); err != nil {
+		return nil, errors.New("the request body must be a JSON object")
+	}
+	if err := json.Unmarshal(c.Body(), out); err != nil {
+		return nil, errors.New("invalid request body: " + err.Error())
+	}
+
+	present := make(map[string]bool, len(fields))
+	for name := range fields {
+		present[name] = true
+	}
+	return present, nil
+}
+
+// apiText is a text field of a create or update request and the model field
+// it is copied to.
+type apiText struct {
+	name  string
+	value *string
+	dest  *string
+}
+
+// setAPIStrings copies the text fields that were sent to the model. None of
+// them may be blank, and on create every one of them must be sent.
+func setAPIStrings(create bool, fields ...apiText) error {
+	for _, field := range fields {
+		if field.value == nil && !create {
+			continue
+		}
+		if field.value == nil || strings.TrimSpace(*field.value) == "" {
+			return errors.New(field.name + " is required")
+		}
+		*field.dest = *field.value
+	}
+	return nil
+}
+
+// apiID returns the numeric route parameter, or 0 when it is not a valid ID.
+func apiID(c *fiber.Ctx, param string) uint {
+	id, err := strconv.ParseUint(c.Params(param), 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint(id)
+}
+
+// apiFilter is a query parameter that restricts a list to rows whose column
+// equals the given value. kind is "bool", "uint" or "string" and decides how
+// the value is parsed.
+type apiFilter struct {
+	column string
+	kind   string
+}
+
+// apiListing describes how a list endpoint can be filtered and sorted.
+// Columns are written into the SQL as they are, so they must never come
+// from the request.
+type apiListing struct {
+	table       string
+	sorts       []string             // columns the list can be sorted by
+	defaultSort string               // e.g. "-created_at"
+	filters     map[string]apiFilter // query parameter -> filter
+	search      string               // column matched by ?q=, if any
+}
+
+// apiPage is the page size and sort field of a list request. sort is nil when
+// the list is sorted by ID.
+type apiPage struct {
+	limit int
+	sort  *schema.Field
+}
+
+// apiCursor is the position of the last row of a page: its value of the sort
+// column, left out when sorting by ID, and its ID to break ties.
+type apiCursor struct {
+	Value json.RawMessage `json:"v,omitempty"`
+	ID    uint            `json:"id"`
+}
+
+// apply adds the filters, sort order, cursor and page size of the request to
+// the query for dest, a pointer to a slice of models. One row more than the
+// page size is selected, so the caller can tell whether another page follows.
+//
+// Pagination uses a cursor instead of page numbers: the cursor holds the sort
+// value and ID of the last row of the previous page and the next page
+// continues after them in sort order, so rows added or deleted meanwhile do
+// not shift the pages.
+func (l apiListing) apply(c *fiber.Ctx, query *gorm.DB, dest interface{}) (*gorm.DB, apiPage, error) {
+	var page apiPage
+
+	for param, filter := range l.filters {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		var arg interface{}
+		switch filter.kind {
+		case "bool":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, page, fmt.Errorf("%s must be true or false", param)
+			}
+			arg = b
+		case "uint":
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, page, fmt.Errorf("%s must be a number", param)
+			}
+			arg = n
+		default:
+			arg = value
+		}
+		query = query.Where(l.table+"."+filter.column+" = ?", arg)
+	}
+
+	if q := strings.TrimSpace(c.Query("q")); q != "" && l.search != "" {
+		query = query.Where(l.table+"."+l.search+" LIKE ?", "%"+q+"%")
+	}
+
+	sort := c.Query("sort", l.defaultSort)
+	desc := strings.HasPrefix(sort, "-")
+	column := strings.TrimPrefix(sort, "-")
+	if column != "id" && !containsString(l.sorts, column) {
+		return nil, page, fmt.Errorf("cannot sort by %s, use one of: id, %s", column, strings.Join(l.sorts, ", "))
+	}
+
+	if column != "id" {
+		stmt := &gorm.Statement{DB: query}
+		if err := stmt.Parse(dest); err != nil {
+			return nil, page, err
+		}
+		page.sort = stmt.Schema.LookUpField(column)
+		if page.sort == nil {
+			return nil, page, fmt.Errorf("cannot sort by %s", column)
+		}
+	}
+
+	page.limit = apiDefaultLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > apiMaxLimit {
+			return nil, page, fmt.Errorf("limit must be between 1 and %d", apiMaxLimit)
+		}
+		page.limit = n
+	}
+
+	op, dir := ">", "asc"
+	if desc {
+		op, dir = "<", "desc"
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		after, value, err := decodeAPICursor(cursor, page.sort)
+		if err != nil {
+			return nil, page, err
+		}
+		id := l.table + ".id"
+		if page.sort == nil {
+			query = query.Where(id+" "+op+" ?", after.ID)
+		} else {
+			col := l.table + "." + column
+			query = query.Where("("+col+" "+op+" ? OR ("+col+" = ? AND "+id+" "+op+" ?))", value, value, after.ID)
+		}
+	}
+
+	if column != "id" {
+		query = query.Order(l.table + "." + column + " " + dir)
+	}
+	query = query.Order(l.table + ".id " + dir)
+
+	return query.Limit(page.limit + 1), page, nil
+}
+
+// encodeAPICursor returns the cursor of the page that follows item, the last
+// model of the current page.
+func encodeAPICursor(item reflect.Value, sort *schema.Field) (string, error) {
+	cursor := apiCursor{ID: uint(item.FieldByName("ID").Uint())}
+	if sort != nil {
+		value, err := json.Marshal(item.FieldByName(sort.Name).Interface())
+		if err != nil {
+			return "", err
+		}
+		cursor.Value = value
+	}
+	raw, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// decodeAPICursor parses a cursor made by encodeAPICursor. The sort value is
+// returned with the Go type of the sort field, so the database compares it
+// the same way as the stored values.
+func decodeAPICursor(cursor string, sort *schema.Field) (apiCursor, interface{}, error) {
+	invalid := errors.New("invalid cursor")
+
+	var after apiCursor
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || json.Unmarshal(raw, &after) != nil || after.ID == 0 {
+		return after, nil, invalid
+	}
+	if sort == nil {
+		return after, nil, nil
+	}
+	if len(after.Value) == 0 {
+		return after, nil, invalid
+	}
+	value := reflect.New(sort.FieldType)
+	if err := json.Unmarshal(after.Value, value.Interface()); err != nil {
+		return after, nil, invalid
+	}
+	return after, value.Elem().Interface(), nil
+}
+
+// findAPIPage runs the list query into dest, a pointer to a slice of models,
+// and trims it to one page. It returns the cursor of the next page, or nil
+// on the last page.
+func findAPIPage(c *fiber.Ctx, query *gorm.DB, listing apiListing, dest interface{}) (interface{}, error) {
+	query, page, err := listing.apply(c, query, dest)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if err := query.Find(dest).Error; err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "failed to load the list")
+	}
+
+	items := reflect.ValueOf(dest).Elem()
+	if items.Len() <= page.limit {
+		return nil, nil
+	}
+	items.Set(items.Slice(0, page.limit))
+	next, err := encodeAPICursor(items.Index(page.limit-1), page.sort)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "failed to load the list")
+	}
+	return next, nil
+}
+
+// sendAPIList sends one page of the list query.
+func sendAPIList(c *fiber.Ctx, query *gorm.DB, listing apiListing, dest interface{}) error {
+	next, err := findAPIPage(c, query, listing, dest)
+	if err != nil {
+		return apiFail(c, err)
+	}
+	return c.JSON(fiber.Map{"data": dest, "next_cursor": next})
+}
+
+// apiFail sends err as an API error, with the status of a *fiber.Error.
+func apiFail(c *fiber.Ctx, err error) error {
+	return apiError(c, errorStatus(err), err.Error())
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"errors"
+	"goxcms/model"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var apiMenuListing = apiListing{
+	table:       "menus",
+	sorts:       []string{"position", "title", "created_at"},
+	defaultSort: "position",
+	filters: map[string]apiFilter{
+		"primary":   {column: "is_primary", kind: "bool"},
+		"parent_id": {column: "parent_id", kind: "uint"},
+		"slug":      {column: "slug", kind: "string"},
+	},
+	search: "title",
+}
+
+// apiMenuInput is the body of the menu create and update requests. Fields
+// left out of an update keep their value; a null parent_id makes the menu a
+// top level menu.
+type apiMenuInput struct {
+	Title    *string `json:"title"`
+	Slug     *string `json:"slug"`
+	ParentID *uint   `json:"parent_id"`
+	Primary  *bool   `json:"primary"`
+	Position *int    `json:"position"`
+}
+
+// apiMenuItemInput is the body of the menu item create and update requests.
+// A null category_id stops the item from opening a category.
+type apiMenuItemInput struct {
+	Title      *string `json:"title"`
+	Link       *string `json:"link"`
+	Position   *int    `json:"position"`
+	CategoryID *uint   `json:"category_id"`
+}
+
+// setAPIMenuItemCategory sets the category of the item if it was sent.
+func setAPIMenuItemCategory(db *gorm.DB, item *model.MenuItem, input apiMenuItemInput, fields map[string]bool) error {
+	if !fields["category_id"] {
+		return nil
+	}
+	if input.CategoryID != nil {
+		if err := db.Select("id").First(&model.Category{}, *input.CategoryID).Error; err != nil {
+			return errors.New("category not found")
+		}
+	}
+	item.CategoryID = input.CategoryID
+	return nil
+}
+
+func preloadMenuItems(tx *gorm.DB) *gorm.DB {
+	return tx.Order("position asc")
+}
+
+func apiFindMenu(c *fiber.Ctx, db *gorm.DB) (model.Menu, error) {
+	var menu model.Menu
+	err := db.Preload("MenuItems", preloadMenuItems).First(&menu, apiID(c, "id")).Error
+	return menu, err
+}
+
+// apiSaveMenu applies the input to the menu and saves it. Only one menu can
+// be the primary menu.
+func apiSaveMenu(db *gorm.DB, menu *model.Menu, input apiMenuInput, fields map[string]bool) error {
+	if input.Slug != nil {
+		menu.Slug = *input.Slug
+	}
+	if input.Position != nil {
+		menu.Position = *input.Position
+	}
+	if input.Primary != nil {
+		menu.Primary = *input.Primary
+	}
+	if fields["parent_id"] {
+		if input.ParentID != nil {
+			if *input.ParentID == menu.ID {
+				return errors.New("a menu cannot be its own parent")
+			}
+			if err := db.First(&model.Menu{}, *input.ParentID).Error; err != nil {
+				return errors.New("parent menu not found")
+			}
+		}
+		menu.ParentID = input.ParentID
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if menu.Primary {
+			if err := tx.Model(&model.Menu{}).Where("is_primary = ? AND id != ?", true, menu.ID).
+				Update("is_primary", false).Error; err != nil {
+				return err
+			}
+		}
+		if menu.ID == 0 {
+			return tx.Omit("MenuItems", "SubMenus").Create(menu).Error
+		}
+		return tx.Model(menu).Select("title", "slug", "parent_id", "is_primary", "position").Updates(menu).Error
+	})
+}
+
+func APIListMenus(c *fiber.Ctx, db *gorm.DB) error {
+	var menus []model.Menu
+	return sendAPIList(c, db.Model(&model.Menu{}).Preload("MenuItems", preloadMenuItems), apiMenuListing, &menus)
+}
+
+func APIGetMenu(c *fiber.Ctx, db *gorm.DB) error {
+	menu, err := apiFindMenu(c, db)
+	if err != nil {
+		return apiError(c, fiber.StatusNotFound, "menu not found")
+	}
+	return apiData(c, fiber.StatusOK, menu)
+}
+
+func APICreateMenu(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermMenuManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage menus")
+	}
+
+	var input apiMenuInput
+	fields, err := apiBody(c, &input)
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	var menu model.Menu
+	if err := setAPIStrings(true, apiText{"title", input.Title, &menu.Title}); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+
+	var count int64
+	db.Model(&model.Menu{}).Where("title = ?", menu.Title).Count(&count)
+	if count > 0 {
+		return apiError(c, fiber.StatusConflict, "a menu with this title already exists")
+	}
+
+	if err := apiSaveMenu(db, &menu, input, fields); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	Audit(c, db, "menu.create", "menu", menu.ID, nil, menu)
+	return apiData(c, fiber.StatusCreated, menu)
+}
+
+func APIUpdateMenu(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermMenuManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage menus")
+	}
+
+	menu, err := apiFindMenu(c, db)
+	if err != nil {
+		return apiError(c, fiber.StatusNotFound, "menu not found")
+	}
+
+	var input apiMenuInput
+	fields, err := apiBody(c, &input)
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	before := menu
+	if err := setAPIStrings(false, apiText{"title", input.Title, &menu.Title}); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+
+	var count int64
+	db.Model(&model.Menu{}).Where("title = ? AND id != ?", menu.Title, menu.ID).Count(&count)
+	if count > 0 {
+		return apiError(c, fiber.StatusConflict, "a menu with this title already exists")
+	}
+
+	if err := apiSaveMenu(db, &menu, input, fields); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	Audit(c, db, "menu.update", "menu", menu.ID, before, menu)
+	return apiData(c, fiber.StatusOK, menu)
+}
+
+func APIDeleteMenu(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermMenuManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage menus")
+	}
+
+	menu, err := apiFindMenu(c, db)
+	if err != nil {
+		return apiError(c, fiber.StatusNotFound, "menu not found")
+	}
+
+	/// the items go with the menu and its submenus move to the top level
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("menu_id = ?", menu.ID).Delete(&model.MenuItem{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&model.Menu{}).Where("parent_id = ?", menu.ID).Update("parent_id", nil).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&menu).Error
+	})
+	if err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to delete the menu")
+	}
+	Audit(c, db, "menu.delete", "menu", menu.ID, menu, nil)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func APICreateMenuItem(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermMenuManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage menus")
+	}
+
+	menu, err := apiFindMenu(c, db)
+	if err != nil {
+		return apiError(c, fiber.StatusNotFound, "menu not found")
+	}
+
+	var input apiMenuItemInput
+	fields, err := apiBody(c, &input)
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	item := model.MenuItem{MenuID: &menu.ID}
+	if err := setAPIStrings(true, apiText{"title", input.Title, &item.Title}, apiText{"link", input.Link, &item.Link}); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if err := setAPIMenuItemCategory(db, &item, input, fields); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if input.Position != nil {
+		item.Position = *input.Position
+	}
+
+	if err := db.Create(&item).Error; err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to create the menu item")
+	}
+	Audit(c, db, "menu_item.create", "menu_item", item.ID, nil, item)
+	return apiData(c, fiber.StatusCreated, item)
+}
+
+func APIUpdateMenuItem(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermMenuManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage menus")
+	}
+
+	var item model.MenuItem
+	if err := db.Where("id = ? AND menu_id = ?", apiID(c, "item_id"), apiID(c, "id")).First(&item).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "menu item not found")
+	}
+
+	var input apiMenuItemInput
+	fields, err := apiBody(c, &input)
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	before := item
+	if err := setAPIStrings(false, apiText{"title", input.Title, &item.Title}, apiText{"link", input.Link, &item.Link}); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if err := setAPIMenuItemCategory(db, &item, input, fields); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if input.Position != nil {
+		item.Position = *input.Position
+	}
+
+	if err := db.Model(&item).Select("title", "link", "position", "category_id").Updates(&item).Error; err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to update the menu item")
+	}
+	Audit(c, db, "menu_item.update", "menu_item", item.ID, before, item)
+	return apiData(c, fiber.StatusOK, item)
+}
+
+func APIDeleteMenuItem(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermMenuManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage menus")
+	}
+
+	var item model.MenuItem
+	if err := db.Where("id = ? AND menu_id = ?", apiID(c, "item_id"), apiID(c, "id")).First(&item).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "menu item not found")
+	}
+
+	if err := db.Delete(&item).Error; err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to delete the menu item")
+	}
+	Audit(c, db, "menu_item.delete", "menu_item", item.ID, item, nil)
+	return c.SendStatus(fiber.StatusNoContent)
+}
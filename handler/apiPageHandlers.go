@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"goxcms/model"
+	"goxcms/search"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var apiPageListing = apiListing{
+	table:       "custom_pages",
+	sorts:       []string{"created_at", "updated_at", "title", "slug"},
+	defaultSort: "-created_at",
+	filters: map[string]apiFilter{
+		"slug":     {column: "slug", kind: "string"},
+		"template": {column: "template", kind: "string"},
+	},
+	search: "title",
+}
+
+// apiPageInput is the body of the page create and update requests. Fields
+// left out of an update keep their value.
+type apiPageInput struct {
+	Title       *string    `json:"title"`
+	Content     *string    `json:"content"`
+	Slug        *string    `json:"slug"`
+	Template    *string    `json:"template"`
+	PublishAt   *time.Time `json:"publish_at"`
+	UnpublishAt *time.Time `json:"unpublish_at"`
+}
+
+func apiPageText(page *model.CustomPage, input apiPageInput) []apiText {
+	return []apiText{
+		{"title", input.Title, &page.Title},
+		{"content", input.Content, &page.Content},
+		{"slug", input.Slug, &page.Slug},
+	}
+}
+
+// apiFindPage loads a page. Without page.manage only pages that are live
+// can be read.
+func apiFindPage(c *fiber.Ctx, db *gorm.DB) (model.CustomPage, bool) {
+	var page model.CustomPage
+	if err := db.First(&page, apiID(c, "id")).Error; err != nil {
+		return page, false
+	}
+	return page, page.IsVisible(time.Now()) || HasPermission(c, model.PermPageManage)
+}
+
+func APIListPages(c *fiber.Ctx, db *gorm.DB) error {
+	query := db.Model(&model.CustomPage{})
+	if !HasPermission(c, model.PermPageManage) {
+		query = query.Scopes(model.PublishedPages)
+	}
+
+	var pages []model.CustomPage
+	return sendAPIList(c, query, apiPageListing, &pages)
+}
+
+func APIGetPage(c *fiber.Ctx, db *gorm.DB) error {
+	page, ok := apiFindPage(c, db)
+	if !ok {
+		return apiError(c, fiber.StatusNotFound, "page not found")
+	}
+	return apiData(c, fiber.StatusOK, page)
+}
+
+func APICreatePage(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermPageManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage pages")
+	}
+
+	var input apiPageInput
+	if _, err := apiBody(c, &input); err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	page := model.CustomPage{Template: "page", PublishAt: input.PublishAt, UnpublishAt: input.UnpublishAt}
+	if err := setAPIStrings(true, apiPageText(&page, input)...); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if err := setAPIStrings(false, apiText{"template", input.Template, &page.Template}); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if err := checkSchedule(page.PublishAt, page.UnpublishAt); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+
+	if apiSlugTaken(db, "custom_pages", page.Slug, 0) {
+		return apiError(c, fiber.StatusConflict, "the slug is already in use")
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&page).Error; err != nil {
+			return err
+		}
+		return saveCustomPageRevision(tx, c, page, "Created")
+	})
+	if err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to create the page")
+	}
+	search.SyncPage(db, page.ID)
+	Audit(c, db, "page.create", "page", page.ID, nil, page)
+
+	return apiData(c, fiber.StatusCreated, page)
+}
+
+func APIUpdatePage(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermPageManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage pages")
+	}
+
+	page, ok := apiFindPage(c, db)
+	if !ok {
+		return apiError(c, fiber.StatusNotFound, "page not found")
+	}
+
+	var input apiPageInput
+	fields, err := apiBody(c, &input)
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	before := page
+	text := append(apiPageText(&page, input), apiText{"template", input.Template, &page.Template})
+	if err := setAPIStrings(false, text...); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if fields["publish_at"] {
+		page.PublishAt = input.PublishAt
+	}
+	if fields["unpublish_at"] {
+		page.UnpublishAt = input.UnpublishAt
+	}
+	if err := checkSchedule(page.PublishAt, page.UnpublishAt); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+
+	if apiSlugTaken(db, "custom_pages", page.Slug, page.ID) {
+		return apiError(c, fiber.StatusConflict, "the slug is already in use")
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		/// select the schedule columns explicitly so clearing a date is saved too
+		if err := tx.Model(&page).Select("title", "content", "slug", "template", "publish_at", "unpublish_at").
+			Updates(&page).Error; err != nil {
+			return err
+		}
+		return saveCustomPageRevision(tx, c, page, "")
+	})
+	if err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to update the page")
+	}
+	search.SyncPage(db, page.ID)
+	Audit(c, db, "page.update", "page", page.ID, before, page)
+
+	return apiData(c, fiber.StatusOK, page)
+}
+
+func APIDeletePage(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermPageManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage pages")
+	}
+
+	page, ok := apiFindPage(c, db)
+	if !ok {
+		return apiError(c, fiber.StatusNotFound, "page not found")
+	}
+
+	if err := db.Delete(&page).Error; err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to delete the page")
+	}
+	search.SyncPage(db, page.ID)
+	Audit(c, db, "page.delete", "page", page.ID, page, nil)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"errors"
+	"goxcms/hooks"
+	"goxcms/model"
+	"goxcms/search"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var apiPostListing = apiListing{
+	table:       "posts",
+	sorts:       []string{"created_at", "updated_at", "title", "slug"},
+	defaultSort: "-created_at",
+	filters: map[string]apiFilter{
+		"published": {column: "published", kind: "bool"},
+		"user_id":   {column: "user_id", kind: "uint"},
+		"slug":      {column: "slug", kind: "string"},
+	},
+	search: "title",
+}
+
+// apiPostInput is the body of the post create and update requests. Fields
+// left out of an update keep their value.
+type apiPostInput struct {
+	Title       *string    `json:"title"`
+	Content     *string    `json:"content"`
+	Slug        *string    `json:"slug"`
+	ImageURL    *string    `json:"image_url"`
+	CategoryIDs *[]uint    `json:"category_ids"`
+	TagIDs      *[]uint    `json:"tag_ids"`
+	Published   *bool      `json:"published"`
+	PublishAt   *time.Time `json:"publish_at"`
+	UnpublishAt *time.Time `json:"unpublish_at"`
+}
+
+// apiVisiblePosts limits a post query to what the user may read: everything
+// with post.edit, their own posts besides the published ones with
+// post.edit_own, and otherwise only published posts.
+func apiVisiblePosts(c *fiber.Ctx, db *gorm.DB) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if HasPermission(c, model.PermPostEdit) {
+			return tx
+		}
+		if HasPermission(c, model.PermPostEditOwn) {
+			published := db.Model(&model.Post{}).Select("id").Scopes(model.PublishedPosts)
+			return tx.Where("posts.user_id = ? OR posts.id IN (?)", currentUserID(c), published)
+		}
+		return tx.Scopes(model.PublishedPosts)
+	}
+}
+
+// apiPostText pairs the text fields of the request with those of the post.
+func apiPostText(post *model.Post, input apiPostInput) []apiText {
+	return []apiText{
+		{"title", input.Title, &post.Title},
+		{"content", input.Content, &post.Content},
+		{"slug", input.Slug, &post.Slug},
+		{"image_url", input.ImageURL, &post.ImageURL},
+	}
+}
+
+func apiCanReadPost(c *fiber.Ctx, post model.Post) bool {
+	return post.IsVisible(time.Now()) || canEditPost(c, post)
+}
+
+// apiLoadTerms fetches the categories and tags with the given IDs and fails
+// when one of them does not exist.
+func apiLoadTerms(tx *gorm.DB, categoryIDs, tagIDs []uint) ([]model.Category, []model.Tag, error) {
+	var categories []model.Category
+	if len(categoryIDs) > 0 {
+		if err := tx.Find(&categories, categoryIDs).Error; err != nil {
+			return nil, nil, err
+		}
+		if len(categories) != len(uniqueIDs(categoryIDs)) {
+			return nil, nil, errors.New("unknown category in category_ids")
+		}
+	}
+
+	var tags []model.Tag
+	if len(tagIDs) > 0 {
+		if err := tx.Find(&tags, tagIDs).Error; err != nil {
+			return nil, nil, err
+		}
+		if len(tags) != len(uniqueIDs(tagIDs)) {
+			return nil, nil, errors.New("unknown tag in tag_ids")
+		}
+	}
+
+	return categories, tags, nil
+}
+
+func uniqueIDs(ids []uint) map[uint]bool {
+	set := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+func apiSlugTaken(db *gorm.DB, table, slug string, exceptID uint) bool {
+	var count int64
+	db.Table(table).Where("slug = ? AND id != ?", slug, exceptID).Count(&count)
+	return count > 0
+}
+
+func APIListPosts(c *fiber.Ctx, db *gorm.DB) error {
+	query := db.Model(&model.Post{}).Preload("Categories").Preload("Tags").Scopes(apiVisiblePosts(c, db))
+
+	if slug := c.Query("category"); slug != "" {
+		query = query.Where("posts.id IN (?)", db.Table("post_categories").Select("post_categories.post_id").
+			Joins("JOIN categories ON categories.id = post_categories.category_id").Where("categories.slug = ?", slug))
+	}
+	if slug := c.Query("tag"); slug != "" {
+		query = query.Where("posts.id IN (?)", db.Table("post_tags").Select("post_tags.post_id").
+			Joins("JOIN tags ON tags.id = post_tags.tag_id").Where("tags.slug = ?", slug))
+	}
+
+	var posts []model.Post
+	return sendAPIList(c, query, apiPostListing, &posts)
+}
+
+func APIGetPost(c *fiber.Ctx, db *gorm.DB) error {
+	var post model.Post
+	if err := db.Preload("Categories").Preload("Tags").First(&post, apiID(c, "id")).Error; err != nil || !apiCanReadPost(c, post) {
+		return apiError(c, fiber.StatusNotFound, "post not found")
+	}
+	return apiData(c, fiber.StatusOK, post)
+}
+
+func APICreatePost(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermPostCreate) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to create posts")
+	}
+
+	var input apiPostInput
+	fields, err := apiBody(c, &input)
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	post := model.Post{UserID: currentUserID(c)}
+	if err := setAPIStrings(true, apiPostText(&post, input)...); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+
+	if fields["published"] || fields["publish_at"] || fields["unpublish_at"] {
+		if !HasPermission(c, model.PermPostPublish) {
+			return apiError(c, fiber.StatusForbidden, "you are not allowed to publish posts")
+		}
+		if input.Published != nil {
+			post.Published = *input.Published
+		}
+		post.PublishAt, post.UnpublishAt = input.PublishAt, input.UnpublishAt
+	}
+	if err := checkSchedule(post.PublishAt, post.UnpublishAt); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+
+	if apiSlugTaken(db, "posts", post.Slug, 0) {
+		return apiError(c, fiber.StatusConflict, "the slug is already in use")
+	}
+
+	var categoryIDs, tagIDs []uint
+	if input.CategoryIDs != nil {
+		categoryIDs = *input.CategoryIDs
+	}
+	if input.TagIDs != nil {
+		tagIDs = *input.TagIDs
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if post.Categories, post.Tags, err = apiLoadTerms(tx, categoryIDs, tagIDs); err != nil {
+			return err
+		}
+		if err := tx.Create(&post).Error; err != nil {
+			return err
+		}
+		return savePostRevision(tx, c, post, "Created")
+	})
+	if err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, "failed to create the post: "+err.Error())
+	}
+
+	search.SyncPost(db, post.ID)
+	hooks.DoAction(hooks.PostCreated, post)
+	Audit(c, db, "post.create", "post", post.ID, nil, post)
+	if post.Published {
+		hooks.DoAction(hooks.PostPublished, post)
+	}
+
+	return apiData(c, fiber.StatusCreated, post)
+}
+
+func APIUpdatePost(c *fiber.Ctx, db *gorm.DB) error {
+	var post model.Post
+	if err := db.Preload("Categories").Preload("Tags").First(&post, apiID(c, "id")).Error; err != nil || !apiCanReadPost(c, post) {
+		return apiError(c, fiber.StatusNotFound, "post not found")
+	}
+	if !canEditPost(c, post) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to edit this post")
+	}
+
+	var input apiPostInput
+	fields, err := apiBody(c, &input)
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	before := post
+	if err := setAPIStrings(false, apiPostText(&post, input)...); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+
+	wasPublished := post.Published
+	if fields["published"] || fields["publish_at"] || fields["unpublish_at"] {
+		if !HasPermission(c, model.PermPostPublish) {
+			return apiError(c, fiber.StatusForbidden, "you are not allowed to publish posts")
+		}
+		if input.Published != nil {
+			post.Published = *input.Published
+		}
+		if fields["publish_at"] {
+			post.PublishAt = input.PublishAt
+		}
+		if fields["unpublish_at"] {
+			post.UnpublishAt = input.UnpublishAt
+		}
+	}
+	if err := checkSchedule(post.PublishAt, post.UnpublishAt); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+
+	if apiSlugTaken(db, "posts", post.Slug, post.ID) {
+		return apiError(c, fiber.StatusConflict, "the slug is already in use")
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if input.CategoryIDs != nil || input.TagIDs != nil {
+			var categoryIDs, tagIDs []uint
+			for _, category := range post.Categories {
+				categoryIDs = append(categoryIDs, category.ID)
+			}
+			for _, tag := range post.Tags {
+				tagIDs = append(tagIDs, tag.ID)
+			}
+			if input.CategoryIDs != nil {
+				categoryIDs = *input.CategoryIDs
+			}
+			if input.TagIDs != nil {
+				tagIDs = *input.TagIDs
+			}
+
+			categories, tags, err := apiLoadTerms(tx, categoryIDs, tagIDs)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&post).Association("Categories").Replace(categories); err != nil {
+				return err
+			}
+			if err := tx.Model(&post).Association("Tags").Replace(tags); err != nil {
+				return err
+			}
+			post.Categories, post.Tags = categories, tags
+		}
+
+		if err := tx.Model(&post).Select("title", "content", "slug", "image_url", "published", "publish_at", "unpublish_at").
+			Updates(&post).Error; err != nil {
+			return err
+		}
+		return savePostRevision(tx, c, post, "")
+	})
+	if err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, "failed to update the post: "+err.Error())
+	}
+
+	search.SyncPost(db, post.ID)
+	hooks.DoAction(hooks.PostUpdated, post)
+	Audit(c, db, "post.update", "post", post.ID, before, post)
+	if post.Published != wasPublished {
+		if post.Published {
+			hooks.DoAction(hooks.PostPublished, post)
+		} else {
+			hooks.DoAction(hooks.PostUnpublished, post)
+		}
+	}
+
+	return apiData(c, fiber.StatusOK, post)
+}
+
+func APIDeletePost(c *fiber.Ctx, db *gorm.DB) error {
+	var post model.Post
+	if err := db.Preload("Categories").Preload("Tags").First(&post, apiID(c, "id")).Error; err != nil || !apiCanReadPost(c, post) {
+		return apiError(c, fiber.StatusNotFound, "post not found")
+	}
+	if !canDeletePost(c, post) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to delete this post")
+	}
+	before := post
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&post).Association("Categories").Clear(); err != nil {
+			return err
+		}
+		if err := tx.Model(&post).Association("Tags").Clear(); err != nil {
+			return err
+		}
+		return tx.Delete(&post).Error
+	})
+	if err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to delete the post")
+	}
+
+	search.SyncPost(db, post.ID)
+	hooks.DoAction(hooks.PostDeleted, post)
+	Audit(c, db, "post.delete", "post", post.ID, before, nil)
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"goxcms/model"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var (
+	apiCategoryListing = apiCategoryTermListing()
+	apiTagListing      = apiTermListing("tags")
+)
+
+// apiCategoryTermListing is the term listing, which categories can also
+// filter by parent and sort by position.
+func apiCategoryTermListing() apiListing {
+	listing := apiTermListing("categories")
+	listing.sorts = append(listing.sorts, "position")
+	listing.filters["parent_id"] = apiFilter{column: "parent_id", kind: "uint"}
+	return listing
+}
+
+// apiTermListing is the listing of categories and tags, which have the same columns.
+func apiTermListing(table string) apiListing {
+	return apiListing{
+		table:       table,
+		sorts:       []string{"name", "slug"},
+		defaultSort: "name",
+		filters: map[string]apiFilter{
+			"slug": {column: "slug", kind: "string"},
+		},
+		search: "name",
+	}
+}
+
+// apiTermInput is the body of the category and tag create and update requests.
+type apiTermInput struct {
+	Name *string `json:"name"`
+	Slug *string `json:"slug"`
+}
+
+// apiCategoryInput is the body of the category create and update requests.
+// A null parent_id makes the category a top level category.
+type apiCategoryInput struct {
+	apiTermInput
+	ParentID             *uint   `json:"parent_id"`
+	Position             *int    `json:"position"`
+	Description          *string `json:"description"`
+	IncludeSubcategories *bool   `json:"include_subcategories"`
+}
+
+// setAPICategory copies the hierarchy fields that were sent to the category.
+func setAPICategory(db *gorm.DB, category *model.Category, input apiCategoryInput, fields map[string]bool) error {
+	if fields["parent_id"] {
+		if err := model.CheckCategoryParent(db, category.ID, input.ParentID); err != nil {
+			return err
+		}
+		category.ParentID = input.ParentID
+	}
+	if input.Position != nil {
+		category.Position = *input.Position
+	}
+	if input.Description != nil {
+		category.Description = *input.Description
+	}
+	if input.IncludeSubcategories != nil {
+		category.IncludeSubcategories = *input.IncludeSubcategories
+	}
+	return nil
+}
+
+// apiTermTaken reports whether another category or tag already uses the name or slug.
+func apiTermTaken(db *gorm.DB, table, name, slug string, exceptID uint) bool {
+	var count int64
+	db.Table(table).Where("(name = ? OR slug = ?) AND id != ?", name, slug, exceptID).Count(&count)
+	return count > 0
+}
+
+// apiCountPosts returns how many posts a category or tag has.
+func apiCountPosts(db *gorm.DB, joinTable, column string, id uint) int {
+	var count int64
+	db.Table(joinTable).Where(column+" = ?", id).Count(&count)
+	return int(count)
+}
+
+func APIListCategories(c *fiber.Ctx, db *gorm.DB) error {
+	var categories []model.Category
+	next, err := findAPIPage(c, db.Model(&model.Category{}), apiCategoryListing, &categories)
+	if err != nil {
+		return apiFail(c, err)
+	}
+
+	for i := range categories {
+		categories[i].PostsCount = apiCountPosts(db, "post_categories", "category_id", categories[i].ID)
+	}
+	return c.JSON(fiber.Map{"data": categories, "next_cursor": next})
+}
+
+func APIGetCategory(c *fiber.Ctx, db *gorm.DB) error {
+	var category model.Category
+	if err := db.First(&category, apiID(c, "id")).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "category not found")
+	}
+	category.PostsCount = apiCountPosts(db, "post_categories", "category_id", category.ID)
+	return apiData(c, fiber.StatusOK, category)
+}
+
+func APICreateCategory(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermTaxonomyManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage categories")
+	}
+
+	var input apiCategoryInput
+	fields, err := apiBody(c, &input)
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	var category model.Category
+	if err := setAPIStrings(true, apiText{"name", input.Name, &category.Name}, apiText{"slug", input.Slug, &category.Slug}); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if err := setAPICategory(db, &category, input, fields); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if apiTermTaken(db, "categories", category.Name, category.Slug, 0) {
+		return apiError(c, fiber.StatusConflict, "a category with this name or slug already exists")
+	}
+
+	if err := db.Create(&category).Error; err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to create the category")
+	}
+	Audit(c, db, "category.create", "category", category.ID, nil, category)
+	return apiData(c, fiber.StatusCreated, category)
+}
+
+func APIUpdateCategory(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermTaxonomyManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage categories")
+	}
+
+	var category model.Category
+	if err := db.First(&category, apiID(c, "id")).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "category not found")
+	}
+
+	var input apiCategoryInput
+	fields, err := apiBody(c, &input)
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+	before := category
+	if err := setAPIStrings(false, apiText{"name", input.Name, &category.Name}, apiText{"slug", input.Slug, &category.Slug}); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if err := setAPICategory(db, &category, input, fields); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if apiTermTaken(db, "categories", category.Name, category.Slug, category.ID) {
+		return apiError(c, fiber.StatusConflict, "a category with this name or slug already exists")
+	}
+
+	if err := db.Model(&category).Select("name", "slug", "parent_id", "position", "description", "include_subcategories").Updates(&category).Error; err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to update the category")
+	}
+	Audit(c, db, "category.update", "category", category.ID, before, category)
+	return apiData(c, fiber.StatusOK, category)
+}
+
+func APIDeleteCategory(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermTaxonomyManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage categories")
+	}
+
+	var category model.Category
+	if err := db.First(&category, apiID(c, "id")).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "category not found")
+	}
+
+	if err := deleteCategory(db, category); err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to delete the category")
+	}
+	Audit(c, db, "category.delete", "category", category.ID, category, nil)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func APIListTags(c *fiber.Ctx, db *gorm.DB) error {
+	var tags []model.Tag
+	next, err := findAPIPage(c, db.Model(&model.Tag{}), apiTagListing, &tags)
+	if err != nil {
+		return apiFail(c, err)
+	}
+
+	for i := range tags {
+		tags[i].PostsCount = apiCountPosts(db, "post_tags", "tag_id", tags[i].ID)
+	}
+	return c.JSON(fiber.Map{"data": tags, "next_cursor": next})
+}
+
+func APIGetTag(c *fiber.Ctx, db *gorm.DB) error {
+	var tag model.Tag
+	if err := db.First(&tag, apiID(c, "id")).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "tag not found")
+	}
+	tag.PostsCount = apiCountPosts(db, "post_tags", "tag_id", tag.ID)
+	return apiData(c, fiber.StatusOK, tag)
+}
+
+func APICreateTag(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermTaxonomyManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage tags")
+	}
+
+	var input apiTermInput
+	if _, err := apiBody(c, &input); err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	var tag model.Tag
+	if err := setAPIStrings(true, apiText{"name", input.Name, &tag.Name}, apiText{"slug", input.Slug, &tag.Slug}); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if apiTermTaken(db, "tags", tag.Name, tag.Slug, 0) {
+		return apiError(c, fiber.StatusConflict, "a tag with this name or slug already exists")
+	}
+
+	if err := db.Create(&tag).Error; err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to create the tag")
+	}
+	Audit(c, db, "tag.create", "tag", tag.ID, nil, tag)
+	return apiData(c, fiber.StatusCreated, tag)
+}
+
+func APIUpdateTag(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermTaxonomyManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage tags")
+	}
+
+	var tag model.Tag
+	if err := db.First(&tag, apiID(c, "id")).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "tag not found")
+	}
+
+	var input apiTermInput
+	if _, err := apiBody(c, &input); err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+	before := tag
+	if err := setAPIStrings(false, apiText{"name", input.Name, &tag.Name}, apiText{"slug", input.Slug, &tag.Slug}); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if apiTermTaken(db, "tags", tag.Name, tag.Slug, tag.ID) {
+		return apiError(c, fiber.StatusConflict, "a tag with this name or slug already exists")
+	}
+
+	if err := saveTag(db, tag, before.Slug); err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to update the tag")
+	}
+	clearTagCache()
+	Audit(c, db, "tag.update", "tag", tag.ID, before, tag)
+	return apiData(c, fiber.StatusOK, tag)
+}
+
+func APIDeleteTag(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermTaxonomyManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage tags")
+	}
+
+	var tag model.Tag
+	if err := db.First(&tag, apiID(c, "id")).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "tag not found")
+	}
+
+	if err := deleteTag(db, tag); err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to delete the tag")
+	}
+	clearTagCache()
+	Audit(c, db, "tag.delete", "tag", tag.ID, tag, nil)
+	return c.SendStatus(fiber.StatusNoContent)
+}
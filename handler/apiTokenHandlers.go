@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"goxcms/model"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// apiTokenPrefix marks the secrets of personal access tokens, so they are
+// easy to spot in logs and by secret scanners.
+const apiTokenPrefix = "gox_"
+
+// apiTokenExpiryDays are the lifetimes offered when creating a token; 0 never expires.
+var apiTokenExpiryDays = []int{30, 90, 365, 0}
+
+func newAPITokenSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + hex.EncodeToString(secret), nil
+}
+
+func APITokensPage(c *fiber.Ctx, db *gorm.DB) error {
+	user := c.Locals("user").(model.User)
+
+	var tokens []model.APIToken
+	db.Where("user_id = ?", user.ID).Order("created_at desc").Find(&tokens)
+
+	return c.Render("account/api_tokens", fiber.Map{
+		"Title":      "API Tokens",
+		"Tokens":     tokens,
+		"Scopes":     model.APIScopes,
+		"ExpiryDays": apiTokenExpiryDays,
+		"IsLoggedIn": c.Locals("isLoggedin"),
+		"Settings":   c.Locals("Settings"),
+	}, "main")
+}
+
+func CreateAPIToken(c *fiber.Ctx, db *gorm.DB) error {
+	user := c.Locals("user").(model.User)
+
+	/// an admin who still has to set up two-factor authentication must not get around it with a token
+	if c.Locals("twoFactorSetupRequired") == true {
+		return redirectToTwoFactorSetup(c)
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	if name == "" || len(name) > 100 {
+		return ShowToastError(c, "Please give the token a name of up to 100 characters")
+	}
+
+	requested := map[string]bool{}
+	for _, scope := range c.Request().PostArgs().PeekMulti("scopes") {
+		requested[string(scope)] = true
+	}
+
+	/// unknown scopes are dropped and the rest kept in their usual order
+	var scopes []string
+	for _, scope := range model.APIScopes {
+		if requested[scope] {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return ShowToastError(c, "Please choose at least one scope")
+	}
+
+	days, err := strconv.Atoi(c.FormValue("expires_days"))
+	if err != nil || days < 0 {
+		return ShowToastError(c, "Invalid expiry")
+	}
+
+	secret, err := newAPITokenSecret()
+	if err != nil {
+		return ShowToastError(c, "Failed to create the token")
+	}
+
+	token := model.APIToken{
+		UserID:    user.ID,
+		Name:      name,
+		Prefix:    secret[:len(apiTokenPrefix)+8],
+		TokenHash: hashToken(secret),
+		Scopes:    strings.Join(scopes, ","),
+	}
+	if days > 0 {
+		expiresAt := time.Now().AddDate(0, 0, days)
+		token.ExpiresAt = &expiresAt
+	}
+
+	if err := db.Create(&token).Error; err != nil {
+		return ShowToastError(c, "Failed to create the token")
+	}
+
+	ShowToast(c, "Token created")
+	return c.Render("account/api_token_created", fiber.Map{"Token": token, "Secret": secret})
+}
+
+func DeleteAPIToken(c *fiber.Ctx, db *gorm.DB) error {
+	user := c.Locals("user").(model.User)
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid token ID")
+	}
+
+	/// users can only delete their own tokens
+	result := db.Where("id = ? AND user_id = ?", id, user.ID).Delete(&model.APIToken{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return ShowToastError(c, "Token not found")
+	}
+
+	ShowToast(c, "Token deleted")
+	return c.SendString("")
+}
+
+// APITokenAuth authenticates requests to the JSON API by the personal access
+// token in the Authorization header. The request then acts as the token's
+// user, so the usual permission checks apply on top of the token's scopes.
+// Login cookies are ignored.
+func APITokenAuth(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals("user", nil)
+		c.Locals("isLoggedin", false)
+		c.Locals("isAdmin", false)
+		c.Locals("permissions", map[string]bool{})
+		c.Locals("sessionID", nil)
+
+		secret, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !ok || !strings.HasPrefix(secret, apiTokenPrefix) {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="api"`)
+			return apiError(c, fiber.StatusUnauthorized, "missing or malformed bearer token")
+		}
+
+		var token model.APIToken
+		if err := db.Where("token_hash = ?", hashToken(secret)).First(&token).Error; err != nil || token.Expired(time.Now()) {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="api", error="invalid_token"`)
+			return apiError(c, fiber.StatusUnauthorized, "invalid or expired token")
+		}
+
+		var user model.User
+		if err := db.First(&user, token.UserID).Error; err != nil {
+			return apiError(c, fiber.StatusUnauthorized, "invalid or expired token")
+		}
+
+		role := LoadRole(db, user.RoleID)
+		if twoFactorSetupRequired(db, user, role) {
+			return apiError(c, fiber.StatusForbidden, "two-factor authentication must be set up first")
+		}
+
+		if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) >= lastSeenInterval {
+			db.Model(&token).UpdateColumn("last_used_at", time.Now())
+		}
+
+		c.Locals("user", user)
+		c.Locals("isLoggedin", true)
+		c.Locals("permissions", role.PermissionSet())
+		c.Locals("isAdmin", role.HasPermission(model.PermAdminAccess))
+		c.Locals("apiToken", token)
+
+		return c.Next()
+	}
+}
+
+// RequireAPIScope only lets the request through when its token has the scope.
+func RequireAPIScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token, ok := c.Locals("apiToken").(model.APIToken)
+		if !ok || !token.HasScope(scope) {
+			return apiError(c, fiber.StatusForbidden, "the token lacks the "+scope+" scope")
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"goxcms/hooks"
+	"goxcms/model"
+	"log"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var apiUserListing = apiListing{
+	table:       "users",
+	sorts:       []string{"created_at", "username"},
+	defaultSort: "username",
+	filters: map[string]apiFilter{
+		"role_id":  {column: "role_id", kind: "uint"},
+		"username": {column: "username", kind: "string"},
+	},
+	search: "username",
+}
+
+// apiUserInput is the body of the user create and update requests. Fields
+// left out of an update keep their value.
+type apiUserInput struct {
+	Username  *string `json:"username"`
+	Password  *string `json:"password"`
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Email     *string `json:"email"`
+	RoleID    *uint   `json:"role_id"`
+}
+
+// apiSetUserRole changes the role of the user. Like in the admin panel it
+// needs role.manage and nobody can change their own role.
+func apiSetUserRole(c *fiber.Ctx, db *gorm.DB, user *model.User, roleID uint) error {
+	if user.RoleID == roleID {
+		return nil
+	}
+	if !HasPermission(c, model.PermRoleManage) {
+		return fiber.NewError(fiber.StatusForbidden, "you are not allowed to change roles")
+	}
+	if user.ID != 0 && user.ID == currentUserID(c) {
+		return fiber.NewError(fiber.StatusForbidden, "you cannot change your own role")
+	}
+	if err := db.First(&model.Role{}, roleID).Error; err != nil {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "role not found")
+	}
+	user.RoleID = roleID
+	return nil
+}
+
+// apiSetUserEmail changes the email address, which then has to be verified again.
+func apiSetUserEmail(user *model.User, email string) bool {
+	email = strings.TrimSpace(email)
+	if user.Email != nil && strings.EqualFold(*user.Email, email) {
+		return false
+	}
+	if email == "" {
+		user.Email = nil
+	} else {
+		user.Email = &email
+	}
+	user.EmailVerifiedAt = nil
+	return user.Email != nil
+}
+
+func APIListUsers(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermUserManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage users")
+	}
+
+	var users []model.User
+	return sendAPIList(c, db.Model(&model.User{}), apiUserListing, &users)
+}
+
+// APICurrentUser returns the user the token belongs to.
+func APICurrentUser(c *fiber.Ctx) error {
+	return apiData(c, fiber.StatusOK, c.Locals("user"))
+}
+
+func APIGetUser(c *fiber.Ctx, db *gorm.DB) error {
+	id := apiID(c, "id")
+	if id != currentUserID(c) && !HasPermission(c, model.PermUserManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage users")
+	}
+
+	var user model.User
+	if err := db.First(&user, id).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "user not found")
+	}
+	return apiData(c, fiber.StatusOK, user)
+}
+
+func APICreateUser(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermUserManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage users")
+	}
+
+	var input apiUserInput
+	if _, err := apiBody(c, &input); err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+
+	var password string
+	user := model.User{RoleID: model.RoleUserID}
+	err := setAPIStrings(true,
+		apiText{"username", input.Username, &user.Username},
+		apiText{"password", input.Password, &password},
+		apiText{"first_name", input.FirstName, &user.FirstName},
+		apiText{"last_name", input.LastName, &user.LastName},
+	)
+	if err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if input.Email != nil {
+		apiSetUserEmail(&user, *input.Email)
+	}
+	if input.RoleID != nil {
+		if err := apiSetUserRole(c, db, &user, *input.RoleID); err != nil {
+			return apiFail(c, err)
+		}
+	}
+
+	user.Password = password
+	if err := validator.New().Struct(&user); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, FormatValidationError(err))
+	}
+
+	if err := db.Where("username = ?", user.Username).First(&model.User{}).Error; err == nil {
+		return apiError(c, fiber.StatusConflict, "the username is already taken")
+	}
+
+	if user.Password, err = HashPassword(password); err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to hash the password")
+	}
+	if err := db.Create(&user).Error; err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to create the user")
+	}
+
+	hooks.DoAction(hooks.UserRegistered, user)
+	Audit(c, db, "user.create", "user", user.ID, nil, user)
+
+	if user.Email != nil {
+		if err := sendVerificationEmail(c, db, user); err != nil {
+			log.Printf("Failed to send the verification email to %s: %v", user.Username, err)
+		}
+	}
+
+	return apiData(c, fiber.StatusCreated, user)
+}
+
+// APIUpdateUser changes a user. Everybody can change their own name, email
+// address and password; changing other users needs user.manage.
+func APIUpdateUser(c *fiber.Ctx, db *gorm.DB) error {
+	id := apiID(c, "id")
+	if id != currentUserID(c) && !HasPermission(c, model.PermUserManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage users")
+	}
+
+	var user model.User
+	if err := db.First(&user, id).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "user not found")
+	}
+
+	var input apiUserInput
+	if _, err := apiBody(c, &input); err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+	if input.Username != nil && *input.Username != user.Username {
+		return apiError(c, fiber.StatusUnprocessableEntity, "the username cannot be changed")
+	}
+
+	before := user
+	err := setAPIStrings(false,
+		apiText{"first_name", input.FirstName, &user.FirstName},
+		apiText{"last_name", input.LastName, &user.LastName},
+	)
+	if err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+
+	emailChanged := false
+	if input.Email != nil {
+		emailChanged = apiSetUserEmail(&user, *input.Email)
+	}
+	if input.RoleID != nil {
+		if err := apiSetUserRole(c, db, &user, *input.RoleID); err != nil {
+			return apiFail(c, err)
+		}
+	}
+
+	if err := validator.New().Struct(&user); err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, FormatValidationError(err))
+	}
+
+	if input.Password != nil {
+		if len(*input.Password) < 6 {
+			return apiError(c, fiber.StatusUnprocessableEntity, "password must be at least 6 characters long")
+		}
+		if user.Password, err = HashPassword(*input.Password); err != nil {
+			return apiError(c, fiber.StatusInternalServerError, "failed to hash the password")
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Select("first_name", "last_name", "email", "email_verified_at", "role_id", "password").
+			Updates(&user).Error; err != nil {
+			return err
+		}
+		/// a new password logs out whoever knew the old one
+		if input.Password != nil {
+			return RevokeUserSessions(tx, user.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to update the user")
+	}
+	Audit(c, db, "user.update", "user", user.ID, before, user)
+	if input.Password != nil {
+		Audit(c, db, "user.password", "user", user.ID, nil, nil)
+	}
+
+	if emailChanged {
+		if err := sendVerificationEmail(c, db, user); err != nil {
+			log.Printf("Failed to send the verification email to %s: %v", user.Username, err)
+		}
+	}
+
+	return apiData(c, fiber.StatusOK, user)
+}
+
+func APIDeleteUser(c *fiber.Ctx, db *gorm.DB) error {
+	if !HasPermission(c, model.PermUserManage) {
+		return apiError(c, fiber.StatusForbidden, "you are not allowed to manage users")
+	}
+
+	id := apiID(c, "id")
+	if id == currentUserID(c) {
+		return apiError(c, fiber.StatusUnprocessableEntity, "you cannot delete yourself")
+	}
+
+	var user model.User
+	if err := db.First(&user, id).Error; err != nil {
+		return apiError(c, fiber.StatusNotFound, "user not found")
+	}
+	if err := DeleteUserAccount(db, user); err != nil {
+		return apiError(c, fiber.StatusInternalServerError, "failed to delete the user")
+	}
+	Audit(c, db, "user.delete", "user", user.ID, user, nil)
+	return c.SendStatus(fiber.StatusNoContent)
+}
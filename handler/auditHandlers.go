@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"goxcms/model"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Audit records an administrative action of the current user. before and
+// after are the target around the change; pass nil where there is none, as
+// for a new or a deleted record.
+func Audit(c *fiber.Ctx, db *gorm.DB, action, targetType string, targetID interface{}, before, after interface{}) {
+	event := model.AuditEvent{
+		Source:     model.AuditSourceAdmin,
+		Action:     action,
+		TargetType: targetType,
+		IP:         c.IP(),
+	}
+	if targetID != nil {
+		event.TargetID = fmt.Sprint(targetID)
+	}
+	if user, ok := c.Locals("user").(model.User); ok {
+		id := user.ID
+		event.ActorID = &id
+		event.ActorName = user.Username
+	}
+	if _, ok := c.Locals("apiToken").(model.APIToken); ok {
+		event.Source = model.AuditSourceAPI
+	}
+
+	RecordAuditEvent(db, event, before, after)
+}
+
+// RecordAuditEvent stores the event with before and after as JSON. The
+// command line uses it directly, since it has no request.
+func RecordAuditEvent(db *gorm.DB, event model.AuditEvent, before, after interface{}) {
+	event.Before = auditJSON(before)
+	event.After = auditJSON(after)
+
+	if err := db.Create(&event).Error; err != nil {
+		log.Printf("Failed to record the audit event %s on %s %s: %v", event.Action, event.TargetType, event.TargetID, err)
+	}
+}
+
+func auditJSON(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// auditQuery applies the filters of the audit log view and export.
+func auditQuery(c *fiber.Ctx, db *gorm.DB) *gorm.DB {
+	query := db.Model(&model.AuditEvent{})
+
+	if actor := strings.TrimSpace(c.Query("actor")); actor != "" {
+		query = query.Where("actor_name LIKE ?", "%"+actor+"%")
+	}
+	if action := strings.TrimSpace(c.Query("action")); action != "" {
+		query = query.Where("action LIKE ?", action+"%")
+	}
+	for _, column := range []string{"target_type", "target_id", "source"} {
+		if value := strings.TrimSpace(c.Query(column)); value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+	if from, err := time.ParseInLocation("2006-01-02", c.Query("from"), time.Local); err == nil {
+		query = query.Where("created_at >= ?", from)
+	}
+	if to, err := time.ParseInLocation("2006-01-02", c.Query("to"), time.Local); err == nil {
+		query = query.Where("created_at < ?", to.AddDate(0, 0, 1))
+	}
+	return query
+}
+
+// auditFilters passes the filters on to the pagination and export links.
+func auditFilters(c *fiber.Ctx) string {
+	values := make([]string, 0, 7)
+	for _, key := range []string{"actor", "action", "target_type", "target_id", "source", "from", "to"} {
+		if value := c.Query(key); value != "" {
+			values = append(values, key+"="+url.QueryEscape(value))
+		}
+	}
+	return strings.Join(values, "&")
+}
+
+func SearchAuditEvents(c *fiber.Ctx, db *gorm.DB) error {
+	var events []model.AuditEvent
+	pageSize := 25
+
+	pageInt, err := strconv.Atoi(c.Query("page", "1"))
+	if err != nil || pageInt < 1 {
+		pageInt = 1
+	}
+
+	var count int64
+	auditQuery(c, db).Count(&count)
+	totalPages := int(math.Ceil(float64(count) / float64(pageSize)))
+	if totalPages < 1 {
+		totalPages = 1
+	}
+
+	auditQuery(c, db).
+		Order("created_at desc, id desc").
+		Limit(pageSize).
+		Offset((pageInt - 1) * pageSize).
+		Find(&events)
+
+	var targetTypes []string
+	db.Model(&model.AuditEvent{}).Distinct("target_type").Order("target_type").Pluck("target_type", &targetTypes)
+
+	return c.Render("admin/table/audit-table", fiber.Map{
+		"Events":      events,
+		"TotalPages":  totalPages,
+		"CurrentPage": pageInt,
+		"Filters":     auditFilters(c),
+		"TargetTypes": targetTypes,
+		"Sources":     []string{model.AuditSourceAdmin, model.AuditSourceAPI, model.AuditSourceCLI},
+		"Query": fiber.Map{
+			"Actor":      c.Query("actor"),
+			"Action":     c.Query("action"),
+			"TargetType": c.Query("target_type"),
+			"TargetID":   c.Query("target_id"),
+			"Source":     c.Query("source"),
+			"From":       c.Query("from"),
+			"To":         c.Query("to"),
+		},
+	})
+}
+
+// ExportAuditEvents sends the filtered audit log as CSV, oldest first. It
+// reads the events in batches so a long log does not fill the memory.
+func ExportAuditEvents(c *fiber.Ctx, db *gorm.DB) error {
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="audit-log-`+time.Now().Format("20060102-150405")+`.csv"`)
+
+	writer := csv.NewWriter(c.Response().BodyWriter())
+	writer.Write([]string{"id", "time", "actor_id", "actor", "source", "action", "target_type", "target_id", "ip", "before", "after"})
+
+	var batch []model.AuditEvent
+	err := auditQuery(c, db).FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for _, event := range batch {
+			actorID := ""
+			if event.ActorID != nil {
+				actorID = strconv.FormatUint(uint64(*event.ActorID), 10)
+			}
+			writer.Write([]string{
+				strconv.FormatUint(uint64(event.ID), 10),
+				event.CreatedAt.UTC().Format(time.RFC3339),
+				actorID,
+				csvSafe(event.ActorName),
+				event.Source,
+				event.Action,
+				event.TargetType,
+				csvSafe(event.TargetID),
+				event.IP,
+				event.Before,
+				event.After,
+			})
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to export the audit log")
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// csvSafe keeps spreadsheets from running a cell as a formula.
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
@@ -2,8 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"goxcms/hooks"
 	"goxcms/model"
+	"log"
 	"strings"
 	"time"
 
@@ -51,11 +54,22 @@ func verifyHCaptcha(hCaptchaResponse string) (bool, error) {
 
 var jwtSecretKey = []byte(viper.GetString("app.secret"))
 
-func GenerateJWT(userID uint) (string, error) {
+// appSecret returns app.secret. It is read on every call, since jwtSecretKey
+// is set when the package is initialised, before the config is loaded.
+func appSecret() []byte {
+	return []byte(viper.GetString("app.secret"))
+}
+
+// jwtLifetime is how long a login lasts, for the token and its session.
+const jwtLifetime = 72 * time.Hour
+
+// GenerateJWT signs a token for the session identified by jti.
+func GenerateJWT(userID uint, jti string) (string, error) {
 	token := jwt.New(jwt.SigningMethodHS256)
 	claims := token.Claims.(jwt.MapClaims)
 	claims["user_id"] = userID
-	claims["exp"] = time.Now().Add(time.Hour * 72).Unix()
+	claims["jti"] = jti
+	claims["exp"] = time.Now().Add(jwtLifetime).Unix()
 
 	tokenString, err := token.SignedString(jwtSecretKey)
 	return tokenString, err
@@ -97,12 +111,16 @@ func ValidateAdmin(c *fiber.Ctx, db *gorm.DB) error {
 	}
 
 	claims := token.Claims.(jwt.MapClaims)
-	userID := claims["user_id"].(float64)
+	userSession, ok := activeSession(db, claims)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+	}
 
 	var user model.User
-	db.First(&user, userID)
+	db.First(&user, userSession.UserID)
 
-	if user.RoleID != 2 {
+	role := LoadRole(db, user.RoleID)
+	if !role.HasPermission(model.PermAdminAccess) {
 		return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
 	}
 
@@ -133,6 +151,8 @@ func formatSingleError(e validator.FieldError) string {
 		return e.Field() + " must be less than " + e.Param() + " characters long"
 	case "alphanum":
 		return e.Field() + " must be alphanumeric"
+	case "http_url":
+		return e.Field() + " must be an http or https URL"
 	default:
 		return e.Field() + " is invalid"
 	}
@@ -187,58 +207,101 @@ func Login(db *gorm.DB, store *session.Store) fiber.Handler {
 			return c.SendStatus(fiber.StatusBadRequest)
 		}
 
+		/// failed logins slow down and then lock the username and the IP address
+		if wait, locked := loginWait(db, req.Username, c.IP()); wait > 0 {
+			return loginThrottled(c, wait, locked)
+		}
+
 		var user model.User
 		if err := db.Where("username = ?", req.Username).First(&user).Error; err != nil {
+			recordLoginFailure(db, req.Username, c.IP())
 			ShowToastError(c, "Invalid login credentials")
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid login credentials"})
 		}
 
 		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+			recordLoginFailure(db, req.Username, c.IP())
 			ShowToastError(c, "Invalid login credentials - Password does not match")
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid login credentials"})
 		}
 
-		sess, err := store.Get(c)
-		if err != nil {
-			ShowToastError(c, "Failed to initiate session")
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to initiate session"})
+		if user.PendingApproval {
+			ShowToastError(c, errAccountPending.Error())
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": errAccountPending.Error()})
 		}
 
-		sess.Set("user_id", user.ID)
-
-		if err := sess.Save(); err != nil {
-			ShowToastError(c, "Failed to initiate session")
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to initiate session"})
+		/// with two-factor authentication the password only unlocks the second step
+		if user.TwoFactorEnabled {
+			return beginTwoFactorLogin(c, db, user)
 		}
 
-		tokenString, err := GenerateJWT(user.ID)
-		if err != nil {
-			ShowToastError(c, "Failed to generate token")
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate token"})
-		}
+		return completeLogin(c, db, store, user)
+	}
+}
 
-		SetJWTTokenCookie(c, tokenString)
+// completeLogin signs the user in once every login step has passed.
+func completeLogin(c *fiber.Ctx, db *gorm.DB, store *session.Store, user model.User) error {
+	role, err := signIn(c, db, store, user)
+	if err != nil {
+		ShowToastError(c, err.Error())
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
 
-		/// csrf token generation
-		csrfToken := GenerateCSRFToken()
+	/// admins who must use two-factor authentication set it up first
+	if twoFactorSetupRequired(db, user, role) {
+		c.Set("HX-Redirect", "/account/2fa")
+	} else {
+		c.Set("HX-Redirect", "/")
+	}
+	c.Status(fiber.StatusOK).SendString("Logged in successfully" + user.Username)
+	return nil
+}
 
-		cookie := new(fiber.Cookie)
-		cookie.Name = "csrf"
-		cookie.Value = csrfToken
-		cookie.HTTPOnly = true
-		cookie.SameSite = "Lax"
-		cookie.Path = "/"
-		c.Cookie(cookie)
+// signIn starts the session and sets the login cookies, whichever way the
+// user proved who they are.
+func signIn(c *fiber.Ctx, db *gorm.DB, store *session.Store, user model.User) (model.Role, error) {
+	sess, err := store.Get(c)
+	if err != nil {
+		return model.Role{}, errors.New("Failed to initiate session")
+	}
 
-		c.Locals("user", user)
-		c.Locals("isLoggedin", true)
-		c.Locals("isAdmin", user.RoleID == uint(2))
-		c.Locals("csrf", csrfToken)
+	sess.Set("user_id", user.ID)
 
-		c.Set("HX-Redirect", "/")
-		c.Status(fiber.StatusOK).SendString("Logged in successfully" + user.Username)
-		return nil
+	if err := sess.Save(); err != nil {
+		return model.Role{}, errors.New("Failed to initiate session")
+	}
+
+	tokenString, err := createSession(c, db, user)
+	if err != nil {
+		return model.Role{}, errors.New("Failed to generate token")
 	}
+
+	SetJWTTokenCookie(c, tokenString)
+
+	/// csrf token generation
+	csrfToken := GenerateCSRFToken()
+
+	cookie := new(fiber.Cookie)
+	cookie.Name = "csrf"
+	cookie.Value = csrfToken
+	cookie.HTTPOnly = true
+	cookie.SameSite = "Lax"
+	cookie.Path = "/"
+	c.Cookie(cookie)
+
+	role := LoadRole(db, user.RoleID)
+
+	c.Locals("user", user)
+	c.Locals("isLoggedin", true)
+	c.Locals("permissions", role.PermissionSet())
+	c.Locals("isAdmin", role.HasPermission(model.PermAdminAccess))
+	c.Locals("csrf", csrfToken)
+
+	clearLoginFailures(db, user.Username)
+
+	hooks.DoAction(hooks.UserLoggedIn, user)
+
+	return role, nil
 }
 
 func GenerateCSRFToken() string {
@@ -246,10 +309,15 @@ func GenerateCSRFToken() string {
 	return uuid.String()
 }
 
-func Logout(c *fiber.Ctx) error {
+func Logout(c *fiber.Ctx, db *gorm.DB) error {
 	sess := c.Locals("session").(*session.Session)
 	sess.Destroy()
 
+	/// the token stops working even if a copy of the cookie survives
+	if sessionID, ok := c.Locals("sessionID").(uint); ok {
+		db.Model(&model.UserSession{}).Where("id = ?", sessionID).Update("revoked", true)
+	}
+
 	cookie := new(fiber.Cookie)
 	cookie.Name = "jwt"
 	cookie.Value = ""
@@ -282,24 +350,25 @@ func Logout(c *fiber.Ctx) error {
 func Register(db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 
-		hCaptchaResponse := c.FormValue("h-captcha-response")
-
-		println("hCaptchaResponse: ", hCaptchaResponse)
+		/// like the login, the CAPTCHA is only asked for when it is shown on the form
+		if viper.GetBool("captcha.enabled") {
+			hCaptchaResponse := c.FormValue("h-captcha-response")
 
-		if hCaptchaResponse == "" {
-			ShowToastError(c, "CAPTCHA verification failed")
-			return c.Status(fiber.StatusBadRequest).SendString("CAPTCHA verification failed")
-		}
+			if hCaptchaResponse == "" {
+				ShowToastError(c, "CAPTCHA verification failed")
+				return c.Status(fiber.StatusBadRequest).SendString("CAPTCHA verification failed")
+			}
 
-		valid, err := verifyHCaptcha(hCaptchaResponse)
-		if err != nil {
-			ShowToastError(c, "CAPTCHA verification failed")
-			return c.Status(fiber.StatusInternalServerError).SendString("CAPTCHA verification failed")
-		}
+			valid, err := verifyHCaptcha(hCaptchaResponse)
+			if err != nil {
+				ShowToastError(c, "CAPTCHA verification failed")
+				return c.Status(fiber.StatusInternalServerError).SendString("CAPTCHA verification failed")
+			}
 
-		if !valid {
-			ShowToastError(c, "CAPTCHA verification failed")
-			return c.Status(fiber.StatusBadRequest).SendString("CAPTCHA verification failed")
+			if !valid {
+				ShowToastError(c, "CAPTCHA verification failed")
+				return c.Status(fiber.StatusBadRequest).SendString("CAPTCHA verification failed")
+			}
 		}
 
 		var user model.User
@@ -308,7 +377,46 @@ func Register(db *gorm.DB) fiber.Handler {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
 		}
 
-		user.RoleID = uint(1)
+		user.RoleID = model.RoleUserID
+		user.EmailVerifiedAt = nil
+		user.TwoFactorEnabled = false
+		user.TwoFactorSecret = ""
+		if user.Email != nil && *user.Email == "" {
+			user.Email = nil
+		}
+
+		mode, domains := registrationSettings(db)
+		var invitation *model.Invitation
+		if token := c.FormValue("invite"); token != "" {
+			found, err := findInvitation(db, token)
+			if err != nil {
+				ShowToastError(c, "The invitation is invalid or has expired")
+				return c.Status(fiber.StatusBadRequest).SendString("The invitation is invalid or has expired")
+			}
+			invitation = &found
+
+			/// the invitation link proves the address it was sent to
+			email := found.Email
+			now := time.Now()
+			user.Email = &email
+			user.EmailVerifiedAt = &now
+			user.RoleID = found.RoleID
+		} else {
+			switch mode {
+			case model.RegistrationInvite:
+				ShowToastError(c, "Registration is by invitation only")
+				return c.Status(fiber.StatusForbidden).SendString("Registration is by invitation only")
+			case model.RegistrationDomain:
+				if user.Email == nil || !emailDomainAllowed(*user.Email, domains) {
+					ShowToastError(c, "Please register with an address at "+strings.Join(domains, ", "))
+					return c.Status(fiber.StatusForbidden).SendString("Please register with an address at " + strings.Join(domains, ", "))
+				}
+				/// until the address is verified anyone could have typed it
+				user.PendingApproval = true
+			case model.RegistrationApproval:
+				user.PendingApproval = true
+			}
+		}
 
 		validate := validator.New()
 		if err := validate.Struct(&user); err != nil {
@@ -328,12 +436,51 @@ func Register(db *gorm.DB) fiber.Handler {
 			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Username already exists"})
 		}
 
-		if err := db.Create(&user).Error; err != nil {
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			if invitation == nil {
+				return nil
+			}
+			result := tx.Model(&model.Invitation{}).
+				Where("id = ? AND used_at IS NULL", invitation.ID).
+				Updates(map[string]interface{}{"used_at": user.EmailVerifiedAt, "user_id": user.ID})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected != 1 {
+				return errInvalidToken
+			}
+			return nil
+		})
+		if errors.Is(err, errInvalidToken) {
+			ShowToastError(c, "The invitation is invalid or has expired")
+			return c.Status(fiber.StatusBadRequest).SendString("The invitation is invalid or has expired")
+		}
+		if err != nil {
 			ShowToastError(c, "Registration failed")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Registration failed"})
 		}
 
-		tokenString, err := GenerateJWT(user.ID)
+		hooks.DoAction(hooks.UserRegistered, user)
+
+		if user.Email != nil && user.EmailVerifiedAt == nil {
+			if err := sendVerificationEmail(c, db, user); err != nil {
+				log.Printf("Failed to send the verification email to %s: %v", user.Username, err)
+			}
+		}
+
+		if user.PendingApproval {
+			message := "Your account has been created and waits for the approval of an administrator."
+			if mode == model.RegistrationDomain {
+				message = "Your account has been created. Open the link we emailed you to activate it."
+			}
+			ShowToast(c, message)
+			return c.SendString(message)
+		}
+
+		tokenString, err := createSession(c, db, user)
 		if err != nil {
 			ShowToastError(c, "Error generating token")
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error generating token"})
@@ -348,6 +495,9 @@ func Register(db *gorm.DB) fiber.Handler {
 
 func AuthStatusMiddleware(db *gorm.DB) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		c.Locals("isAdmin", false)
+		c.Locals("permissions", map[string]bool{})
+
 		tokenString := c.Cookies("jwt")
 		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -368,22 +518,28 @@ func AuthStatusMiddleware(db *gorm.DB) fiber.Handler {
 			return c.Next()
 		}
 
-		userID, ok := claims["user_id"].(float64)
+		userSession, ok := activeSession(db, claims)
 		if !ok {
 			c.Locals("isLoggedin", false)
 			return c.Next()
 		}
 
 		var user model.User
-		if err := db.First(&user, uint(userID)).Error; err != nil {
+		if err := db.First(&user, userSession.UserID).Error; err != nil {
 			c.Locals("isLoggedin", false)
 			return c.Next()
 		}
 
+		touchSession(db, userSession)
+		c.Locals("sessionID", userSession.ID)
+
+		role := LoadRole(db, user.RoleID)
+
 		c.Locals("isLoggedin", true)
 		c.Locals("user", user)
-
-		c.Locals("isAdmin", user.RoleID == uint(2))
+		c.Locals("permissions", role.PermissionSet())
+		c.Locals("isAdmin", role.HasPermission(model.PermAdminAccess))
+		c.Locals("twoFactorSetupRequired", twoFactorSetupRequired(db, user, role))
 
 		return c.Next()
 	}
@@ -401,6 +557,9 @@ func IsAdmin(c *fiber.Ctx) error {
 	if c.Locals("isAdmin") == false {
 		return c.Status(fiber.StatusUnauthorized).Redirect("/login")
 	}
+	if c.Locals("twoFactorSetupRequired") == true {
+		return redirectToTwoFactorSetup(c)
+	}
 	return c.Next()
 }
 
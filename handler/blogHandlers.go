@@ -2,11 +2,16 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 
+	"goxcms/hooks"
 	"goxcms/model"
+	"goxcms/search"
+	"goxcms/spam"
 	"html/template"
 	"strconv"
 	"strings"
+	"time"
 
 	"math"
 
@@ -31,6 +36,12 @@ func AdminAddBlogPost(c *fiber.Ctx, db *gorm.DB) error {
 
 	categoryIDs, tagIDs := extractIDs(c.FormValue("categories_input")), extractIDs(c.FormValue("tags_input"))
 
+	publishAt, unpublishAt, err := parseSchedule(c)
+	if err != nil {
+		ShowToastError(c, err.Error())
+		return c.SendString(err.Error())
+	}
+
 	// Start a transaction
 	tx := db.Begin()
 	defer func() {
@@ -58,15 +69,28 @@ func AdminAddBlogPost(c *fiber.Ctx, db *gorm.DB) error {
 		Categories: categories, Tags: tags,
 	}
 
+	if HasPermission(c, model.PermPostPublish) {
+		post.PublishAt, post.UnpublishAt = publishAt, unpublishAt
+	}
+
 	if err := tx.Create(&post).Error; err != nil {
 		return c.SendString("Post creation failed: " + err.Error())
 	}
 
+	if err := savePostRevision(tx, c, post, "Created"); err != nil {
+		tx.Rollback()
+		return c.SendString("Error saving post revision: " + err.Error())
+	}
+
 	tx.Commit()
 	if tx.Error != nil {
 		return c.SendString("Transaction commit failed: " + tx.Error.Error())
 	}
 
+	search.SyncPost(db, post.ID)
+	hooks.DoAction(hooks.PostCreated, post)
+	Audit(c, db, "post.create", "post", post.ID, nil, post)
+
 	postID := strconv.Itoa(int(post.ID))
 
 	message := map[string]string{"showToast": "Settings updated successfully", "clearForm": "true"}
@@ -95,16 +119,16 @@ func AdminAddBlogPost(c *fiber.Ctx, db *gorm.DB) error {
 }
 
 func AdminEditBlogPost(c *fiber.Ctx, db *gorm.DB) error {
-	if c.Locals("isAdmin") == false || c.Locals("isLoggedin") == false {
-		c.Redirect("/")
-		return nil
-	}
-
 	postID, _ := c.ParamsInt("post_id")
 
 	var post model.Post
 	db.Preload("Categories").Preload("Tags").First(&post, postID)
 
+	if !canEditPost(c, post) {
+		c.Redirect("/")
+		return nil
+	}
+
 	var categories []model.Category
 	var tags []model.Tag
 
@@ -125,6 +149,9 @@ func AdminEditBlogPost(c *fiber.Ctx, db *gorm.DB) error {
 		"PostImage":   post.ImageURL,
 		"PostID":      postIDStr,
 		"Published":   post.Published,
+		"CanPublish":  HasPermission(c, model.PermPostPublish),
+		"PublishAt":   ScheduleValue(post.PublishAt),
+		"UnpublishAt": ScheduleValue(post.UnpublishAt),
 		"PostContent": template.HTML(post.Content),
 		"Categories":  categories,
 		"Tags":        tags,
@@ -159,6 +186,12 @@ func AdminUpdateBlogPost(c *fiber.Ctx, db *gorm.DB) error {
 
 	categoryIDs, tagIDs := extractIDs(c.FormValue("categories_input")), extractIDs(c.FormValue("tags_input")) // c.FormValue("categories"), c.FormValue("tags")
 
+	publishAt, unpublishAt, err := parseSchedule(c)
+	if err != nil {
+		ShowToastError(c, err.Error())
+		return c.SendString(err.Error())
+	}
+
 	// Start a transaction
 	tx := db.Begin()
 	defer func() {
@@ -173,12 +206,25 @@ func AdminUpdateBlogPost(c *fiber.Ctx, db *gorm.DB) error {
 		return c.SendString("Error fetching post: " + err.Error())
 	}
 
+	if !canEditPost(c, post) {
+		tx.Rollback()
+		ShowToastError(c, "You are not allowed to edit this post")
+		return c.Status(fiber.StatusForbidden).SendString("You are not allowed to edit this post")
+	}
+
+	before := post
+
 	// Update the post with the new values
 	post.Title = title
 	post.Content = content
 	post.Slug = slug
 	post.ImageURL = image
 
+	/// only users who may publish can change when the post goes live
+	if HasPermission(c, model.PermPostPublish) {
+		post.PublishAt, post.UnpublishAt = publishAt, unpublishAt
+	}
+
 	// Fetch categories and tags from the database
 	var categories []model.Category
 	if err := tx.Find(&categories, categoryIDs).Error; err != nil {
@@ -219,11 +265,20 @@ func AdminUpdateBlogPost(c *fiber.Ctx, db *gorm.DB) error {
 		return c.SendString("Error updating post's tags: " + err.Error())
 	}
 
+	if err := savePostRevision(tx, c, post, ""); err != nil {
+		tx.Rollback()
+		return c.SendString("Error saving post revision: " + err.Error())
+	}
+
 	tx.Commit()
 	if tx.Error != nil {
 		return c.SendString("Transaction commit failed: " + tx.Error.Error())
 	}
 
+	search.SyncPost(db, post.ID)
+	hooks.DoAction(hooks.PostUpdated, post)
+	Audit(c, db, "post.update", "post", post.ID, before, post)
+
 	message := map[string]string{"showToast": "Post updated successfully", "clearForm": "true"}
 	messageBytes, _ := json.Marshal(message)
 	c.Set("HX-Trigger", string(messageBytes))
@@ -243,9 +298,18 @@ func AdminSearchPosts(c *fiber.Ctx, db *gorm.DB) error {
 		pageInt = 1
 	}
 
+	// Users without post.edit only see their own posts
+	scope := func(tx *gorm.DB) *gorm.DB {
+		tx = tx.Where("title LIKE ?", "%"+searchQuery+"%")
+		if !HasPermission(c, model.PermPostEdit) {
+			tx = tx.Where("user_id = ?", c.Locals("user").(model.User).ID)
+		}
+		return tx
+	}
+
 	// Implement search logic with pagination
 	db.Preload("Categories").Preload("Tags").
-		Where("title LIKE ?", "%"+searchQuery+"%").
+		Scopes(scope).
 		Order("created_at desc").
 		Limit(pageSize).
 		Offset((pageInt - 1) * pageSize).
@@ -254,12 +318,13 @@ func AdminSearchPosts(c *fiber.Ctx, db *gorm.DB) error {
 	// Calculate total pages
 	var count int64
 	db.Model(&model.Post{}).
-		Where("title LIKE ?", "%"+searchQuery+"%").
+		Scopes(scope).
 		Count(&count)
 	totalPages := int(math.Ceil(float64(count) / float64(pageSize)))
 
 	return c.Render("admin/table/post-table", fiber.Map{
 		"Posts":       posts,
+		"CanPublish":  HasPermission(c, model.PermPostPublish),
 		"TotalPages":  totalPages,
 		"CurrentPage": pageInt,
 		// Indicate that this is a search result
@@ -275,7 +340,14 @@ func AdminDeletePost(c *fiber.Ctx, db *gorm.DB) error {
 
 	var post model.Post
 
-	db.Preload("Categories").Preload("Tags").First(&post, id)
+	if err := db.Preload("Categories").Preload("Tags").First(&post, id).Error; err != nil {
+		return ShowToastError(c, "Post not found")
+	}
+
+	if !canDeletePost(c, post) {
+		ShowToastError(c, "You are not allowed to delete this post")
+		return c.Status(fiber.StatusForbidden).SendString("You are not allowed to delete this post")
+	}
 
 	for _, category := range post.Categories {
 		db.Model(&category).Association("Posts").Delete(&post)
@@ -286,6 +358,9 @@ func AdminDeletePost(c *fiber.Ctx, db *gorm.DB) error {
 	}
 
 	db.Delete(&post)
+	search.SyncPost(db, post.ID)
+	hooks.DoAction(hooks.PostDeleted, post)
+	Audit(c, db, "post.delete", "post", post.ID, post, nil)
 
 	c.Status(fiber.StatusOK)
 
@@ -317,13 +392,13 @@ func BlogPage(c *fiber.Ctx, db *gorm.DB) error {
 	offset := (pageNumber - 1) * postsPerPage
 
 	var posts []model.Post
-	result := db.Preload("Categories").Preload("Tags").Where("published = ?", true).Offset(offset).Limit(postsPerPage).Find(&posts)
+	result := db.Preload("Categories").Preload("Tags").Scopes(model.PublishedPosts).Offset(offset).Limit(postsPerPage).Find(&posts)
 	if result.Error != nil {
 		return c.Status(500).SendString(result.Error.Error())
 	}
 
 	var totalPosts int64
-	result = db.Model(&model.Post{}).Where("published = ?", true).Count(&totalPosts)
+	result = db.Model(&model.Post{}).Scopes(model.PublishedPosts).Count(&totalPosts)
 	if result.Error != nil {
 		return c.Status(500).SendString(result.Error.Error())
 	}
@@ -359,14 +434,6 @@ func BlogPage(c *fiber.Ctx, db *gorm.DB) error {
 func BlogPostPage(c *fiber.Ctx, db *gorm.DB) error {
 	slug := c.Params("slug")
 
-	/// get current loged in userID if any
-	userID := uint(0)
-	if c.Locals("isLoggedin") == true {
-
-		userID = c.Locals("user").(model.User).ID
-
-	}
-
 	if slug == "" {
 		return c.Redirect("/blog")
 	}
@@ -380,23 +447,40 @@ func BlogPostPage(c *fiber.Ctx, db *gorm.DB) error {
 		}, "main")
 	}
 
-	comments := []model.Comment{}
-	db.Preload("User").Where("post_id = ? AND status != ?", post.ID, "pending").Find(&comments)
-
 	// Handle unpublished posts
-	if !post.Published && !c.Locals("isAdmin").(bool) {
+	if !post.IsVisible(time.Now()) && !canEditPost(c, post) {
 		return c.Status(404).Render("404", fiber.Map{
 			"Title":    "404",
 			"Settings": c.Locals("Settings"),
 		}, "main")
 	}
 
+	comments := []model.Comment{}
+	db.Preload("User.Avatar").Where("post_id = ? AND status = ?", post.ID, model.CommentApproved).Order("created_at asc").Find(&comments)
+
+	var guest *guestIdentity
+	if c.Locals("isLoggedin") != true && guestCommentsAllowed(db) {
+		remembered := rememberedGuest(c)
+		guest = &remembered
+	}
+
+	content := hooks.ApplyFilters(hooks.PostContentRender, post.Content, post).(string)
+
+	/// private profiles are not linked
+	var author *model.User
+	var user model.User
+	if err := db.First(&user, post.UserID).Error; err == nil && !user.PrivateProfile {
+		author = &user
+	}
+
 	return c.Render("blog/blog_post", fiber.Map{
-		"UserID":     userID,
+		"Author":     author,
 		"Title":      post.Title,
 		"Post":       post,
-		"Comments":   comments,
-		"Content":    template.HTML(post.Content),
+		"Comments":   commentThread(c, comments, guest),
+		"Guest":      guest,
+		"FormToken":  spam.NewFormToken(),
+		"Content":    template.HTML(content),
 		"Tags":       post.Tags,
 		"Categories": post.Categories,
 		"CreatedAt":  post.CreatedAt,
@@ -416,10 +500,22 @@ func TogglePostStatus(c *fiber.Ctx, db *gorm.DB) error {
 		return ShowToastError(c, "Post not found")
 	}
 
+	/// toggling by hand overrides any schedule
 	newStatus := !post.Published
-	if err := db.Model(&post).Update("published", newStatus).Error; err != nil {
+	if err := db.Model(&post).Updates(map[string]interface{}{"published": newStatus, "publish_at": nil, "unpublish_at": nil}).Error; err != nil {
 		return ShowToastError(c, "Error updating post status")
 	}
+	search.SyncPost(db, post.ID)
+
+	before := post
+	post.Published, post.PublishAt, post.UnpublishAt = newStatus, nil, nil
+	if newStatus {
+		hooks.DoAction(hooks.PostPublished, post)
+		Audit(c, db, "post.publish", "post", post.ID, before, post)
+	} else {
+		hooks.DoAction(hooks.PostUnpublished, post)
+		Audit(c, db, "post.unpublish", "post", post.ID, before, post)
+	}
 
 	if newStatus {
 		ShowToastError(c, "Post published successfully")
@@ -453,6 +549,29 @@ func TogglePostStatus(c *fiber.Ctx, db *gorm.DB) error {
 
 }
 
+// canEditPost reports whether the current user may edit the post, either
+// through post.edit or because they wrote it and hold post.edit_own.
+func canEditPost(c *fiber.Ctx, post model.Post) bool {
+	if post.ID == 0 {
+		return false
+	}
+	if HasPermission(c, model.PermPostEdit) {
+		return true
+	}
+	user, ok := c.Locals("user").(model.User)
+	return ok && post.UserID == user.ID && HasPermission(c, model.PermPostEditOwn)
+}
+
+// canDeletePost reports whether the current user may delete the post. Authors
+// holding post.delete_own can only remove their own drafts.
+func canDeletePost(c *fiber.Ctx, post model.Post) bool {
+	if HasPermission(c, model.PermPostDelete) {
+		return true
+	}
+	user, ok := c.Locals("user").(model.User)
+	return ok && post.UserID == user.ID && !post.Published && HasPermission(c, model.PermPostDeleteOwn)
+}
+
 func extractIDs(ids string) []uint {
 	var idList []uint
 
@@ -473,3 +592,49 @@ func extractIDs(ids string) []uint {
 
 	return idList
 }
+
+// scheduleLayout is the value format of <input type="datetime-local">.
+const scheduleLayout = "2006-01-02T15:04"
+
+// parseSchedule reads the publish_at and unpublish_at form fields. Empty
+// fields clear the schedule.
+func parseSchedule(c *fiber.Ctx) (publishAt, unpublishAt *time.Time, err error) {
+	parse := func(field string) (*time.Time, error) {
+		value := strings.TrimSpace(c.FormValue(field))
+		if value == "" {
+			return nil, nil
+		}
+		t, err := time.ParseInLocation(scheduleLayout, value, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", field, value)
+		}
+		return &t, nil
+	}
+
+	if publishAt, err = parse("publish_at"); err != nil {
+		return nil, nil, err
+	}
+	if unpublishAt, err = parse("unpublish_at"); err != nil {
+		return nil, nil, err
+	}
+	if err := checkSchedule(publishAt, unpublishAt); err != nil {
+		return nil, nil, err
+	}
+	return publishAt, unpublishAt, nil
+}
+
+// checkSchedule makes sure a post or page is not taken down before it goes live.
+func checkSchedule(publishAt, unpublishAt *time.Time) error {
+	if publishAt != nil && unpublishAt != nil && !unpublishAt.After(*publishAt) {
+		return fmt.Errorf("unpublish date must be after the publish date")
+	}
+	return nil
+}
+
+// ScheduleValue formats a schedule time for a datetime-local input.
+func ScheduleValue(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.In(time.Local).Format(scheduleLayout)
+}
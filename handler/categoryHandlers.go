@@ -2,8 +2,10 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"goxcms/model"
 	"strconv"
+	"strings"
 
 	"math"
 
@@ -41,9 +43,11 @@ func BlogCategoryPage(c *fiber.Ctx, db *gorm.DB) error {
 		}, "main")
 	}
 
+	categoryIDs := listedCategoryIDs(db, category)
+
 	var posts []model.Post
-	db.Joins("JOIN post_categories ON post_categories.post_id = posts.id").
-		Where("post_categories.category_id = ? AND posts.published = ?", category.ID, true).
+	db.Scopes(model.PublishedPosts).
+		Where("posts.id IN (SELECT post_id FROM post_categories WHERE category_id IN ?)", categoryIDs).
 		Order("posts.created_at desc").
 		Limit(postsPerPage).
 		Offset(offset).
@@ -51,13 +55,13 @@ func BlogCategoryPage(c *fiber.Ctx, db *gorm.DB) error {
 
 	var totalPosts int64
 	db.Model(&model.Post{}).
-		Joins("JOIN post_categories ON post_categories.post_id = posts.id").
-		Where("post_categories.category_id = ? AND posts.published = ?", category.ID, true).
+		Scopes(model.PublishedPosts).
+		Where("posts.id IN (SELECT post_id FROM post_categories WHERE category_id IN ?)", categoryIDs).
 		Count(&totalPosts)
 
 	totalPages := int(math.Ceil(float64(totalPosts) / float64(postsPerPage)))
 
-	if pageNumber > totalPages {
+	if pageNumber > totalPages && totalPages > 0 {
 		return c.Redirect("/blog/category/" + slug + "/1")
 	}
 
@@ -67,40 +71,172 @@ func BlogCategoryPage(c *fiber.Ctx, db *gorm.DB) error {
 
 	}
 
+	ancestors, _ := model.CategoryAncestors(db, category)
+	breadcrumbs := []breadcrumb{{Name: "Home", Link: "/"}, {Name: "Blog", Link: "/blog"}}
+	for _, ancestor := range ancestors {
+		breadcrumbs = append(breadcrumbs, breadcrumb{Name: ancestor.Name, Link: "/blog/category/" + ancestor.Slug})
+	}
+	breadcrumbs = append(breadcrumbs, breadcrumb{Name: category.Name, Link: "/blog/category/" + category.Slug})
+
+	var subcategories []model.Category
+	db.Where("parent_id = ?", category.ID).Order("position asc, name asc").Find(&subcategories)
+
 	return c.Render("blog/blog_category", fiber.Map{
-		"Title":         category.Name,
-		"Posts":         posts,
-		"Slug":          category.Slug,
-		"IsAdmin":       c.Locals("isAdmin"),
-		"IsLoggedIn":    c.Locals("isLoggedin"),
-		"TotalPages":    totalPagesArray,
-		"TotalPagesInt": totalPages,
-		"NextPage":      pageNumber + 1,
-		"PrevPage":      pageNumber - 1,
-		"CurrentPage":   pageNumber,
-		"Settings":      c.Locals("Settings"),
+		"Title":          category.Name,
+		"Category":       category,
+		"Breadcrumbs":    breadcrumbs,
+		"BreadcrumbList": breadcrumbList(breadcrumbs),
+		"Subcategories":  subcategories,
+		"Posts":          posts,
+		"Slug":           category.Slug,
+		"IsAdmin":        c.Locals("isAdmin"),
+		"IsLoggedIn":     c.Locals("isLoggedin"),
+		"TotalPages":     totalPagesArray,
+		"TotalPagesInt":  totalPages,
+		"NextPage":       pageNumber + 1,
+		"PrevPage":       pageNumber - 1,
+		"CurrentPage":    pageNumber,
+		"Settings":       c.Locals("Settings"),
 	}, "main")
 }
 
-func AddCategory(c *fiber.Ctx, db *gorm.DB) error {
-	name := c.FormValue("category_name")
-	slug := c.FormValue("category_slug")
+// listedCategoryIDs returns the categories whose posts are listed on the page
+// and in the feeds of a category: the category itself, and its subcategories
+// if it includes them.
+func listedCategoryIDs(db *gorm.DB, category model.Category) []uint {
+	ids := []uint{category.ID}
+	if category.IncludeSubcategories {
+		descendants, err := model.CategoryDescendantIDs(db, category.ID)
+		if err == nil {
+			ids = append(ids, descendants...)
+		}
+	}
+	return ids
+}
+
+// breadcrumb is one step of the trail above a page, Link relative to the site.
+type breadcrumb struct {
+	Name string
+	Link string
+}
+
+// breadcrumbList describes a breadcrumb trail as schema.org JSON-LD.
+func breadcrumbList(breadcrumbs []breadcrumb) fiber.Map {
+	items := make([]fiber.Map, 0, len(breadcrumbs))
+	for i, crumb := range breadcrumbs {
+		items = append(items, fiber.Map{
+			"@type":    "ListItem",
+			"position": i + 1,
+			"name":     crumb.Name,
+			"item":     absoluteURL(crumb.Link),
+		})
+	}
+	return fiber.Map{
+		"@context":        "https://schema.org",
+		"@type":           "BreadcrumbList",
+		"itemListElement": items,
+	}
+}
+
+// categoryFromForm copies the fields of the category form to the category.
+func categoryFromForm(c *fiber.Ctx, db *gorm.DB, category *model.Category) error {
+	category.Name = strings.TrimSpace(c.FormValue("category_name"))
+	category.Slug = strings.TrimSpace(c.FormValue("category_slug"))
+	category.Description = strings.TrimSpace(c.FormValue("category_description"))
+	category.IncludeSubcategories = c.FormValue("include_subcategories") == "on"
+	if category.Name == "" || category.Slug == "" {
+		return errors.New("Please enter a name and a slug")
+	}
+
+	category.Position = 0
+	if position := c.FormValue("category_position"); position != "" {
+		value, err := strconv.Atoi(position)
+		if err != nil {
+			return errors.New("The position must be a number")
+		}
+		category.Position = value
+	}
 
+	category.ParentID = nil
+	if parent := c.FormValue("parent_id"); parent != "" {
+		value, err := strconv.ParseUint(parent, 10, 64)
+		if err != nil {
+			return errors.New("Invalid parent category")
+		}
+		parentID := uint(value)
+		category.ParentID = &parentID
+	}
+	if err := model.CheckCategoryParent(db, category.ID, category.ParentID); err != nil {
+		return err
+	}
+
+	var existing model.Category
+	db.Where("(name = ? OR slug = ?) AND id != ?", category.Name, category.Slug, category.ID).First(&existing)
+	if existing.ID != 0 {
+		if existing.Name == category.Name {
+			return errors.New("Category name already exists")
+		}
+		return errors.New("Category slug already exists")
+	}
+	return nil
+}
+
+// CategoryFormView renders the modal for adding a category, or for editing
+// the one in the id parameter.
+func CategoryFormView(c *fiber.Ctx, db *gorm.DB) error {
 	var category model.Category
-	db.Where("name = ?", name).Or("slug = ?", slug).First(&category)
+	if id := c.Params("id"); id != "" {
+		if err := db.First(&category, id).Error; err != nil {
+			return ShowToastError(c, "Category not found")
+		}
+	} else if parentID, err := strconv.ParseUint(c.Query("parent_id"), 10, 64); err == nil {
+		parent := uint(parentID)
+		category.ParentID = &parent
+	}
 
+	tree, err := model.CategoryTree(db)
+	if err != nil {
+		return ShowToastError(c, "Failed to load the categories")
+	}
+
+	/// a category cannot be moved under itself or its subcategories, so they are not offered
+	var parents []*model.CategoryNode
+	excluded := map[uint]bool{}
 	if category.ID != 0 {
-		if category.Name == name {
-			return ShowToastError(c, "Category name already exists")
-		} else if category.Slug == slug {
-			return ShowToastError(c, "Category slug already exists")
+		excluded[category.ID] = true
+		descendants, _ := model.CategoryDescendantIDs(db, category.ID)
+		for _, id := range descendants {
+			excluded[id] = true
+		}
+	}
+	for _, node := range model.FlattenCategoryTree(tree) {
+		if !excluded[node.ID] {
+			parents = append(parents, node)
 		}
 	}
 
-	db.Create(&model.Category{
-		Name: name,
-		Slug: slug,
+	var parentID uint
+	if category.ParentID != nil {
+		parentID = *category.ParentID
+	}
+
+	return c.Render("admin/table/category-form", fiber.Map{
+		"Category": category,
+		"ParentID": parentID,
+		"Parents":  parents,
 	})
+}
+
+func AddCategory(c *fiber.Ctx, db *gorm.DB) error {
+	var category model.Category
+	if err := categoryFromForm(c, db, &category); err != nil {
+		return ShowToastError(c, err.Error())
+	}
+
+	if err := db.Create(&category).Error; err != nil {
+		return ShowToastError(c, "Error adding category")
+	}
+	Audit(c, db, "category.create", "category", category.ID, nil, category)
 
 	message := map[string]string{"showToast": "Category added successfully"}
 	messageBytes, _ := json.Marshal(message)
@@ -111,6 +247,42 @@ func AddCategory(c *fiber.Ctx, db *gorm.DB) error {
 	return nil
 }
 
+func EditCategory(c *fiber.Ctx, db *gorm.DB) error {
+	var category model.Category
+	if err := db.First(&category, c.Params("id")).Error; err != nil {
+		return ShowToastError(c, "Category not found")
+	}
+	before := category
+
+	if err := categoryFromForm(c, db, &category); err != nil {
+		return ShowToastError(c, err.Error())
+	}
+
+	if err := db.Model(&category).Select("name", "slug", "parent_id", "position", "description", "include_subcategories").Updates(&category).Error; err != nil {
+		return ShowToastError(c, "Error updating category")
+	}
+	Audit(c, db, "category.update", "category", category.ID, before, category)
+
+	return ShowToast(c, "Category updated successfully")
+}
+
+// deleteCategory removes a category from its posts and menus and deletes it.
+// Its subcategories move up to its parent.
+func deleteCategory(db *gorm.DB, category model.Category) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&model.Category{}).Where("parent_id = ?", category.ID).Update("parent_id", category.ParentID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&model.MenuItem{}).Where("category_id = ?", category.ID).Update("category_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM post_categories WHERE category_id = ?", category.ID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&category).Error
+	})
+}
+
 func DeleteCategory(c *fiber.Ctx, db *gorm.DB) error {
 	id := c.Query("id")
 	var category model.Category
@@ -121,60 +293,46 @@ func DeleteCategory(c *fiber.Ctx, db *gorm.DB) error {
 		return ShowToastError(c, "Category not found")
 	}
 
-	if err := db.Exec("DELETE FROM post_categories WHERE category_id = ?", category.ID).Error; err != nil {
-		// Handle the error if deleting the associated records fails
-		return ShowToastError(c, "Error deleting associated records")
-	}
-
-	if err := db.Delete(&category).Error; err != nil {
-		// Handle the error if deleting the category fails
+	if err := deleteCategory(db, category); err != nil {
 		return ShowToastError(c, "Error deleting category")
 	}
+	Audit(c, db, "category.delete", "category", category.ID, category, nil)
 
 	return ShowToastError(c, "Category deleted successfully")
 }
 
+// SearchCategories renders the category tree. With a search query it shows
+// the matching categories only, still in tree order.
 func SearchCategories(c *fiber.Ctx, db *gorm.DB) error {
-	// Get the page number and search query from the query parameters
-	page := c.Query("page", "1")
-	pageSize := 10 // Default page size
 	searchQuery := c.Query("query")
 
-	// Convert page string to int
-	pageInt, err := strconv.Atoi(page)
-	if err != nil || pageInt < 1 {
-		pageInt = 1
+	tree, err := model.CategoryTree(db)
+	if err != nil {
+		return ShowToastError(c, "Failed to load the categories")
 	}
 
-	// Search for categories with pagination
-	var categories []model.Category
-	db.Where("name LIKE ?", "%"+searchQuery+"%").
-		Limit(pageSize).
-		Offset((pageInt - 1) * pageSize).
-		Find(&categories)
-
 	// Count the number of posts for each category
-	for i := range categories {
-		var count int64
-		db.Model(&model.Post{}).
-			Joins("join post_categories on post_categories.post_id = posts.id").
-			Where("post_categories.category_id = ?", categories[i].ID).
-			Count(&count)
-
-		categories[i].PostsCount = int(count)
+	var counts []struct {
+		CategoryID uint
+		Count      int
+	}
+	db.Table("post_categories").Select("category_id, count(*) as count").Group("category_id").Scan(&counts)
+	postCounts := make(map[uint]int, len(counts))
+	for _, count := range counts {
+		postCounts[count.CategoryID] = count.Count
 	}
 
-	var totalMatchingCount int64
-	db.Model(&model.Category{}).
-		Where("name LIKE ?", "%"+searchQuery+"%").
-		Count(&totalMatchingCount)
-	totalPages := int(math.Ceil(float64(totalMatchingCount) / float64(pageSize)))
+	var categories []*model.CategoryNode
+	for _, node := range model.FlattenCategoryTree(tree) {
+		if searchQuery != "" && !strings.Contains(strings.ToLower(node.Name), strings.ToLower(searchQuery)) {
+			continue
+		}
+		node.PostsCount = postCounts[node.ID]
+		categories = append(categories, node)
+	}
 
 	return c.Render("admin/table/category-table", fiber.Map{
 		"Categories":  categories,
-		"TotalPages":  totalPages,
-		"CurrentPage": pageInt,
-
 		"SearchQuery": searchQuery,
 	})
 }
@@ -1,10 +1,18 @@
 package handlers
 
 import (
+	"errors"
+	"goxcms/hooks"
 	"goxcms/model"
+	"goxcms/notify"
+	"goxcms/spam"
 	"html/template"
+	"log"
+	"math"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/spf13/viper"
@@ -12,6 +20,104 @@ import (
 	"gorm.io/gorm"
 )
 
+// commentView is a comment in the thread of the post page.
+type commentView struct {
+	model.Comment
+	Replies        []*commentView
+	CanReply       bool
+	CanEdit        bool
+	Avatar         string
+	Guest          *guestIdentity // set when the visitor can reply as a guest
+	FormToken      string         // from spam.NewFormToken, for the reply form
+	CaptchaSiteKey string         // set when replies need a CAPTCHA
+}
+
+// commentThread nests the approved comments of a post under the comments
+// they reply to. Replies to a comment that is not shown are left out with it.
+// A guest is given when the visitor may comment as one.
+func commentThread(c *fiber.Ctx, comments []model.Comment, guest *guestIdentity) []*commentView {
+	maxDepth := viper.GetInt("comments.max_depth")
+	canComment := c.Locals("isLoggedin") == true && HasPermission(c, model.PermCommentCreate) || guest != nil
+	userID := currentUserID(c)
+	formToken := spam.NewFormToken()
+
+	captchaSiteKey := ""
+	if settings, ok := c.Locals("Settings").(map[string]string); ok && settings["CaptchaEnabled"] == "true" {
+		captchaSiteKey = settings["CaptchaSiteKey"]
+	}
+
+	children := map[uint][]model.Comment{}
+	var roots []model.Comment
+	for _, comment := range comments {
+		if comment.ParentID == nil {
+			roots = append(roots, comment)
+		} else {
+			children[*comment.ParentID] = append(children[*comment.ParentID], comment)
+		}
+	}
+
+	var build func(comments []model.Comment, depth int) []*commentView
+	build = func(comments []model.Comment, depth int) []*commentView {
+		views := make([]*commentView, 0, len(comments))
+		for _, comment := range comments {
+			views = append(views, &commentView{
+				Comment:        comment,
+				Replies:        build(children[comment.ID], depth+1),
+				CanReply:       canComment && depth < maxDepth,
+				CanEdit:        userID != 0 && canEditComment(comment, userID),
+				Avatar:         commentAvatar(comment),
+				Guest:          guest,
+				FormToken:      formToken,
+				CaptchaSiteKey: captchaSiteKey,
+			})
+		}
+		return views
+	}
+	return build(roots, 0)
+}
+
+// commentDepth is 0 for a comment on the post and one more for every reply
+// above it.
+func commentDepth(db *gorm.DB, comment model.Comment) int {
+	depth := 0
+	for comment.ParentID != nil && depth <= viper.GetInt("comments.max_depth") {
+		var parent model.Comment
+		if err := db.Select("id", "parent_id").First(&parent, *comment.ParentID).Error; err != nil {
+			break
+		}
+		comment = parent
+		depth++
+	}
+	return depth
+}
+
+var (
+	errCommentParent  = errors.New("parent comment not found")
+	errCommentTooDeep = errors.New("the thread is too deep for more replies")
+)
+
+// replyParent checks that a reply goes to an approved comment of the same
+// post, no deeper than the settings allow.
+func replyParent(db *gorm.DB, postID, parentID uint) (*uint, error) {
+	var parent model.Comment
+	if err := db.Where("post_id = ? AND status = ?", postID, model.CommentApproved).First(&parent, parentID).Error; err != nil {
+		return nil, errCommentParent
+	}
+	if commentDepth(db, parent) >= viper.GetInt("comments.max_depth") {
+		return nil, errCommentTooDeep
+	}
+	return &parent.ID, nil
+}
+
+// canEditComment reports whether the user may still edit or delete the
+// comment as its author.
+func canEditComment(comment model.Comment, userID uint) bool {
+	window := time.Duration(viper.GetInt("comments.edit_minutes")) * time.Minute
+	return comment.UserID == userID &&
+		(comment.Status == model.CommentApproved || comment.Status == model.CommentPending) &&
+		time.Since(comment.CreatedAt) < window
+}
+
 func AddComment(c *fiber.Ctx, db *gorm.DB) error {
 
 	capcha_enabled := viper.GetBool("captcha.enabled")
@@ -43,22 +149,50 @@ func AddComment(c *fiber.Ctx, db *gorm.DB) error {
 	comment.Content = sanitizeHTML(c.FormValue("comment"))
 	postID, _ := strconv.Atoi(c.FormValue("post_id"))
 	comment.PostID = uint(postID)
-	userID, _ := strconv.Atoi(c.FormValue("user_id"))
-	comment.UserID = uint(userID)
 
-	comment.User = model.User{ID: comment.UserID}
+	/// comments always wait for a moderator, those of guests too
+	comment.Status = model.CommentPending
 
-	comment.Status = "pending"
+	// Logged in users comment as themselves, guests with the name they enter
+	comment.UserID = currentUserID(c)
+	var guest guestIdentity
+	if comment.UserID == 0 {
+		var err error
+		if guest, err = guestFromForm(c); err != nil {
+			return ShowToastError(c, err.Error())
+		}
+		comment.GuestName, comment.GuestEmail, comment.GuestWebsite = guest.Name, guest.Email, guest.Website
+	}
 
-	// Check if the user is authenticated and is the same user as in the form data
-	if uint(userID) != c.Locals("user").(model.User).ID {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"message": "Unauthorized",
-		})
+	if strings.TrimSpace(comment.Content) == "" {
+		return ShowToastError(c, "Please write a comment")
 	}
 
+	var post model.Post
+	if err := db.First(&post, comment.PostID).Error; err != nil || (!post.IsVisible(time.Now()) && !canEditPost(c, post)) {
+		return ShowToastError(c, "Post not found")
+	}
+
+	if parentID, err := strconv.ParseUint(c.FormValue("parent_id"), 10, 64); err == nil {
+		switch comment.ParentID, err = replyParent(db, post.ID, uint(parentID)); err {
+		case errCommentTooDeep:
+			return ShowToastError(c, "This thread is too deep for more replies")
+		case errCommentParent:
+			return ShowToastError(c, "The comment you reply to is gone")
+		}
+	}
+
+	comment.IP = c.IP()
+	applySpamCheck(&comment, spam.Check(db, spam.Submission{
+		Comment:   comment,
+		IP:        comment.IP,
+		Form:      true,
+		Honeypot:  c.FormValue("website"),
+		FormToken: c.FormValue("form_token"),
+	}))
+
 	// Validate the data
-	err := db.Create(&comment).Error
+	err := db.Omit("User").Create(&comment).Error
 	if err != nil {
 		ShowToast(c, "Error creating comment"+err.Error())
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -66,6 +200,14 @@ func AddComment(c *fiber.Ctx, db *gorm.DB) error {
 		})
 	}
 
+	hooks.DoAction(hooks.CommentCreated, comment)
+	if comment.Status == model.CommentSpam {
+		hooks.DoAction(hooks.CommentSpam, comment)
+	}
+	if comment.UserID == 0 {
+		rememberGuest(c, guest)
+	}
+
 	ShowToast(c, "Comment created successfully")
 
 	htmlMessage := template.HTML("<div class='alert alert-success'>Comment created successfully</div>")
@@ -74,6 +216,97 @@ func AddComment(c *fiber.Ctx, db *gorm.DB) error {
 	return c.Status(fiber.StatusCreated).SendString(string(htmlMessage))
 }
 
+// applySpamCheck keeps the spam score on the comment for the moderators and
+// sends it to the spam folder when the score is high enough. The author is
+// not told, so spammers learn nothing from it.
+func applySpamCheck(comment *model.Comment, result spam.Result) {
+	comment.SpamScore = result.Score
+	comment.SpamReasons = result.Summary()
+	if result.IsSpam() {
+		comment.Status = model.CommentSpam
+	}
+}
+
+// findOwnComment loads the comment of the request if the current user may
+// still change it.
+func findOwnComment(c *fiber.Ctx, db *gorm.DB) (model.Comment, bool) {
+	var comment model.Comment
+	id, err := c.ParamsInt("id")
+	if err != nil || db.First(&comment, id).Error != nil {
+		return comment, false
+	}
+	return comment, canEditComment(comment, currentUserID(c))
+}
+
+// EditOwnComment lets authors fix their comment for a while after writing it.
+func EditOwnComment(c *fiber.Ctx, db *gorm.DB) error {
+	comment, ok := findOwnComment(c, db)
+	if !ok {
+		return ShowToastError(c, "This comment can no longer be edited")
+	}
+
+	content := sanitizeHTML(c.FormValue("comment"))
+	if strings.TrimSpace(content) == "" {
+		return ShowToastError(c, "Please write a comment")
+	}
+
+	before := comment
+	now := time.Now()
+	comment.Content = content
+	comment.EditedAt = &now
+
+	/// an edit is checked like a new comment, so an approved comment cannot be filled with spam afterwards
+	applySpamCheck(&comment, spam.Check(db, spam.Submission{Comment: comment, IP: c.IP(), Edit: true}))
+	if comment.Status == model.CommentApproved && comment.SpamScore > 0 {
+		comment.Status = model.CommentPending
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		/// the filter learned the old text, which has to come out of its counts before it is replaced
+		if err := spam.Forget(tx, before); err != nil {
+			return err
+		}
+		comment.SpamClass = ""
+		return tx.Model(&comment).Select("content", "edited_at", "status", "spam_score", "spam_reasons").Updates(&comment).Error
+	})
+	if err != nil {
+		return ShowToastError(c, "Failed to save the comment")
+	}
+	hooks.DoAction(hooks.CommentUpdated, comment)
+	if comment.Status != before.Status {
+		if before.Status == model.CommentApproved {
+			hooks.DoAction(hooks.CommentUnapproved, comment)
+		}
+		if comment.Status == model.CommentSpam {
+			hooks.DoAction(hooks.CommentSpam, comment)
+		}
+	}
+
+	ShowToast(c, "Comment saved")
+	c.Set("HX-Refresh", "true")
+	return nil
+}
+
+// DeleteOwnComment moves the author's comment to the trash, within the same
+// time as editing.
+func DeleteOwnComment(c *fiber.Ctx, db *gorm.DB) error {
+	comment, ok := findOwnComment(c, db)
+	if !ok {
+		return ShowToastError(c, "This comment can no longer be deleted")
+	}
+
+	old := comment.Status
+	comment.Status = model.CommentTrash
+	if err := db.Model(&comment).Update("status", comment.Status).Error; err != nil {
+		return ShowToastError(c, "Failed to delete the comment")
+	}
+	commentStatusChanged(db, comment, old)
+
+	ShowToast(c, "Comment deleted")
+	c.Set("HX-Refresh", "true")
+	return nil
+}
+
 // SanitizeHTML sanitizes the HTML input to prevent XSS attacks
 func sanitizeHTML(input string) string {
 	// Remove any HTML tags and attributes
@@ -85,97 +318,209 @@ func sanitizeHTML(input string) string {
 	return sanitized
 }
 
+// SearchCommentsView is the moderation queue. It shows the pending comments
+// unless another status is asked for.
 func SearchCommentsView(c *fiber.Ctx, db *gorm.DB) error {
 	var comments []model.Comment
 	searchQuery := c.FormValue("query")
+	status := c.FormValue("status", model.CommentPending)
+	if status != "all" && !model.ValidCommentStatus(status) {
+		status = model.CommentPending
+	}
 	page, err := strconv.Atoi(c.FormValue("page", "1"))
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"message": "Invalid page number",
-		})
+	if err != nil || page < 1 {
+		page = 1
 	}
-	limit := 10
+	limit := 20
 	offset := (page - 1) * limit
 
-	db.Where("content LIKE ?", "%"+searchQuery+"%").Limit(limit).Offset(offset).Find(&comments)
-
-	currentPage := page
+	query := db.Model(&model.Comment{}).Where("content LIKE ?", "%"+searchQuery+"%")
+	if status != "all" {
+		query = query.Where("status = ?", status)
+	}
 
-	/// count total comments for pagination ///
 	var totalComments int64
-	db.Model(&model.Comment{}).Where("content LIKE ?", "%"+searchQuery+"%").Count(&totalComments)
-	TotalPages := int(totalComments / int64(limit))
+	query.Count(&totalComments)
+	totalPages := int(math.Ceil(float64(totalComments) / float64(limit)))
+	if totalPages < 1 {
+		totalPages = 1
+	}
+
+	query.Preload("User").Order("created_at desc").Limit(limit).Offset(offset).Find(&comments)
 
-	if TotalPages == 0 {
-		TotalPages = 1
+	postIDs := make([]uint, len(comments))
+	for i, comment := range comments {
+		postIDs[i] = comment.PostID
+	}
+	var postList []model.Post
+	db.Select("id", "title", "slug").Where("id IN ?", postIDs).Find(&postList)
+	posts := make(map[uint]model.Post, len(postList))
+	for _, post := range postList {
+		posts[post.ID] = post
+	}
+
+	counts := map[string]int64{}
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	db.Model(&model.Comment{}).Select("status, COUNT(*) AS count").Group("status").Scan(&rows)
+	for _, row := range rows {
+		counts[row.Status] = row.Count
 	}
 
 	return c.Render("admin/table/comments-table", fiber.Map{
 		"Comments":    comments,
-		"CurrentPage": currentPage,
-		"TotalPages":  TotalPages,
+		"Posts":       posts,
+		"CurrentPage": page,
+		"TotalPages":  totalPages,
 		"SearchQuery": searchQuery,
+		"Status":      status,
+		"Statuses":    model.CommentStatuses,
+		"Counts":      counts,
+		"Threshold":   viper.GetFloat64("spam.threshold"),
 	})
 }
 
-func ToggleCommentStatus(c *fiber.Ctx, db *gorm.DB) error {
-	commentID, _ := strconv.Atoi(c.Params("id"))
-	var comment model.Comment
-	db.First(&comment, commentID)
+// commentActions maps the bulk actions of the moderation queue to the status
+// they set. "delete" removes the comments for good instead.
+var commentActions = map[string]string{
+	"approve":   model.CommentApproved,
+	"unapprove": model.CommentPending,
+	"spam":      model.CommentSpam,
+	"trash":     model.CommentTrash,
+}
 
-	if comment.Status == "approved" {
-		comment.Status = "pending"
-	} else {
-		comment.Status = "approved"
+// BulkModerateComments applies an action to the selected comments and shows
+// the queue again.
+func BulkModerateComments(c *fiber.Ctx, db *gorm.DB) error {
+	action := c.FormValue("action")
+	status, ok := commentActions[action]
+	if !ok && action != "delete" {
+		return ShowToastError(c, "Unknown action")
 	}
 
-	db.Save(&comment)
-	button := GetCommentStatusButton(comment)
-	button = string(template.HTML(button)) // convert to string
+	var ids []uint
+	for _, value := range c.Context().PostArgs().PeekMulti("ids") {
+		if id, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			ids = append(ids, uint(id))
+		}
+	}
+	if len(ids) == 0 {
+		ShowToastError(c, "No comments selected")
+		return SearchCommentsView(c, db)
+	}
 
-	ShowToast(c, "Comment status changed successfully")
+	changed := 0
+	for _, id := range ids {
+		var comment model.Comment
+		if err := db.First(&comment, id).Error; err != nil {
+			continue
+		}
 
-	return c.SendString(button)
-	/// return the button with the new status
-}
+		if action == "delete" {
+			if err := deleteComment(db, comment); err != nil {
+				continue
+			}
+			Audit(c, db, "comment.delete", "comment", comment.ID, comment, nil)
+			changed++
+			continue
+		}
 
-func GetCommentStatusButton(comment model.Comment) string {
-	var button string
+		if comment.Status == status {
+			continue
+		}
+		before := comment
+		comment.Status = status
+		if err := db.Model(&comment).Update("status", status).Error; err != nil {
+			continue
+		}
+		commentStatusChanged(db, comment, before.Status)
+		Audit(c, db, "comment."+action, "comment", comment.ID, before, comment)
+		changed++
+	}
 
-	commentID := strconv.Itoa(int(comment.ID))
+	ShowToast(c, strconv.Itoa(changed)+" comment(s) changed")
+	return SearchCommentsView(c, db)
+}
 
-	if comment.Status == "approved" {
-		button = `<button id="comment-status-button-` + commentID + `"
-					class="btn btn-secondary btn-sm"
-					hx-post="/toggle-comment-status/` + commentID + `" 
-					hx-target="#comment-status-button-` + commentID + `" hx-headers='{"X-No-Cache": "true"}'
-					hx-confirm="Are you sure you want to change the status of this comment?"
-					hx-swap="outerHTML">
-					Unapprove
-				</button>`
-	} else {
-		button = `<button id="comment-status-button-` + commentID + `"
-					class="btn btn-success btn-sm"
-					hx-post="/toggle-comment-status/` + commentID + `" 
-					hx-target="#comment-status-button-` + commentID + `" hx-headers='{"X-No-Cache": "true"}'
-					hx-confirm="Are you sure you want to change the status of this comment?"
-					hx-swap="outerHTML">
-					Approve
-				</button>`
+// commentStatusChanged fires the hooks of a comment that went from the old
+// status to its current one, and tells the parent author about a reply the
+// first time it is approved.
+func commentStatusChanged(db *gorm.DB, comment model.Comment, old string) {
+	if comment.Status == old {
+		return
+	}
+	/// what moderators approve or mark as spam teaches the spam filter
+	if comment.Status == model.CommentApproved || comment.Status == model.CommentSpam {
+		if _, err := spam.Learn(db, comment, comment.Status == model.CommentSpam); err != nil {
+			log.Printf("Failed to train the spam filter with comment %d: %v", comment.ID, err)
+		}
 	}
 
-	return button
+	switch {
+	case comment.Status == model.CommentApproved:
+		hooks.DoAction(hooks.CommentApproved, comment)
+		notifyReply(db, comment)
+	case old == model.CommentApproved:
+		hooks.DoAction(hooks.CommentUnapproved, comment)
+	}
+	if comment.Status == model.CommentSpam {
+		hooks.DoAction(hooks.CommentSpam, comment)
+	}
 }
 
-func DeleteComment(c *fiber.Ctx, db *gorm.DB) error {
-	commentID, _ := strconv.Atoi(c.Params("id"))
-	var comment model.Comment
-	db.First(&comment, commentID)
+// notifyReply tells the author of the parent comment about an approved reply.
+// Nobody is told about their own replies, and nobody is told twice.
+func notifyReply(db *gorm.DB, reply model.Comment) {
+	if reply.ParentID == nil || reply.NotifiedAt != nil {
+		return
+	}
 
-	db.Delete(&comment)
+	var parent model.Comment
+	if err := db.Preload("User").First(&parent, *reply.ParentID).Error; err != nil || parent.User.ID == 0 || parent.UserID == reply.UserID {
+		return
+	}
+	var post model.Post
+	if err := db.First(&post, reply.PostID).Error; err != nil {
+		return
+	}
+	if reply.UserID != 0 {
+		db.First(&reply.User, reply.UserID)
+	}
 
-	ShowToast(c, "Comment deleted successfully")
+	/// only one request may send it when two moderators approve at once
+	now := time.Now()
+	result := db.Model(&model.Comment{}).Where("id = ? AND notified_at IS NULL", reply.ID).Update("notified_at", now)
+	if result.Error != nil || result.RowsAffected != 1 {
+		return
+	}
 
-	return c.SendStatus(fiber.StatusNoContent)
+	notify.Send(notify.Notification{
+		Kind:    notify.CommentReply,
+		User:    parent.User,
+		Subject: reply.AuthorName() + " replied to your comment on " + post.Title,
+		Link:    absoluteURL("/blog/post/" + post.Slug + "#comment-" + strconv.FormatUint(uint64(reply.ID), 10)),
+		Data: map[string]interface{}{
+			"Post":    post,
+			"Comment": parent,
+			"Reply":   reply,
+		},
+	})
+}
 
+// deleteComment removes a comment for good. Its replies move up to its
+// parent, so they stay in the thread.
+func deleteComment(db *gorm.DB, comment model.Comment) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&model.Comment{}).Where("parent_id = ?", comment.ID).Update("parent_id", comment.ParentID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&comment).Error
+	})
+	if err != nil {
+		return err
+	}
+	hooks.DoAction(hooks.CommentDeleted, comment)
+	return nil
 }
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"goxcms/model"
+	"goxcms/search"
 	"math"
 	"strconv"
 
@@ -44,6 +45,11 @@ func AddCustomPage(c *fiber.Ctx, db *gorm.DB, app *fiber.App, engine *html.Engin
 		return c.SendString("Missing required fields: title, content, slug, template")
 	}
 
+	publishAt, unpublishAt, err := parseSchedule(c)
+	if err != nil {
+		return c.SendString(err.Error())
+	}
+
 	var existingPage model.CustomPage
 	result := db.Where("slug = ? OR title = ?", slug, title).First(&existingPage)
 	if result.Error == nil {
@@ -51,10 +57,12 @@ func AddCustomPage(c *fiber.Ctx, db *gorm.DB, app *fiber.App, engine *html.Engin
 	}
 
 	customPage := model.CustomPage{
-		Title:    title,
-		Content:  content,
-		Slug:     slug,
-		Template: template,
+		Title:       title,
+		Content:     content,
+		Slug:        slug,
+		Template:    template,
+		PublishAt:   publishAt,
+		UnpublishAt: unpublishAt,
 	}
 
 	//RenderCustomPage(c, db, app, slug, engine)
@@ -65,6 +73,12 @@ func AddCustomPage(c *fiber.Ctx, db *gorm.DB, app *fiber.App, engine *html.Engin
 		return c.Status(fiber.StatusInternalServerError).SendString(result.Error.Error())
 	}
 
+	if err := saveCustomPageRevision(db, c, customPage, "Created"); err != nil {
+		return ShowToastError(c, "Custom page added but its revision could not be saved: "+err.Error())
+	}
+	search.SyncPage(db, customPage.ID)
+	Audit(c, db, "page.create", "page", customPage.ID, nil, customPage)
+
 	return ShowToast(c, "Custom Page Added - Restart server to see changes")
 
 }
@@ -123,18 +137,41 @@ func EditCustomPage(c *fiber.Ctx, db *gorm.DB) error {
 		return c.SendString("Missing required fields: id, title, content, slug, template")
 	}
 
+	publishAt, unpublishAt, err := parseSchedule(c)
+	if err != nil {
+		return c.SendString(err.Error())
+	}
+
+	var before model.CustomPage
+	if err := db.First(&before, idInt).Error; err != nil {
+		return c.SendString("Custom page not found")
+	}
+
 	customPage := model.CustomPage{
-		Title:    title,
-		Content:  content,
-		Slug:     slug,
-		Template: template,
+		Title:       title,
+		Content:     content,
+		Slug:        slug,
+		Template:    template,
+		PublishAt:   publishAt,
+		UnpublishAt: unpublishAt,
 	}
 
-	result := db.Model(&model.CustomPage{}).Where("id = ?", id).Updates(customPage)
+	/// select the schedule columns explicitly so clearing a date is saved too
+	result := db.Model(&model.CustomPage{}).Where("id = ?", id).
+		Select("title", "content", "slug", "template", "publish_at", "unpublish_at").
+		Updates(customPage)
 	if result.Error != nil {
 		return c.Status(fiber.StatusInternalServerError).SendString(result.Error.Error())
 	}
 
+	if err := db.First(&customPage, idInt).Error; err == nil {
+		if err := saveCustomPageRevision(db, c, customPage, ""); err != nil {
+			return ShowToastError(c, "Custom Page Updated but its revision could not be saved: "+err.Error())
+		}
+	}
+	search.SyncPage(db, uint(idInt))
+	Audit(c, db, "page.update", "page", idInt, before, customPage)
+
 	return ShowToastError(c, "Custom Page Updated")
 }
 
@@ -149,10 +186,15 @@ func DeleteCustomPage(c *fiber.Ctx, db *gorm.DB) error {
 		return c.SendString("No ID provided")
 	}
 
+	var customPage model.CustomPage
+	db.First(&customPage, id)
+
 	result := db.Delete(&model.CustomPage{}, id)
 	if result.Error != nil {
 		return c.Status(fiber.StatusInternalServerError).SendString(result.Error.Error())
 	}
+	search.SyncPage(db, uint(id))
+	Audit(c, db, "page.delete", "page", id, customPage, nil)
 
 	return ShowToastError(c, "Custom Page Deleted")
 }
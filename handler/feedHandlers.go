@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"goxcms/model"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// Feed formats served under /feed.xml, /atom.xml and /feed.json.
+const (
+	FeedRSS  = "rss"
+	FeedAtom = "atom"
+	FeedJSON = "json"
+)
+
+var feedTagRegex = regexp.MustCompile(`<[^>]*>`)
+
+// feedInfo describes the channel a feed is built for.
+type feedInfo struct {
+	Title       string
+	Description string
+	Link        string // page the feed belongs to, relative to app.url
+	Self        string // URL of the feed itself, relative to app.url
+	Site        model.BasicWebsiteInfo
+	Updated     time.Time
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Language      string    `xml:"language,omitempty"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	AtomLink      rssLink   `xml:"atom:link"`
+	Image         *rssImage `xml:"image,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssImage struct {
+	URL   string `xml:"url"`
+	Title string `xml:"title"`
+	Link  string `xml:"link"`
+}
+
+type rssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	GUID        rssGUID       `xml:"guid"`
+	PubDate     string        `xml:"pubDate"`
+	Description string        `xml:"description"`
+	Categories  []string      `xml:"category"`
+	Enclosure   *rssEnclosure `xml:"enclosure,omitempty"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int    `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Author   atomAuthor  `xml:"author"`
+	Logo     string      `xml:"logo,omitempty"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published"`
+	Links      []atomLink     `xml:"link"`
+	Content    atomContent    `xml:"content"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr,omitempty"`
+}
+
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url"`
+	FeedURL     string           `json:"feed_url"`
+	Description string           `json:"description,omitempty"`
+	Icon        string           `json:"icon,omitempty"`
+	Language    string           `json:"language,omitempty"`
+	Authors     []jsonFeedAuthor `json:"authors,omitempty"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+type jsonFeedItem struct {
+	ID            string               `json:"id"`
+	URL           string               `json:"url"`
+	Title         string               `json:"title"`
+	ContentHTML   string               `json:"content_html,omitempty"`
+	ContentText   string               `json:"content_text,omitempty"`
+	Image         string               `json:"image,omitempty"`
+	DatePublished string               `json:"date_published"`
+	DateModified  string               `json:"date_modified"`
+	Tags          []string             `json:"tags,omitempty"`
+	Attachments   []jsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+type jsonFeedAttachment struct {
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type"`
+}
+
+func BlogFeed(c *fiber.Ctx, db *gorm.DB, format string) error {
+	info := feedInfo{Link: "/blog", Self: "/blog/" + feedFile(format)}
+	return renderFeed(c, db, db, info, format)
+}
+
+func BlogCategoryFeed(c *fiber.Ctx, db *gorm.DB, format string) error {
+	slug := c.Params("slug")
+
+	var category model.Category
+	if err := db.Where("slug = ?", slug).First(&category).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("Category not found")
+	}
+
+	query := db.Where("posts.id IN (SELECT post_id FROM post_categories WHERE category_id IN ?)", listedCategoryIDs(db, category))
+
+	info := feedInfo{
+		Title: "Category: " + category.Name,
+		Link:  "/blog/category/" + category.Slug,
+		Self:  "/blog/category/" + category.Slug + "/" + feedFile(format),
+	}
+	return renderFeed(c, db, query, info, format)
+}
+
+func BlogTagFeed(c *fiber.Ctx, db *gorm.DB, format string) error {
+	slug := c.Params("slug")
+
+	var tag model.Tag
+	if err := db.Where("slug = ?", slug).First(&tag).Error; err != nil {
+		if link, ok := tagRedirectLink(db, slug); ok {
+			return c.Redirect(link+"/"+feedFile(format), fiber.StatusMovedPermanently)
+		}
+		return c.Status(fiber.StatusNotFound).SendString("Tag not found")
+	}
+
+	query := db.Joins("JOIN post_tags ON post_tags.post_id = posts.id").
+		Where("post_tags.tag_id = ?", tag.ID)
+
+	info := feedInfo{
+		Title: "Tag: " + tag.Name,
+		Link:  "/blog/tag/" + tag.Slug,
+		Self:  "/blog/tag/" + tag.Slug + "/" + feedFile(format),
+	}
+	return renderFeed(c, db, query, info, format)
+}
+
+func feedFile(format string) string {
+	switch format {
+	case FeedAtom:
+		return "atom.xml"
+	case FeedJSON:
+		return "feed.json"
+	}
+	return "feed.xml"
+}
+
+// renderFeed loads the latest published posts matching query and writes them
+// in the requested format. Readers sending a matching If-None-Match or
+// If-Modified-Since get a 304 without a body.
+func renderFeed(c *fiber.Ctx, db *gorm.DB, query *gorm.DB, info feedInfo, format string) error {
+	limit := viper.GetInt("feed.items")
+	if limit <= 0 {
+		limit = 20
+	}
+
+	var posts []model.Post
+	if err := query.Preload("Categories").Preload("Tags").
+		Scopes(model.PublishedPosts).
+		Order("posts.created_at desc").
+		Limit(limit).
+		Find(&posts).Error; err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+
+	db.First(&info.Site)
+	if info.Title == "" {
+		info.Title = info.Site.Name
+	} else {
+		info.Title = info.Site.Name + " - " + info.Title
+	}
+	info.Description = info.Site.Tagline
+	if info.Description == "" {
+		info.Description = info.Site.About
+	}
+
+	/// a scheduled post goes live without touching updated_at
+	for _, post := range posts {
+		if modified := postModified(post); modified.After(info.Updated) {
+			info.Updated = modified
+		}
+	}
+	if info.Site.UpdatedAt.After(info.Updated) {
+		info.Updated = info.Site.UpdatedAt
+	}
+
+	var body []byte
+	var contentType string
+	var err error
+
+	switch format {
+	case FeedAtom:
+		body, err = xml.MarshalIndent(buildAtomFeed(info, posts), "", "  ")
+		body = append([]byte(xml.Header), body...)
+		contentType = "application/atom+xml; charset=utf-8"
+	case FeedJSON:
+		body, err = json.MarshalIndent(buildJSONFeed(info, posts), "", "  ")
+		contentType = "application/feed+json; charset=utf-8"
+	default:
+		body, err = xml.MarshalIndent(buildRSSFeed(info, posts), "", "  ")
+		body = append([]byte(xml.Header), body...)
+		contentType = "application/rss+xml; charset=utf-8"
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+	}
+
+	sum := sha1.Sum(body)
+	c.Set(fiber.HeaderETag, `"`+hex.EncodeToString(sum[:])+`"`)
+	if !info.Updated.IsZero() {
+		c.Set(fiber.HeaderLastModified, info.Updated.UTC().Format(http.TimeFormat))
+	}
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+
+	if c.Fresh() {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+	return c.Send(body)
+}
+
+func buildRSSFeed(info feedInfo, posts []model.Post) rssFeed {
+	channel := rssChannel{
+		Title:         info.Title,
+		Link:          absoluteURL(info.Link),
+		Description:   info.Description,
+		Language:      info.Site.Language,
+		LastBuildDate: info.Updated.UTC().Format(time.RFC1123Z),
+		AtomLink:      rssLink{Href: absoluteURL(info.Self), Rel: "self", Type: "application/rss+xml"},
+	}
+	if info.Site.LogoURL != "" {
+		channel.Image = &rssImage{URL: absoluteURL(info.Site.LogoURL), Title: info.Title, Link: channel.Link}
+	}
+
+	for _, post := range posts {
+		link := absoluteURL("/blog/post/" + post.Slug)
+		item := rssItem{
+			Title:       post.Title,
+			Link:        link,
+			GUID:        rssGUID{Value: link, IsPermaLink: true},
+			PubDate:     postPublished(post).UTC().Format(time.RFC1123Z),
+			Description: feedContent(post),
+			Categories:  categoryNames(post),
+		}
+		if post.ImageURL != "" {
+			item.Enclosure = &rssEnclosure{URL: absoluteURL(post.ImageURL), Type: imageType(post.ImageURL)}
+		}
+		channel.Items = append(channel.Items, item)
+	}
+
+	return rssFeed{Version: "2.0", AtomNS: "http://www.w3.org/2005/Atom", Channel: channel}
+}
+
+func buildAtomFeed(info feedInfo, posts []model.Post) atomFeed {
+	feed := atomFeed{
+		Title:    info.Title,
+		Subtitle: info.Description,
+		ID:       absoluteURL(info.Link),
+		Updated:  info.Updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: absoluteURL(info.Link), Rel: "alternate", Type: "text/html"},
+			{Href: absoluteURL(info.Self), Rel: "self", Type: "application/atom+xml"},
+		},
+		Author: atomAuthor{Name: info.Site.Name, Email: info.Site.Email},
+	}
+	if info.Site.LogoURL != "" {
+		feed.Logo = absoluteURL(info.Site.LogoURL)
+	}
+
+	for _, post := range posts {
+		link := absoluteURL("/blog/post/" + post.Slug)
+		entry := atomEntry{
+			Title:     post.Title,
+			ID:        link,
+			Updated:   postModified(post).UTC().Format(time.RFC3339),
+			Published: postPublished(post).UTC().Format(time.RFC3339),
+			Links:     []atomLink{{Href: link, Rel: "alternate", Type: "text/html"}},
+			Content:   atomContent{Type: "html", Body: feedContent(post)},
+		}
+		if post.ImageURL != "" {
+			entry.Links = append(entry.Links, atomLink{Href: absoluteURL(post.ImageURL), Rel: "enclosure", Type: imageType(post.ImageURL)})
+		}
+		for _, category := range post.Categories {
+			entry.Categories = append(entry.Categories, atomCategory{Term: category.Slug, Label: category.Name})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	return feed
+}
+
+func buildJSONFeed(info feedInfo, posts []model.Post) jsonFeed {
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       info.Title,
+		HomePageURL: absoluteURL(info.Link),
+		FeedURL:     absoluteURL(info.Self),
+		Description: info.Description,
+		Language:    info.Site.Language,
+		Authors:     []jsonFeedAuthor{{Name: info.Site.Name, URL: absoluteURL("/")}},
+		Items:       []jsonFeedItem{},
+	}
+	if info.Site.LogoURL != "" {
+		feed.Icon = absoluteURL(info.Site.LogoURL)
+	}
+
+	for _, post := range posts {
+		link := absoluteURL("/blog/post/" + post.Slug)
+		item := jsonFeedItem{
+			ID:            link,
+			URL:           link,
+			Title:         post.Title,
+			DatePublished: postPublished(post).UTC().Format(time.RFC3339),
+			DateModified:  postModified(post).UTC().Format(time.RFC3339),
+			Tags:          categoryNames(post),
+		}
+		if viper.GetBool("feed.full_content") {
+			item.ContentHTML = post.Content
+		} else {
+			item.ContentText = feedExcerpt(post.Content)
+		}
+		if post.ImageURL != "" {
+			item.Image = absoluteURL(post.ImageURL)
+			item.Attachments = []jsonFeedAttachment{{URL: item.Image, MimeType: imageType(post.ImageURL)}}
+		}
+		feed.Items = append(feed.Items, item)
+	}
+
+	return feed
+}
+
+// postPublished is the date a post went live.
+func postPublished(post model.Post) time.Time {
+	if post.PublishAt != nil {
+		return *post.PublishAt
+	}
+	return post.CreatedAt
+}
+
+func postModified(post model.Post) time.Time {
+	if published := postPublished(post); published.After(post.UpdatedAt) {
+		return published
+	}
+	return post.UpdatedAt
+}
+
+// feedContent returns the full HTML content or a plain text excerpt,
+// depending on feed.full_content.
+func feedContent(post model.Post) string {
+	if viper.GetBool("feed.full_content") {
+		return post.Content
+	}
+	return feedExcerpt(post.Content)
+}
+
+func feedExcerpt(content string) string {
+	text := strings.Join(strings.Fields(feedTagRegex.ReplaceAllString(content, " ")), " ")
+	runes := []rune(text)
+	if len(runes) <= 300 {
+		return text
+	}
+	return strings.TrimSpace(string(runes[:300])) + "..."
+}
+
+func categoryNames(post model.Post) []string {
+	names := make([]string, 0, len(post.Categories))
+	for _, category := range post.Categories {
+		names = append(names, category.Name)
+	}
+	return names
+}
+
+func absoluteURL(link string) string {
+	if strings.HasPrefix(link, "http://") || strings.HasPrefix(link, "https://") {
+		return link
+	}
+	if !strings.HasPrefix(link, "/") {
+		link = "/" + link
+	}
+	return strings.TrimSuffix(viper.GetString("app.url"), "/") + link
+}
+
+func imageType(imageURL string) string {
+	ext := path.Ext(strings.SplitN(imageURL, "?", 2)[0])
+	if t := mime.TypeByExtension(ext); strings.HasPrefix(t, "image/") {
+		return t
+	}
+	return "image/jpeg"
+}
@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"errors"
+	"goxcms/hooks"
 	"goxcms/model"
 	"math"
 	"math/rand"
+	"mime/multipart"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -40,49 +43,72 @@ func UploadFile(c *fiber.Ctx, db *gorm.DB) error {
 		return c.Status(fiber.StatusBadRequest).SendString("Cannot read file: " + err.Error())
 	}
 
+	fileModel, err := storeUpload(c, db, file)
+	if err != nil {
+		return c.Status(errorStatus(err)).SendString(err.Error())
+	}
+	Audit(c, db, "file.upload", "file", fileModel.ID, nil, fileModel)
+
+	// Respond with success message
+	c.SendStatus(fiber.StatusOK)
+	ShowToast(c, "File uploaded successfully")
+	return nil
+}
+
+// storeUpload validates an uploaded file, saves it to the upload directory
+// and adds it to the media library. Its errors are *fiber.Error values that
+// carry the status to answer with.
+func storeUpload(c *fiber.Ctx, db *gorm.DB, file *multipart.FileHeader) (model.File, error) {
 	// Validate file size
 	if file.Size > MaxFileSize {
-		return c.Status(fiber.StatusBadRequest).SendString("File size exceeds the limit")
+		return model.File{}, fiber.NewError(fiber.StatusBadRequest, "File size exceeds the limit")
 	}
 
 	// Validate file type based on extension
 	fileType := filepath.Ext(file.Filename)
 	if !isValidFileType(fileType) {
-		return c.Status(fiber.StatusBadRequest).SendString("File type not allowed")
+		return model.File{}, fiber.NewError(fiber.StatusBadRequest, "File type not allowed")
 	}
 
 	// Check file content type from header
 	if !isValidContentType(file.Header.Get("Content-Type")) {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid content type")
+		return model.File{}, fiber.NewError(fiber.StatusBadRequest, "Invalid content type")
 	}
 
 	// Generate a random string for the filename to ensure uniqueness
 	randomString := generateRandomFilenameString(RandomFilenameSize)
-	oldFilename := file.Filename
+	oldFilename := filepath.Base(file.Filename)
 	filename := oldFilename[:len(oldFilename)-len(fileType)] + "_" + randomString + fileType
 
-	// Save the file to the disk
-
 	// Save the file to the disk
 	if err := c.SaveFile(file, filepath.Join(UploadDir, filename)); err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Cannot save file to disk")
+		return model.File{}, fiber.NewError(fiber.StatusInternalServerError, "Cannot save file to disk")
 	}
 
 	// Represent the file in the database
 	fileModel := model.File{
-		Name: filename,
-		Path: "/static/uploads/" + filename, // Save the path to the file
+		Name:      filename,
+		Extension: fileType,
+		Path:      "/static/uploads/" + filename, // Save the path to the file
 	}
 
 	// Save file reference to the database
 	if err := db.Create(&fileModel).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Cannot save file to database")
+		return model.File{}, fiber.NewError(fiber.StatusInternalServerError, "Cannot save file to database")
 	}
 
-	// Respond with success message
-	c.SendStatus(fiber.StatusOK)
-	ShowToast(c, "File uploaded successfully")
-	return nil
+	hooks.DoAction(hooks.FileUploaded, fileModel)
+	return fileModel, nil
+}
+
+// errorStatus returns the status carried by a *fiber.Error, or 500 for any
+// other error.
+func errorStatus(err error) int {
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return fiberErr.Code
+	}
+	return fiber.StatusInternalServerError
 }
 
 // Check if file type is allowed
@@ -111,28 +137,45 @@ func generateRandomFilenameString(length int) string {
 }
 
 func DeleteFile(c *fiber.Ctx, db *gorm.DB) error {
-	filename := c.FormValue("name")
+	fileModel, err := removeUpload(db, c.FormValue("name"))
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+	Audit(c, db, "file.delete", "file", fileModel.ID, fileModel, nil)
+
+	ShowToast(c, "File deleted successfully")
+	c.SendStatus(fiber.StatusOK)
+	return nil
+}
+
+// removeUpload deletes a file of the media library from the disk and the
+// database. Like storeUpload it returns *fiber.Error values.
+func removeUpload(db *gorm.DB, filename string) (model.File, error) {
 	safeFilename := filepath.Base(filename)
 	filePath := filepath.Join(UploadDir, safeFilename)
 
 	// Check if the file exists
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "File not found"})
+		return model.File{}, fiber.NewError(fiber.StatusNotFound, "File not found")
 	}
 
 	// Delete the file from disk
 	if err := os.Remove(filePath); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete file from disk"})
+		return model.File{}, fiber.NewError(fiber.StatusInternalServerError, "Failed to delete file from disk")
 	}
 
 	// Delete the file from the database
+	var fileModel model.File
+	db.Where("name = ?", safeFilename).First(&fileModel)
 	if err := db.Delete(&model.File{}, "name = ?", safeFilename).Error; err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete file from database"})
+		return fileModel, fiber.NewError(fiber.StatusInternalServerError, "Failed to delete file from database")
+	}
+	if fileModel.ID != 0 {
+		db.Model(&model.User{}).Where("avatar_file_id = ?", fileModel.ID).Update("avatar_file_id", nil)
 	}
 
-	ShowToast(c, "File deleted successfully")
-	c.SendStatus(fiber.StatusOK)
-	return nil
+	hooks.DoAction(hooks.FileDeleted, fileModel)
+	return fileModel, nil
 }
 
 // SearchFiles searches for files based on a query and returns the results.
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"goxcms/model"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// guestCookie remembers the name, email and website of a guest who
+// commented, so the comment forms are filled in on the next visit.
+const guestCookie = "comment_guest"
+
+const guestCookieLifetime = 365 * 24 * time.Hour
+
+// guestIdentity is what guests enter instead of logging in.
+type guestIdentity struct {
+	Name    string
+	Email   string
+	Website string
+}
+
+func guestCommentsAllowed(db *gorm.DB) bool {
+	var settings model.BasicWebsiteInfo
+	db.Select("guest_comments").First(&settings)
+	return settings.GuestComments
+}
+
+// RequireCommentPermission lets users comment who may create comments, and
+// guests when the site allows guest comments.
+func RequireCommentPermission(db *gorm.DB) fiber.Handler {
+	requirePermission := RequirePermission(model.PermCommentCreate)
+	return func(c *fiber.Ctx) error {
+		if c.Locals("isLoggedin") == true {
+			return requirePermission(c)
+		}
+		if !guestCommentsAllowed(db) {
+			ShowToastError(c, "Please log in to comment")
+			return c.Status(fiber.StatusUnauthorized).SendString("Unauthorized")
+		}
+		return c.Next()
+	}
+}
+
+// guestFromForm reads and checks the guest fields of a comment form.
+func guestFromForm(c *fiber.Ctx) (guestIdentity, error) {
+	guest := guestIdentity{
+		Name:    strings.TrimSpace(c.FormValue("guest_name")),
+		Email:   strings.TrimSpace(c.FormValue("guest_email")),
+		Website: strings.TrimSpace(c.FormValue("guest_website")),
+	}
+
+	if guest.Name == "" || len(guest.Name) > 100 {
+		return guest, errors.New("Please enter your name, up to 100 characters")
+	}
+	if len(guest.Email) > 255 || validator.New().Var(guest.Email, "required,email") != nil {
+		return guest, errors.New("Please enter a valid email address")
+	}
+	if guest.Website != "" {
+		link, err := url.Parse(guest.Website)
+		if err != nil || (link.Scheme != "http" && link.Scheme != "https") || link.Host == "" || len(guest.Website) > 255 {
+			return guest, errors.New("Please enter a website starting with http:// or https://")
+		}
+	}
+	return guest, nil
+}
+
+// rememberGuest stores the guest's details in a signed cookie.
+func rememberGuest(c *fiber.Ctx, guest guestIdentity) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"purpose": guestCookie,
+		"name":    guest.Name,
+		"email":   guest.Email,
+		"website": guest.Website,
+		"exp":     time.Now().Add(guestCookieLifetime).Unix(),
+	})
+	signed, err := token.SignedString(appSecret())
+	if err != nil {
+		return
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     guestCookie,
+		Value:    signed,
+		Path:     "/",
+		Expires:  time.Now().Add(guestCookieLifetime),
+		HTTPOnly: true,
+		SameSite: "Lax",
+	})
+}
+
+// rememberedGuest returns the details of a returning guest, or empty ones
+// when the cookie is missing or was not signed by this site.
+func rememberedGuest(c *fiber.Ctx) guestIdentity {
+	var guest guestIdentity
+	raw := c.Cookies(guestCookie)
+	if raw == "" {
+		return guest
+	}
+
+	token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return appSecret(), nil
+	})
+	if err != nil || !token.Valid {
+		return guest
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != guestCookie {
+		return guest
+	}
+
+	guest.Name, _ = claims["name"].(string)
+	guest.Email, _ = claims["email"].(string)
+	guest.Website, _ = claims["website"].(string)
+	return guest
+}
@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"goxcms/hooks"
 	"goxcms/model"
+	"html"
 	"math"
 	"sort"
 	"strconv"
@@ -53,6 +56,7 @@ func AddMenu(c *fiber.Ctx, db *gorm.DB) error {
 	if err := db.Create(&menu).Error; err != nil {
 		return err
 	}
+	Audit(c, db, "menu.create", "menu", menu.ID, nil, menu)
 
 	ShowToast(c, "Menu added successfully")
 
@@ -82,15 +86,61 @@ func AddMenuItem(c *fiber.Ctx, db *gorm.DB) error {
 	menuItem.Link = link
 	menuItem.MenuID = &menuIDUint
 	menuItem.Position = position // New: Set position
+	if err := menuItemCategoryFromForm(c, db, &menuItem); err != nil {
+		return ShowToastError(c, err.Error())
+	}
 
 	if err := db.Create(&menuItem).Error; err != nil {
 		return err
 	}
+	Audit(c, db, "menu_item.create", "menu_item", menuItem.ID, nil, menuItem)
 
 	ShowToast(c, "Menu item added successfully")
 	return nil
 }
 
+// menuItemCategoryFromForm sets the category whose subcategories the item
+// opens. Without a link of its own the item links to the category page.
+func menuItemCategoryFromForm(c *fiber.Ctx, db *gorm.DB, menuItem *model.MenuItem) error {
+	menuItem.CategoryID = nil
+	if categoryIDStr := c.FormValue("menu_item_category"); categoryIDStr != "" {
+		var category model.Category
+		if err := db.First(&category, categoryIDStr).Error; err != nil {
+			return errors.New("Category not found")
+		}
+		menuItem.CategoryID = &category.ID
+		if menuItem.Link == "" {
+			menuItem.Link = "/blog/category/" + category.Slug
+		}
+	}
+	if menuItem.Link == "" {
+		return errors.New("Please enter a link or choose a category")
+	}
+	return nil
+}
+
+// menuCategories returns the category tree by category ID, for the items
+// that open a category. It is nil when no item does.
+func menuCategories(db *gorm.DB, items []*model.MenuItem) map[uint]*model.CategoryNode {
+	needed := false
+	for _, item := range items {
+		needed = needed || item.CategoryID != nil
+	}
+	if !needed {
+		return nil
+	}
+
+	tree, err := model.CategoryTree(db)
+	if err != nil {
+		return nil
+	}
+	categories := map[uint]*model.CategoryNode{}
+	for _, node := range model.FlattenCategoryTree(tree) {
+		categories[node.ID] = node
+	}
+	return categories
+}
+
 func DeleteMenu(c *fiber.Ctx, db *gorm.DB) error {
 	idStr := c.Params("id")
 	id, err := strconv.Atoi(idStr)
@@ -98,9 +148,13 @@ func DeleteMenu(c *fiber.Ctx, db *gorm.DB) error {
 		return err
 	}
 
+	var menu model.Menu
+	db.First(&menu, id)
+
 	if err := db.Where("id = ?", id).Delete(&model.Menu{}).Error; err != nil {
 		return err
 	}
+	Audit(c, db, "menu.delete", "menu", id, menu, nil)
 
 	ShowToast(c, "Menu and associated menu items deleted successfully")
 	return nil
@@ -113,9 +167,13 @@ func DeleteMenuItem(c *fiber.Ctx, db *gorm.DB) error {
 		return err
 	}
 
+	var menuItem model.MenuItem
+	db.First(&menuItem, id)
+
 	if err := db.Where("id = ?", id).Delete(&model.MenuItem{}).Error; err != nil {
 		return err
 	}
+	Audit(c, db, "menu_item.delete", "menu_item", id, menuItem, nil)
 
 	ShowToast(c, "Menu item deleted successfully")
 	return nil
@@ -128,9 +186,14 @@ func RemoveSubmenuFromMenu(c *fiber.Ctx, db *gorm.DB) error {
 		return err
 	}
 
-	if err := db.Model(&model.Menu{}).Where("id = ?", id).Update("parent_id", nil).Error; err != nil {
+	var menu model.Menu
+	db.First(&menu, id)
+	before := menu
+
+	if err := db.Model(&menu).Where("id = ?", id).Update("parent_id", nil).Error; err != nil {
 		return err
 	}
+	Audit(c, db, "menu.update", "menu", id, before, menu)
 
 	ShowToast(c, "Submenu removed from menu successfully")
 	return nil
@@ -147,6 +210,7 @@ func EditMenu(c *fiber.Ctx, db *gorm.DB) error {
 	if err := db.First(&menu, id).Error; err != nil {
 		return err
 	}
+	before := menu
 
 	menu.Title = c.FormValue("menu_title")
 	menu.Primary = c.FormValue("menu_primary") == "on"
@@ -174,6 +238,7 @@ func EditMenu(c *fiber.Ctx, db *gorm.DB) error {
 	if err := db.Save(&menu).Error; err != nil {
 		return err
 	}
+	Audit(c, db, "menu.update", "menu", menu.ID, before, menu)
 
 	ShowToast(c, "Menu edited successfully")
 	return nil
@@ -190,6 +255,7 @@ func EditMenuItem(c *fiber.Ctx, db *gorm.DB) error {
 	if err := db.First(&menuItem, id).Error; err != nil {
 		return err
 	}
+	before := menuItem
 
 	menuItem.Title = c.FormValue("menu_item_title")
 	menuItem.Link = c.FormValue("menu_item_link")
@@ -206,10 +272,14 @@ func EditMenuItem(c *fiber.Ctx, db *gorm.DB) error {
 		return ShowToastError(c, "Failed to update menu item: "+posErr.Error())
 	}
 	menuItem.Position = position
+	if err := menuItemCategoryFromForm(c, db, &menuItem); err != nil {
+		return ShowToastError(c, err.Error())
+	}
 
 	if err := db.Save(&menuItem).Error; err != nil {
 		return ShowToastError(c, "Failed to update menu item: "+err.Error())
 	}
+	Audit(c, db, "menu_item.update", "menu_item", menuItem.ID, before, menuItem)
 
 	ShowToast(c, "Menu item updated successfully")
 	return nil
@@ -262,10 +332,18 @@ func EditMenuItemView(c *fiber.Ctx, db *gorm.DB) error {
 	// Convert ID to the same type as MenuID
 	menuItemID := uint(menuItem.ID)
 
+	var categoryID uint
+	if menuItem.CategoryID != nil {
+		categoryID = *menuItem.CategoryID
+	}
+	tree, _ := model.CategoryTree(db)
+
 	return c.Render("admin/menu/edit-menu-item", fiber.Map{
 		"MenuItem":   menuItem,
 		"Menus":      menus,
 		"MenuItemID": menuItemID,
+		"CategoryID": categoryID,
+		"Categories": model.FlattenCategoryTree(tree),
 	})
 }
 
@@ -302,8 +380,11 @@ func SearchMenuAdminTable(c *fiber.Ctx, db *gorm.DB) error {
 		Count(&totalMatchingCount)
 	totalPages := int(math.Ceil(float64(totalMatchingCount) / float64(pageSize)))
 
+	tree, _ := model.CategoryTree(db)
+
 	return c.Render("admin/table/menu-table", fiber.Map{
 		"Menus":       menus, // No need to separate and recombine by primary status for ordering
+		"Categories":  model.FlattenCategoryTree(tree),
 		"TotalPages":  totalPages,
 		"CurrentPage": pageInt,
 		"SearchQuery": searchQuery,
@@ -334,13 +415,16 @@ func GetPrimaryMenuRender(c *fiber.Ctx, db *gorm.DB) error {
 		isAdmin = false
 	}
 
-	htmlMenuString := buildMenuHTML(menu, isAdmin, userLoggedIn)
+	menu.MenuItems = hooks.ApplyFilters(hooks.MenuItems, menu.MenuItems, menu).([]*model.MenuItem)
+
+	categories := menuCategories(db, menu.MenuItems)
+	htmlMenuString := buildMenuHTML(menu, categories, isAdmin, userLoggedIn)
 
 	return c.SendString(htmlMenuString)
 }
 
 // Separating the HTML building into its own function for clarity
-func buildMenuHTML(menu model.Menu, isAdmin bool, userLoggedIn bool) string {
+func buildMenuHTML(menu model.Menu, categories map[uint]*model.CategoryNode, isAdmin bool, userLoggedIn bool) string {
 	htmlMenuString := "<div class=\"collapse navbar-collapse\" id=\"navbarNavDropdown\">\n"
 	htmlMenuString += "\t<ul class=\"navbar-nav me-auto\">\n"
 
@@ -351,6 +435,10 @@ func buildMenuHTML(menu model.Menu, isAdmin bool, userLoggedIn bool) string {
 
 	// Loop through top-level MenuItems
 	for _, menuItem := range menu.MenuItems {
+		if menuItem.CategoryID != nil && categories[*menuItem.CategoryID] != nil && len(categories[*menuItem.CategoryID].Children) > 0 {
+			htmlMenuString += buildCategoryDropdownHTML(menuItem, categories[*menuItem.CategoryID])
+			continue
+		}
 		htmlMenuString += fmt.Sprintf("\t\t<li class=\"nav-item\"><a class=\"nav-link\" href=\"%s\">%s</a></li>\n", menuItem.Link, menuItem.Title)
 	}
 
@@ -383,6 +471,25 @@ func buildMenuHTML(menu model.Menu, isAdmin bool, userLoggedIn bool) string {
 
 	return htmlMenuString
 }
+
+// buildCategoryDropdownHTML renders an item that opens a category as a
+// dropdown of the category and its subcategories, indented by depth.
+func buildCategoryDropdownHTML(menuItem *model.MenuItem, category *model.CategoryNode) string {
+	id := strconv.Itoa(int(menuItem.ID))
+	htmlMenuString := "\t\t<li class=\"nav-item dropdown\">\n"
+	htmlMenuString += "\t\t\t<a class=\"nav-link dropdown-toggle\" href=\"#\" id=\"navbarCategoryLink-" + id + "\" role=\"button\" data-bs-toggle=\"dropdown\" aria-expanded=\"false\">" + menuItem.Title + "</a>\n"
+	htmlMenuString += "\t\t\t<ul class=\"dropdown-menu\" aria-labelledby=\"navbarCategoryLink-" + id + "\">\n"
+	htmlMenuString += "\t\t\t\t<li><a class=\"dropdown-item\" href=\"" + menuItem.Link + "\">All " + html.EscapeString(category.Name) + "</a></li>\n"
+	htmlMenuString += "\t\t\t\t<li><hr class=\"dropdown-divider\"></li>\n"
+	for _, subcategory := range model.FlattenCategoryTree(category.Children) {
+		indent := strconv.Itoa(int(math.Min(float64(3+subcategory.Depth-category.Depth), 5)))
+		htmlMenuString += "\t\t\t\t<li><a class=\"dropdown-item ps-" + indent + "\" href=\"/blog/category/" + subcategory.Slug + "\">" + html.EscapeString(subcategory.Name) + "</a></li>\n"
+	}
+	htmlMenuString += "\t\t\t</ul>\n"
+	htmlMenuString += "\t\t</li>\n"
+	return htmlMenuString
+}
+
 func adminControls() string {
 	return `<div class="btn-group" role="group" aria-label="Admin group">
 		<a href="/admin" class="btn btn-sm btn-outline-primary px-4 my-2">Admin Dashboard</a>
@@ -393,6 +500,11 @@ func adminControls() string {
 func userControls(loggedIn bool) string {
 	if loggedIn {
 		return `<ul class="navbar-nav ms-auto">
+			<li class="nav-item"><a class="nav-link" href="/account/profile">Profile</a></li>
+			<li class="nav-item"><a class="nav-link" href="/account/2fa">Security</a></li>
+			<li class="nav-item"><a class="nav-link" href="/account/sessions">Sessions</a></li>
+			<li class="nav-item"><a class="nav-link" href="/account/tokens">API Tokens</a></li>
+			<li class="nav-item"><a class="nav-link" href="/account/privacy">Your Data</a></li>
 			<li class="nav-item"><button hx-post="/logout" hx-swap="none" hx-target="body" hx-headers='{"X-No-Cache": "true"}' class="btn btn-link nav-link" style="text-decoration: none; color: inherit;">Logout</button></li>
 			</ul>`
 	}
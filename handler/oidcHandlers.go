@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"goxcms/hooks"
+	"goxcms/model"
+	"goxcms/oidc"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// oidcCookie carries the state, nonce and PKCE verifier of a login at a
+// provider until the provider sends the browser back. It is a JWT signed with
+// the app secret, so it works with prefork and cannot be altered.
+const oidcCookie = "oidc_login"
+
+const oidcLoginWindow = 10 * time.Minute
+
+// errOIDCLogin is shown when the login fails for a reason the user cannot fix.
+var errOIDCLogin = errors.New("The login failed, please try again")
+
+func oidcRedirectURL(provider *oidc.Provider) string {
+	return strings.TrimRight(viper.GetString("app.url"), "/") + "/auth/oidc/" + provider.Name + "/callback"
+}
+
+// oidcFailed shows the login page with the message.
+func oidcFailed(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).Render("login", fiber.Map{
+		"Title":         "Login",
+		"Settings":      c.Locals("Settings"),
+		"OIDCProviders": oidc.Providers(),
+		"Error":         message,
+	}, "main")
+}
+
+// OIDCLogin sends the browser to the provider's login page.
+func OIDCLogin(c *fiber.Ctx) error {
+	provider, ok := oidc.Get(c.Params("provider"))
+	if !ok {
+		return oidcFailed(c, fiber.StatusNotFound, "Unknown login provider")
+	}
+
+	var values [3]string
+	for i := range values {
+		value, err := oidc.RandomString()
+		if err != nil {
+			return oidcFailed(c, fiber.StatusInternalServerError, errOIDCLogin.Error())
+		}
+		values[i] = value
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	authURL, err := provider.AuthCodeURL(oidcRedirectURL(provider), state, nonce, verifier)
+	if err != nil {
+		log.Printf("OIDC login with %s failed: %v", provider.Name, err)
+		return oidcFailed(c, fiber.StatusBadGateway, provider.Label+" is not available right now")
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"provider": provider.Name,
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+		"exp":      time.Now().Add(oidcLoginWindow).Unix(),
+	})
+	signed, err := token.SignedString(appSecret())
+	if err != nil {
+		return oidcFailed(c, fiber.StatusInternalServerError, errOIDCLogin.Error())
+	}
+
+	/// Lax still sends the cookie when the provider redirects back
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcCookie,
+		Value:    signed,
+		Path:     "/auth/oidc",
+		Expires:  time.Now().Add(oidcLoginWindow),
+		HTTPOnly: true,
+		SameSite: "Lax",
+	})
+
+	return c.Redirect(authURL)
+}
+
+// pendingOIDCLogin reads and clears the cookie set by OIDCLogin.
+func pendingOIDCLogin(c *fiber.Ctx, provider string) (jwt.MapClaims, bool) {
+	raw := c.Cookies(oidcCookie)
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcCookie,
+		Value:    "",
+		Path:     "/auth/oidc",
+		Expires:  time.Now().Add(-1 * time.Hour),
+		HTTPOnly: true,
+	})
+
+	token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return appSecret(), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, false
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["provider"] != provider {
+		return nil, false
+	}
+	return claims, true
+}
+
+// OIDCCallback finishes the login when the provider sends the browser back.
+func OIDCCallback(db *gorm.DB, store *session.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		provider, ok := oidc.Get(c.Params("provider"))
+		if !ok {
+			return oidcFailed(c, fiber.StatusNotFound, "Unknown login provider")
+		}
+
+		pending, ok := pendingOIDCLogin(c, provider.Name)
+		state, _ := pending["state"].(string)
+		if !ok || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+			return oidcFailed(c, fiber.StatusBadRequest, "Your login has expired, please try again")
+		}
+
+		if c.Query("error") == "access_denied" {
+			return oidcFailed(c, fiber.StatusUnauthorized, "The login at "+provider.Label+" was cancelled")
+		}
+		if c.Query("error") != "" || c.Query("code") == "" {
+			log.Printf("OIDC login with %s failed: %s %s", provider.Name, c.Query("error"), c.Query("error_description"))
+			return oidcFailed(c, fiber.StatusUnauthorized, errOIDCLogin.Error())
+		}
+
+		verifier, _ := pending["verifier"].(string)
+		nonce, _ := pending["nonce"].(string)
+		identity, err := provider.Exchange(c.Query("code"), oidcRedirectURL(provider), verifier, nonce)
+		if err != nil {
+			log.Printf("OIDC login with %s failed: %v", provider.Name, err)
+			return oidcFailed(c, fiber.StatusUnauthorized, errOIDCLogin.Error())
+		}
+
+		user, err := oidcUser(c, db, provider, identity)
+		if err != nil {
+			return oidcFailed(c, fiber.StatusForbidden, err.Error())
+		}
+		if user.PendingApproval {
+			return oidcFailed(c, fiber.StatusForbidden, errAccountPending.Error())
+		}
+
+		/// the provider replaces the password, not the second factor
+		if user.TwoFactorEnabled {
+			if err := setTwoFactorCookie(c, db, user); err != nil {
+				return oidcFailed(c, fiber.StatusInternalServerError, errOIDCLogin.Error())
+			}
+			return c.Redirect("/login/2fa")
+		}
+
+		role, err := signIn(c, db, store, user)
+		if err != nil {
+			return oidcFailed(c, fiber.StatusInternalServerError, err.Error())
+		}
+		if twoFactorSetupRequired(db, user, role) {
+			return c.Redirect("/account/2fa")
+		}
+		return c.Redirect("/")
+	}
+}
+
+// oidcUser returns the user behind the identity. A known identity signs in
+// its user. Otherwise a verified email address links the identity to the
+// account with that address, and without one a new account is created when
+// auth.oidc.auto_provision is on.
+func oidcUser(c *fiber.Ctx, db *gorm.DB, provider *oidc.Provider, identity oidc.Identity) (model.User, error) {
+	var user model.User
+	now := time.Now()
+
+	var link model.UserIdentity
+	if err := db.Where("provider = ? AND subject = ?", provider.Name, identity.Subject).First(&link).Error; err == nil {
+		if err := db.First(&user, link.UserID).Error; err != nil {
+			return user, errors.New("The account linked to this login no longer exists")
+		}
+		db.Model(&link).Updates(map[string]interface{}{"email": identity.Email, "last_login_at": now})
+		return user, nil
+	}
+
+	link = model.UserIdentity{
+		Provider:    provider.Name,
+		Subject:     identity.Subject,
+		Email:       identity.Email,
+		LastLoginAt: now,
+	}
+
+	if identity.EmailVerified {
+		err := db.Where("LOWER(email) = ?", strings.ToLower(identity.Email)).First(&user).Error
+		if err == nil {
+			/// an unverified address may have been typed in by somebody else
+			if !user.EmailVerified() {
+				return user, errors.New("An account with this email address exists. Log in with your password and verify your email address to link it.")
+			}
+			link.UserID = user.ID
+			if err := db.Create(&link).Error; err != nil {
+				return user, errOIDCLogin
+			}
+			return user, nil
+		}
+	}
+
+	if !viper.GetBool("auth.oidc.auto_provision") {
+		return user, errors.New("There is no account for this login")
+	}
+	return provisionOIDCUser(c, db, provider, identity, link)
+}
+
+// provisionOIDCUser creates an account for the identity. It gets a random
+// password, which the user can replace through the password reset.
+func provisionOIDCUser(c *fiber.Ctx, db *gorm.DB, provider *oidc.Provider, identity oidc.Identity, link model.UserIdentity) (model.User, error) {
+	var user model.User
+
+	roleName := provider.DefaultRole
+	if roleName == "" {
+		roleName = viper.GetString("auth.oidc.default_role")
+	}
+	var role model.Role
+	if err := db.Where("name = ?", roleName).First(&role).Error; err != nil {
+		log.Printf("OIDC login with %s failed: the default role %q does not exist", provider.Name, roleName)
+		return user, errOIDCLogin
+	}
+
+	secret, err := oidc.RandomString()
+	if err != nil {
+		return user, errOIDCLogin
+	}
+	password, err := HashPassword(secret)
+	if err != nil {
+		return user, errOIDCLogin
+	}
+
+	/// the registration mode applies to accounts created at login too
+	mode, domains := registrationSettings(db)
+	pending := false
+	switch mode {
+	case model.RegistrationInvite:
+		return user, errors.New("Registration is by invitation only")
+	case model.RegistrationDomain:
+		if !identity.EmailVerified || !emailDomainAllowed(identity.Email, domains) {
+			return user, errors.New("Registration is only open to addresses at " + strings.Join(domains, ", "))
+		}
+	case model.RegistrationApproval:
+		pending = true
+	}
+
+	username := oidcUsername(db, identity)
+	user = model.User{
+		Username:  username,
+		Password:  password,
+		RoleID:    role.ID,
+		FirstName: oidcName(identity.GivenName, username),
+		LastName:  oidcName(identity.FamilyName, username),
+
+		PendingApproval: pending,
+	}
+	if identity.GivenName == "" && identity.FamilyName == "" {
+		first, last, _ := strings.Cut(strings.TrimSpace(identity.Name), " ")
+		user.FirstName, user.LastName = oidcName(first, username), oidcName(last, username)
+	}
+
+	/// an address another account already uses stays off the new account
+	if identity.Email != "" && db.Where("LOWER(email) = ?", strings.ToLower(identity.Email)).First(&model.User{}).Error != nil {
+		email := identity.Email
+		user.Email = &email
+		if identity.EmailVerified {
+			user.EmailVerifiedAt = &link.LastLoginAt
+		}
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		link.UserID = user.ID
+		return tx.Create(&link).Error
+	})
+	if err != nil {
+		log.Printf("OIDC login with %s failed: %v", provider.Name, err)
+		return user, errOIDCLogin
+	}
+
+	hooks.DoAction(hooks.UserRegistered, user)
+
+	if user.Email != nil && user.EmailVerifiedAt == nil {
+		if err := sendVerificationEmail(c, db, user); err != nil {
+			log.Printf("Failed to send the verification email to %s: %v", user.Username, err)
+		}
+	}
+
+	return user, nil
+}
+
+// oidcUsername picks a free username that passes the validation of
+// model.User, from the provider's username, the email address or the name.
+func oidcUsername(db *gorm.DB, identity oidc.Identity) string {
+	localPart, _, _ := strings.Cut(identity.Email, "@")
+
+	base := "user"
+	for _, candidate := range []string{identity.Username, localPart, identity.Name} {
+		var b strings.Builder
+		for _, r := range candidate {
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+				b.WriteRune(r)
+			}
+		}
+		if b.Len() >= 2 {
+			base = b.String()
+			break
+		}
+	}
+	if len(base) > 24 {
+		base = base[:24]
+	}
+
+	username := base
+	for i := 2; ; i++ {
+		var count int64
+		db.Unscoped().Model(&model.User{}).Where("username = ?", username).Count(&count)
+		if count == 0 {
+			return username
+		}
+		username = base + strconv.Itoa(i)
+	}
+}
+
+// oidcName returns the name if it fits the length limits of model.User and
+// the fallback otherwise.
+func oidcName(name, fallback string) string {
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > 30 {
+		name = string([]rune(name)[:30])
+	}
+	if utf8.RuneCountInString(name) < 2 {
+		return fallback
+	}
+	return name
+}
@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"goxcms/database"
+	"goxcms/model"
+	"goxcms/oidc"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/spf13/viper"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// oidcTestViews renders the error message of a page and nothing else.
+type oidcTestViews struct{}
+
+func (oidcTestViews) Load() error { return nil }
+
+func (oidcTestViews) Render(w io.Writer, name string, binding interface{}, layout ...string) error {
+	if data, ok := binding.(fiber.Map); ok && data["Error"] != nil {
+		fmt.Fprint(w, data["Error"])
+	}
+	return nil
+}
+
+// oidcTestSetup is a provider named "test" at an issuer served by the test,
+// and an app with its login routes on a fresh database.
+type oidcTestSetup struct {
+	issuer *httptest.Server
+	claims jwt.MapClaims // claims of the next ID token
+	app    *fiber.App
+	db     *gorm.DB
+	role   model.Role
+}
+
+func newOIDCTestSetup(t *testing.T) *oidcTestSetup {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &oidcTestSetup{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 s.issuer.URL,
+			"authorization_endpoint": s.issuer.URL + "/authorize",
+			"token_endpoint":         s.issuer.URL + "/token",
+			"userinfo_endpoint":      s.issuer.URL + "/userinfo",
+			"jwks_uri":               s.issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, s.claims)
+		token.Header["kid"] = "key-1"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "access-token", "id_token": signed})
+	})
+	s.issuer = httptest.NewServer(mux)
+	t.Cleanup(s.issuer.Close)
+
+	s.claims = jwt.MapClaims{
+		"iss":                s.issuer.URL,
+		"aud":                "client",
+		"sub":                "subject-1",
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"preferred_username": "alice",
+		"given_name":         "Alice",
+		"family_name":        "Smith",
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+	}
+
+	viper.Set("app.secret", "test secret")
+	viper.Set("app.url", "https://cms.example")
+	viper.Set("auth.oidc.default_role", "member")
+	viper.Set("auth.oidc.auto_provision", true)
+	viper.Set("auth.oidc.providers", []map[string]interface{}{{
+		"name":          "test",
+		"issuer":        s.issuer.URL,
+		"client_id":     "client",
+		"client_secret": "secret",
+	}})
+	if err := oidc.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.db, err = gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.sqlite")), &gorm.Config{
+		DisableForeignKeyConstraintWhenMigrating: true,
+		Logger:                                   logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.MigrateUp(s.db); err != nil {
+		t.Fatal(err)
+	}
+	s.role = model.Role{Name: "member"}
+	if err := s.db.Create(&s.role).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	s.app = fiber.New(fiber.Config{Views: oidcTestViews{}})
+	s.app.Get("/auth/oidc/:provider", OIDCLogin)
+	s.app.Get("/auth/oidc/:provider/callback", OIDCCallback(s.db, session.New()))
+	return s
+}
+
+// createUser adds an account with the email address, verified or not.
+func (s *oidcTestSetup) createUser(t *testing.T, username, email string, verified bool) model.User {
+	t.Helper()
+
+	user := model.User{
+		Username:  username,
+		Password:  "not a hash",
+		FirstName: "First",
+		LastName:  "Last",
+		RoleID:    s.role.ID,
+		Email:     &email,
+	}
+	if verified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+	if err := s.db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// login starts a login and returns the cookie and the state and nonce the
+// provider was sent.
+func (s *oidcTestSetup) login(t *testing.T) (*http.Cookie, string, string) {
+	t.Helper()
+
+	resp, err := s.app.Test(httptest.NewRequest("GET", "/auth/oidc/test", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusFound {
+		t.Fatalf("the login answered %d", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), s.issuer.URL+"/authorize?") {
+		t.Fatalf("the login went to %s", location)
+	}
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == oidcCookie {
+			return cookie, location.Query().Get("state"), location.Query().Get("nonce")
+		}
+	}
+	t.Fatal("the login set no cookie")
+	return nil, "", ""
+}
+
+// callback sends the browser back from the provider.
+func (s *oidcTestSetup) callback(t *testing.T, cookie *http.Cookie, state string) (*http.Response, string) {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/auth/oidc/test/callback?"+url.Values{"code": {"code-1"}, "state": {state}}.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	resp, err := s.app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+// signIn runs a whole login with the provider.
+func (s *oidcTestSetup) signIn(t *testing.T) (*http.Response, string) {
+	t.Helper()
+
+	cookie, state, nonce := s.login(t)
+	s.claims["nonce"] = nonce
+	return s.callback(t, cookie, state)
+}
+
+// identityUser returns the ID of the user the provider's subject is linked
+// to, or 0.
+func (s *oidcTestSetup) identityUser(subject string) uint {
+	var link model.UserIdentity
+	s.db.Where("provider = ? AND subject = ?", "test", subject).First(&link)
+	return link.UserID
+}
+
+func (s *oidcTestSetup) userCount() int64 {
+	var count int64
+	s.db.Model(&model.User{}).Count(&count)
+	return count
+}
+
+func TestOIDCCallbackLinksVerifiedEmail(t *testing.T) {
+	s := newOIDCTestSetup(t)
+	user := s.createUser(t, "existing", "Alice@Example.com", true)
+
+	resp, body := s.signIn(t)
+	if resp.StatusCode != fiber.StatusFound || resp.Header.Get("Location") != "/" {
+		t.Fatalf("the callback answered %d %q", resp.StatusCode, body)
+	}
+	if id := s.identityUser("subject-1"); id != user.ID {
+		t.Errorf("the identity is linked to user %d, want %d", id, user.ID)
+	}
+	if count := s.userCount(); count != 1 {
+		t.Errorf("there are %d users, want the existing one only", count)
+	}
+
+	signedIn := false
+	for _, cookie := range resp.Cookies() {
+		signedIn = signedIn || (cookie.Name == "jwt" && cookie.Value != "")
+	}
+	if !signedIn {
+		t.Error("the callback set no jwt cookie")
+	}
+
+	/// later logins find the link even when the address changed
+	s.claims["email"] = "alice@elsewhere.example"
+	if resp, body := s.signIn(t); resp.StatusCode != fiber.StatusFound {
+		t.Fatalf("the second login answered %d %q", resp.StatusCode, body)
+	}
+	if count := s.userCount(); count != 1 {
+		t.Errorf("there are %d users after the second login, want 1", count)
+	}
+}
+
+func TestOIDCCallbackKeepsUnverifiedAccount(t *testing.T) {
+	s := newOIDCTestSetup(t)
+	s.createUser(t, "existing", "alice@example.com", false)
+
+	resp, body := s.signIn(t)
+	if resp.StatusCode != fiber.StatusForbidden || !strings.Contains(body, "verify your email address to link it") {
+		t.Errorf("the callback answered %d %q", resp.StatusCode, body)
+	}
+	if id := s.identityUser("subject-1"); id != 0 {
+		t.Errorf("the identity was linked to user %d", id)
+	}
+}
+
+func TestOIDCCallbackProvisions(t *testing.T) {
+	s := newOIDCTestSetup(t)
+
+	resp, body := s.signIn(t)
+	if resp.StatusCode != fiber.StatusFound {
+		t.Fatalf("the callback answered %d %q", resp.StatusCode, body)
+	}
+
+	var user model.User
+	if err := s.db.Where("username = ?", "alice").First(&user).Error; err != nil {
+		t.Fatalf("no account was created: %v", err)
+	}
+	if user.RoleID != s.role.ID || user.FirstName != "Alice" || user.LastName != "Smith" {
+		t.Errorf("the account is %+v", user)
+	}
+	if !user.EmailVerified() || *user.Email != "alice@example.com" {
+		t.Errorf("the account has the address %v, verified %v", user.Email, user.EmailVerified())
+	}
+	if id := s.identityUser("subject-1"); id != user.ID {
+		t.Errorf("the identity is linked to user %d, want %d", id, user.ID)
+	}
+}
+
+func TestOIDCCallbackProvisionsBesideUnverifiedIdentity(t *testing.T) {
+	s := newOIDCTestSetup(t)
+	existing := s.createUser(t, "alice", "alice@example.com", true)
+	s.claims["email_verified"] = false
+
+	resp, body := s.signIn(t)
+	if resp.StatusCode != fiber.StatusFound {
+		t.Fatalf("the callback answered %d %q", resp.StatusCode, body)
+	}
+
+	id := s.identityUser("subject-1")
+	if id == 0 || id == existing.ID {
+		t.Fatalf("the identity is linked to user %d, want a new account", id)
+	}
+	var user model.User
+	s.db.First(&user, id)
+	if user.Username != "alice2" || user.Email != nil {
+		t.Errorf("the new account is %q with the address %v", user.Username, user.Email)
+	}
+}
+
+func TestOIDCCallbackWithoutProvisioning(t *testing.T) {
+	s := newOIDCTestSetup(t)
+	viper.Set("auth.oidc.auto_provision", false)
+	t.Cleanup(func() { viper.Set("auth.oidc.auto_provision", true) })
+
+	resp, body := s.signIn(t)
+	if resp.StatusCode != fiber.StatusForbidden || !strings.Contains(body, "There is no account for this login") {
+		t.Errorf("the callback answered %d %q", resp.StatusCode, body)
+	}
+	if count := s.userCount(); count != 0 {
+		t.Errorf("%d accounts were created", count)
+	}
+}
+
+func TestOIDCCallbackChecksStateAndNonce(t *testing.T) {
+	s := newOIDCTestSetup(t)
+
+	cookie, state, nonce := s.login(t)
+	s.claims["nonce"] = nonce
+	if resp, body := s.callback(t, cookie, state+"x"); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("a wrong state answered %d %q", resp.StatusCode, body)
+	}
+	if resp, body := s.callback(t, nil, state); resp.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("a callback without the cookie answered %d %q", resp.StatusCode, body)
+	}
+
+	cookie, state, _ = s.login(t)
+	s.claims["nonce"] = nonce
+	if resp, body := s.callback(t, cookie, state); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("an ID token with the nonce of another login answered %d %q", resp.StatusCode, body)
+	}
+
+	if count := s.userCount(); count != 0 {
+		t.Errorf("%d accounts were created", count)
+	}
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"goxcms/hooks"
+	"goxcms/model"
+	"goxcms/search"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// PersonalDataFunc returns what a plugin keeps about the user. It is added to
+// their data export as JSON.
+type PersonalDataFunc func(db *gorm.DB, user model.User) (interface{}, error)
+
+var (
+	personalDataMu        sync.RWMutex
+	personalDataProviders = map[string]PersonalDataFunc{}
+)
+
+// RegisterPersonalData lets a plugin add its data about a user to the export,
+// as name.json. Plugins that store user data should also remove it on the
+// hooks.UserDeleted action.
+func RegisterPersonalData(name string, fn PersonalDataFunc) {
+	personalDataMu.Lock()
+	defer personalDataMu.Unlock()
+	personalDataProviders[name] = fn
+}
+
+// UnregisterPersonalData removes a plugin from the export, for Teardown.
+func UnregisterPersonalData(name string) {
+	personalDataMu.Lock()
+	defer personalDataMu.Unlock()
+	delete(personalDataProviders, name)
+}
+
+func PrivacyPage(c *fiber.Ctx, db *gorm.DB) error {
+	return c.Render("account/privacy", fiber.Map{
+		"Title":      "Your Data",
+		"Cascade":    accountDeletionPolicy(db) == model.AccountDeletionCascade,
+		"IsLoggedIn": c.Locals("isLoggedin"),
+		"Settings":   c.Locals("Settings"),
+	}, "main")
+}
+
+// ExportPersonalData sends the user a ZIP of JSON files with their profile,
+// posts, comments, sessions and whatever the enabled plugins keep about them.
+func ExportPersonalData(c *fiber.Ctx, db *gorm.DB) error {
+	var user model.User
+	if err := db.Preload("Avatar").First(&user, currentUserID(c)).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).SendString("User not found")
+	}
+
+	var posts []model.Post
+	db.Preload("Categories").Preload("Tags").Where("user_id = ?", user.ID).Order("id").Find(&posts)
+	var comments []model.Comment
+	db.Where("user_id = ?", user.ID).Order("id").Find(&comments)
+	var sessions []model.UserSession
+	db.Where("user_id = ?", user.ID).Order("id").Find(&sessions)
+
+	files := map[string]interface{}{
+		"profile":  user,
+		"posts":    posts,
+		"comments": comments,
+		"sessions": sessions,
+	}
+
+	personalDataMu.RLock()
+	for name, fn := range personalDataProviders {
+		data, err := fn(db, user)
+		if err != nil {
+			personalDataMu.RUnlock()
+			log.Printf("Failed to export the %s data of user %d: %v", name, user.ID, err)
+			return c.Status(fiber.StatusInternalServerError).SendString("Failed to export your data")
+		}
+		files[name] = data
+	}
+	personalDataMu.RUnlock()
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+user.Username+`-data-`+now.Format("20060102")+`.zip"`)
+	c.Set("Cache-Control", "no-store")
+
+	archive := zip.NewWriter(c.Response().BodyWriter())
+	for _, name := range names {
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: name + ".json", Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(files[name]); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// DeleteAccount lets users delete their own account after confirming it with
+// their password.
+func DeleteAccount(c *fiber.Ctx, db *gorm.DB) error {
+	user := c.Locals("user").(model.User)
+	if !checkPassword(c, user) {
+		return ShowToastError(c, "Wrong password")
+	}
+
+	/// somebody has to be left to run the site
+	if LoadRole(db, user.RoleID).HasPermission(model.PermUserManage) {
+		managers := db.Table("role_permissions").
+			Select("role_permissions.role_id").
+			Joins("JOIN permissions ON permissions.id = role_permissions.permission_id").
+			Where("permissions.name = ?", model.PermUserManage)
+		var others int64
+		db.Model(&model.User{}).Where("id <> ? AND role_id IN (?)", user.ID, managers).Count(&others)
+		if others == 0 {
+			return ShowToastError(c, "You are the last user who can manage users, give the role to someone else first")
+		}
+	}
+
+	if err := DeleteUserAccount(db, user); err != nil {
+		log.Printf("Failed to delete the account of user %d: %v", user.ID, err)
+		return ShowToastError(c, "Failed to delete your account")
+	}
+
+	clearJWTCookie(c)
+	c.Set("HX-Redirect", "/")
+	return c.SendString("Account deleted")
+}
+
+func accountDeletionPolicy(db *gorm.DB) string {
+	var settings model.BasicWebsiteInfo
+	db.Select("account_deletion").First(&settings)
+	if settings.AccountDeletion == model.AccountDeletionCascade {
+		return model.AccountDeletionCascade
+	}
+	return model.AccountDeletionAnonymize
+}
+
+// DeleteUserAccount deletes the user with their logins, tokens and sessions.
+// Depending on the account deletion policy their posts and comments are
+// deleted too or kept with no author, so nothing points to the missing user.
+func DeleteUserAccount(db *gorm.DB, user model.User) error {
+	cascade := accountDeletionPolicy(db) == model.AccountDeletionCascade
+
+	var posts []model.Post
+	var comments []model.Comment
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if cascade {
+			if err := tx.Where("user_id = ?", user.ID).Find(&posts).Error; err != nil {
+				return err
+			}
+			postIDs := make([]uint, len(posts))
+			for i, post := range posts {
+				postIDs[i] = post.ID
+			}
+			/// the comments of others go with the posts they were written on
+			if err := tx.Where("user_id = ? OR post_id IN ?", user.ID, postIDs).Find(&comments).Error; err != nil {
+				return err
+			}
+
+			if len(postIDs) > 0 {
+				for _, table := range []string{"post_categories", "post_tags"} {
+					if err := tx.Exec("DELETE FROM "+table+" WHERE post_id IN ?", postIDs).Error; err != nil {
+						return err
+					}
+				}
+				if err := tx.Where("post_id IN ?", postIDs).Delete(&model.PostRevision{}).Error; err != nil {
+					return err
+				}
+				if err := tx.Delete(&model.Post{}, postIDs).Error; err != nil {
+					return err
+				}
+			}
+			if len(comments) > 0 {
+				/// replies of others to the deleted comments stay on the posts that stay
+				commentIDs := make([]uint, len(comments))
+				for i, comment := range comments {
+					commentIDs[i] = comment.ID
+				}
+				if err := tx.Model(&model.Comment{}).Where("parent_id IN ?", commentIDs).Update("parent_id", nil).Error; err != nil {
+					return err
+				}
+				if err := tx.Delete(&comments).Error; err != nil {
+					return err
+				}
+			}
+		} else {
+			if err := tx.Model(&model.Post{}).Where("user_id = ?", user.ID).Update("user_id", 0).Error; err != nil {
+				return err
+			}
+			/// the address the comments came from would point back to the user
+			if err := tx.Model(&model.Comment{}).Where("user_id = ?", user.ID).Updates(map[string]interface{}{"user_id": 0, "ip": ""}).Error; err != nil {
+				return err
+			}
+		}
+
+		/// revisions of posts and pages that stay keep their history without the author
+		for _, revision := range []interface{}{&model.PostRevision{}, &model.CustomPageRevision{}} {
+			if err := tx.Model(revision).Where("user_id = ?", user.ID).Update("user_id", 0).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Model(&model.Invitation{}).Where("user_id = ?", user.ID).Update("user_id", nil).Error; err != nil {
+			return err
+		}
+
+		for _, owned := range []interface{}{
+			&model.UserSession{}, &model.APIToken{}, &model.UserToken{}, &model.RecoveryCode{}, &model.UserIdentity{},
+		} {
+			if err := tx.Where("user_id = ?", user.ID).Delete(owned).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(&user).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, post := range posts {
+		search.SyncPost(db, post.ID)
+		hooks.DoAction(hooks.PostDeleted, post)
+	}
+	for _, comment := range comments {
+		hooks.DoAction(hooks.CommentDeleted, comment)
+	}
+	hooks.DoAction(hooks.UserDeleted, user)
+	return nil
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"goxcms/model"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const profilePostsPerPage = 5
+
+// UserProfilePage shows the public profile of a user with their published
+// posts. Private profiles are only shown to their owner and to user managers.
+func UserProfilePage(c *fiber.Ctx, db *gorm.DB) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return profileNotFound(c)
+	}
+
+	var user model.User
+	if err := db.Preload("Avatar").First(&user, id).Error; err != nil {
+		return profileNotFound(c)
+	}
+	if user.PrivateProfile && currentUserID(c) != user.ID && !HasPermission(c, model.PermUserManage) {
+		return profileNotFound(c)
+	}
+
+	pageNumber, err := strconv.Atoi(c.Params("page", "1"))
+	if err != nil || pageNumber < 1 {
+		pageNumber = 1
+	}
+
+	var totalPosts int64
+	db.Model(&model.Post{}).Scopes(model.PublishedPosts).Where("user_id = ?", user.ID).Count(&totalPosts)
+	totalPages := int(math.Ceil(float64(totalPosts) / float64(profilePostsPerPage)))
+
+	if totalPages > 0 && pageNumber > totalPages {
+		return c.Redirect("/user/" + strconv.FormatUint(id, 10))
+	}
+
+	var posts []model.Post
+	db.Scopes(model.PublishedPosts).
+		Where("user_id = ?", user.ID).
+		Order("created_at desc").
+		Limit(profilePostsPerPage).
+		Offset((pageNumber - 1) * profilePostsPerPage).
+		Find(&posts)
+
+	var totalPagesArray []int
+	for i := 1; i <= totalPages; i++ {
+		totalPagesArray = append(totalPagesArray, i)
+	}
+
+	return c.Render("user_profile", fiber.Map{
+		"Title":         user.DisplayName(),
+		"Profile":       user,
+		"IsOwnProfile":  currentUserID(c) == user.ID,
+		"Posts":         posts,
+		"PostCount":     totalPosts,
+		"TotalPages":    totalPagesArray,
+		"TotalPagesInt": totalPages,
+		"NextPage":      pageNumber + 1,
+		"PrevPage":      pageNumber - 1,
+		"CurrentPage":   pageNumber,
+		"IsAdmin":       c.Locals("isAdmin"),
+		"IsLoggedIn":    c.Locals("isLoggedin"),
+		"Settings":      c.Locals("Settings"),
+	}, "main")
+}
+
+func profileNotFound(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusNotFound).Render("404", fiber.Map{
+		"Title":    "404",
+		"Settings": c.Locals("Settings"),
+	}, "main")
+}
+
+// ProfilePage shows the form where users edit their own profile.
+func ProfilePage(c *fiber.Ctx, db *gorm.DB) error {
+	user := c.Locals("user").(model.User)
+
+	var files []model.File
+	db.Order("created_at desc").Find(&files)
+
+	avatarID := uint(0)
+	if user.AvatarFileID != nil {
+		avatarID = *user.AvatarFileID
+	}
+
+	return c.Render("account/profile", fiber.Map{
+		"Title":      "Profile",
+		"Profile":    user,
+		"Files":      files,
+		"AvatarID":   avatarID,
+		"IsLoggedIn": c.Locals("isLoggedin"),
+		"Settings":   c.Locals("Settings"),
+	}, "main")
+}
+
+func UpdateProfile(c *fiber.Ctx, db *gorm.DB) error {
+	var user model.User
+	if err := db.First(&user, currentUserID(c)).Error; err != nil {
+		return ShowToastError(c, "User not found")
+	}
+
+	user.FirstName = strings.TrimSpace(c.FormValue("first_name"))
+	user.LastName = strings.TrimSpace(c.FormValue("last_name"))
+	user.Bio = strings.TrimSpace(c.FormValue("bio"))
+	user.WebsiteURL = strings.TrimSpace(c.FormValue("website_url"))
+	user.TwitterURL = strings.TrimSpace(c.FormValue("twitter_url"))
+	user.GitHubURL = strings.TrimSpace(c.FormValue("github_url"))
+	user.LinkedInURL = strings.TrimSpace(c.FormValue("linkedin_url"))
+	user.PrivateProfile = c.FormValue("private_profile") == "on"
+
+	user.AvatarFileID = nil
+	if avatar := c.FormValue("avatar_file_id"); avatar != "" {
+		fileID, err := strconv.ParseUint(avatar, 10, 64)
+		var file model.File
+		if err != nil || db.First(&file, fileID).Error != nil {
+			return ShowToastError(c, "The avatar is not in the media library")
+		}
+		user.AvatarFileID = &file.ID
+	}
+
+	if err := validator.New().Struct(&user); err != nil {
+		return ShowToastError(c, FormatValidationError(err))
+	}
+
+	err := db.Model(&user).
+		Select("first_name", "last_name", "bio", "avatar_file_id", "website_url", "twitter_url", "git_hub_url", "linked_in_url", "private_profile").
+		Updates(&user).Error
+	if err != nil {
+		return ShowToastError(c, "Failed to save the profile")
+	}
+
+	return ShowToast(c, "Profile saved")
+}
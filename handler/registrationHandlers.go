@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"goxcms/mail"
+	"goxcms/model"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+var errAccountPending = errors.New("Your account is not active yet, it waits for email verification or the approval of an administrator")
+
+// registrationSettings returns the registration mode and the email domains
+// it allows.
+func registrationSettings(db *gorm.DB) (string, []string) {
+	var settings model.BasicWebsiteInfo
+	db.Select("registration_mode", "registration_domains").First(&settings)
+
+	mode := settings.RegistrationMode
+	if mode == "" {
+		mode = model.RegistrationOpen
+	}
+	return mode, parseDomains(settings.RegistrationDomains)
+}
+
+// parseDomains splits a list of domains separated by commas or spaces.
+func parseDomains(value string) []string {
+	var domains []string
+	for _, domain := range strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}) {
+		if domain = strings.TrimPrefix(domain, "@"); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+func emailDomainAllowed(email string, domains []string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range domains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// findInvitation returns the invitation if it is unused and not expired.
+func findInvitation(db *gorm.DB, token string) (model.Invitation, error) {
+	var invitation model.Invitation
+	if token == "" {
+		return invitation, errInvalidToken
+	}
+	err := db.Preload("Role").
+		Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashToken(token), time.Now()).
+		First(&invitation).Error
+	if err != nil {
+		return invitation, errInvalidToken
+	}
+	return invitation, nil
+}
+
+func RegisterPage(c *fiber.Ctx, db *gorm.DB) error {
+	if c.Locals("isLoggedin") == true {
+		return c.Redirect("/")
+	}
+
+	mode, domains := registrationSettings(db)
+
+	token := c.Query("invite")
+	var invitation *model.Invitation
+	if found, err := findInvitation(db, token); err == nil {
+		invitation = &found
+	}
+
+	return c.Render("register", fiber.Map{
+		"Title":         "Register",
+		"Mode":          mode,
+		"Domains":       strings.Join(domains, ", "),
+		"Invitation":    invitation,
+		"InviteToken":   token,
+		"InvalidInvite": token != "" && invitation == nil,
+		"Settings":      c.Locals("Settings"),
+	}, "main")
+}
+
+// SearchRegistrations lists the accounts waiting for approval and the
+// invitations.
+func SearchRegistrations(c *fiber.Ctx, db *gorm.DB) error {
+	var pending []model.User
+	db.Where("pending_approval = ?", true).Order("created_at asc").Find(&pending)
+
+	var invitations []model.Invitation
+	db.Preload("Role").Order("created_at desc").Limit(50).Find(&invitations)
+
+	/// only those who manage roles can invite with another role than the default one
+	var roles []model.Role
+	if HasPermission(c, model.PermRoleManage) {
+		db.Order("id asc").Find(&roles)
+	}
+
+	mode, _ := registrationSettings(db)
+
+	return c.Render("admin/table/registration-table", fiber.Map{
+		"Pending":       pending,
+		"Invitations":   invitations,
+		"Roles":         roles,
+		"DefaultRoleID": model.RoleUserID,
+		"Days":          viper.GetInt("mail.invitation_days"),
+		"Mode":          mode,
+	})
+}
+
+func CreateInvitation(c *fiber.Ctx, db *gorm.DB) error {
+	email := strings.TrimSpace(c.FormValue("email"))
+	if validator.New().Var(email, "required,email") != nil {
+		return ShowToastError(c, "Please enter a valid email address")
+	}
+	if db.Where("LOWER(email) = ?", strings.ToLower(email)).First(&model.User{}).Error == nil {
+		return ShowToastError(c, "An account with this email address already exists")
+	}
+
+	var role model.Role
+	roleID, err := strconv.ParseUint(c.FormValue("role_id", strconv.FormatUint(uint64(model.RoleUserID), 10)), 10, 64)
+	if err != nil || db.First(&role, roleID).Error != nil {
+		return ShowToastError(c, "Role not found")
+	}
+	if role.ID != model.RoleUserID && !HasPermission(c, model.PermRoleManage) {
+		return ShowToastError(c, "You are not allowed to assign roles")
+	}
+
+	days, err := strconv.Atoi(c.FormValue("days"))
+	if err != nil || days < 1 || days > 90 {
+		days = viper.GetInt("mail.invitation_days")
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return ShowToastError(c, "Failed to create the invitation")
+	}
+	token := hex.EncodeToString(secret)
+
+	invitation := model.Invitation{
+		Email:     email,
+		RoleID:    role.ID,
+		TokenHash: hashToken(token),
+		InvitedBy: c.Locals("user").(model.User).Username,
+		ExpiresAt: time.Now().AddDate(0, 0, days),
+	}
+	if err := db.Create(&invitation).Error; err != nil {
+		return ShowToastError(c, "Failed to create the invitation")
+	}
+	Audit(c, db, "invitation.create", "invitation", invitation.ID, nil, invitation)
+
+	mail.Queue(email, "You are invited to "+siteName(c), "invitation", map[string]interface{}{
+		"SiteName":  siteName(c),
+		"InvitedBy": invitation.InvitedBy,
+		"Role":      role.Name,
+		"Link":      emailLink("/register", url.Values{"invite": {token}}),
+		"Days":      days,
+	})
+
+	return ShowToast(c, "Invitation sent to "+email)
+}
+
+func DeleteInvitation(c *fiber.Ctx, db *gorm.DB) error {
+	id, err := c.ParamsInt("id")
+	var invitation model.Invitation
+	if err != nil || db.First(&invitation, id).Error != nil {
+		return ShowToastError(c, "Invitation not found")
+	}
+
+	if err := db.Delete(&invitation).Error; err != nil {
+		return ShowToastError(c, "Failed to withdraw the invitation")
+	}
+	Audit(c, db, "invitation.delete", "invitation", invitation.ID, invitation, nil)
+
+	ShowToast(c, "Invitation for "+invitation.Email+" withdrawn")
+	return c.SendString("")
+}
+
+// findPendingUser loads the account of the request that waits for approval.
+func findPendingUser(c *fiber.Ctx, db *gorm.DB) (model.User, bool) {
+	var user model.User
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return user, false
+	}
+	err = db.Where("pending_approval = ?", true).First(&user, id).Error
+	return user, err == nil
+}
+
+func ApproveUser(c *fiber.Ctx, db *gorm.DB) error {
+	user, ok := findPendingUser(c, db)
+	if !ok {
+		return ShowToastError(c, "No account waiting for approval")
+	}
+	before := user
+
+	if err := db.Model(&user).Update("pending_approval", false).Error; err != nil {
+		return ShowToastError(c, "Failed to approve the account")
+	}
+	Audit(c, db, "user.approve", "user", user.ID, before, user)
+
+	if user.Email != nil {
+		mail.Queue(*user.Email, "Your account has been approved", "account_approved", map[string]interface{}{
+			"SiteName": siteName(c),
+			"User":     user,
+			"Link":     absoluteURL("/login"),
+		})
+	}
+
+	ShowToast(c, user.Username+" can log in now")
+	return c.SendString("")
+}
+
+// RejectUser deletes an account that waits for approval.
+func RejectUser(c *fiber.Ctx, db *gorm.DB) error {
+	user, ok := findPendingUser(c, db)
+	if !ok {
+		return ShowToastError(c, "No account waiting for approval")
+	}
+
+	if err := DeleteUserAccount(db, user); err != nil {
+		return ShowToastError(c, "Failed to reject the account")
+	}
+	Audit(c, db, "user.reject", "user", user.ID, user, nil)
+
+	ShowToast(c, "Account of "+user.Username+" rejected")
+	return c.SendString("")
+}
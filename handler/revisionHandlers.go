@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"goxcms/hooks"
+	"goxcms/model"
+	"goxcms/search"
+	"goxcms/utils"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// revisionListItem is what the revisions page shows for post and page revisions alike.
+type revisionListItem struct {
+	ID        uint
+	Title     string
+	Slug      string
+	Note      string
+	Author    string
+	CreatedAt time.Time
+}
+
+// revisionField is a single non-content field compared between two revisions.
+type revisionField struct {
+	Name    string
+	Old     string
+	New     string
+	Changed bool
+}
+
+func currentUserID(c *fiber.Ctx) uint {
+	if user, ok := c.Locals("user").(model.User); ok {
+		return user.ID
+	}
+	return 0
+}
+
+// savePostRevision stores a snapshot of the post. The post must have its
+// categories and tags loaded.
+func savePostRevision(tx *gorm.DB, c *fiber.Ctx, post model.Post, note string) error {
+	revision := model.NewPostRevision(post, currentUserID(c), note)
+	return tx.Create(&revision).Error
+}
+
+// saveCustomPageRevision stores a snapshot of the custom page.
+func saveCustomPageRevision(tx *gorm.DB, c *fiber.Ctx, page model.CustomPage, note string) error {
+	revision := model.NewCustomPageRevision(page, currentUserID(c), note)
+	return tx.Create(&revision).Error
+}
+
+// canManageRevisions checks that the current user may edit the post or page the revisions belong to.
+func canManageRevisions(c *fiber.Ctx, db *gorm.DB, kind string, id int) bool {
+	switch kind {
+	case "post":
+		var post model.Post
+		db.First(&post, id)
+		return canEditPost(c, post)
+	case "page":
+		return HasPermission(c, model.PermPageManage)
+	}
+	return false
+}
+
+func authorName(user model.User) string {
+	if user.ID == 0 {
+		return "Unknown"
+	}
+	return user.Username
+}
+
+func ListRevisions(c *fiber.Ctx, db *gorm.DB) error {
+	kind := c.Params("kind")
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	if !canManageRevisions(c, db, kind, id) {
+		return c.Redirect("/")
+	}
+
+	var items []revisionListItem
+	var title, backURL string
+
+	switch kind {
+	case "post":
+		var post model.Post
+		db.First(&post, id)
+		title, backURL = post.Title, "/admin/post/edit/"+strconv.Itoa(id)
+
+		var revisions []model.PostRevision
+		db.Preload("User").Where("post_id = ?", id).Order("id desc").Find(&revisions)
+		for _, r := range revisions {
+			items = append(items, revisionListItem{ID: r.ID, Title: r.Title, Slug: r.Slug, Note: r.Note, Author: authorName(r.User), CreatedAt: r.CreatedAt})
+		}
+	case "page":
+		var page model.CustomPage
+		db.First(&page, id)
+		title, backURL = page.Title, "/edit-custompage/"+strconv.Itoa(id)
+
+		var revisions []model.CustomPageRevision
+		db.Preload("User").Where("custom_page_id = ?", id).Order("id desc").Find(&revisions)
+		for _, r := range revisions {
+			items = append(items, revisionListItem{ID: r.ID, Title: r.Title, Slug: r.Slug, Note: r.Note, Author: authorName(r.User), CreatedAt: r.CreatedAt})
+		}
+	}
+
+	return c.Render("admin/revisions", fiber.Map{
+		"Title":      "Revisions - " + title,
+		"ItemTitle":  title,
+		"Kind":       kind,
+		"ItemID":     id,
+		"BackURL":    backURL,
+		"Revisions":  items,
+		"IsAdmin":    c.Locals("isAdmin"),
+		"IsLoggedIn": c.Locals("isLoggedin"),
+		"Settings":   c.Locals("Settings"),
+	}, "main")
+}
+
+func RevisionDiff(c *fiber.Ctx, db *gorm.DB) error {
+	kind := c.Params("kind")
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	if !canManageRevisions(c, db, kind, id) {
+		return c.Status(fiber.StatusForbidden).SendString("Forbidden")
+	}
+
+	fromID, toID := c.QueryInt("from"), c.QueryInt("to")
+	if fromID == 0 || toID == 0 {
+		return c.SendString("<div class='alert alert-info'>Select two revisions to compare</div>")
+	}
+
+	var fields []revisionField
+	var oldContent, newContent string
+
+	switch kind {
+	case "post":
+		var from, to model.PostRevision
+		if db.Where("post_id = ?", id).First(&from, fromID).Error != nil || db.Where("post_id = ?", id).First(&to, toID).Error != nil {
+			return c.Status(fiber.StatusNotFound).SendString("Revision not found")
+		}
+		fields = []revisionField{
+			newRevisionField("Title", from.Title, to.Title),
+			newRevisionField("Slug", from.Slug, to.Slug),
+			newRevisionField("Image", from.ImageURL, to.ImageURL),
+			newRevisionField("Categories", joinTerms(from.CategoryTerms()), joinTerms(to.CategoryTerms())),
+			newRevisionField("Tags", joinTerms(from.TagTerms()), joinTerms(to.TagTerms())),
+		}
+		oldContent, newContent = from.Content, to.Content
+	case "page":
+		var from, to model.CustomPageRevision
+		if db.Where("custom_page_id = ?", id).First(&from, fromID).Error != nil || db.Where("custom_page_id = ?", id).First(&to, toID).Error != nil {
+			return c.Status(fiber.StatusNotFound).SendString("Revision not found")
+		}
+		fields = []revisionField{
+			newRevisionField("Title", from.Title, to.Title),
+			newRevisionField("Slug", from.Slug, to.Slug),
+			newRevisionField("Template", from.Template, to.Template),
+		}
+		oldContent, newContent = from.Content, to.Content
+	default:
+		return c.Status(fiber.StatusNotFound).SendString("Unknown revision type")
+	}
+
+	return c.Render("admin/revision-diff", fiber.Map{
+		"FromID": fromID,
+		"ToID":   toID,
+		"Fields": fields,
+		"Lines":  utils.DiffLines(oldContent, newContent),
+	})
+}
+
+func RestoreRevision(c *fiber.Ctx, db *gorm.DB) error {
+	kind := c.Params("kind")
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+	revisionID, err := c.ParamsInt("revision_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	if !canManageRevisions(c, db, kind, id) {
+		return c.Status(fiber.StatusForbidden).SendString("Forbidden")
+	}
+
+	note := "Restored revision #" + strconv.Itoa(revisionID)
+
+	switch kind {
+	case "post":
+		before, post, err := restorePostRevision(c, db, id, revisionID, note)
+		if err != nil {
+			return ShowToastError(c, "Restore failed: "+err.Error())
+		}
+		search.SyncPost(db, post.ID)
+		hooks.DoAction(hooks.PostUpdated, post)
+		Audit(c, db, "post.restore", "post", post.ID, before, post)
+	case "page":
+		before, page, err := restoreCustomPageRevision(c, db, id, revisionID, note)
+		if err != nil {
+			return ShowToastError(c, "Restore failed: "+err.Error())
+		}
+		search.SyncPage(db, page.ID)
+		Audit(c, db, "page.restore", "page", page.ID, before, page)
+	default:
+		return c.Status(fiber.StatusNotFound).SendString("Unknown revision type")
+	}
+
+	c.Set("HX-Refresh", "true")
+	return ShowToast(c, note)
+}
+
+// restorePostRevision returns the post before the restore and as the
+// revision left it.
+func restorePostRevision(c *fiber.Ctx, db *gorm.DB, postID, revisionID int, note string) (model.Post, model.Post, error) {
+	var before, post model.Post
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var revision model.PostRevision
+		if err := tx.Where("post_id = ?", postID).First(&revision, revisionID).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Preload("Categories").Preload("Tags").First(&post, postID).Error; err != nil {
+			return err
+		}
+		before = post
+
+		/// only restore the slug when no other post took it in the meantime
+		var slugTaken int64
+		tx.Model(&model.Post{}).Where("slug = ? AND id != ?", revision.Slug, post.ID).Count(&slugTaken)
+		if slugTaken == 0 {
+			post.Slug = revision.Slug
+		}
+
+		post.Title = revision.Title
+		post.Content = revision.Content
+		post.ImageURL = revision.ImageURL
+
+		var categories []model.Category
+		if ids := termIDs(revision.CategoryTerms()); len(ids) > 0 {
+			tx.Find(&categories, ids)
+		}
+
+		var tags []model.Tag
+		if ids := termIDs(revision.TagTerms()); len(ids) > 0 {
+			tx.Find(&tags, ids)
+		}
+
+		if err := tx.Omit("Categories", "Tags").Save(&post).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&post).Association("Categories").Replace(categories); err != nil {
+			return err
+		}
+		if err := tx.Model(&post).Association("Tags").Replace(tags); err != nil {
+			return err
+		}
+
+		post.Categories, post.Tags = categories, tags
+		return savePostRevision(tx, c, post, note)
+	})
+	return before, post, err
+}
+
+// restoreCustomPageRevision returns the page before the restore and as the
+// revision left it.
+func restoreCustomPageRevision(c *fiber.Ctx, db *gorm.DB, pageID, revisionID int, note string) (model.CustomPage, model.CustomPage, error) {
+	var before, page model.CustomPage
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var revision model.CustomPageRevision
+		if err := tx.Where("custom_page_id = ?", pageID).First(&revision, revisionID).Error; err != nil {
+			return err
+		}
+
+		if err := tx.First(&page, pageID).Error; err != nil {
+			return err
+		}
+		before = page
+
+		var slugTaken int64
+		tx.Model(&model.CustomPage{}).Where("slug = ? AND id != ?", revision.Slug, page.ID).Count(&slugTaken)
+		if slugTaken == 0 {
+			page.Slug = revision.Slug
+		}
+
+		page.Title = revision.Title
+		page.Content = revision.Content
+		page.Template = revision.Template
+
+		if err := tx.Save(&page).Error; err != nil {
+			return err
+		}
+
+		return saveCustomPageRevision(tx, c, page, note)
+	})
+	return before, page, err
+}
+
+func newRevisionField(name, oldValue, newValue string) revisionField {
+	return revisionField{Name: name, Old: oldValue, New: newValue, Changed: oldValue != newValue}
+}
+
+func joinTerms(terms []model.RevisionTerm) string {
+	names := make([]string, 0, len(terms))
+	for _, term := range terms {
+		names = append(names, term.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func termIDs(terms []model.RevisionTerm) []uint {
+	ids := make([]uint, 0, len(terms))
+	for _, term := range terms {
+		ids = append(ids, term.ID)
+	}
+	return ids
+}
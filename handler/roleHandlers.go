@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"goxcms/model"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// LoadRole fetches a role together with its permissions. An unknown role ID
+// returns an empty role that grants nothing.
+func LoadRole(db *gorm.DB, roleID uint) model.Role {
+	var role model.Role
+	db.Preload("Permissions").First(&role, roleID)
+	return role
+}
+
+// HasPermission reports whether the current request's user holds the permission.
+func HasPermission(c *fiber.Ctx, permission string) bool {
+	permissions, ok := c.Locals("permissions").(map[string]bool)
+	if !ok {
+		return false
+	}
+	return permissions[permission]
+}
+
+// RequirePermission only lets the request through when the logged in user's
+// role grants the given permission.
+func RequirePermission(permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Locals("isLoggedin") != true {
+			return c.Status(fiber.StatusUnauthorized).Redirect("/login")
+		}
+
+		if !HasPermission(c, permission) {
+			ShowToastError(c, "You do not have permission to do that ("+permission+")")
+			return c.Status(fiber.StatusForbidden).SendString("Forbidden")
+		}
+
+		if c.Locals("twoFactorSetupRequired") == true {
+			return redirectToTwoFactorSetup(c)
+		}
+
+		return c.Next()
+	}
+}
+
+func SearchRoles(c *fiber.Ctx, db *gorm.DB) error {
+	var roles []model.Role
+	db.Preload("Permissions").Order("id asc").Find(&roles)
+
+	var permissions []model.Permission
+	db.Order("name asc").Find(&permissions)
+
+	/// map of "roleID:permission" so the template can tick the checkboxes
+	granted := make(map[string]bool)
+	for _, role := range roles {
+		for _, permission := range role.Permissions {
+			granted[strconv.Itoa(int(role.ID))+":"+permission.Name] = true
+		}
+	}
+
+	userCounts := make(map[uint]int64)
+	for _, role := range roles {
+		var count int64
+		db.Model(&model.User{}).Where("role_id = ?", role.ID).Count(&count)
+		userCounts[role.ID] = count
+	}
+
+	return c.Render("admin/table/role-table", fiber.Map{
+		"Roles":       roles,
+		"Permissions": permissions,
+		"Granted":     granted,
+		"UserCounts":  userCounts,
+	})
+}
+
+func AddRole(c *fiber.Ctx, db *gorm.DB) error {
+	name := strings.TrimSpace(c.FormValue("role_name"))
+	if name == "" {
+		return ShowToastError(c, "Role name is required")
+	}
+
+	var existing model.Role
+	if err := db.Where("name = ?", name).First(&existing).Error; err == nil {
+		return ShowToastError(c, "Role "+name+" already exists")
+	}
+
+	role := model.Role{Name: name}
+	if err := db.Create(&role).Error; err != nil {
+		return ShowToastError(c, "Error creating role: "+err.Error())
+	}
+	Audit(c, db, "role.create", "role", role.ID, nil, role)
+
+	return ShowToast(c, "Role added successfully")
+}
+
+func DeleteRole(c *fiber.Ctx, db *gorm.DB) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	if uint(id) == model.RoleUserID || uint(id) == model.RoleAdminID {
+		return ShowToastError(c, "Built-in roles cannot be deleted")
+	}
+
+	role := LoadRole(db, uint(id))
+	if role.ID == 0 {
+		return ShowToastError(c, "Role not found")
+	}
+
+	before := role
+
+	tx := db.Begin()
+
+	/// users of a deleted role fall back to the default user role
+	if err := tx.Model(&model.User{}).Where("role_id = ?", role.ID).Update("role_id", model.RoleUserID).Error; err != nil {
+		tx.Rollback()
+		return ShowToastError(c, "Error reassigning users")
+	}
+
+	if err := tx.Model(&role).Association("Permissions").Clear(); err != nil {
+		tx.Rollback()
+		return ShowToastError(c, "Error removing role permissions")
+	}
+
+	if err := tx.Delete(&role).Error; err != nil {
+		tx.Rollback()
+		return ShowToastError(c, "Error deleting role")
+	}
+
+	tx.Commit()
+	Audit(c, db, "role.delete", "role", role.ID, before, nil)
+
+	return ShowToast(c, "Role "+role.Name+" deleted, its users now have the "+model.RoleUser+" role")
+}
+
+func ToggleRolePermission(c *fiber.Ctx, db *gorm.DB) error {
+	roleID, err := strconv.Atoi(c.FormValue("role_id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid role ID")
+	}
+	permissionName := c.FormValue("permission")
+
+	role := LoadRole(db, uint(roleID))
+	if role.ID == 0 {
+		return ShowToastError(c, "Role not found")
+	}
+
+	var permission model.Permission
+	if err := db.Where("name = ?", permissionName).First(&permission).Error; err != nil {
+		return ShowToastError(c, "Permission not found")
+	}
+
+	before := role
+
+	if role.HasPermission(permission.Name) {
+		/// keep at least one role able to get back into the role screen
+		if role.ID == model.RoleAdminID && (permission.Name == model.PermAdminAccess || permission.Name == model.PermRoleManage) {
+			ShowToastError(c, "The "+permission.Name+" permission cannot be removed from the "+model.RoleAdmin+" role")
+			return c.SendString(rolePermissionCheckbox(role.ID, permission.Name, true))
+		}
+
+		if err := db.Model(&role).Association("Permissions").Delete(&permission); err != nil {
+			return ShowToastError(c, "Error updating role: "+err.Error())
+		}
+		Audit(c, db, "role.revoke", "role", role.ID, before, LoadRole(db, role.ID))
+		ShowToast(c, "Removed "+permission.Name+" from "+role.Name)
+		return c.SendString(rolePermissionCheckbox(role.ID, permission.Name, false))
+	}
+
+	if err := db.Model(&role).Association("Permissions").Append(&permission); err != nil {
+		return ShowToastError(c, "Error updating role: "+err.Error())
+	}
+	Audit(c, db, "role.grant", "role", role.ID, before, LoadRole(db, role.ID))
+	ShowToast(c, "Granted "+permission.Name+" to "+role.Name)
+	return c.SendString(rolePermissionCheckbox(role.ID, permission.Name, true))
+}
+
+func rolePermissionCheckbox(roleID uint, permission string, checked bool) string {
+	id := strconv.Itoa(int(roleID))
+	checkedAttr := ""
+	if checked {
+		checkedAttr = " checked"
+	}
+
+	return `<input class="form-check-input" type="checkbox"` + checkedAttr + `
+		hx-post="/toggle-role-permission" hx-vals='{"role_id": "` + id + `", "permission": "` + permission + `"}'
+		hx-swap="outerHTML" hx-headers='{"X-No-Cache": "true"}'>`
+}
+
+func SetUserRole(c *fiber.Ctx, db *gorm.DB) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	roleID, err := strconv.Atoi(c.FormValue("role_id"))
+	if err != nil {
+		return ShowToastError(c, "Invalid role")
+	}
+
+	currentUser := c.Locals("user").(model.User)
+	if currentUser.ID == uint(id) {
+		return ShowToastError(c, "You cannot change your own role")
+	}
+
+	var role model.Role
+	if err := db.First(&role, roleID).Error; err != nil {
+		return ShowToastError(c, "Role not found")
+	}
+
+	var user model.User
+	if err := db.First(&user, id).Error; err != nil {
+		return ShowToastError(c, "User not found")
+	}
+	before := user
+
+	if err := db.Model(&user).Update("role_id", role.ID).Error; err != nil {
+		return ShowToastError(c, "Error updating user role")
+	}
+	Audit(c, db, "user.role", "user", user.ID, before, user)
+
+	return ShowToast(c, "User role changed to "+role.Name)
+}
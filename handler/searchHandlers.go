@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"goxcms/search"
+	"math"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func SearchPage(c *fiber.Ctx, db *gorm.DB) error {
+	query := strings.TrimSpace(c.Query("q"))
+	page := c.QueryInt("page", 1)
+	if page < 1 {
+		page = 1
+	}
+	perPage := 10
+
+	var results search.Results
+	var searchError string
+
+	if query != "" {
+		var err error
+		results, err = search.Search(query, page, perPage)
+		if err != nil {
+			searchError = err.Error()
+		}
+	}
+
+	totalPages := int(math.Ceil(float64(results.Total) / float64(perPage)))
+
+	var totalPagesArray []int
+	for i := 1; i <= totalPages; i++ {
+		totalPagesArray = append(totalPagesArray, i)
+	}
+
+	return c.Render("search", fiber.Map{
+		"Title":         "Search",
+		"Query":         query,
+		"Results":       results.Hits,
+		"Total":         results.Total,
+		"Error":         searchError,
+		"TotalPages":    totalPagesArray,
+		"TotalPagesInt": totalPages,
+		"CurrentPage":   page,
+		"PrevPage":      page - 1,
+		"NextPage":      page + 1,
+		"IsAdmin":       c.Locals("isAdmin"),
+		"IsLoggedIn":    c.Locals("isLoggedin"),
+		"Settings":      c.Locals("Settings"),
+	}, "main")
+}
+
+func RebuildSearchIndex(c *fiber.Ctx, db *gorm.DB) error {
+	if err := search.Rebuild(db); err != nil {
+		return ShowToastError(c, "Error rebuilding search index: "+err.Error())
+	}
+	Audit(c, db, "search.rebuild", "search", nil, nil, nil)
+	return ShowToast(c, "Search index rebuilt")
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"fmt"
+	"goxcms/hooks"
+	"goxcms/model"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// loginCounter is one of the two things failed logins are counted for.
+type loginCounter struct {
+	key       string
+	value     string
+	lockAfter int
+	throttled string // security event types
+	locked    string
+}
+
+func loginThrottleEnabled() bool {
+	return viper.GetBool("login_throttle.enabled")
+}
+
+func loginUserKey(username string) string {
+	return "login:user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+func loginIPKey(ip string) string {
+	return "login:ip:" + ip
+}
+
+func loginCounters(username, ip string) []loginCounter {
+	return []loginCounter{
+		{loginUserKey(username), username, viper.GetInt("login_throttle.lockout_attempts"), model.SecurityUserThrottled, model.SecurityUserLocked},
+		{loginIPKey(ip), ip, viper.GetInt("login_throttle.ip_lockout_attempts"), model.SecurityIPThrottled, model.SecurityIPLocked},
+	}
+}
+
+func readLoginAttempts(db *gorm.DB, key string) model.LoginAttempt {
+	var attempts model.LoginAttempt
+	db.Where("login_key = ? AND expires_at > ?", key, time.Now().Unix()).Limit(1).Find(&attempts)
+	return attempts
+}
+
+// loginWait returns how long a login for the username from the IP address
+// has to wait, and whether the wait is a lockout rather than the backoff.
+func loginWait(db *gorm.DB, username, ip string) (time.Duration, bool) {
+	if !loginThrottleEnabled() {
+		return 0, false
+	}
+
+	now := time.Now().Unix()
+	var wait int64
+	locked := false
+	for _, counter := range loginCounters(username, ip) {
+		attempts := readLoginAttempts(db, counter.key)
+		until := attempts.NextAttempt
+		if attempts.LockedUntil > now {
+			until = attempts.LockedUntil
+			locked = true
+		}
+		if until-now > wait {
+			wait = until - now
+		}
+	}
+	return time.Duration(wait) * time.Second, locked
+}
+
+// recordLoginFailure counts a failed login for the username and the IP
+// address. After login_throttle.free_attempts failures every further login
+// waits twice as long as the one before, and at the lockout threshold the
+// username or address is locked for login_throttle.lockout_minutes.
+//
+// Every change is a single statement in the database, so failed logins that
+// arrive at the same time, in one process or several, are all counted and
+// each event is recorded once.
+func recordLoginFailure(db *gorm.DB, username, ip string) {
+	if !loginThrottleEnabled() {
+		return
+	}
+
+	now := time.Now().Unix()
+	free := viper.GetInt("login_throttle.free_attempts")
+	baseDelay := int64(viper.GetInt("login_throttle.base_delay_seconds"))
+	maxDelay := int64(viper.GetInt("login_throttle.max_delay_seconds"))
+	lockout := int64(viper.GetInt("login_throttle.lockout_minutes")) * 60
+	window := int64(viper.GetInt("login_throttle.window_minutes")) * 60
+
+	/// counts whose window has passed or whose lockout has been served start over
+	db.Where("expires_at <= ? OR (locked_until > 0 AND locked_until <= ?)", now, now).Delete(&model.LoginAttempt{})
+
+	for _, counter := range loginCounters(username, ip) {
+		/// the counter lives until the window has passed after the last failure or the lockout
+		err := db.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "login_key"}},
+			DoUpdates: clause.Set{
+				{Column: clause.Column{Name: "failures"}, Value: gorm.Expr("login_attempts.failures + 1")},
+				{Column: clause.Column{Name: "expires_at"}, Value: gorm.Expr("CASE WHEN login_attempts.expires_at > ? THEN login_attempts.expires_at ELSE ? END", now+window, now+window)},
+			},
+		}).Create(&model.LoginAttempt{Key: counter.key, Failures: 1, ExpiresAt: now + window}).Error
+		if err != nil {
+			log.Printf("Failed to count the failed login for %s: %v", counter.value, err)
+			continue
+		}
+		attempts := readLoginAttempts(db, counter.key)
+		row := db.Model(&model.LoginAttempt{}).Where("login_key = ?", counter.key)
+
+		if over := attempts.Failures - free; over > 0 {
+			delay := maxDelay
+			if over <= 30 && baseDelay<<(over-1) < maxDelay {
+				delay = baseDelay << (over - 1)
+			}
+			/// only the request that starts the backoff records it, the others just move the next attempt later
+			if row.Session(&gorm.Session{}).Where("next_attempt = 0").Update("next_attempt", now+delay).RowsAffected == 1 {
+				recordSecurityEvent(db, counter.throttled, username, ip,
+					fmt.Sprintf("%d failed logins for %s, further logins are slowed down", attempts.Failures, counter.value))
+			} else {
+				row.Session(&gorm.Session{}).Where("next_attempt < ?", now+delay).Update("next_attempt", now+delay)
+			}
+		}
+
+		if counter.lockAfter > 0 && attempts.Failures >= counter.lockAfter {
+			expires := now + window
+			if now+lockout > expires {
+				expires = now + lockout
+			}
+			locked := row.Session(&gorm.Session{}).Where("locked_until = 0").Updates(map[string]interface{}{"locked_until": now + lockout, "expires_at": expires})
+			if locked.RowsAffected == 1 {
+				recordSecurityEvent(db, counter.locked, username, ip,
+					fmt.Sprintf("%d failed logins for %s, locked for %d minutes", attempts.Failures, counter.value, lockout/60))
+			}
+		}
+	}
+}
+
+// clearLoginFailures forgets the failed logins of the username once its
+// owner has logged in. The count of the IP address stays, so an attacker
+// cannot reset it by logging into an account of their own.
+func clearLoginFailures(db *gorm.DB, username string) {
+	db.Where("login_key = ?", loginUserKey(username)).Delete(&model.LoginAttempt{})
+}
+
+// loginThrottled answers a login that has to wait.
+func loginThrottled(c *fiber.Ctx, wait time.Duration, locked bool) error {
+	message := "Too many failed logins, please try again in " + waitText(wait)
+	if locked {
+		message = "Too many failed logins, login is locked for " + waitText(wait)
+	}
+
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	ShowToastError(c, message)
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": message})
+}
+
+func waitText(wait time.Duration) string {
+	if wait < time.Minute {
+		seconds := int(math.Ceil(wait.Seconds()))
+		if seconds == 1 {
+			return "1 second"
+		}
+		return strconv.Itoa(seconds) + " seconds"
+	}
+	minutes := int(math.Ceil(wait.Minutes()))
+	if minutes == 1 {
+		return "1 minute"
+	}
+	return strconv.Itoa(minutes) + " minutes"
+}
+
+// recordSecurityEvent stores the event, writes it to the log and tells the
+// plugins.
+func recordSecurityEvent(db *gorm.DB, eventType, username, ip, details string) {
+	event := model.SecurityEvent{
+		Type:     eventType,
+		Username: username,
+		IP:       ip,
+		Details:  details,
+	}
+	if err := db.Create(&event).Error; err != nil {
+		log.Printf("Failed to record the security event %s: %v", eventType, err)
+	}
+	log.Printf("Security event %s: %s", eventType, details)
+
+	hooks.DoAction(hooks.SecurityEvent, event)
+}
+
+func SearchSecurityEvents(c *fiber.Ctx, db *gorm.DB) error {
+	var events []model.SecurityEvent
+	searchQuery := c.Query("query")
+	eventType := c.Query("type")
+	pageSize := 20
+
+	pageInt, err := strconv.Atoi(c.Query("page", "1"))
+	if err != nil || pageInt < 1 {
+		pageInt = 1
+	}
+
+	query := db.Model(&model.SecurityEvent{}).
+		Where("username LIKE ? OR ip LIKE ?", "%"+searchQuery+"%", "%"+searchQuery+"%")
+	if eventType != "" {
+		query = query.Where("type = ?", eventType)
+	}
+
+	var count int64
+	query.Count(&count)
+	totalPages := int(math.Ceil(float64(count) / float64(pageSize)))
+	if totalPages < 1 {
+		totalPages = 1
+	}
+
+	query.Order("created_at desc").
+		Limit(pageSize).
+		Offset((pageInt - 1) * pageSize).
+		Find(&events)
+
+	return c.Render("admin/table/security-event-table", fiber.Map{
+		"Events":      events,
+		"TotalPages":  totalPages,
+		"CurrentPage": pageInt,
+		"SearchQuery": searchQuery,
+		"Type":        eventType,
+		"Types": []string{
+			model.SecurityUserThrottled, model.SecurityIPThrottled,
+			model.SecurityUserLocked, model.SecurityIPLocked,
+			model.SecurityLoginUnlocked,
+		},
+	})
+}
+
+// unlockLogin lifts the backoff and lockout of a username or an IP address.
+func unlockLogin(c *fiber.Ctx, db *gorm.DB, key, username, ip, what string) error {
+	if err := db.Where("login_key = ?", key).Delete(&model.LoginAttempt{}).Error; err != nil {
+		return ShowToastError(c, "Failed to unlock "+what)
+	}
+
+	admin := c.Locals("user").(model.User)
+	recordSecurityEvent(db, model.SecurityLoginUnlocked, username, ip, what+" unlocked by "+admin.Username)
+	if username != "" {
+		Audit(c, db, "login.unlock", "username", username, nil, nil)
+	} else {
+		Audit(c, db, "login.unlock", "ip", ip, nil, nil)
+	}
+
+	return ShowToast(c, what+" can log in again")
+}
+
+// UnlockLogin unlocks the username or IP address of a security event.
+func UnlockLogin(c *fiber.Ctx, db *gorm.DB) error {
+	value := strings.TrimSpace(c.FormValue("value"))
+	if value == "" {
+		return ShowToastError(c, "Nothing to unlock")
+	}
+
+	switch c.FormValue("kind") {
+	case "username":
+		return unlockLogin(c, db, loginUserKey(value), value, "", value)
+	case "ip":
+		return unlockLogin(c, db, loginIPKey(value), "", value, value)
+	}
+	return ShowToastError(c, "Nothing to unlock")
+}
+
+// UnlockUser unlocks the username of a user from the user table.
+func UnlockUser(c *fiber.Ctx, db *gorm.DB) error {
+	var user model.User
+	if err := db.First(&user, c.Params("id")).Error; err != nil {
+		return ShowToastError(c, "User not found")
+	}
+	return unlockLogin(c, db, loginUserKey(user.Username), user.Username, "", user.Username)
+}
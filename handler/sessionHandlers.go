@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"goxcms/model"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// lastSeenInterval limits how often a session's last-seen time is written.
+const lastSeenInterval = time.Minute
+
+// createSession records a new login and returns the signed token for it.
+func createSession(c *fiber.Ctx, db *gorm.DB, user model.User) (string, error) {
+	now := time.Now()
+
+	userAgent := c.Get(fiber.HeaderUserAgent)
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+
+	userSession := model.UserSession{
+		JTI:        uuid.New().String(),
+		UserID:     user.ID,
+		IP:         c.IP(),
+		UserAgent:  userAgent,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(jwtLifetime),
+	}
+
+	/// expired sessions of the user are of no use anymore
+	db.Where("user_id = ? AND expires_at < ?", user.ID, now).Delete(&model.UserSession{})
+
+	if err := db.Create(&userSession).Error; err != nil {
+		return "", err
+	}
+	return GenerateJWT(user.ID, userSession.JTI)
+}
+
+// activeSession returns the session a token belongs to, as long as it is
+// still valid. Tokens issued before sessions were recorded have no jti and
+// are refused.
+func activeSession(db *gorm.DB, claims jwt.MapClaims) (model.UserSession, bool) {
+	var userSession model.UserSession
+
+	jti, _ := claims["jti"].(string)
+	userID, _ := claims["user_id"].(float64)
+	if jti == "" || userID == 0 {
+		return userSession, false
+	}
+
+	err := db.Where("jti = ? AND user_id = ? AND revoked = ? AND expires_at > ?", jti, uint(userID), false, time.Now()).
+		First(&userSession).Error
+	return userSession, err == nil
+}
+
+func touchSession(db *gorm.DB, userSession model.UserSession) {
+	if time.Since(userSession.LastSeenAt) < lastSeenInterval {
+		return
+	}
+	db.Model(&userSession).UpdateColumn("last_seen_at", time.Now())
+}
+
+// RevokeUserSessions logs the user out everywhere.
+func RevokeUserSessions(db *gorm.DB, userID uint) error {
+	return db.Model(&model.UserSession{}).
+		Where("user_id = ? AND revoked = ?", userID, false).
+		Update("revoked", true).Error
+}
+
+func clearJWTCookie(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     "jwt",
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Now().Add(-1 * time.Hour),
+		HTTPOnly: true,
+	})
+}
+
+func SessionsPage(c *fiber.Ctx, db *gorm.DB) error {
+	user := c.Locals("user").(model.User)
+
+	var sessions []model.UserSession
+	db.Where("user_id = ? AND revoked = ? AND expires_at > ?", user.ID, false, time.Now()).
+		Order("last_seen_at desc").
+		Find(&sessions)
+
+	return c.Render("account/sessions", fiber.Map{
+		"Title":      "Active Sessions",
+		"Sessions":   sessions,
+		"CurrentID":  c.Locals("sessionID"),
+		"IsLoggedIn": c.Locals("isLoggedin"),
+		"Settings":   c.Locals("Settings"),
+	}, "main")
+}
+
+func RevokeSession(c *fiber.Ctx, db *gorm.DB) error {
+	user := c.Locals("user").(model.User)
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid session ID")
+	}
+
+	/// users can only end their own sessions
+	result := db.Model(&model.UserSession{}).
+		Where("id = ? AND user_id = ?", id, user.ID).
+		Update("revoked", true)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return ShowToastError(c, "Session not found")
+	}
+
+	if c.Locals("sessionID") == uint(id) {
+		clearJWTCookie(c)
+		c.Set("HX-Redirect", "/login")
+	}
+
+	ShowToast(c, "Session logged out")
+	return c.SendString("")
+}
+
+func RevokeAllSessions(c *fiber.Ctx, db *gorm.DB) error {
+	user := c.Locals("user").(model.User)
+
+	if err := RevokeUserSessions(db, user.ID); err != nil {
+		return ShowToastError(c, "Failed to log out the sessions")
+	}
+
+	clearJWTCookie(c)
+	ShowToast(c, "Logged out everywhere")
+	c.Set("HX-Redirect", "/login")
+	return nil
+}
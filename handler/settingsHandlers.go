@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"goxcms/model"
+	"strconv"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"gorm.io/gorm"
@@ -17,6 +19,8 @@ func UpdateSettings(c *fiber.Ctx, db *gorm.DB) error {
 		return c.Status(fiber.StatusInternalServerError).SendString("Error retrieving current settings")
 	}
 
+	before := settings
+
 	// Update settings with form data
 	updatedSettings := updateSettingsFromForm(&settings, c)
 
@@ -26,6 +30,8 @@ func UpdateSettings(c *fiber.Ctx, db *gorm.DB) error {
 		return c.Status(fiber.StatusInternalServerError).SendString("Failed to update settings")
 	}
 
+	Audit(c, db, "settings.update", "settings", updatedSettings.ID, before, updatedSettings)
+
 	// Update settings in locals
 	c.Locals("Settings", MapSettingsToMap(updatedSettings))
 
@@ -62,6 +68,18 @@ func updateSettingsFromForm(settings *model.BasicWebsiteInfo, c *fiber.Ctx) mode
 	settings.Language = c.FormValue("language")               // Add or update based on your actual form and needs
 	settings.Locale = c.FormValue("locale")                   // Add or update based on your actual form and needs
 	settings.TimeZone = c.FormValue("timezone")               // Add or update based on your actual form and needs
+	settings.RequireAdminTwoFactor = c.FormValue("require_admin_two_factor") == "on"
+	settings.AccountDeletion = model.AccountDeletionAnonymize
+	if c.FormValue("account_deletion") == model.AccountDeletionCascade {
+		settings.AccountDeletion = model.AccountDeletionCascade
+	}
+	settings.RegistrationMode = model.RegistrationOpen
+	switch mode := c.FormValue("registration_mode"); mode {
+	case model.RegistrationDomain, model.RegistrationInvite, model.RegistrationApproval:
+		settings.RegistrationMode = mode
+	}
+	settings.RegistrationDomains = strings.Join(parseDomains(c.FormValue("registration_domains")), ", ")
+	settings.GuestComments = c.FormValue("guest_comments") == "on"
 	return *settings
 }
 
@@ -91,5 +109,11 @@ func MapSettingsToMap(settings model.BasicWebsiteInfo) map[string]string {
 		"TimeZone":       settings.TimeZone,
 		"SelectedTheme":  settings.SelectedTheme,
 		"ContainerClass": settings.ContainerClass,
+
+		"RequireAdminTwoFactor": strconv.FormatBool(settings.RequireAdminTwoFactor),
+		"AccountDeletion":       settings.AccountDeletion,
+		"RegistrationMode":      settings.RegistrationMode,
+		"RegistrationDomains":   settings.RegistrationDomains,
+		"GuestComments":         strconv.FormatBool(settings.GuestComments),
 	}
 }
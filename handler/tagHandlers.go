@@ -36,6 +36,9 @@ func BlogTagPage(c *fiber.Ctx, db *gorm.DB) error {
 	var tag model.Tag
 	result := db.Where("Slug = ?", slug).First(&tag)
 	if result.Error != nil || tag.ID == 0 {
+		if link, ok := tagRedirectLink(db, slug); ok {
+			return c.Redirect(link+"/"+page, fiber.StatusMovedPermanently)
+		}
 		return c.Status(404).Render("404", fiber.Map{
 			"Title": "404",
 		}, "main")
@@ -43,7 +46,8 @@ func BlogTagPage(c *fiber.Ctx, db *gorm.DB) error {
 
 	var posts []model.Post
 	db.Joins("JOIN post_tags ON post_tags.post_id = posts.id").
-		Where("post_tags.tag_id = ? AND posts.published = ?", tag.ID, true).
+		Scopes(model.PublishedPosts).
+		Where("post_tags.tag_id = ?", tag.ID).
 		Order("posts.created_at desc").
 		Limit(postsPerPage).
 		Offset(offset).
@@ -52,12 +56,13 @@ func BlogTagPage(c *fiber.Ctx, db *gorm.DB) error {
 	var totalPosts int64
 	db.Model(&model.Post{}).
 		Joins("JOIN post_tags ON post_tags.post_id = posts.id").
-		Where("post_tags.tag_id = ? AND posts.published = ?", tag.ID, true).
+		Scopes(model.PublishedPosts).
+		Where("post_tags.tag_id = ?", tag.ID).
 		Count(&totalPosts)
 
 	totalPages := int(math.Ceil(float64(totalPosts) / float64(postsPerPage)))
 
-	if pageNumber > totalPages {
+	if pageNumber > totalPages && totalPages > 0 {
 		return c.Redirect("/blog/tag/" + slug + "/1")
 	}
 
@@ -118,8 +123,13 @@ func SearchTag(c *fiber.Ctx, db *gorm.DB) error {
 		Count(&totalMatchingCount)
 	totalPages := int(math.Ceil(float64(totalMatchingCount) / float64(pageSize)))
 
+	// All tags, for choosing the tag to merge into
+	var allTags []model.Tag
+	db.Order("name asc").Find(&allTags)
+
 	return c.Render("admin/table/tag-table", fiber.Map{
 		"Tags":        tags,
+		"AllTags":     allTags,
 		"TotalPages":  totalPages,
 		"CurrentPage": pageInt,
 		"SearchQuery": searchQuery,
@@ -142,10 +152,12 @@ func AddTag(c *fiber.Ctx, db *gorm.DB) error {
 		}
 	}
 
-	db.Create(&model.Tag{
+	tag = model.Tag{
 		Name: name,
 		Slug: slug,
-	})
+	}
+	db.Create(&tag)
+	Audit(c, db, "tag.create", "tag", tag.ID, nil, tag)
 
 	message := map[string]string{"showToast": "Tag added successfully"}
 	messageBytes, _ := json.Marshal(message)
@@ -166,14 +178,11 @@ func DeleteTag(c *fiber.Ctx, db *gorm.DB) error {
 		return ShowToastError(c, "Tag not found")
 	}
 
-	// Delete the associated records in the "post_tags" table
-	if err := db.Exec("DELETE FROM post_tags WHERE tag_id = ?", tag.ID).Error; err != nil {
-		return ShowToastError(c, "Error deleting associated records")
-	}
-
-	if err := db.Delete(&tag).Error; err != nil {
+	if err := deleteTag(db, tag); err != nil {
 		return ShowToastError(c, "Error deleting tag")
 	}
+	clearTagCache()
+	Audit(c, db, "tag.delete", "tag", tag.ID, tag, nil)
 
 	return ShowToastError(c, "Tag with ID "+id+" deleted successfully")
 }
@@ -0,0 +1,402 @@
+package handlers
+
+import (
+	"goxcms/model"
+	"goxcms/utils"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// tagRedirectLink returns the page of the tag that used to have the slug,
+// for links to tags that were renamed or merged.
+func tagRedirectLink(db *gorm.DB, slug string) (string, bool) {
+	var redirect model.TagRedirect
+	if err := db.Where("old_slug = ?", slug).First(&redirect).Error; err != nil {
+		return "", false
+	}
+	var tag model.Tag
+	if err := db.Select("slug").First(&tag, redirect.TagID).Error; err != nil {
+		return "", false
+	}
+	return "/blog/tag/" + tag.Slug, true
+}
+
+// saveTag stores a new name and slug of a tag. When the slug changed, the
+// old one redirects to the tag from now on.
+func saveTag(db *gorm.DB, tag model.Tag, oldSlug string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if tag.Slug != oldSlug {
+			/// a slug in use again by a tag must not redirect anywhere
+			if err := tx.Where("old_slug = ?", tag.Slug).Delete(&model.TagRedirect{}).Error; err != nil {
+				return err
+			}
+			if err := addTagRedirect(tx, oldSlug, tag.ID); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&tag).Select("name", "slug").Updates(&tag).Error
+	})
+}
+
+func addTagRedirect(tx *gorm.DB, oldSlug string, tagID uint) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "old_slug"}},
+		DoUpdates: clause.AssignmentColumns([]string{"tag_id"}),
+	}).Create(&model.TagRedirect{OldSlug: oldSlug, TagID: tagID}).Error
+}
+
+// deleteTag removes a tag from its posts and deletes it with its redirects.
+func deleteTag(db *gorm.DB, tag model.Tag) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM post_tags WHERE tag_id = ?", tag.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("tag_id = ?", tag.ID).Delete(&model.TagRedirect{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&tag).Error
+	})
+}
+
+// clearTagCache drops the cached pages after a tag changed, since posts,
+// tag pages and the tag cloud show its name and link to its slug.
+func clearTagCache() {
+	if err := utils.ClearCache(); err != nil {
+		log.Printf("Clearing the cache after changing tags failed: %v", err)
+	}
+}
+
+// mergeTags moves the posts of the sources to the target and deletes the
+// sources. Their slugs, and the slugs that redirected to them, redirect to
+// the target afterwards.
+func mergeTags(db *gorm.DB, target model.Tag, sources []model.Tag) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, source := range sources {
+			if err := tx.Exec("INSERT INTO post_tags (post_id, tag_id) SELECT post_id, ? FROM post_tags WHERE tag_id = ? AND post_id NOT IN (SELECT post_id FROM post_tags WHERE tag_id = ?)",
+				target.ID, source.ID, target.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("DELETE FROM post_tags WHERE tag_id = ?", source.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&model.TagRedirect{}).Where("tag_id = ?", source.ID).Update("tag_id", target.ID).Error; err != nil {
+				return err
+			}
+			if err := addTagRedirect(tx, source.Slug, target.ID); err != nil {
+				return err
+			}
+			if err := tx.Delete(&source).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// EditTagView renders the modal for renaming a tag.
+func EditTagView(c *fiber.Ctx, db *gorm.DB) error {
+	var tag model.Tag
+	if err := db.First(&tag, c.Params("id")).Error; err != nil {
+		return ShowToastError(c, "Tag not found")
+	}
+
+	var redirects []model.TagRedirect
+	db.Where("tag_id = ?", tag.ID).Order("old_slug asc").Find(&redirects)
+
+	return c.Render("admin/table/tag-form", fiber.Map{
+		"Tag":       tag,
+		"Redirects": redirects,
+	})
+}
+
+// RenameTag changes the name and slug of a tag. The page at the old slug
+// redirects to the new one.
+func RenameTag(c *fiber.Ctx, db *gorm.DB) error {
+	var tag model.Tag
+	if err := db.First(&tag, c.Params("id")).Error; err != nil {
+		return ShowToastError(c, "Tag not found")
+	}
+	before := tag
+
+	tag.Name = strings.TrimSpace(c.FormValue("tag_name"))
+	tag.Slug = strings.TrimSpace(c.FormValue("tag_slug"))
+	if tag.Name == "" || tag.Slug == "" {
+		return ShowToastError(c, "Please enter a name and a slug")
+	}
+
+	var existing model.Tag
+	db.Where("(name = ? OR slug = ?) AND id != ?", tag.Name, tag.Slug, tag.ID).First(&existing)
+	if existing.ID != 0 {
+		if existing.Name == tag.Name {
+			return ShowToastError(c, "Tag name already exists")
+		}
+		return ShowToastError(c, "Tag with the slug already exists")
+	}
+
+	if err := saveTag(db, tag, before.Slug); err != nil {
+		return ShowToastError(c, "Error renaming tag")
+	}
+	clearTagCache()
+	Audit(c, db, "tag.update", "tag", tag.ID, before, tag)
+
+	if tag.Slug != before.Slug {
+		return ShowToast(c, "Tag renamed, /blog/tag/"+before.Slug+" now redirects to /blog/tag/"+tag.Slug)
+	}
+	return ShowToast(c, "Tag renamed successfully")
+}
+
+// MergeTags merges the selected tags into the target tag.
+func MergeTags(c *fiber.Ctx, db *gorm.DB) error {
+	render := SearchTag
+	if c.FormValue("view") == "report" {
+		render = TagReport
+	}
+
+	var target model.Tag
+	if err := db.First(&target, c.FormValue("target_id")).Error; err != nil {
+		ShowToastError(c, "Choose the tag to merge into")
+		return render(c, db)
+	}
+
+	var ids []uint
+	for _, value := range c.Context().PostArgs().PeekMulti("ids") {
+		if id, err := strconv.ParseUint(string(value), 10, 64); err == nil && uint(id) != target.ID {
+			ids = append(ids, uint(id))
+		}
+	}
+	var sources []model.Tag
+	if len(ids) > 0 {
+		db.Where("id IN ?", ids).Find(&sources)
+	}
+	if len(sources) == 0 {
+		ShowToastError(c, "No tags selected to merge")
+		return render(c, db)
+	}
+
+	if err := mergeTags(db, target, sources); err != nil {
+		ShowToastError(c, "Error merging tags")
+		return render(c, db)
+	}
+	clearTagCache()
+	Audit(c, db, "tag.merge", "tag", target.ID, sources, target)
+
+	names := make([]string, 0, len(sources))
+	for _, source := range sources {
+		names = append(names, source.Name)
+	}
+	ShowToast(c, "Merged "+strings.Join(names, ", ")+" into "+target.Name)
+	return render(c, db)
+}
+
+// tagBulkPosts finds the posts the bulk retagging form filters for.
+func tagBulkPosts(c *fiber.Ctx, db *gorm.DB) []uint {
+	query := db.Model(&model.Post{})
+	if search := strings.TrimSpace(c.FormValue("query")); search != "" {
+		query = query.Where("title LIKE ?", "%"+search+"%")
+	}
+	if categoryID := c.FormValue("category_id"); categoryID != "" {
+		query = query.Where("id IN (SELECT post_id FROM post_categories WHERE category_id = ?)", categoryID)
+	}
+	if withTagID := c.FormValue("with_tag_id"); withTagID != "" {
+		query = query.Where("id IN (SELECT post_id FROM post_tags WHERE tag_id = ?)", withTagID)
+	}
+	switch c.FormValue("status") {
+	case "published":
+		query = query.Where("published = ?", true)
+	case "draft":
+		query = query.Where("published = ?", false)
+	}
+
+	var ids []uint
+	query.Pluck("id", &ids)
+	return ids
+}
+
+// BulkTagPostsView renders the modal for adding a tag to or removing it from
+// many posts at once.
+func BulkTagPostsView(c *fiber.Ctx, db *gorm.DB) error {
+	var tags []model.Tag
+	db.Order("name asc").Find(&tags)
+	tree, _ := model.CategoryTree(db)
+
+	tagID, _ := strconv.ParseUint(c.Query("tag_id"), 10, 64)
+
+	return c.Render("admin/table/tag-bulk-form", fiber.Map{
+		"Tags":       tags,
+		"Categories": model.FlattenCategoryTree(tree),
+		"TagID":      uint(tagID),
+	})
+}
+
+// BulkTagPosts adds a tag to, or removes it from, every post matching the
+// filters. The preview action only counts them.
+func BulkTagPosts(c *fiber.Ctx, db *gorm.DB) error {
+	action := c.FormValue("action")
+	if action != "add" && action != "remove" && action != "preview" {
+		return ShowToastError(c, "Unknown action")
+	}
+
+	var tag model.Tag
+	if err := db.First(&tag, c.FormValue("tag_id")).Error; err != nil {
+		return ShowToastError(c, "Choose a tag")
+	}
+
+	ids := tagBulkPosts(c, db)
+	if action == "preview" {
+		return ShowToast(c, strconv.Itoa(len(ids))+" posts match the filters")
+	}
+	if len(ids) == 0 {
+		return ShowToastError(c, "No posts match the filters")
+	}
+
+	var result *gorm.DB
+	if action == "add" {
+		result = db.Exec("INSERT INTO post_tags (post_id, tag_id) SELECT id, ? FROM posts WHERE id IN ? AND id NOT IN (SELECT post_id FROM post_tags WHERE tag_id = ?)",
+			tag.ID, ids, tag.ID)
+	} else {
+		result = db.Exec("DELETE FROM post_tags WHERE tag_id = ? AND post_id IN ?", tag.ID, ids)
+	}
+	if result.Error != nil {
+		return ShowToastError(c, "Error updating posts")
+	}
+	Audit(c, db, "tag.bulk_"+action, "tag", tag.ID, nil, fiber.Map{"post_ids": ids})
+
+	changed := strconv.FormatInt(result.RowsAffected, 10)
+	if action == "add" {
+		return ShowToast(c, "Added "+tag.Name+" to "+changed+" posts")
+	}
+	return ShowToast(c, "Removed "+tag.Name+" from "+changed+" posts")
+}
+
+// tagDuplicate is a pair of tags that probably mean the same. Merge is the
+// less used one, which the report offers to merge into Keep.
+type tagDuplicate struct {
+	Keep   model.Tag
+	Merge  model.Tag
+	Reason string
+}
+
+// tagKey reduces a tag name to what is left when case, punctuation, a plural
+// s and a "lang" or "js" suffix are ignored, so "Golang", "go" and "Go-lang"
+// have the same key.
+func tagKey(name string) string {
+	key := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+	for _, suffix := range []string{"lang", "js"} {
+		if len(key) >= len(suffix)+2 && strings.HasSuffix(key, suffix) {
+			key = strings.TrimSuffix(key, suffix)
+			break
+		}
+	}
+	if len(key) > 3 && strings.HasSuffix(key, "s") && !strings.HasSuffix(key, "ss") {
+		key = strings.TrimSuffix(key, "s")
+	}
+	return key
+}
+
+// editDistance is the Levenshtein distance of two strings.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current := make([]int, len(rb)+1)
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(rb)]
+}
+
+// similarTagKeys reports whether two keys look like typos of each other: one
+// letter apart, or two for long words.
+func similarTagKeys(a, b string) bool {
+	shorter := min(len(a), len(b))
+	if shorter < 4 {
+		return false
+	}
+	allowed := 1
+	if shorter >= 8 {
+		allowed = 2
+	}
+	return editDistance(a, b) <= allowed
+}
+
+// TagReport lists unused tags and tags that look like duplicates.
+func TagReport(c *fiber.Ctx, db *gorm.DB) error {
+	var tags []model.Tag
+	db.Order("name asc").Find(&tags)
+
+	var counts []struct {
+		TagID uint
+		Count int
+	}
+	db.Table("post_tags").Select("tag_id, count(*) as count").Group("tag_id").Scan(&counts)
+	postCounts := make(map[uint]int, len(counts))
+	for _, count := range counts {
+		postCounts[count.TagID] = count.Count
+	}
+
+	var unused []model.Tag
+	keys := make([]string, len(tags))
+	for i := range tags {
+		tags[i].PostsCount = postCounts[tags[i].ID]
+		keys[i] = tagKey(tags[i].Name)
+		if tags[i].PostsCount == 0 {
+			unused = append(unused, tags[i])
+		}
+	}
+
+	/// of two duplicates the more used tag is kept, on a tie the older one
+	keep := func(a, b model.Tag) (model.Tag, model.Tag) {
+		if b.PostsCount > a.PostsCount || b.PostsCount == a.PostsCount && b.ID < a.ID {
+			return b, a
+		}
+		return a, b
+	}
+
+	var duplicates []tagDuplicate
+	for i := range tags {
+		for j := i + 1; j < len(tags); j++ {
+			var reason string
+			switch {
+			case keys[i] == keys[j]:
+				reason = "Same name apart from case, punctuation or suffix"
+			case similarTagKeys(keys[i], keys[j]):
+				reason = "Similar spelling"
+			default:
+				continue
+			}
+			kept, merged := keep(tags[i], tags[j])
+			duplicates = append(duplicates, tagDuplicate{Keep: kept, Merge: merged, Reason: reason})
+		}
+	}
+	sort.SliceStable(duplicates, func(i, j int) bool {
+		return duplicates[i].Keep.PostsCount > duplicates[j].Keep.PostsCount
+	})
+
+	return c.Render("admin/table/tag-report", fiber.Map{
+		"Unused":     unused,
+		"Duplicates": duplicates,
+		"TagsCount":  len(tags),
+	})
+}
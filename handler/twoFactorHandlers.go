@@ -0,0 +1,402 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"goxcms/model"
+	"html/template"
+	"image/png"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// twoFactorCookie carries the pending login between the password and the
+// code step.
+const twoFactorCookie = "two_factor"
+
+const (
+	twoFactorPeriod      = 30 // seconds per code, as RFC 6238 recommends
+	twoFactorLoginWindow = 5 * time.Minute
+	twoFactorMaxAttempts = 5
+	recoveryCodeCount    = 10
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+// twoFactorSetupRequired reports whether the user must enroll before using
+// the admin area.
+func twoFactorSetupRequired(db *gorm.DB, user model.User, role model.Role) bool {
+	if user.TwoFactorEnabled || !role.HasPermission(model.PermAdminAccess) {
+		return false
+	}
+
+	var settings model.BasicWebsiteInfo
+	db.Select("require_admin_two_factor").First(&settings)
+	return settings.RequireAdminTwoFactor
+}
+
+func redirectToTwoFactorSetup(c *fiber.Ctx) error {
+	if c.Get("HX-Request") == "true" {
+		ShowToastError(c, "Please set up two-factor authentication first")
+		c.Set("HX-Redirect", "/account/2fa")
+		return c.SendStatus(fiber.StatusOK)
+	}
+	return c.Redirect("/account/2fa")
+}
+
+// matchTOTP returns the time step the code belongs to. One step of clock
+// drift is allowed either way, and steps up to lastStep are refused so a code
+// cannot be replayed.
+func matchTOTP(secret, code string, lastStep int64) (int64, bool) {
+	now := time.Now().Unix() / twoFactorPeriod
+	for _, step := range []int64{now, now - 1, now + 1} {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := hotp.GenerateCodeCustom(secret, uint64(step), hotp.ValidateOpts{
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func normalizeCode(code string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+}
+
+// verifyTwoFactorCode accepts a code from the authenticator app or an unused
+// recovery code and uses it up.
+func verifyTwoFactorCode(db *gorm.DB, user model.User, code string) bool {
+	code = normalizeCode(code)
+
+	if len(code) == 6 {
+		step, ok := matchTOTP(user.TwoFactorSecret, code, user.TwoFactorLastStep)
+		if !ok {
+			return false
+		}
+		result := db.Model(&model.User{}).
+			Where("id = ? AND two_factor_last_step < ?", user.ID, step).
+			Update("two_factor_last_step", step)
+		return result.Error == nil && result.RowsAffected == 1
+	}
+
+	result := db.Model(&model.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashToken(code)).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// newRecoveryCodes replaces the recovery codes of the user and returns the
+// new ones, which are only ever shown once.
+func newRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&model.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	rows := make([]model.RecoveryCode, 0, recoveryCodeCount)
+	max := big.NewInt(int64(len(recoveryCodeAlphabet)))
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 10)
+		for j := range raw {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return nil, err
+			}
+			raw[j] = recoveryCodeAlphabet[n.Int64()]
+		}
+		code := string(raw[:5]) + "-" + string(raw[5:])
+		codes = append(codes, code)
+		rows = append(rows, model.RecoveryCode{UserID: userID, CodeHash: hashToken(normalizeCode(code))})
+	}
+
+	if err := tx.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// beginTwoFactorLogin remembers who passed the password check and sends the
+// browser to the code form.
+func beginTwoFactorLogin(c *fiber.Ctx, db *gorm.DB, user model.User) error {
+	if err := setTwoFactorCookie(c, db, user); err != nil {
+		ShowToastError(c, "Failed to initiate session")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to initiate session"})
+	}
+
+	c.Set("HX-Redirect", "/login/2fa")
+	return c.Status(fiber.StatusOK).SendString("Two-factor code required")
+}
+
+// setTwoFactorCookie issues the pending login the code form picks up.
+func setTwoFactorCookie(c *fiber.Ctx, db *gorm.DB, user model.User) error {
+	token, err := issueUserToken(db, user, model.TokenTwoFactorLogin, "", twoFactorLoginWindow)
+	if err != nil {
+		return err
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     twoFactorCookie,
+		Value:    token,
+		Path:     "/login/2fa",
+		Expires:  time.Now().Add(twoFactorLoginWindow),
+		HTTPOnly: true,
+		SameSite: "Lax",
+	})
+	return nil
+}
+
+func clearTwoFactorCookie(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     twoFactorCookie,
+		Value:    "",
+		Path:     "/login/2fa",
+		Expires:  time.Now().Add(-1 * time.Hour),
+		HTTPOnly: true,
+	})
+}
+
+func TwoFactorLoginPage(c *fiber.Ctx, db *gorm.DB) error {
+	if _, err := findUserToken(db, c.Cookies(twoFactorCookie), model.TokenTwoFactorLogin); err != nil {
+		return c.Redirect("/login")
+	}
+
+	return c.Render("login_2fa", fiber.Map{
+		"Title":    "Two-Factor Authentication",
+		"Settings": c.Locals("Settings"),
+	}, "main")
+}
+
+func TwoFactorLogin(db *gorm.DB, store *session.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		expired := func(message string) error {
+			clearTwoFactorCookie(c)
+			ShowToastError(c, message)
+			c.Set("HX-Redirect", "/login")
+			return c.Status(fiber.StatusUnauthorized).SendString(message)
+		}
+
+		pending, err := findUserToken(db, c.Cookies(twoFactorCookie), model.TokenTwoFactorLogin)
+		if err != nil {
+			return expired("Your login has expired, please log in again")
+		}
+
+		var user model.User
+		if err := db.First(&user, pending.UserID).Error; err != nil || !user.TwoFactorEnabled {
+			return expired("Your login has expired, please log in again")
+		}
+
+		if wait, locked := loginWait(db, user.Username, c.IP()); wait > 0 {
+			return loginThrottled(c, wait, locked)
+		}
+
+		if !verifyTwoFactorCode(db, user, c.FormValue("code")) {
+			recordLoginFailure(db, user.Username, c.IP())
+			if pending.Attempts+1 >= twoFactorMaxAttempts {
+				db.Delete(&pending)
+				return expired("Too many invalid codes, please log in again")
+			}
+			db.Model(&pending).Update("attempts", gorm.Expr("attempts + 1"))
+
+			ShowToastError(c, "Invalid authentication code")
+			return c.Status(fiber.StatusUnauthorized).SendString("Invalid authentication code")
+		}
+
+		/// the pending login is used up, so a second request with the same cookie fails
+		if _, err := consumeUserToken(db, c.Cookies(twoFactorCookie), model.TokenTwoFactorLogin); err != nil {
+			return expired("Your login has expired, please log in again")
+		}
+		clearTwoFactorCookie(c)
+
+		return completeLogin(c, db, store, user)
+	}
+}
+
+// twoFactorKey returns the key being enrolled. The secret is created on the
+// first visit and kept on the user, so reloading the page shows the same QR
+// code.
+func twoFactorKey(c *fiber.Ctx, db *gorm.DB, user model.User) (*otp.Key, error) {
+	opts := totp.GenerateOpts{
+		Issuer:      siteName(c),
+		AccountName: user.Username,
+		Period:      twoFactorPeriod,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	}
+
+	if user.TwoFactorSecret != "" {
+		secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(user.TwoFactorSecret)
+		if err == nil {
+			opts.Secret = secret
+			return totp.Generate(opts)
+		}
+	}
+
+	key, err := totp.Generate(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Model(&user).Update("two_factor_secret", key.Secret()).Error; err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func qrCodeDataURL(key *otp.Key) (template.URL, error) {
+	img, err := key.Image(220, 220)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+func TwoFactorPage(c *fiber.Ctx, db *gorm.DB) error {
+	user := c.Locals("user").(model.User)
+
+	data := fiber.Map{
+		"Title":      "Two-Factor Authentication",
+		"Enabled":    user.TwoFactorEnabled,
+		"Required":   c.Locals("twoFactorSetupRequired"),
+		"IsLoggedIn": c.Locals("isLoggedin"),
+		"Settings":   c.Locals("Settings"),
+	}
+
+	if user.TwoFactorEnabled {
+		var remaining int64
+		db.Model(&model.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", user.ID).Count(&remaining)
+		data["RemainingCodes"] = remaining
+		return c.Render("account/two_factor", data, "main")
+	}
+
+	key, err := twoFactorKey(c, db, user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to create a secret")
+	}
+	qrCode, err := qrCodeDataURL(key)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to create the QR code")
+	}
+
+	data["QRCode"] = qrCode
+	data["Secret"] = key.Secret()
+	return c.Render("account/two_factor", data, "main")
+}
+
+func EnableTwoFactor(c *fiber.Ctx, db *gorm.DB) error {
+	user := c.Locals("user").(model.User)
+	if user.TwoFactorEnabled {
+		return ShowToastError(c, "Two-factor authentication is already enabled")
+	}
+	if user.TwoFactorSecret == "" {
+		ShowToastError(c, "The setup has expired, please reload the page")
+		return c.Status(fiber.StatusBadRequest).SendString("The setup has expired, please reload the page")
+	}
+
+	step, ok := matchTOTP(user.TwoFactorSecret, normalizeCode(c.FormValue("code")), 0)
+	if !ok {
+		ShowToastError(c, "Invalid authentication code")
+		return c.Status(fiber.StatusBadRequest).SendString("The code does not match, check the time on your device and try again")
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&user).Updates(map[string]interface{}{
+			"two_factor_enabled":   true,
+			"two_factor_last_step": step,
+		}).Error
+		if err != nil {
+			return err
+		}
+		codes, err = newRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		ShowToastError(c, "Failed to enable two-factor authentication")
+		return c.Status(fiber.StatusInternalServerError).SendString("Failed to enable two-factor authentication")
+	}
+
+	ShowToast(c, "Two-factor authentication enabled")
+	return c.Render("account/two_factor_codes", fiber.Map{"Codes": codes})
+}
+
+// checkPassword confirms a sensitive change with the current password.
+func checkPassword(c *fiber.Ctx, user model.User) bool {
+	return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(c.FormValue("password"))) == nil
+}
+
+func DisableTwoFactor(c *fiber.Ctx, db *gorm.DB) error {
+	user := c.Locals("user").(model.User)
+	if !user.TwoFactorEnabled {
+		return ShowToastError(c, "Two-factor authentication is not enabled")
+	}
+	if !checkPassword(c, user) {
+		return ShowToastError(c, "Wrong password")
+	}
+
+	role := LoadRole(db, user.RoleID)
+	user.TwoFactorEnabled = false
+	if twoFactorSetupRequired(db, user, role) {
+		return ShowToastError(c, "Two-factor authentication is required for administrators")
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&user).Updates(map[string]interface{}{
+			"two_factor_enabled":   false,
+			"two_factor_secret":    "",
+			"two_factor_last_step": 0,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&model.RecoveryCode{}).Error
+	})
+	if err != nil {
+		return ShowToastError(c, "Failed to disable two-factor authentication")
+	}
+
+	ShowToast(c, "Two-factor authentication disabled")
+	c.Set("HX-Redirect", "/account/2fa")
+	return nil
+}
+
+func RegenerateRecoveryCodes(c *fiber.Ctx, db *gorm.DB) error {
+	user := c.Locals("user").(model.User)
+	if !user.TwoFactorEnabled {
+		return ShowToastError(c, "Two-factor authentication is not enabled")
+	}
+	if !checkPassword(c, user) {
+		return ShowToastError(c, "Wrong password")
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = newRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return ShowToastError(c, "Failed to create recovery codes")
+	}
+
+	ShowToast(c, "New recovery codes created, the old ones no longer work")
+	return c.Render("account/two_factor_codes", fiber.Map{"Codes": codes})
+}
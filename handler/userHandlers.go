@@ -32,8 +32,12 @@ func SearchUsers(c *fiber.Ctx, db *gorm.DB) error {
 		Count(&count)
 	totalPages := int(math.Ceil(float64(count) / float64(pageSize)))
 
+	var roles []model.Role
+	db.Order("id asc").Find(&roles)
+
 	return c.Render("admin/table/user-table", fiber.Map{
 		"Users":       users,
+		"Roles":       roles,
 		"TotalPages":  totalPages,
 		"CurrentPage": pageInt,
 		"SearchQuery": searchQuery,
@@ -59,9 +63,10 @@ func DeleteUser(c *fiber.Ctx, db *gorm.DB) error {
 		return err
 	}
 
-	if err := db.Delete(&user).Error; err != nil {
-		return err
+	if err := DeleteUserAccount(db, user); err != nil {
+		return ShowToastError(c, "Failed to delete the user")
 	}
+	Audit(c, db, "user.delete", "user", user.ID, user, nil)
 
 	c.Status(fiber.StatusOK)
 
@@ -69,3 +74,19 @@ func DeleteUser(c *fiber.Ctx, db *gorm.DB) error {
 
 	return nil
 }
+
+// ForceLogoutUser ends every session of a user, for example after an account
+// was compromised.
+func ForceLogoutUser(c *fiber.Ctx, db *gorm.DB) error {
+	var user model.User
+	if err := db.First(&user, c.Params("id")).Error; err != nil {
+		return ShowToastError(c, "User not found")
+	}
+
+	if err := RevokeUserSessions(db, user.ID); err != nil {
+		return ShowToastError(c, "Failed to log out "+user.Username)
+	}
+	Audit(c, db, "user.logout", "user", user.ID, nil, nil)
+
+	return ShowToast(c, user.Username+" has been logged out everywhere")
+}
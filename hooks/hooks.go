@@ -0,0 +1,163 @@
+// Package hooks is the event bus between the core and plugins. Actions let
+// plugins react when something happens; filters let them change a value
+// before the core uses it. Callbacks run in order of priority, lowest first,
+// and in order of registration within the same priority.
+package hooks
+
+import (
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Actions fired by the core, with the type of the data they carry.
+const (
+	PostCreated     = "post.created"     // model.Post
+	PostUpdated     = "post.updated"     // model.Post
+	PostPublished   = "post.published"   // model.Post
+	PostUnpublished = "post.unpublished" // model.Post
+	PostDeleted     = "post.deleted"     // model.Post
+
+	CommentCreated    = "comment.created"    // model.Comment
+	CommentApproved   = "comment.approved"   // model.Comment
+	CommentUnapproved = "comment.unapproved" // model.Comment
+	CommentUpdated    = "comment.updated"    // model.Comment, edited by its author
+	CommentSpam       = "comment.spam"       // model.Comment, marked as spam by a moderator or the spam filter
+	CommentDeleted    = "comment.deleted"    // model.Comment
+
+	UserRegistered    = "user.registered"     // model.User
+	UserLoggedIn      = "user.logged_in"      // model.User
+	UserPasswordReset = "user.password_reset" // model.User
+	UserEmailVerified = "user.email_verified" // model.User
+	UserDeleted       = "user.deleted"        // model.User, after the account and its data are gone
+
+	FileUploaded = "file.uploaded" // model.File
+	FileDeleted  = "file.deleted"  // model.File
+
+	SecurityEvent = "security.event" // model.SecurityEvent, e.g. a login lockout
+)
+
+// Filters applied by the core, with the type of the value they pass along.
+const (
+	PostContentRender = "post.content.render" // string, the post HTML; args: model.Post
+	MenuItems         = "menu.items"          // []*model.MenuItem of the primary menu; args: model.Menu
+)
+
+// DefaultPriority is the priority to use when the order does not matter.
+const DefaultPriority = 10
+
+// ActionFunc handles an action. data is documented with each action name.
+type ActionFunc func(data interface{})
+
+// FilterFunc returns the value, changed or not. It must return a value of the
+// same type it received; args carry extra context documented with each filter.
+type FilterFunc func(value interface{}, args ...interface{}) interface{}
+
+type callback struct {
+	id       int
+	priority int
+	action   ActionFunc
+	filter   FilterFunc
+}
+
+var (
+	mu      sync.RWMutex
+	nextID  int
+	actions = map[string][]callback{}
+	filters = map[string][]callback{}
+)
+
+// AddAction subscribes fn to an action. The returned function unsubscribes it,
+// which plugins should call in Teardown.
+func AddAction(name string, priority int, fn ActionFunc) func() {
+	return add(actions, name, callback{priority: priority, action: fn})
+}
+
+// AddFilter subscribes fn to a filter. The returned function unsubscribes it.
+func AddFilter(name string, priority int, fn FilterFunc) func() {
+	return add(filters, name, callback{priority: priority, filter: fn})
+}
+
+// DoAction runs every callback subscribed to the action. A callback that
+// panics is logged and skipped so it cannot break the request that fired it.
+func DoAction(name string, data interface{}) {
+	for _, cb := range snapshot(actions, name) {
+		func() {
+			defer recoverHook("action", name)
+			cb.action(data)
+		}()
+	}
+}
+
+// ApplyFilters passes value through every callback subscribed to the filter
+// and returns the result, which always has the type of value. A callback that
+// panics or returns a value of another type is logged and skipped.
+func ApplyFilters(name string, value interface{}, args ...interface{}) interface{} {
+	for _, cb := range snapshot(filters, name) {
+		func() {
+			defer recoverHook("filter", name)
+			filtered := cb.filter(value, args...)
+			if reflect.TypeOf(filtered) != reflect.TypeOf(value) {
+				log.Printf("Ignored filter hook %s returning %T instead of %T", name, filtered, value)
+				return
+			}
+			value = filtered
+		}()
+	}
+	return value
+}
+
+// HasAction reports whether anything is subscribed to the action.
+func HasAction(name string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return len(actions[name]) > 0
+}
+
+// HasFilter reports whether anything is subscribed to the filter.
+func HasFilter(name string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return len(filters[name]) > 0
+}
+
+func add(registry map[string][]callback, name string, cb callback) func() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	nextID++
+	cb.id = nextID
+	list := append(registry[name], cb)
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].priority < list[j].priority
+	})
+	registry[name] = list
+
+	id := cb.id
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		list := registry[name]
+		for i := range list {
+			if list[i].id == id {
+				registry[name] = append(list[:i:i], list[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// snapshot copies the callbacks so they run without holding the lock, which
+// lets a callback add or remove hooks itself.
+func snapshot(registry map[string][]callback, name string) []callback {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]callback(nil), registry[name]...)
+}
+
+func recoverHook(kind, name string) {
+	if r := recover(); r != nil {
+		log.Printf("Recovered from panic in %s hook %s: %v", kind, name, r)
+	}
+}
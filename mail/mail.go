@@ -0,0 +1,187 @@
+// Package mail sends the emails of the CMS. Messages are rendered from the
+// templates in views/emails through the same html.Engine as the pages and
+// handed to a Mailer, which is SMTP in production and a file or log writer
+// during development.
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	stdhtml "html"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/template/html/v2"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// ErrNotConfigured is returned when a message is sent before Init.
+var ErrNotConfigured = errors.New("mail is not configured")
+
+// Message is a single email with an HTML and a plain text body.
+type Message struct {
+	To      string
+	Subject string
+	HTML    string
+	Text    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+var (
+	mu     sync.RWMutex
+	mailer Mailer
+	engine *html.Engine
+)
+
+// Init selects the mailer from mail.driver and keeps the engine to render
+// the email templates with.
+func Init(views *html.Engine) error {
+	var m Mailer
+	switch driver := viper.GetString("mail.driver"); driver {
+	case "smtp":
+		m = NewSMTPMailer()
+	case "file":
+		m = NewFileMailer(viper.GetString("mail.file_dir"))
+	case "log":
+		m = NewFileMailer("")
+	default:
+		return fmt.Errorf("unknown mail driver %q", driver)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	mailer = m
+	engine = views
+	return nil
+}
+
+// SetMailer replaces the mailer chosen by Init.
+func SetMailer(m Mailer) {
+	mu.Lock()
+	defer mu.Unlock()
+	mailer = m
+}
+
+// Render renders views/emails/<name>.html inside the email layout and
+// views/emails/<name>_text.html as the plain text body.
+func Render(name string, data map[string]interface{}) (htmlBody, textBody string, err error) {
+	mu.RLock()
+	views := engine
+	mu.RUnlock()
+	if views == nil {
+		return "", "", ErrNotConfigured
+	}
+
+	binding := map[string]interface{}{
+		"SiteName": viper.GetString("app.name"),
+		"SiteURL":  strings.TrimRight(viper.GetString("app.url"), "/"),
+	}
+	for key, value := range data {
+		binding[key] = value
+	}
+
+	var buf bytes.Buffer
+	if err := views.Render(&buf, "emails/"+name, binding, "emails/layout"); err != nil {
+		return "", "", err
+	}
+	htmlBody = buf.String()
+
+	buf.Reset()
+	if err := views.Render(&buf, "emails/"+name+"_text", binding); err != nil {
+		return "", "", err
+	}
+	/// the engine escapes for HTML, which the text body must not be
+	textBody = stdhtml.UnescapeString(strings.TrimSpace(buf.String())) + "\n"
+
+	return htmlBody, textBody, nil
+}
+
+// Send renders the template name and delivers it to one recipient.
+func Send(to, subject, name string, data map[string]interface{}) error {
+	mu.RLock()
+	m := mailer
+	mu.RUnlock()
+	if m == nil {
+		return ErrNotConfigured
+	}
+
+	htmlBody, textBody, err := Render(name, data)
+	if err != nil {
+		return err
+	}
+
+	return m.Send(Message{To: to, Subject: subject, HTML: htmlBody, Text: textBody})
+}
+
+// Queue sends the message in the background so the request does not wait
+// for the mail server. Failures are logged.
+func Queue(to, subject, name string, data map[string]interface{}) {
+	go func() {
+		if err := Send(to, subject, name, data); err != nil {
+			log.Printf("Failed to send %s email to %s: %v", name, to, err)
+		}
+	}()
+}
+
+// from returns the sender address of all messages.
+func from() string {
+	return viper.GetString("mail.from")
+}
+
+// build encodes msg as a multipart/alternative MIME message.
+func build(msg Message) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	domain := viper.GetString("app.domain")
+	if domain == "" {
+		domain = "localhost"
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "From: %s\r\n", from())
+	fmt.Fprintf(&out, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&out, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&out, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&out, "Message-ID: <%s@%s>\r\n", uuid.New().String(), domain)
+	fmt.Fprintf(&out, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&out, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", parts.Boundary())
+	out.Write(body.Bytes())
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,104 @@
+package mail
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// SMTPMailer delivers messages through an SMTP server.
+type SMTPMailer struct {
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	Encryption string // starttls, tls or none
+	Timeout    time.Duration
+}
+
+// NewSMTPMailer reads the server from the mail.smtp.* settings.
+func NewSMTPMailer() *SMTPMailer {
+	return &SMTPMailer{
+		Host:       viper.GetString("mail.smtp.host"),
+		Port:       viper.GetInt("mail.smtp.port"),
+		Username:   viper.GetString("mail.smtp.username"),
+		Password:   viper.GetString("mail.smtp.password"),
+		Encryption: viper.GetString("mail.smtp.encryption"),
+		Timeout:    time.Duration(viper.GetInt("mail.smtp.timeout_seconds")) * time.Second,
+	}
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	sender, err := netmail.ParseAddress(from())
+	if err != nil {
+		return fmt.Errorf("invalid mail.from: %w", err)
+	}
+	recipient, err := netmail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient: %w", err)
+	}
+
+	data, err := build(msg)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	tlsConfig := &tls.Config{ServerName: m.Host}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: m.Timeout}
+	if m.Encryption == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if m.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(m.Timeout))
+	}
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if m.Encryption == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(sender.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(recipient.Address); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
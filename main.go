@@ -2,11 +2,15 @@ package main
 
 import (
 	"goxcms/database"
+	"goxcms/mail"
+	"goxcms/oidc"
 	"goxcms/plugin_system"
 	"goxcms/routes"
+	"goxcms/search"
 	"goxcms/utils"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -23,17 +27,36 @@ func main() {
 
 	db := database.InitDB()
 
-	defer func() {
-		sqlDB, _ := db.DB()
-		sqlDB.Close()
-	}()
+	/// without a command the server is started, as before the command line existed
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	code := runCommand(db, args)
+
+	sqlDB, _ := db.DB()
+	sqlDB.Close()
+
+	os.Exit(code)
+}
+
+// serve runs the web server until it fails.
+func serve(db *gorm.DB) int {
+	/// with prefork the parent migrates before the children are started
+	if viper.GetBool("database.auto_migrate") && !fiber.IsChild() {
+		if err := database.MigrateUp(db); err != nil {
+			log.Printf("Failed to migrate the database: %v", err)
+			return 1
+		}
+	}
 
 	app := setupFiberApp(db)
 
 	host := viper.GetString("server.host")
 	port := viper.GetString("server.port")
 
-	log.Fatal(app.Listen(host + ":" + port))
+	log.Println(app.Listen(host + ":" + port))
+	return 1
 }
 
 func setupFiberApp(db *gorm.DB) *fiber.App {
@@ -62,6 +85,14 @@ func setupFiberApp(db *gorm.DB) *fiber.App {
 		MaxAge: 3600,
 	}
 
+	if err := mail.Init(engine); err != nil {
+		log.Printf("Mail is disabled: %v", err)
+	}
+
+	if err := oidc.Init(); err != nil {
+		log.Printf("OIDC login is disabled: %v", err)
+	}
+
 	store := utils.SetupStore(app)
 
 	utils.SetupRateLimiter(app, store)
@@ -76,6 +107,13 @@ func setupFiberApp(db *gorm.DB) *fiber.App {
 	plugin_system.InitializePlugins(app, db, engine)
 	plugin_system.AddPluginManagerRoutes(app, db)
 
+	/// with prefork the parent process only supervises the children
+	if !viper.GetBool("server.prefork") || fiber.IsChild() {
+		if err := search.Init(db); err != nil {
+			log.Printf("Search is disabled: %v", err)
+		}
+	}
+
 	app.Use("/static", filesystem.New(fsConfig))
 
 	app.Static("/static", "./static", fiber.Static{
@@ -114,6 +152,7 @@ func setupFiberApp(db *gorm.DB) *fiber.App {
 
 	utils.GenerateSiteMap(db)
 	utils.CreateBasicWebsiteInfo(db)
+	utils.StartScheduler(db)
 
 	return app
 }
@@ -2,6 +2,28 @@ package model
 
 import "time"
 
+// Account deletion policies, for what happens to the posts and comments of a
+// deleted user.
+const (
+	AccountDeletionAnonymize = "anonymize" // keep the content without an author
+	AccountDeletionCascade   = "cascade"   // delete the content with the account
+)
+
+// Registration modes, for who can create an account. An invitation works in
+// every mode.
+const (
+	RegistrationOpen     = "open"
+	RegistrationDomain   = "domain"   // email addresses of the allowed domains, active once verified
+	RegistrationInvite   = "invite"   // only with an invitation
+	RegistrationApproval = "approval" // an admin approves every new account
+)
+
+// The values the account deletion and registration settings accept.
+var (
+	AccountDeletionPolicies = []string{AccountDeletionAnonymize, AccountDeletionCascade}
+	RegistrationModes       = []string{RegistrationOpen, RegistrationDomain, RegistrationInvite, RegistrationApproval}
+)
+
 type BasicWebsiteInfo struct {
 	ID             uint      `json:"id" gorm:"primaryKey"`
 	Name           string    `json:"name"`
@@ -31,4 +53,10 @@ type BasicWebsiteInfo struct {
 	UpdatedAt      time.Time `json:"updated_at"`
 	SelectedTheme  string    `json:"selected_theme" default:"cerulean"`
 	ContainerClass string    `json:"container_class" default:"container"`
+
+	RequireAdminTwoFactor bool   `json:"require_admin_two_factor"`
+	AccountDeletion       string `json:"account_deletion" gorm:"size:16;default:anonymize"`
+	RegistrationMode      string `json:"registration_mode" gorm:"size:16;default:open"`
+	RegistrationDomains   string `json:"registration_domains"` // comma separated, for RegistrationDomain
+	GuestComments         bool   `json:"guest_comments"`       // comments with a name and email address instead of an account
 }
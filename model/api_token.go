@@ -0,0 +1,77 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// API token scopes. Every resource of the API has a read and a write scope.
+const (
+	ScopePostsRead       = "posts:read"
+	ScopePostsWrite      = "posts:write"
+	ScopePagesRead       = "pages:read"
+	ScopePagesWrite      = "pages:write"
+	ScopeCategoriesRead  = "categories:read"
+	ScopeCategoriesWrite = "categories:write"
+	ScopeTagsRead        = "tags:read"
+	ScopeTagsWrite       = "tags:write"
+	ScopeMenusRead       = "menus:read"
+	ScopeMenusWrite      = "menus:write"
+	ScopeCommentsRead    = "comments:read"
+	ScopeCommentsWrite   = "comments:write"
+	ScopeFilesRead       = "files:read"
+	ScopeFilesWrite      = "files:write"
+	ScopeUsersRead       = "users:read"
+	ScopeUsersWrite      = "users:write"
+)
+
+// APIScopes lists every scope a token can be given, in the order the token
+// form shows them.
+var APIScopes = []string{
+	ScopePostsRead, ScopePostsWrite,
+	ScopePagesRead, ScopePagesWrite,
+	ScopeCategoriesRead, ScopeCategoriesWrite,
+	ScopeTagsRead, ScopeTagsWrite,
+	ScopeMenusRead, ScopeMenusWrite,
+	ScopeCommentsRead, ScopeCommentsWrite,
+	ScopeFilesRead, ScopeFilesWrite,
+	ScopeUsersRead, ScopeUsersWrite,
+}
+
+// APIToken is a personal access token for the JSON API. It acts as the user
+// who created it, limited to its scopes. Only the SHA-256 hash of the secret
+// is stored; Prefix is kept so users can tell their tokens apart.
+type APIToken struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	UserID     uint       `json:"user_id" gorm:"index;not null"`
+	Name       string     `json:"name" gorm:"size:100;not null"`
+	Prefix     string     `json:"prefix" gorm:"size:16"`
+	TokenHash  string     `json:"-" gorm:"size:64;uniqueIndex;not null"`
+	Scopes     string     `json:"scopes"` // comma separated
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"` // nil never expires
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// ScopeList returns the scopes of the token.
+func (t APIToken) ScopeList() []string {
+	if t.Scopes == "" {
+		return nil
+	}
+	return strings.Split(t.Scopes, ",")
+}
+
+// HasScope reports whether the token was given the scope.
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token has run out at the given time.
+func (t APIToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !t.ExpiresAt.After(now)
+}
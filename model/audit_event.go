@@ -0,0 +1,44 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrAuditEventImmutable is returned when something tries to change or
+// remove an audit event.
+var ErrAuditEventImmutable = errors.New("audit events cannot be changed or deleted")
+
+// Sources of audit events.
+const (
+	AuditSourceAdmin = "admin"
+	AuditSourceAPI   = "api"
+	AuditSourceCLI   = "cli"
+)
+
+// AuditEvent records an administrative action: who did what to which
+// record, and how the record looked before and after. Events are only ever
+// added; the hooks below refuse updates and deletes through GORM.
+type AuditEvent struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	ActorID    *uint     `json:"actor_id" gorm:"index"`                // nil for the command line
+	ActorName  string    `json:"actor_name" gorm:"size:255"`           // kept when the actor is deleted
+	Source     string    `json:"source" gorm:"size:16;not null"`       // admin, api or cli
+	Action     string    `json:"action" gorm:"size:64;index;not null"` // e.g. post.delete
+	TargetType string    `json:"target_type" gorm:"size:64;index"`
+	TargetID   string    `json:"target_id" gorm:"size:255;index"`
+	Before     string    `json:"before" gorm:"type:text"` // JSON, empty when the target did not exist yet
+	After      string    `json:"after" gorm:"type:text"`  // JSON, empty when the target is gone
+	IP         string    `json:"ip" gorm:"size:64"`
+	CreatedAt  time.Time `json:"created_at" gorm:"index"`
+}
+
+func (AuditEvent) BeforeUpdate(tx *gorm.DB) error {
+	return ErrAuditEventImmutable
+}
+
+func (AuditEvent) BeforeDelete(tx *gorm.DB) error {
+	return ErrAuditEventImmutable
+}
@@ -0,0 +1,139 @@
+package model
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
+// CategoryNode is a category in the category tree.
+type CategoryNode struct {
+	Category
+	Depth    int // 0 for top level categories
+	Children []*CategoryNode
+}
+
+// CategoryTree loads every category and arranges them under their parents,
+// each level ordered by position and then name. A category whose parent is
+// gone is shown at the top level.
+func CategoryTree(db *gorm.DB) ([]*CategoryNode, error) {
+	var categories []Category
+	if err := db.Order("position asc, name asc").Find(&categories).Error; err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[uint]*CategoryNode, len(categories))
+	for _, category := range categories {
+		nodes[category.ID] = &CategoryNode{Category: category}
+	}
+
+	var roots []*CategoryNode
+	for _, category := range categories {
+		node := nodes[category.ID]
+		if category.ParentID != nil {
+			if parent, ok := nodes[*category.ParentID]; ok {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+	setCategoryDepth(roots, 0)
+	return roots, nil
+}
+
+func setCategoryDepth(nodes []*CategoryNode, depth int) {
+	for _, node := range nodes {
+		node.Depth = depth
+		setCategoryDepth(node.Children, depth+1)
+	}
+}
+
+// FlattenCategoryTree lists a tree depth first, every category followed by
+// its subcategories, for indented lists and selects.
+func FlattenCategoryTree(nodes []*CategoryNode) []*CategoryNode {
+	var flat []*CategoryNode
+	for _, node := range nodes {
+		flat = append(flat, node)
+		flat = append(flat, FlattenCategoryTree(node.Children)...)
+	}
+	return flat
+}
+
+// CategoryDescendantIDs returns the IDs of the subcategories of a category,
+// at any depth.
+func CategoryDescendantIDs(db *gorm.DB, id uint) ([]uint, error) {
+	var categories []Category
+	if err := db.Select("id", "parent_id").Where("parent_id IS NOT NULL").Find(&categories).Error; err != nil {
+		return nil, err
+	}
+	children := map[uint][]uint{}
+	for _, category := range categories {
+		children[*category.ParentID] = append(children[*category.ParentID], category.ID)
+	}
+
+	var ids []uint
+	seen := map[uint]bool{id: true}
+	queue := children[id]
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if seen[next] {
+			continue
+		}
+		seen[next] = true
+		ids = append(ids, next)
+		queue = append(queue, children[next]...)
+	}
+	return ids, nil
+}
+
+// CategoryAncestors returns the parents of a category up to the top level,
+// the top level category first.
+func CategoryAncestors(db *gorm.DB, category Category) ([]Category, error) {
+	var ancestors []Category
+	seen := map[uint]bool{category.ID: true}
+	for parentID := category.ParentID; parentID != nil && !seen[*parentID]; {
+		var parent Category
+		if err := db.First(&parent, *parentID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				break
+			}
+			return nil, err
+		}
+		seen[parent.ID] = true
+		ancestors = append([]Category{parent}, ancestors...)
+		parentID = parent.ParentID
+	}
+	return ancestors, nil
+}
+
+var errCategoryLoop = errors.New("a category cannot be placed under itself or one of its subcategories")
+
+// CheckCategoryParent returns an error if the category with the ID may not be
+// moved under parentID. New categories have ID 0 and only need an existing
+// parent.
+func CheckCategoryParent(db *gorm.DB, id uint, parentID *uint) error {
+	if parentID == nil {
+		return nil
+	}
+	if err := db.Select("id").First(&Category{}, *parentID).Error; err != nil {
+		return errors.New("parent category not found")
+	}
+	if id == 0 {
+		return nil
+	}
+	if *parentID == id {
+		return errCategoryLoop
+	}
+	descendants, err := CategoryDescendantIDs(db, id)
+	if err != nil {
+		return err
+	}
+	for _, descendant := range descendants {
+		if descendant == *parentID {
+			return errCategoryLoop
+		}
+	}
+	return nil
+}
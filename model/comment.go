@@ -0,0 +1,57 @@
+package model
+
+import "time"
+
+// Statuses of a Comment. Only approved comments are shown on the site.
+const (
+	CommentApproved = "approved"
+	CommentPending  = "pending"
+	CommentSpam     = "spam"
+	CommentTrash    = "trash"
+)
+
+// CommentStatuses lists the statuses in the order the moderation queue shows them.
+var CommentStatuses = []string{CommentPending, CommentApproved, CommentSpam, CommentTrash}
+
+// ValidCommentStatus reports whether status is one of CommentStatuses.
+func ValidCommentStatus(status string) bool {
+	for _, s := range CommentStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+type Comment struct {
+	ID           uint       `json:"id" gorm:"primaryKey"`
+	Content      string     `json:"content"`
+	UserID       uint       `json:"user_id"`
+	User         User       `json:"user" gorm:"foreignKey:UserID"`
+	PostID       uint       `json:"post_id"`
+	ParentID     *uint      `json:"parent_id" gorm:"index"` // the comment this one replies to
+	Status       string     `json:"status" gorm:"default:pending"`
+	EditedAt     *time.Time `json:"edited_at"`
+	NotifiedAt   *time.Time `json:"-"` // when the parent author was told about the reply
+	SpamScore    float64    `json:"-" gorm:"not null;default:0"`
+	SpamReasons  string     `json:"-" gorm:"size:512"` // shown to moderators only, so spammers cannot tune against it
+	SpamClass    string     `json:"-" gorm:"size:8"`   // how the spam filter was trained with it
+	IP           string     `json:"-" gorm:"size:64;index"`
+	GuestName    string     `json:"guest_name" gorm:"size:100"` // set with UserID 0 when a guest wrote it
+	GuestEmail   string     `json:"-" gorm:"size:255"`
+	GuestWebsite string     `json:"guest_website" gorm:"size:255"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// AuthorName is the name shown with the comment.
+func (c Comment) AuthorName() string {
+	switch {
+	case c.User.ID != 0:
+		return c.User.Username
+	case c.GuestName != "":
+		return c.GuestName
+	default:
+		return "Deleted user"
+	}
+}
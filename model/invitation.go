@@ -0,0 +1,30 @@
+package model
+
+import "time"
+
+// Invitation lets somebody register in any registration mode, with the role
+// chosen by the admin who invited them. Only the SHA-256 hash of the secret in
+// the emailed link is stored.
+type Invitation struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	Email     string     `json:"email" gorm:"size:255;index;not null"`
+	RoleID    uint       `json:"role_id" gorm:"not null"`
+	Role      Role       `json:"role" gorm:"foreignKey:RoleID"`
+	TokenHash string     `json:"-" gorm:"size:64;uniqueIndex;not null"`
+	InvitedBy string     `json:"invited_by" gorm:"size:255"` // username of the admin
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null"`
+	UsedAt    *time.Time `json:"used_at"`
+	UserID    *uint      `json:"user_id"` // the account created with it
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Status is "accepted", "expired" or "pending".
+func (i Invitation) Status() string {
+	switch {
+	case i.UsedAt != nil:
+		return "accepted"
+	case !i.ExpiresAt.After(time.Now()):
+		return "expired"
+	}
+	return "pending"
+}
@@ -21,13 +21,14 @@ type Menu struct {
 
 // MenuItem represents the structure for an item in a menu.
 type MenuItem struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	Title     string    `json:"title"`
-	Link      string    `json:"link"`
-	MenuID    *uint     `json:"menu_id"`                                          // Pointer to allow null (zero value)
-	Position  int       `json:"position" gorm:"index:idx_item_position,sort:asc"` // Position field for ordering items within a menu
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	Title      string    `json:"title"`
+	Link       string    `json:"link"`
+	MenuID     *uint     `json:"menu_id"`                                          // Pointer to allow null (zero value)
+	Position   int       `json:"position" gorm:"index:idx_item_position,sort:asc"` // Position field for ordering items within a menu
+	CategoryID *uint     `json:"category_id"`                                      // Opens the subcategories of this category as a dropdown
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
 }
 
 // MenuRepository defines the interface for menu repository operations.
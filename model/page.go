@@ -2,15 +2,37 @@ package model
 
 import (
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type CustomPage struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	Title     string    `json:"title"`
-	Content   string    `json:"content"`
-	Slug      string    `json:"slug"`
-	Template  string    `json:"template" gorm:"default:'page'"`
-	Published bool      `json:"published" gorm:"default:false"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	Title       string     `json:"title"`
+	Content     string     `json:"content"`
+	Slug        string     `json:"slug"`
+	Template    string     `json:"template" gorm:"default:'page'"`
+	Published   bool       `json:"published" gorm:"default:false"`
+	PublishAt   *time.Time `json:"publish_at" gorm:"index"`
+	UnpublishAt *time.Time `json:"unpublish_at" gorm:"index"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// IsVisible reports whether the page may be served at the given time. Pages
+// without a schedule are always served, as they were before scheduling existed.
+func (p CustomPage) IsVisible(now time.Time) bool {
+	if p.UnpublishAt != nil && !p.UnpublishAt.After(now) {
+		return false
+	}
+	if p.PublishAt != nil && p.PublishAt.After(now) {
+		return false
+	}
+	return true
+}
+
+// PublishedPages is a query scope matching the pages IsVisible accepts right now.
+func PublishedPages(db *gorm.DB) *gorm.DB {
+	now := time.Now()
+	return db.Where("(custom_pages.publish_at IS NULL OR custom_pages.publish_at <= ?) AND (custom_pages.unpublish_at IS NULL OR custom_pages.unpublish_at > ?)", now, now)
 }
@@ -0,0 +1,117 @@
+package model
+
+// Permission is a named capability that can be granted to a role.
+type Permission struct {
+	ID          uint   `json:"id" gorm:"primaryKey"`
+	Name        string `json:"name" gorm:"uniqueIndex;size:100"`
+	Description string `json:"description"`
+}
+
+// Built-in role IDs. Users created before roles existed already point at these.
+const (
+	RoleUserID  uint = 1
+	RoleAdminID uint = 2
+)
+
+// Built-in role names
+const (
+	RoleUser        = "User"
+	RoleAdmin       = "Admin"
+	RoleEditor      = "Editor"
+	RoleAuthor      = "Author"
+	RoleModerator   = "Moderator"
+	RoleShopManager = "Shop Manager"
+)
+
+// Permission names used by routes and handlers
+const (
+	PermAdminAccess     = "admin.access"
+	PermPostCreate      = "post.create"
+	PermPostEditOwn     = "post.edit_own"
+	PermPostEdit        = "post.edit"
+	PermPostPublish     = "post.publish"
+	PermPostDeleteOwn   = "post.delete_own"
+	PermPostDelete      = "post.delete"
+	PermTaxonomyManage  = "taxonomy.manage"
+	PermCommentCreate   = "comment.create"
+	PermCommentModerate = "comment.moderate"
+	PermPageManage      = "page.manage"
+	PermMenuManage      = "menu.manage"
+	PermMediaUpload     = "media.upload"
+	PermMediaDelete     = "media.delete"
+	PermUserManage      = "user.manage"
+	PermRoleManage      = "role.manage"
+	PermSettingsManage  = "settings.manage"
+	PermPluginManage    = "plugin.manage"
+	PermShopManage      = "shop.manage"
+	PermCacheClear      = "cache.clear"
+	PermAuditView       = "audit.view"
+)
+
+// DefaultPermissions is the list of permissions seeded on first start.
+var DefaultPermissions = []Permission{
+	{Name: PermAdminAccess, Description: "Open the admin panel"},
+	{Name: PermPostCreate, Description: "Write new posts as drafts"},
+	{Name: PermPostEditOwn, Description: "Edit own posts"},
+	{Name: PermPostEdit, Description: "Edit any post"},
+	{Name: PermPostPublish, Description: "Publish and unpublish posts"},
+	{Name: PermPostDeleteOwn, Description: "Delete own unpublished posts"},
+	{Name: PermPostDelete, Description: "Delete any post"},
+	{Name: PermTaxonomyManage, Description: "Manage categories and tags"},
+	{Name: PermCommentCreate, Description: "Write comments"},
+	{Name: PermCommentModerate, Description: "Approve and delete comments"},
+	{Name: PermPageManage, Description: "Manage custom pages"},
+	{Name: PermMenuManage, Description: "Manage menus"},
+	{Name: PermMediaUpload, Description: "Upload files to the media library"},
+	{Name: PermMediaDelete, Description: "Delete files from the media library"},
+	{Name: PermUserManage, Description: "Manage user accounts"},
+	{Name: PermRoleManage, Description: "Manage roles and their permissions"},
+	{Name: PermSettingsManage, Description: "Change website settings"},
+	{Name: PermPluginManage, Description: "Enable, disable and configure plugins"},
+	{Name: PermShopManage, Description: "Manage the shop and its products"},
+	{Name: PermCacheClear, Description: "Clear the cache"},
+	{Name: PermAuditView, Description: "View and export the audit log"},
+}
+
+// DefaultRolePermissions maps each built-in role to the permissions it gets
+// when it is first created. The admin role always gets every permission.
+var DefaultRolePermissions = map[string][]string{
+	RoleUser: {
+		PermCommentCreate,
+	},
+	RoleAuthor: {
+		PermAdminAccess, PermPostCreate, PermPostEditOwn, PermPostDeleteOwn,
+		PermMediaUpload, PermCommentCreate,
+	},
+	RoleEditor: {
+		PermAdminAccess, PermPostCreate, PermPostEditOwn, PermPostEdit, PermPostPublish,
+		PermPostDeleteOwn, PermPostDelete, PermTaxonomyManage, PermPageManage,
+		PermMenuManage, PermMediaUpload, PermMediaDelete, PermCommentCreate,
+		PermCommentModerate, PermCacheClear,
+	},
+	RoleModerator: {
+		PermAdminAccess, PermCommentCreate, PermCommentModerate,
+	},
+	RoleShopManager: {
+		PermAdminAccess, PermShopManage, PermMediaUpload, PermCommentCreate,
+	},
+}
+
+// HasPermission reports whether the role grants the named permission.
+func (r Role) HasPermission(name string) bool {
+	for _, permission := range r.Permissions {
+		if permission.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// PermissionSet returns the role's permissions as a lookup map.
+func (r Role) PermissionSet() map[string]bool {
+	set := make(map[string]bool, len(r.Permissions))
+	for _, permission := range r.Permissions {
+		set[permission.Name] = true
+	}
+	return set
+}
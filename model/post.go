@@ -2,28 +2,60 @@ package model
 
 import (
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type Post struct {
-	ID         uint       `json:"id" gorm:"primaryKey"`
-	Title      string     `json:"title"`
-	Content    string     `json:"content"`
-	UserID     uint       `json:"user_id"`
-	Categories []Category `json:"categories" gorm:"many2many:post_categories;"`
-	Tags       []Tag      `json:"tags" gorm:"many2many:post_tags;"`
-	Slug       string     `json:"slug"`
-	ImageURL   string     `json:"image_url"`
-	Published  bool       `json:"published" gorm:"default:false"`
-	CreatedAt  time.Time  `json:"created_at"`
-	UpdatedAt  time.Time  `json:"updated_at"`
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	Title       string     `json:"title"`
+	Content     string     `json:"content"`
+	UserID      uint       `json:"user_id"`
+	Categories  []Category `json:"categories" gorm:"many2many:post_categories;"`
+	Tags        []Tag      `json:"tags" gorm:"many2many:post_tags;"`
+	Slug        string     `json:"slug"`
+	ImageURL    string     `json:"image_url"`
+	Published   bool       `json:"published" gorm:"default:false"`
+	PublishAt   *time.Time `json:"publish_at" gorm:"index"`
+	UnpublishAt *time.Time `json:"unpublish_at" gorm:"index"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// IsVisible reports whether the post is publicly visible at the given time.
+// A publish date makes the post visible once it has passed, even before the
+// scheduler flips the Published flag, and an unpublish date always hides it.
+func (p Post) IsVisible(now time.Time) bool {
+	if p.UnpublishAt != nil && !p.UnpublishAt.After(now) {
+		return false
+	}
+	if p.PublishAt != nil {
+		return !p.PublishAt.After(now)
+	}
+	return p.Published
+}
+
+// IsScheduled reports whether the post has a publish date in the future.
+func (p Post) IsScheduled() bool {
+	return p.PublishAt != nil && p.PublishAt.After(time.Now())
+}
+
+// PublishedPosts is a query scope matching the posts IsVisible accepts right now.
+func PublishedPosts(db *gorm.DB) *gorm.DB {
+	now := time.Now()
+	return db.Where("(posts.published = ? OR posts.publish_at IS NOT NULL) AND (posts.publish_at IS NULL OR posts.publish_at <= ?) AND (posts.unpublish_at IS NULL OR posts.unpublish_at > ?)", true, now, now)
 }
 
 type Category struct {
-	ID         uint   `json:"id" gorm:"primaryKey"`
-	Name       string `json:"name"`
-	Slug       string `json:"slug"`
-	Posts      []Post `json:"posts" gorm:"many2many:post_categories;"`
-	PostsCount int    `json:"posts_count" gorm:"-"`
+	ID                   uint   `json:"id" gorm:"primaryKey"`
+	Name                 string `json:"name"`
+	Slug                 string `json:"slug"`
+	ParentID             *uint  `json:"parent_id" gorm:"index"` // nil for top level categories
+	Position             int    `json:"position"`               // order among the categories with the same parent
+	Description          string `json:"description"`
+	IncludeSubcategories bool   `json:"include_subcategories"` // the category page also lists the posts of its subcategories
+	Posts                []Post `json:"posts" gorm:"many2many:post_categories;"`
+	PostsCount           int    `json:"posts_count" gorm:"-"`
 }
 
 type Tag struct {
@@ -33,14 +65,3 @@ type Tag struct {
 	Posts      []Post `json:"posts" gorm:"many2many:post_tags;"`
 	PostsCount int    `json:"posts_count" gorm:"-"`
 }
-
-type Comment struct {
-	ID        uint      `json:"id" gorm:"primaryKey"`
-	Content   string    `json:"content"`
-	UserID    uint      `json:"user_id"`
-	User      User      `json:"user" gorm:"foreignKey:UserID"`
-	PostID    uint      `json:"post_id"`
-	Status    string    `json:"status" gorm:"default:pending"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-}
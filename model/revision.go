@@ -0,0 +1,98 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// RevisionTerm is the part of a category or tag kept in a revision snapshot,
+// so the revision still reads correctly after the term itself is deleted.
+type RevisionTerm struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// PostRevision is a snapshot of a post taken every time it is saved.
+type PostRevision struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	PostID     uint      `json:"post_id" gorm:"index"`
+	Title      string    `json:"title"`
+	Content    string    `json:"content"`
+	Slug       string    `json:"slug"`
+	ImageURL   string    `json:"image_url"`
+	Categories string    `json:"categories"` // JSON encoded []RevisionTerm
+	Tags       string    `json:"tags"`       // JSON encoded []RevisionTerm
+	Note       string    `json:"note"`
+	UserID     uint      `json:"user_id"`
+	User       User      `json:"user" gorm:"foreignKey:UserID"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CustomPageRevision is a snapshot of a custom page taken every time it is saved.
+type CustomPageRevision struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	CustomPageID uint      `json:"custom_page_id" gorm:"index"`
+	Title        string    `json:"title"`
+	Content      string    `json:"content"`
+	Slug         string    `json:"slug"`
+	Template     string    `json:"template"`
+	Note         string    `json:"note"`
+	UserID       uint      `json:"user_id"`
+	User         User      `json:"user" gorm:"foreignKey:UserID"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// NewPostRevision snapshots the post as it is now.
+func NewPostRevision(post Post, userID uint, note string) PostRevision {
+	categories := make([]RevisionTerm, 0, len(post.Categories))
+	for _, category := range post.Categories {
+		categories = append(categories, RevisionTerm{ID: category.ID, Name: category.Name})
+	}
+
+	tags := make([]RevisionTerm, 0, len(post.Tags))
+	for _, tag := range post.Tags {
+		tags = append(tags, RevisionTerm{ID: tag.ID, Name: tag.Name})
+	}
+
+	categoriesJSON, _ := json.Marshal(categories)
+	tagsJSON, _ := json.Marshal(tags)
+
+	return PostRevision{
+		PostID:     post.ID,
+		Title:      post.Title,
+		Content:    post.Content,
+		Slug:       post.Slug,
+		ImageURL:   post.ImageURL,
+		Categories: string(categoriesJSON),
+		Tags:       string(tagsJSON),
+		Note:       note,
+		UserID:     userID,
+	}
+}
+
+// CategoryTerms decodes the categories stored in the revision.
+func (r PostRevision) CategoryTerms() []RevisionTerm {
+	var terms []RevisionTerm
+	json.Unmarshal([]byte(r.Categories), &terms)
+	return terms
+}
+
+// TagTerms decodes the tags stored in the revision.
+func (r PostRevision) TagTerms() []RevisionTerm {
+	var terms []RevisionTerm
+	json.Unmarshal([]byte(r.Tags), &terms)
+	return terms
+}
+
+// NewCustomPageRevision snapshots the custom page as it is now.
+func NewCustomPageRevision(page CustomPage, userID uint, note string) CustomPageRevision {
+	return CustomPageRevision{
+		CustomPageID: page.ID,
+		Title:        page.Title,
+		Content:      page.Content,
+		Slug:         page.Slug,
+		Template:     page.Template,
+		Note:         note,
+		UserID:       userID,
+	}
+}
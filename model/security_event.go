@@ -0,0 +1,36 @@
+package model
+
+import (
+	"time"
+)
+
+// Types of SecurityEvent.
+const (
+	SecurityUserThrottled = "login.user_throttled" // failed logins started to slow down a username
+	SecurityIPThrottled   = "login.ip_throttled"   // failed logins started to slow down an IP address
+	SecurityUserLocked    = "login.user_locked"
+	SecurityIPLocked      = "login.ip_locked"
+	SecurityLoginUnlocked = "login.unlocked" // an admin lifted a lockout
+)
+
+// SecurityEvent records something that happened to the protection of the
+// accounts, such as a lockout after too many failed logins.
+type SecurityEvent struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Type      string    `json:"type" gorm:"size:64;index;not null"`
+	Username  string    `json:"username" gorm:"size:255;index"`
+	IP        string    `json:"ip" gorm:"size:64;index"`
+	Details   string    `json:"details" gorm:"size:512"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
+
+// LoginAttempt counts the recent failed logins of a username or an IP
+// address. The counts are changed with single statements, so every server
+// process sees and adds to the same count.
+type LoginAttempt struct {
+	Key         string `gorm:"column:login_key;primaryKey;size:255"`
+	Failures    int    `gorm:"not null;default:0"`
+	NextAttempt int64  `gorm:"not null;default:0"` // unix seconds; earlier logins are refused
+	LockedUntil int64  `gorm:"not null;default:0"` // unix seconds
+	ExpiresAt   int64  `gorm:"index;not null"`     // unix seconds; the count is forgotten afterwards
+}
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// UserSession is a login. The JWT cookie carries the JTI, and a token is
+// only accepted while its session exists, has not expired and is not revoked.
+type UserSession struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	JTI        string    `json:"-" gorm:"column:jti;size:36;uniqueIndex;not null"`
+	UserID     uint      `json:"user_id" gorm:"index;not null"`
+	IP         string    `json:"ip" gorm:"size:64"`
+	UserAgent  string    `json:"user_agent" gorm:"size:512"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at" gorm:"not null"`
+	Revoked    bool      `json:"revoked" gorm:"index;not null;default:false"`
+}
+
+// Device is a short description of the browser and system of the session,
+// guessed from the user agent.
+func (s UserSession) Device() string {
+	ua := s.UserAgent
+	if ua == "" {
+		return "Unknown device"
+	}
+
+	browser := "Unknown browser"
+	for _, candidate := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(ua, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+
+	for _, candidate := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, candidate.token) {
+			return browser + " on " + candidate.name
+		}
+	}
+	return browser
+}
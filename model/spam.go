@@ -0,0 +1,15 @@
+package model
+
+// Spam filter classes, kept on a comment once a moderator labeled it.
+const (
+	SpamClassSpam = "spam"
+	SpamClassHam  = "ham"
+)
+
+// SpamWord counts the comments labeled spam and not spam by moderators that
+// contain a word. The row with the empty word counts the labeled comments.
+type SpamWord struct {
+	Word string `gorm:"primaryKey;size:64"`
+	Spam int    `gorm:"not null;default:0"`
+	Ham  int    `gorm:"not null;default:0"`
+}
@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+// TagRedirect keeps the slug a tag had before it was renamed or merged into
+// another tag, so old links to its page lead to the tag it is now.
+type TagRedirect struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	OldSlug   string    `json:"old_slug" gorm:"uniqueIndex"`
+	TagID     uint      `json:"tag_id" gorm:"index"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,27 @@
+package model
+
+import (
+	"time"
+)
+
+// Purposes of a UserToken.
+const (
+	TokenPasswordReset     = "password_reset"
+	TokenEmailVerification = "email_verification"
+	TokenTwoFactorLogin    = "two_factor_login" // password checked, code still missing
+)
+
+// UserToken is a single use secret sent to a user by email. Only the SHA-256
+// hash of the secret is stored, so a leaked table cannot be used to take over
+// accounts.
+type UserToken struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"index;not null"`
+	Purpose   string     `json:"purpose" gorm:"size:32;index;not null"`
+	TokenHash string     `json:"-" gorm:"size:64;uniqueIndex;not null"`
+	Email     string     `json:"email" gorm:"size:255"` // address being verified
+	ExpiresAt time.Time  `json:"expires_at" gorm:"not null"`
+	UsedAt    *time.Time `json:"used_at"`
+	Attempts  int        `json:"-"` // failed tries, for tokens that guard a second step
+	CreatedAt time.Time  `json:"created_at"`
+}
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
@@ -18,12 +19,51 @@ type User struct {
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `gorm:"index"`
+
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+
+	TwoFactorEnabled  bool   `json:"two_factor_enabled"`
+	TwoFactorSecret   string `json:"-" gorm:"size:64"` // also set while enrolling, before it is enabled
+	TwoFactorLastStep int64  `json:"-"`                // time step of the last accepted code, so a code works only once
+
+	PendingApproval bool `json:"pending_approval" gorm:"index;not null;default:false"` // cannot log in until approved
+
+	// Public profile at /user/:id
+	Bio            string `form:"bio" json:"bio" gorm:"type:text" validate:"max=2000"`
+	AvatarFileID   *uint  `json:"avatar_file_id"` // an image of the media library
+	Avatar         *File  `json:"avatar,omitempty" gorm:"foreignKey:AvatarFileID"`
+	WebsiteURL     string `form:"website_url" json:"website_url" validate:"omitempty,http_url,max=255"`
+	TwitterURL     string `form:"twitter_url" json:"twitter_url" validate:"omitempty,http_url,max=255"`
+	GitHubURL      string `form:"github_url" json:"github_url" validate:"omitempty,http_url,max=255"`
+	LinkedInURL    string `form:"linkedin_url" json:"linkedin_url" validate:"omitempty,http_url,max=255"`
+	PrivateProfile bool   `json:"private_profile"` // hides the profile and keeps it out of the sitemap
+}
+
+// DisplayName is the name shown on the profile and next to posts.
+func (u User) DisplayName() string {
+	return strings.TrimSpace(u.FirstName + " " + u.LastName)
+}
+
+// EmailVerified reports whether the current email address has been confirmed.
+func (u User) EmailVerified() bool {
+	return u.Email != nil && u.EmailVerifiedAt != nil
+}
+
+// RecoveryCode is a single use code that replaces the authenticator app when
+// it is lost. Only the SHA-256 hash of the code is stored.
+type RecoveryCode struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	UserID    uint       `json:"user_id" gorm:"index;not null"`
+	CodeHash  string     `json:"-" gorm:"size:64;not null"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
 }
 
 // Role struct
 type Role struct {
-	ID   uint   `json:"id" gorm:"primaryKey"`
-	Name string `json:"name" validate:"required"`
+	ID          uint         `json:"id" gorm:"primaryKey"`
+	Name        string       `json:"name" validate:"required"`
+	Permissions []Permission `json:"permissions" gorm:"many2many:role_permissions;"`
 }
 
 // Validation function
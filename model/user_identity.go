@@ -0,0 +1,17 @@
+package model
+
+import (
+	"time"
+)
+
+// UserIdentity links a user to an account at an OpenID Connect provider, so
+// the user can sign in there instead of with a password.
+type UserIdentity struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	UserID      uint      `json:"user_id" gorm:"index;not null"`
+	Provider    string    `json:"provider" gorm:"size:64;uniqueIndex:idx_user_identity_subject;not null"`
+	Subject     string    `json:"subject" gorm:"size:255;uniqueIndex:idx_user_identity_subject;not null"`
+	Email       string    `json:"email" gorm:"size:255"` // as the provider reported it at the last login
+	CreatedAt   time.Time `json:"created_at"`
+	LastLoginAt time.Time `json:"last_login_at"`
+}
@@ -0,0 +1,91 @@
+// Package notify tells users about things that concern them, such as a reply
+// to their comment. Every registered notifier gets each notification; the
+// email notifier is registered from the start and plugins can add others,
+// such as a chat or push service, or unregister it to replace it.
+package notify
+
+import (
+	"goxcms/mail"
+	"goxcms/model"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Kinds of Notification.
+const (
+	CommentReply = "comment.reply" // Data: Post model.Post, Comment and Reply model.Comment
+)
+
+// Notification is a message for one user. Subject and Link make sense on
+// their own, so a notifier that cannot use Data can still deliver it.
+type Notification struct {
+	Kind    string
+	User    model.User
+	Subject string
+	Link    string                 // absolute URL of what the notification is about
+	Data    map[string]interface{} // documented with each kind, also passed to the email template
+}
+
+// Notifier delivers notifications through one channel.
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// NotifierFunc lets a function be used as a Notifier.
+type NotifierFunc func(n Notification) error
+
+func (f NotifierFunc) Notify(n Notification) error {
+	return f(n)
+}
+
+var (
+	mu        sync.RWMutex
+	notifiers = map[string]Notifier{"email": NotifierFunc(emailNotifier)}
+)
+
+// Register adds a notifier under a name, replacing one with the same name.
+func Register(name string, notifier Notifier) {
+	mu.Lock()
+	defer mu.Unlock()
+	notifiers[name] = notifier
+}
+
+// Unregister removes a notifier, for Teardown.
+func Unregister(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(notifiers, name)
+}
+
+// Send hands the notification to every notifier. Failures are logged, so
+// they never break the request that caused the notification.
+func Send(n Notification) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for name, notifier := range notifiers {
+		if err := notifier.Notify(n); err != nil {
+			log.Printf("Failed to send the %s notification to %s by %s: %v", n.Kind, n.User.Username, name, err)
+		}
+	}
+}
+
+// emailNotifier mails the notification with the email template named like
+// its kind, with dots replaced by underscores. Only verified addresses get
+// mail, so nobody is sent notifications for an address somebody else typed in.
+func emailNotifier(n Notification) error {
+	if !n.User.EmailVerified() {
+		return nil
+	}
+
+	data := map[string]interface{}{
+		"User": n.User,
+		"Link": n.Link,
+	}
+	for key, value := range n.Data {
+		data[key] = value
+	}
+
+	mail.Queue(*n.User.Email, n.Subject, strings.ReplaceAll(n.Kind, ".", "_"), data)
+	return nil
+}
@@ -0,0 +1,377 @@
+// Package oidc signs users in through OpenID Connect providers such as
+// Google, Keycloak or Authentik. Providers come from auth.oidc.providers in
+// the config. Each one is discovered from its issuer on first use, and the ID
+// tokens it returns are checked against the keys it publishes. Plain OAuth2
+// providers like GitHub work too when their endpoints are configured by hand;
+// the identity then comes from the userinfo endpoint alone.
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/spf13/viper"
+)
+
+// ProviderConfig is one entry of auth.oidc.providers.
+type ProviderConfig struct {
+	Name         string   `mapstructure:"name"`  // used in the callback URL
+	Label        string   `mapstructure:"label"` // shown on the login button
+	Issuer       string   `mapstructure:"issuer"`
+	ClientID     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	Scopes       []string `mapstructure:"scopes"`
+	DefaultRole  string   `mapstructure:"default_role"` // overrides auth.oidc.default_role
+	TrustEmail   bool     `mapstructure:"trust_email"`  // treat addresses as verified when the provider does not say
+
+	// Endpoints for providers without discovery. With an issuer they
+	// replace the discovered ones.
+	AuthURL     string `mapstructure:"auth_url"`
+	TokenURL    string `mapstructure:"token_url"`
+	UserInfoURL string `mapstructure:"userinfo_url"`
+}
+
+// Identity is what a provider tells about the user who signed in.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+	Name          string
+	GivenName     string
+	FamilyName    string
+}
+
+// Provider is a configured identity provider.
+type Provider struct {
+	ProviderConfig
+
+	mu          sync.Mutex
+	meta        *metadata
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+// metadata is the part of the discovery document the login needs.
+type metadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+var (
+	mu        sync.RWMutex
+	providers []*Provider
+
+	client = resty.New().SetTimeout(10 * time.Second)
+
+	validName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+)
+
+// Init loads the providers from the config. Nothing is fetched yet, so a
+// provider that is down does not stop the server from starting.
+func Init() error {
+	var configs []ProviderConfig
+	if err := viper.UnmarshalKey("auth.oidc.providers", &configs); err != nil {
+		return err
+	}
+
+	loaded := make([]*Provider, 0, len(configs))
+	seen := map[string]bool{}
+	for _, config := range configs {
+		switch {
+		case !validName.MatchString(config.Name):
+			return fmt.Errorf("provider name %q must be lowercase letters, digits, - or _", config.Name)
+		case seen[config.Name]:
+			return fmt.Errorf("provider %q is configured twice", config.Name)
+		case config.ClientID == "":
+			return fmt.Errorf("provider %q has no client_id", config.Name)
+		case config.Issuer == "" && (config.AuthURL == "" || config.TokenURL == "" || config.UserInfoURL == ""):
+			return fmt.Errorf("provider %q needs an issuer, or auth_url, token_url and userinfo_url", config.Name)
+		}
+		seen[config.Name] = true
+
+		if config.Label == "" {
+			config.Label = config.Name
+		}
+		if len(config.Scopes) == 0 {
+			config.Scopes = []string{"openid", "email", "profile"}
+		}
+		config.Issuer = strings.TrimRight(config.Issuer, "/")
+		loaded = append(loaded, &Provider{ProviderConfig: config})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	providers = loaded
+	return nil
+}
+
+// Providers returns the configured providers in config order.
+func Providers() []*Provider {
+	mu.RLock()
+	defer mu.RUnlock()
+	return providers
+}
+
+// Get returns the provider with the name.
+func Get(name string) (*Provider, bool) {
+	for _, p := range Providers() {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// RandomString returns a URL safe random string for states, nonces and PKCE
+// verifiers.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// discover returns the provider's endpoints. A successful discovery is kept
+// for the life of the process; a failed one is retried on the next login.
+func (p *Provider) discover() (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	if p.Issuer == "" {
+		p.meta = &metadata{
+			AuthorizationEndpoint: p.AuthURL,
+			TokenEndpoint:         p.TokenURL,
+			UserinfoEndpoint:      p.UserInfoURL,
+		}
+		return p.meta, nil
+	}
+
+	var meta metadata
+	if err := getJSON(p.Issuer+"/.well-known/openid-configuration", "", &meta); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimRight(meta.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovery: the document is for issuer %q", meta.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("discovery: the document lacks endpoints")
+	}
+
+	for _, override := range []struct{ value, dest *string }{
+		{&p.AuthURL, &meta.AuthorizationEndpoint},
+		{&p.TokenURL, &meta.TokenEndpoint},
+		{&p.UserInfoURL, &meta.UserinfoEndpoint},
+	} {
+		if *override.value != "" {
+			*override.dest = *override.value
+		}
+	}
+
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// AuthCodeURL returns the address of the provider's login page. The state,
+// nonce and PKCE verifier have to be kept until the callback.
+func (p *Provider) AuthCodeURL(redirectURL, state, nonce, verifier string) (string, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {redirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if p.Issuer != "" {
+		query.Set("nonce", nonce)
+	}
+
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return meta.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange trades the code from the callback for the user's identity.
+func (p *Provider) Exchange(code, redirectURL, verifier, nonce string) (Identity, error) {
+	var identity Identity
+
+	meta, err := p.discover()
+	if err != nil {
+		return identity, err
+	}
+
+	form := map[string]string{
+		"grant_type":    "authorization_code",
+		"code":          code,
+		"redirect_uri":  redirectURL,
+		"code_verifier": verifier,
+	}
+	request := client.R().SetHeader("Accept", "application/json")
+	if p.basicAuth(meta) {
+		/// RFC 6749 wants the credentials form encoded before they go into the header
+		request.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	} else {
+		form["client_id"] = p.ClientID
+		form["client_secret"] = p.ClientSecret
+	}
+
+	resp, err := request.SetFormData(form).Post(meta.TokenEndpoint)
+	if err != nil {
+		return identity, fmt.Errorf("token request: %w", err)
+	}
+
+	var token tokenResponse
+	if err := json.Unmarshal(resp.Body(), &token); err != nil {
+		return identity, fmt.Errorf("token response: %w", err)
+	}
+	if token.Error != "" {
+		return identity, fmt.Errorf("token response: %s %s", token.Error, token.ErrorDescription)
+	}
+	if resp.IsError() {
+		return identity, fmt.Errorf("token response: %s", resp.Status())
+	}
+
+	var claims map[string]interface{}
+	if p.Issuer != "" {
+		if token.IDToken == "" {
+			return identity, errors.New("token response: no id_token")
+		}
+		if claims, err = p.verifyIDToken(meta, token.IDToken, nonce); err != nil {
+			return identity, err
+		}
+	}
+
+	/// ID tokens often leave out the profile, which the userinfo endpoint has
+	if (claims == nil || claimString(claims, "email") == "") && meta.UserinfoEndpoint != "" && token.AccessToken != "" {
+		var info map[string]interface{}
+		if err := getJSON(meta.UserinfoEndpoint, token.AccessToken, &info); err != nil {
+			return identity, fmt.Errorf("userinfo: %w", err)
+		}
+		if claims == nil {
+			claims = info
+		} else if claimString(info, "sub") != claimString(claims, "sub") {
+			return identity, errors.New("userinfo: the subject does not match the ID token")
+		} else {
+			for key, value := range info {
+				if _, ok := claims[key]; !ok {
+					claims[key] = value
+				}
+			}
+		}
+	}
+	if claims == nil {
+		return identity, errors.New("the provider returned no identity")
+	}
+
+	identity = Identity{
+		Subject:    claimString(claims, "sub", "id"),
+		Email:      strings.TrimSpace(claimString(claims, "email")),
+		Username:   claimString(claims, "preferred_username", "login", "nickname"),
+		Name:       claimString(claims, "name"),
+		GivenName:  claimString(claims, "given_name"),
+		FamilyName: claimString(claims, "family_name"),
+	}
+	if identity.Subject == "" {
+		return identity, errors.New("the identity has no subject")
+	}
+
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	default:
+		identity.EmailVerified = p.TrustEmail
+	}
+	identity.EmailVerified = identity.EmailVerified && identity.Email != ""
+
+	return identity, nil
+}
+
+// basicAuth reports whether the client authenticates with HTTP basic auth,
+// which is the default of the spec, rather than in the form.
+func (p *Provider) basicAuth(meta *metadata) bool {
+	if len(meta.TokenAuthMethods) == 0 {
+		return p.Issuer != ""
+	}
+	for _, method := range meta.TokenAuthMethods {
+		if method == "client_secret_basic" {
+			return true
+		}
+	}
+	return false
+}
+
+// getJSON fetches a JSON document, with the access token if there is one.
+func getJSON(address, accessToken string, out interface{}) error {
+	request := client.R().SetHeader("Accept", "application/json")
+	if accessToken != "" {
+		request.SetAuthToken(accessToken)
+	}
+
+	resp, err := request.Get(address)
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("%s answered %s", address, resp.Status())
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(resp.String()))
+	decoder.UseNumber()
+	return decoder.Decode(out)
+}
+
+// claimString returns the first of the claims that is set. Numbers count as
+// well, since GitHub's user IDs are numeric.
+func claimString(claims map[string]interface{}, names ...string) string {
+	for _, name := range names {
+		switch value := claims[name].(type) {
+		case string:
+			if value != "" {
+				return value
+			}
+		case json.Number:
+			return value.String()
+		case float64:
+			return fmt.Sprintf("%.0f", value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,263 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// testIssuer is an OpenID Connect provider with discovery, a key set, a
+// token endpoint and a userinfo endpoint. The token endpoint hands out an ID
+// token with claims, signed by signer under the key ID tokenKid.
+type testIssuer struct {
+	*httptest.Server
+
+	key      *rsa.PrivateKey
+	kid      string
+	signer   *rsa.PrivateKey
+	tokenKid string
+	claims   jwt.MapClaims
+	userinfo map[string]interface{}
+
+	mu   sync.Mutex
+	form url.Values // the last token request
+	user string     // the client ID of its basic auth
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := &testIssuer{key: key, kid: "key-1", signer: key, tokenKid: "key-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                 is.URL,
+			"authorization_endpoint": is.URL + "/authorize",
+			"token_endpoint":         is.URL + "/token",
+			"userinfo_endpoint":      is.URL + "/userinfo",
+			"jwks_uri":               is.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": is.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(is.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(is.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user, _, _ := r.BasicAuth()
+		is.mu.Lock()
+		is.form, is.user = r.PostForm, user
+		is.mu.Unlock()
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, is.claims)
+		token.Header["kid"] = is.tokenKid
+		signed, err := token.SignedString(is.signer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]string{"access_token": "access-token", "token_type": "Bearer", "id_token": signed})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, is.userinfo)
+	})
+
+	is.Server = httptest.NewServer(mux)
+	t.Cleanup(is.Close)
+
+	is.claims = jwt.MapClaims{
+		"iss":                is.URL,
+		"aud":                "client",
+		"sub":                "subject-1",
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"preferred_username": "alice",
+		"given_name":         "Alice",
+		"family_name":        "Smith",
+		"nonce":              "nonce-1",
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+	}
+	is.userinfo = map[string]interface{}{"sub": "subject-1", "email": "alice@example.com", "email_verified": true}
+	return is
+}
+
+func (is *testIssuer) provider() *Provider {
+	return &Provider{ProviderConfig: ProviderConfig{
+		Name:         "test",
+		Issuer:       is.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Scopes:       []string{"openid", "email", "profile"},
+	}}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	is := newTestIssuer(t)
+
+	address, err := is.provider().AuthCodeURL("https://cms.example/callback", "state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(address, is.URL+"/authorize?") {
+		t.Errorf("the login page is %s", address)
+	}
+
+	challenge := sha256.Sum256([]byte("verifier-1"))
+	query := parsed.Query()
+	for name, want := range map[string]string{
+		"client_id":             "client",
+		"redirect_uri":          "https://cms.example/callback",
+		"state":                 "state-1",
+		"nonce":                 "nonce-1",
+		"code_challenge":        base64.RawURLEncoding.EncodeToString(challenge[:]),
+		"code_challenge_method": "S256",
+	} {
+		if got := query.Get(name); got != want {
+			t.Errorf("%s is %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	is := newTestIssuer(t)
+
+	identity, err := is.provider().Exchange("code-1", "https://cms.example/callback", "verifier-1", "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Identity{
+		Subject:       "subject-1",
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		Username:      "alice",
+		GivenName:     "Alice",
+		FamilyName:    "Smith",
+	}
+	if identity != want {
+		t.Errorf("the identity is %+v, want %+v", identity, want)
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if is.user != "client" {
+		t.Errorf("the client authenticated as %q", is.user)
+	}
+	for name, want := range map[string]string{
+		"grant_type":    "authorization_code",
+		"code":          "code-1",
+		"redirect_uri":  "https://cms.example/callback",
+		"code_verifier": "verifier-1",
+	} {
+		if got := is.form.Get(name); got != want {
+			t.Errorf("the token request has %s %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestExchangeUserinfo(t *testing.T) {
+	is := newTestIssuer(t)
+	delete(is.claims, "email")
+	delete(is.claims, "email_verified")
+	is.userinfo = map[string]interface{}{"sub": "subject-1", "email": "info@example.com", "email_verified": "true", "name": "Info"}
+
+	identity, err := is.provider().Exchange("code-1", "https://cms.example/callback", "verifier-1", "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Email != "info@example.com" || !identity.EmailVerified || identity.Name != "Info" {
+		t.Errorf("the identity is %+v, want the profile from the userinfo endpoint", identity)
+	}
+
+	is.userinfo["sub"] = "subject-2"
+	if _, err := is.provider().Exchange("code-1", "https://cms.example/callback", "verifier-1", "nonce-1"); err == nil || !strings.Contains(err.Error(), "subject does not match") {
+		t.Errorf("a userinfo response for another subject gave %v", err)
+	}
+}
+
+func TestExchangeChecksIDToken(t *testing.T) {
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		change  func(is *testIssuer)
+		wantErr string // empty when the token is accepted
+	}{
+		{"bad signature", func(is *testIssuer) { is.signer = other }, "verification error"},
+		{"unknown key", func(is *testIssuer) { is.tokenKid = "key-2" }, `unknown key "key-2"`},
+		{"wrong issuer", func(is *testIssuer) { is.claims["iss"] = "https://evil.example" }, "wrong issuer"},
+		{"wrong audience", func(is *testIssuer) { is.claims["aud"] = "other-client" }, "wrong audience"},
+		{"several audiences without azp", func(is *testIssuer) { is.claims["aud"] = []string{"client", "other-client"} }, "wrong audience"},
+		{"several audiences with another azp", func(is *testIssuer) {
+			is.claims["aud"] = []string{"client", "other-client"}
+			is.claims["azp"] = "other-client"
+		}, "wrong audience"},
+		{"several audiences with azp", func(is *testIssuer) {
+			is.claims["aud"] = []string{"client", "other-client"}
+			is.claims["azp"] = "client"
+		}, ""},
+		{"expired", func(is *testIssuer) { is.claims["exp"] = time.Now().Add(-2 * clockSkew).Unix() }, "expired"},
+		{"expired within the clock skew", func(is *testIssuer) { is.claims["exp"] = time.Now().Add(-clockSkew / 2).Unix() }, ""},
+		{"no expiry", func(is *testIssuer) { delete(is.claims, "exp") }, "expired"},
+		{"issued in the future", func(is *testIssuer) { is.claims["iat"] = time.Now().Add(2 * clockSkew).Unix() }, "not valid yet"},
+		{"wrong nonce", func(is *testIssuer) { is.claims["nonce"] = "nonce-2" }, "wrong nonce"},
+		{"no nonce", func(is *testIssuer) { delete(is.claims, "nonce") }, "wrong nonce"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			is := newTestIssuer(t)
+			test.change(is)
+
+			_, err := is.provider().Exchange("code-1", "https://cms.example/callback", "verifier-1", "nonce-1")
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("the token was rejected: %v", err)
+			case test.wantErr != "" && err == nil:
+				t.Errorf("the token was accepted, want %q", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Errorf("the error is %q, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+// Package plugin_settings lets plugins declare their settings as a typed
+// schema. The core renders the admin form from the schema, validates what is
+// submitted and stores the values as JSON in model.Plugin.Settings.
+package plugin_settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"goxcms/model"
+
+	"gorm.io/gorm"
+)
+
+// Type decides how a setting is rendered and validated.
+type Type string
+
+const (
+	TypeString Type = "string"
+	TypeInt    Type = "int"
+	TypeBool   Type = "bool"
+	TypeSelect Type = "select"
+	TypeURL    Type = "url"
+	TypeSecret Type = "secret" // never sent back to the browser
+)
+
+// Option is one choice of a select setting.
+type Option struct {
+	Value string
+	Label string
+}
+
+// Field describes a single setting and the rules its value must follow.
+type Field struct {
+	Key     string
+	Type    Type
+	Label   string
+	Help    string
+	Default string
+	Options []Option // for TypeSelect
+
+	Required  bool
+	Min       *int   // lowest value of a TypeInt
+	Max       *int   // highest value of a TypeInt
+	MinLength int    // in characters, 0 for no limit
+	MaxLength int    // in characters, 0 for no limit
+	Pattern   string // regular expression the whole value must match
+}
+
+// Schema is the ordered list of settings of a plugin.
+type Schema []Field
+
+// Values are the stored settings, keyed by Field.Key.
+type Values map[string]string
+
+// IntPtr returns a pointer to n, for Field.Min and Field.Max.
+func IntPtr(n int) *int {
+	return &n
+}
+
+// String returns the value of key.
+func (v Values) String(key string) string {
+	return v[key]
+}
+
+// Int returns the value of key as a number, or 0 if it is not one.
+func (v Values) Int(key string) int {
+	n, _ := strconv.Atoi(v[key])
+	return n
+}
+
+// Bool reports whether key is switched on.
+func (v Values) Bool(key string) bool {
+	b, _ := strconv.ParseBool(v[key])
+	return b
+}
+
+// Defaults returns the default value of every field.
+func (s Schema) Defaults() Values {
+	values := make(Values, len(s))
+	for _, field := range s {
+		values[field.Key] = field.Default
+	}
+	return values
+}
+
+// Redacted returns a copy of the values with the secrets masked, for logs
+// and the audit log.
+func (s Schema) Redacted(values Values) Values {
+	redacted := make(Values, len(values))
+	for key, value := range values {
+		redacted[key] = value
+	}
+	for _, field := range s {
+		if field.Type == TypeSecret && redacted[field.Key] != "" {
+			redacted[field.Key] = "[secret]"
+		}
+	}
+	return redacted
+}
+
+// Validate checks the submitted values against the schema. It returns the
+// normalized values to store and an error message per invalid field. Secrets
+// left empty keep their current value.
+func (s Schema) Validate(input, current Values) (Values, map[string]string) {
+	values := make(Values, len(s))
+	invalid := map[string]string{}
+
+	for _, field := range s {
+		value := strings.TrimSpace(input[field.Key])
+
+		if field.Type == TypeSecret && value == "" {
+			values[field.Key] = current[field.Key]
+			continue
+		}
+
+		normalized, err := field.validate(value)
+		if err != nil {
+			invalid[field.Key] = err.Error()
+			normalized = value
+		}
+		values[field.Key] = normalized
+	}
+
+	return values, invalid
+}
+
+func (f Field) validate(value string) (string, error) {
+	if f.Type == TypeBool {
+		/// unchecked checkboxes are not submitted at all
+		on := value == "on" || value == "true" || value == "1"
+		return strconv.FormatBool(on), nil
+	}
+
+	if value == "" {
+		if f.Required {
+			return "", fmt.Errorf("%s is required", f.Label)
+		}
+		return "", nil
+	}
+
+	length := len([]rune(value))
+	if f.MinLength > 0 && length < f.MinLength {
+		return "", fmt.Errorf("%s must be at least %d characters", f.Label, f.MinLength)
+	}
+	if f.MaxLength > 0 && length > f.MaxLength {
+		return "", fmt.Errorf("%s must be at most %d characters", f.Label, f.MaxLength)
+	}
+
+	switch f.Type {
+	case TypeInt:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("%s must be a whole number", f.Label)
+		}
+		if f.Min != nil && n < *f.Min {
+			return "", fmt.Errorf("%s must be at least %d", f.Label, *f.Min)
+		}
+		if f.Max != nil && n > *f.Max {
+			return "", fmt.Errorf("%s must be at most %d", f.Label, *f.Max)
+		}
+		value = strconv.Itoa(n)
+	case TypeSelect:
+		valid := false
+		for _, option := range f.Options {
+			if option.Value == value {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return "", fmt.Errorf("%s has an unknown option", f.Label)
+		}
+	case TypeURL:
+		u, err := url.ParseRequestURI(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", fmt.Errorf("%s must be an http or https URL", f.Label)
+		}
+	}
+
+	if f.Pattern != "" {
+		re, err := regexp.Compile("^(?:" + f.Pattern + ")$")
+		if err != nil {
+			return "", fmt.Errorf("%s has an invalid pattern", f.Label)
+		}
+		if !re.MatchString(value) {
+			return "", fmt.Errorf("%s has an invalid format", f.Label)
+		}
+	}
+
+	return value, nil
+}
+
+// Load returns the stored settings of the plugin, with defaults for the
+// fields that were never saved.
+func Load(db *gorm.DB, pluginName string, schema Schema) Values {
+	values := schema.Defaults()
+
+	plugin := model.Plugin{}
+	db.Where("name = ?", pluginName).First(&plugin)
+
+	stored := Values{}
+	if plugin.Settings != "" {
+		if err := json.Unmarshal([]byte(plugin.Settings), &stored); err != nil {
+			return values
+		}
+	}
+	for key, value := range stored {
+		if _, ok := values[key]; ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// Save stores the settings of the plugin.
+func Save(db *gorm.DB, pluginName string, values Values) error {
+	settingsJSON, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return db.Model(&model.Plugin{}).Where("name = ?", pluginName).Update("settings", string(settingsJSON)).Error
+}
@@ -1,6 +1,8 @@
 package plugin_system
 
 import (
+	"goxcms/plugin_settings"
+
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/template/html/v2"
 	"gorm.io/gorm"
@@ -18,3 +20,9 @@ type Plugin interface {
 	DefaultSettings() map[string]string
 	Enabled(db *gorm.DB) bool
 }
+
+// Configurable is implemented by plugins that declare their settings. The
+// plugin manager renders and validates the settings form from the schema.
+type Configurable interface {
+	SettingsSchema() plugin_settings.Schema
+}
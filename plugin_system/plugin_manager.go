@@ -43,17 +43,20 @@ func RegisterPlugin(plugin Plugin, db *gorm.DB) {
 	plugins = append(plugins, plugin)
 }
 
+// InitializePlugins mounts the plugin router on the app and sets up the
+// plugins that are enabled in the database. Plugins enabled later are set up
+// when they are switched on.
 func InitializePlugins(app *fiber.App, db *gorm.DB, engine *html.Engine) {
-	for _, plugin := range plugins {
-		/// Initialize plugin that are in the database and are enabled only
-		pluginDB := model.Plugin{}
-		db.Where("name = ?", plugin.Name()).First(&pluginDB)
-		if pluginDB.Enabled {
-			if err := plugin.Setup(app, db, engine); err != nil {
-				log.Printf("Error setting up plugin %s: %v", plugin.Name(), err)
-			}
-		}
-	}
+	config := app.Config()
+	config.Prefork = false
+	config.DisableStartupMessage = true
+
+	router = &pluginRouter{config: config, db: db, engine: engine}
+	app.Use(router.dispatch)
+	router.sync()
+
+	/// pick up plugins switched by other prefork children or from the command line
+	router.watch()
 }
 
 func GetPlugins() []Plugin {
@@ -62,8 +65,11 @@ func GetPlugins() []Plugin {
 }
 
 func TeardownPlugins() {
+	if router == nil {
+		return
+	}
 	for _, plugin := range plugins {
-		if err := plugin.Teardown(); err != nil {
+		if err := router.deactivate(plugin); err != nil {
 			log.Printf("Error tearing down plugin %s: %v", plugin.Name(), err)
 		}
 	}
@@ -78,24 +84,58 @@ func GetPluginByName(pluginName string) Plugin {
 	return nil
 }
 
+// EnableDisablePlugin flips the enabled flag of the plugin and runs its Setup
+// or Teardown right away.
 func EnableDisablePlugin(pluginName string, db *gorm.DB) error {
+	/// the flag is read and written under the lock, so two quick clicks switch the plugin twice
+	if router != nil {
+		router.toggleMu.Lock()
+		defer router.toggleMu.Unlock()
+	}
+
 	pluginDB := model.Plugin{}
 	db.Where("name = ?", pluginName).First(&pluginDB)
 	if pluginDB.ID == 0 {
 		return nil
 	}
-	/// change value in database and then reload the plugin if enabled
+
+	/// only the flag is written, so settings saved meanwhile are kept
 	pluginDB.Enabled = !pluginDB.Enabled
-	db.Save(&pluginDB)
-	println("Plugin enabled: ", pluginDB.Enabled)
-	/// reset app store from app store (cache) and reload the plugin
+	if err := db.Model(&pluginDB).Update("enabled", pluginDB.Enabled).Error; err != nil {
+		return err
+	}
 
-	return nil
+	plugin := GetPluginByName(pluginName)
+	if plugin == nil || router == nil {
+		return nil
+	}
+
+	if pluginDB.Enabled {
+		if err := router.activate(plugin); err != nil {
+			/// keep the flag in line with what is actually running
+			db.Model(&pluginDB).Update("enabled", false)
+			return err
+		}
+		return nil
+	}
+	return router.deactivate(plugin)
+}
+
+// SetPluginEnabled stores whether the plugin is enabled. Running servers
+// follow within plugins.sync_interval_seconds.
+func SetPluginEnabled(pluginName string, enabled bool, db *gorm.DB) error {
+	pluginDB := model.Plugin{}
+	if err := db.Where("name = ?", pluginName).First(&pluginDB).Error; err != nil {
+		return fmt.Errorf("plugin %s is not registered", pluginName)
+	}
+	return db.Model(&pluginDB).Update("enabled", enabled).Error
 }
 
 // / add route to enable/disable plugin
 func AddPluginManagerRoutes(app *fiber.App, db *gorm.DB) {
-	app.Get("/admin/plugins/enable/:name", handlers.IsAdmin, handlers.IsLoggedIn, enableDisablePluginHandler(db))
+	app.Get("/admin/plugins/enable/:name", handlers.IsLoggedIn, handlers.RequirePermission(model.PermPluginManage), enableDisablePluginHandler(db))
+	app.Get("/admin/plugins/:name/settings", handlers.IsLoggedIn, handlers.RequirePermission(model.PermPluginManage), pluginSettingsPage(db))
+	app.Post("/admin/plugins/:name/settings", handlers.IsLoggedIn, handlers.RequirePermission(model.PermPluginManage), updatePluginSettings(db))
 }
 
 func enableDisablePluginHandler(db *gorm.DB) fiber.Handler {
@@ -103,27 +143,30 @@ func enableDisablePluginHandler(db *gorm.DB) fiber.Handler {
 		pluginName := c.Params("name")
 		fmt.Println("Plugin name: ", pluginName)
 
-		EnableDisablePlugin(pluginName, db)
-
 		plugin := GetPluginByName(pluginName)
 		if plugin == nil {
 			fmt.Println("Plugin not found")
 			return c.SendStatus(fiber.StatusNotFound)
 		}
 
-		buttonText := "Enable"
-		if plugin.Enabled(db) {
-			buttonText = "Disable"
+		if err := EnableDisablePlugin(pluginName, db); err != nil {
+			return handlers.ShowToastError(c, "Error switching plugin: "+err.Error())
 		}
 
-		buttonClass := "btn btn-success mt-2 btn-plugin"
-		if plugin.Enabled(db) {
-			buttonClass = "btn btn-danger mt-2 btn-plugin"
+		enabled := plugin.Enabled(db)
+		buttonText, buttonClass, action := "Enable", "btn btn-success mt-2 btn-plugin", "disabled"
+		if enabled {
+			buttonText, buttonClass, action = "Disable", "btn btn-danger mt-2 btn-plugin", "enabled"
+		}
+		auditAction := "plugin.disable"
+		if enabled {
+			auditAction = "plugin.enable"
 		}
+		handlers.Audit(c, db, auditAction, "plugin", pluginName, fiber.Map{"enabled": !enabled}, fiber.Map{"enabled": enabled})
 
 		htmxResponse := fmt.Sprintf(`<button id="plugin-%s" class="%s" hx-get="/admin/plugins/enable/%s" hx-trigger="click" hx-headers='{"X-No-Cache": "true"}' hx-swap="outerHTML">%s</button>`, pluginName, buttonClass, pluginName, buttonText)
 
-		handlers.ShowToast(c, "Plugin "+buttonText+"d successfully, restart the server to see changes")
+		handlers.ShowToast(c, "Plugin "+action+" successfully")
 
 		return c.Status(fiber.StatusOK).SendString(htmxResponse)
 	}
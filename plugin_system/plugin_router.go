@@ -0,0 +1,179 @@
+package plugin_system
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"goxcms/model"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/template/html/v2"
+	"github.com/spf13/viper"
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+)
+
+// routeMissKey is set by the catch-all at the end of each plugin app when
+// none of the plugin's routes answered the request.
+type routeMissKey struct{}
+
+// mount is one enabled plugin and the app that holds its routes.
+type mount struct {
+	plugin   Plugin
+	handler  fasthttp.RequestHandler
+	inflight sync.WaitGroup
+}
+
+// pluginRouter sends requests to the apps of the enabled plugins. Each plugin
+// gets its own fiber.App, so enabling or disabling it only swaps that app in
+// or out and never touches the routes of the main app.
+type pluginRouter struct {
+	mu     sync.RWMutex
+	mounts []*mount
+
+	toggleMu sync.Mutex // serializes Setup and Teardown
+	config   fiber.Config
+	db       *gorm.DB
+	engine   *html.Engine
+}
+
+var router *pluginRouter
+
+// dispatch tries each enabled plugin in turn and continues with the main app
+// when none of them has a matching route.
+func (r *pluginRouter) dispatch(c *fiber.Ctx) error {
+	if r.serve(c) {
+		return nil
+	}
+	return c.Next()
+}
+
+// serve reports whether a plugin answered the request. The plugins are
+// released before the main app continues, as that may be the request that
+// disables one of them.
+func (r *pluginRouter) serve(c *fiber.Ctx) bool {
+	r.mu.RLock()
+	mounts := make([]*mount, len(r.mounts))
+	copy(mounts, r.mounts)
+	/// counted while holding the lock, so deactivate waits for this request
+	for _, m := range mounts {
+		m.inflight.Add(1)
+	}
+	r.mu.RUnlock()
+
+	defer func() {
+		for _, m := range mounts {
+			m.inflight.Done()
+		}
+	}()
+
+	for _, m := range mounts {
+		c.Locals(routeMissKey{}, false)
+		m.handler(c.Context())
+		if c.Locals(routeMissKey{}) != true {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *pluginRouter) active(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, m := range r.mounts {
+		if m.plugin.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// activate runs the plugin's Setup against a fresh app and starts routing
+// requests to it.
+func (r *pluginRouter) activate(plugin Plugin) error {
+	if r.active(plugin.Name()) {
+		return nil
+	}
+
+	app := fiber.New(r.config)
+	if err := plugin.Setup(app, r.db, r.engine); err != nil {
+		return err
+	}
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals(routeMissKey{}, true)
+		return nil
+	})
+
+	m := &mount{plugin: plugin, handler: app.Handler()}
+
+	r.mu.Lock()
+	r.mounts = append(r.mounts, m)
+	r.mu.Unlock()
+
+	log.Printf("Plugin %s enabled", plugin.Name())
+	return nil
+}
+
+// deactivate stops routing requests to the plugin, waits for the requests it
+// is still serving and then runs its Teardown.
+func (r *pluginRouter) deactivate(plugin Plugin) error {
+	var removed *mount
+
+	r.mu.Lock()
+	for i, m := range r.mounts {
+		if m.plugin.Name() == plugin.Name() {
+			removed = m
+			r.mounts = append(r.mounts[:i:i], r.mounts[i+1:]...)
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	if removed == nil {
+		return nil
+	}
+
+	removed.inflight.Wait()
+	log.Printf("Plugin %s disabled", plugin.Name())
+	return plugin.Teardown()
+}
+
+// sync brings every registered plugin in line with its enabled flag in the
+// database.
+func (r *pluginRouter) sync() {
+	r.toggleMu.Lock()
+	defer r.toggleMu.Unlock()
+
+	for _, plugin := range plugins {
+		pluginDB := model.Plugin{}
+		if err := r.db.Where("name = ?", plugin.Name()).First(&pluginDB).Error; err != nil {
+			continue
+		}
+
+		var err error
+		if pluginDB.Enabled {
+			err = r.activate(plugin)
+		} else {
+			err = r.deactivate(plugin)
+		}
+		if err != nil {
+			log.Printf("Error switching plugin %s: %v", plugin.Name(), err)
+		}
+	}
+}
+
+// watch keeps the process in sync with plugins switched by other processes,
+// such as the other prefork children or the command line.
+func (r *pluginRouter) watch() {
+	interval := time.Duration(viper.GetInt("plugins.sync_interval_seconds")) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			r.sync()
+		}
+	}()
+}
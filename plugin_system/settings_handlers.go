@@ -0,0 +1,105 @@
+package plugin_system
+
+import (
+	handlers "goxcms/handler"
+	"goxcms/plugin_settings"
+	"goxcms/utils"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// settingView is one field of the generated settings form.
+type settingView struct {
+	plugin_settings.Field
+	Value    string
+	HasValue bool // a secret is stored, without sending it to the browser
+	Error    string
+}
+
+func settingsForm(schema plugin_settings.Schema, values plugin_settings.Values, invalid map[string]string) []settingView {
+	fields := make([]settingView, 0, len(schema))
+	for _, field := range schema {
+		view := settingView{Field: field, Value: values[field.Key], Error: invalid[field.Key]}
+		if field.Type == plugin_settings.TypeSecret {
+			view.HasValue = view.Value != ""
+			view.Value = ""
+		}
+		fields = append(fields, view)
+	}
+	return fields
+}
+
+// configurablePlugin returns the plugin and its schema, or nil when the
+// plugin does not exist or declares no settings.
+func configurablePlugin(name string) (Plugin, plugin_settings.Schema) {
+	plugin := GetPluginByName(name)
+	if plugin == nil {
+		return nil, nil
+	}
+	configurable, ok := plugin.(Configurable)
+	if !ok {
+		return nil, nil
+	}
+	return plugin, configurable.SettingsSchema()
+}
+
+func pluginSettingsPage(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		plugin, schema := configurablePlugin(c.Params("name"))
+		if plugin == nil {
+			return c.Status(fiber.StatusNotFound).Render("404", fiber.Map{
+				"Title":    "404",
+				"Settings": c.Locals("Settings"),
+			}, "main")
+		}
+
+		values := plugin_settings.Load(db, plugin.Name(), schema)
+
+		return c.Render("admin/plugin_settings", fiber.Map{
+			"Title":      plugin.Name() + " Settings",
+			"PluginName": plugin.Name(),
+			"Fields":     settingsForm(schema, values, nil),
+			"IsAdmin":    c.Locals("isAdmin"),
+			"IsLoggedIn": c.Locals("isLoggedin"),
+			"Settings":   c.Locals("Settings"),
+		}, "main")
+	}
+}
+
+func updatePluginSettings(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		plugin, schema := configurablePlugin(c.Params("name"))
+		if plugin == nil {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+
+		input := plugin_settings.Values{}
+		for _, field := range schema {
+			input[field.Key] = c.FormValue(field.Key)
+		}
+
+		current := plugin_settings.Load(db, plugin.Name(), schema)
+		values, invalid := schema.Validate(input, current)
+
+		if len(invalid) > 0 {
+			handlers.ShowToastError(c, "Please correct the highlighted settings")
+		} else if err := plugin_settings.Save(db, plugin.Name(), values); err != nil {
+			handlers.ShowToastError(c, "Error saving settings: "+err.Error())
+		} else {
+			handlers.ShowToast(c, "Settings saved successfully")
+			values = plugin_settings.Load(db, plugin.Name(), schema)
+			/// pages the plugin renders must not keep showing the old settings
+			if err := utils.ClearCache(); err != nil {
+				log.Printf("Clearing the cache after saving the %s settings failed: %v", plugin.Name(), err)
+			}
+			handlers.Audit(c, db, "plugin.settings", "plugin", plugin.Name(), schema.Redacted(current), schema.Redacted(values))
+		}
+
+		return c.Render("admin/plugin_settings_form", fiber.Map{
+			"PluginName": plugin.Name(),
+			"Fields":     settingsForm(schema, values, invalid),
+		})
+	}
+}
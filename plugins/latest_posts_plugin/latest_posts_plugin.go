@@ -3,6 +3,7 @@ package latest_posts_plugin
 import (
 	"fmt"
 	"goxcms/model"
+	"goxcms/plugin_settings"
 	"html/template"
 
 	"github.com/gofiber/fiber/v2"
@@ -19,27 +20,31 @@ const (
 	Enabled    = false
 )
 
+var settingsSchema = plugin_settings.Schema{
+	{Key: "heading", Type: plugin_settings.TypeString, Label: "Heading", Help: "Shown above the list, leave empty to hide it", Default: "Latest Posts", MaxLength: 100},
+	{Key: "post_limit", Type: plugin_settings.TypeInt, Label: "Number of posts", Default: "5", Required: true, Min: plugin_settings.IntPtr(1), Max: plugin_settings.IntPtr(20)},
+	{Key: "show_images", Type: plugin_settings.TypeBool, Label: "Show post images", Default: "true"},
+}
+
 func (p *LatestPostsPlugin) Setup(app *fiber.App, db *gorm.DB, engine *html.Engine) error {
 	fmt.Println("LatestPosts Plugin setup")
 	app.Get("/latest_posts_plugin", func(c *fiber.Ctx) error {
-		/// if plugin is not enabled return 404
-		if !p.Enabled(db) {
-			return c.Status(404).SendString("Plugin not enabled")
-		}
+		settings := plugin_settings.Load(db, PluginName, settingsSchema)
 		posts := []model.Post{}
-		postLimit := 5
-		postQuery := db.Where("published = ?", true).Order("created_at desc").Limit(postLimit).Find(&posts)
+		postLimit := settings.Int("post_limit")
+		postQuery := db.Scopes(model.PublishedPosts).Order("created_at desc").Limit(postLimit).Find(&posts)
 		if postQuery.Error != nil {
 			return c.Status(500).SendString("Error fetching latest posts")
 		}
 
 		tmpl := template.Must(template.New("latest_posts").Parse(`
-			<p class="mb-4">Latest Posts PLUGIN</p>
+			{{if .Heading}}<p class="mb-4">{{.Heading}}</p>{{end}}
 			<div class="d-flex flex-wrap justify-content-center">
-				{{range .}}
+				{{$showImages := .ShowImages}}
+				{{range .Posts}}
 				<div class="m-2 bg-body rounded shadow">
 					<a href="/blog/post/{{.Slug}}" class="text-decoration-none d-block">
-						<img src="{{.ImageURL}}" class="w-100" style="max-height: 200px; object-fit: cover;">
+						{{if $showImages}}<img src="{{.ImageURL}}" class="w-100" style="max-height: 200px; object-fit: cover;">{{end}}
 						<div class="p-3">
 							<h3 style="font-size: 1.2rem; font-weight: bold;" class="text-secondary">
 								<a href="/blog/post/{{.Slug}}" class="text-decoration-none">{{.Title}}</a>
@@ -51,7 +56,11 @@ func (p *LatestPostsPlugin) Setup(app *fiber.App, db *gorm.DB, engine *html.Engi
 			</div>
 		`))
 
-		err := tmpl.Execute(c.Response().BodyWriter(), posts)
+		err := tmpl.Execute(c.Response().BodyWriter(), map[string]interface{}{
+			"Heading":    settings.String("heading"),
+			"ShowImages": settings.Bool("show_images"),
+			"Posts":      posts,
+		})
 		if err != nil {
 			return c.Status(500).SendString("Error rendering latest posts")
 		}
@@ -75,15 +84,15 @@ func (p *LatestPostsPlugin) Author() string {
 	return Author
 }
 func (p *LatestPostsPlugin) DefaultSettings() map[string]string {
-	return map[string]string{}
+	return settingsSchema.Defaults()
+}
+
+func (p *LatestPostsPlugin) SettingsSchema() plugin_settings.Schema {
+	return settingsSchema
 }
 
 func (p *LatestPostsPlugin) Settings(db *gorm.DB) map[string]string {
-	plugin := &model.Plugin{}
-	db.Where("name = ?", PluginName).First(plugin)
-	return map[string]string{
-		"Enabled": fmt.Sprintf("%t", plugin.Enabled),
-	}
+	return plugin_settings.Load(db, PluginName, settingsSchema)
 }
 
 func (p *LatestPostsPlugin) Version() string {
@@ -2,6 +2,7 @@ package logger_plugin
 
 import (
 	"fmt"
+	"goxcms/hooks"
 
 	"github.com/fatih/color"
 	"github.com/gofiber/fiber/v2"
@@ -9,7 +10,18 @@ import (
 	// import print color package
 )
 
-type LoggerPlugin struct{}
+type LoggerPlugin struct {
+	unsubscribe []func()
+}
+
+// events written to the log next to the requests
+var loggedEvents = []string{
+	hooks.PostCreated, hooks.PostPublished, hooks.PostUnpublished, hooks.PostDeleted,
+	hooks.CommentCreated, hooks.CommentApproved,
+	hooks.UserRegistered, hooks.UserLoggedIn,
+	hooks.FileUploaded, hooks.FileDeleted,
+	hooks.SecurityEvent,
+}
 
 func (p *LoggerPlugin) Setup(app *fiber.App, db *gorm.DB) error {
 	fmt.Println("LoggerPlugin setup")
@@ -24,11 +36,22 @@ func (p *LoggerPlugin) Setup(app *fiber.App, db *gorm.DB) error {
 		return c.Next()
 	})
 
+	for _, event := range loggedEvents {
+		event := event
+		p.unsubscribe = append(p.unsubscribe, hooks.AddAction(event, hooks.DefaultPriority, func(data interface{}) {
+			color.White("Event: %s (%T)", event, data)
+		}))
+	}
+
 	return nil
 }
 
 func (p *LoggerPlugin) Teardown() error {
 	fmt.Println("LoggerPlugin teardown")
+	for _, unsubscribe := range p.unsubscribe {
+		unsubscribe()
+	}
+	p.unsubscribe = nil
 	return nil
 }
 
@@ -1,10 +1,12 @@
 package shop_plugin
 
 import (
-	"encoding/json"
 	"fmt"
+	"goxcms/database"
 	handlers "goxcms/handler"
 	"goxcms/model"
+	"goxcms/plugin_settings"
+	"goxcms/search"
 	"html/template"
 	"math/rand"
 	"regexp"
@@ -25,12 +27,13 @@ const (
 	Enabled    = false
 )
 
-var defaultSettings = map[string]string{
-	"shop_name":        "Shop Name",
-	"shop_description": "Shop Description",
-	"shop_address":     "Shop Address",
-	"shop_phone":       "Shop Phone",
-	"shop_email":       "Shop Email",
+var settingsSchema = plugin_settings.Schema{
+	{Key: "shop_name", Type: plugin_settings.TypeString, Label: "Shop name", Default: "Shop Name", Required: true, MaxLength: 100},
+	{Key: "shop_description", Type: plugin_settings.TypeString, Label: "Shop description", Help: "Shown on the shop page", Default: "Shop Description", MaxLength: 500},
+	{Key: "shop_address", Type: plugin_settings.TypeString, Label: "Address", Default: "Shop Address", MaxLength: 200},
+	{Key: "shop_phone", Type: plugin_settings.TypeString, Label: "Phone", Default: "Shop Phone", MaxLength: 50},
+	{Key: "shop_email", Type: plugin_settings.TypeString, Label: "Email", Help: "Where customers can reach the shop", Pattern: `[^@\s]+@[^@\s]+\.[^@\s]+`},
+	{Key: "products_per_page", Type: plugin_settings.TypeInt, Label: "Products per page", Default: "10", Required: true, Min: plugin_settings.IntPtr(1), Max: plugin_settings.IntPtr(100)},
 }
 
 type Product struct {
@@ -52,6 +55,21 @@ type ProductCategory struct {
 	SubCategories string `json:"sub_categories" gorm:"default:''"`
 }
 
+func init() {
+	database.RegisterMigrations(PluginName,
+		database.Migration{
+			Version: 1,
+			Name:    "create product tables",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(&Product{}, &ProductCategory{})
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropTable(&Product{}, &ProductCategory{})
+			},
+		},
+	)
+}
+
 func (p *ShopPlugin) AddProduct(c *fiber.Ctx, db *gorm.DB) error {
 	var product Product
 
@@ -74,9 +92,35 @@ func (p *ShopPlugin) AddProduct(c *fiber.Ctx, db *gorm.DB) error {
 		})
 	}
 
+	search.Index(productDocument(product))
+
 	return c.Status(fiber.StatusCreated).SendString("Product created successfully")
 }
 
+func productDocument(product Product) search.Document {
+	return search.Document{
+		Type:  "product",
+		ID:    strconv.FormatUint(uint64(product.ID), 10),
+		Title: product.Name,
+		Body:  search.PlainText(product.Description),
+		URL:   "/product/" + strconv.FormatUint(uint64(product.ID), 10),
+	}
+}
+
+// searchDocuments feeds all products to the site search when the index is rebuilt.
+func searchDocuments(db *gorm.DB) ([]search.Document, error) {
+	var products []Product
+	if err := db.Find(&products).Error; err != nil {
+		return nil, err
+	}
+
+	docs := make([]search.Document, 0, len(products))
+	for _, product := range products {
+		docs = append(docs, productDocument(product))
+	}
+	return docs, nil
+}
+
 func sanitizeHTML(input string) string {
 	// Remove any HTML tags and attributes
 	sanitized := regexp.MustCompile(`<[^>]*>`).ReplaceAllString(input, "")
@@ -116,33 +160,6 @@ func generateRandomProducts(db *gorm.DB) error {
 func (p *ShopPlugin) Setup(app *fiber.App, db *gorm.DB, engine *html.Engine) error {
 	fmt.Println("ShopPlugin setup")
 
-	db.AutoMigrate(&Product{})
-	db.AutoMigrate(&ProductCategory{})
-
-	/// check settings if they are empty and add default settings
-	plugin := &model.Plugin{}
-	db.Where("name = ?", PluginName).First(plugin)
-	settings := plugin.Settings
-
-	if settings == "" {
-		println("Empty settings found, adding default settings")
-		defaultSettingsJSON, err := json.Marshal(p.DefaultSettings())
-		if err != nil {
-			fmt.Println("Error marshaling default settings:", err)
-			return err
-		}
-
-		plugin.Settings = string(defaultSettingsJSON)
-		db.Save(&plugin)
-		println("Default settings added")
-	}
-
-	// break point here
-	for key, value := range p.Settings(db) {
-		println("Key: ", key, " Value: ", value)
-	}
-
-	println("ShopPlugin setup done" + settings)
 	// Check if product categories exist, if not, add an example category
 	var productCategories []ProductCategory
 	if err := db.Find(&productCategories).Error; err != nil {
@@ -165,21 +182,15 @@ func (p *ShopPlugin) Setup(app *fiber.App, db *gorm.DB, engine *html.Engine) err
 		}
 	}
 
-	app.Post("/ShopPlugin/add_product", func(c *fiber.Ctx) error {
-		if !p.Enabled(db) {
-			return c.Status(404).SendString("Plugin not enabled")
-		}
+	search.RegisterProvider("product", "Product", searchDocuments)
+
+	app.Post("/ShopPlugin/add_product", handlers.IsLoggedIn, handlers.RequirePermission(model.PermShopManage), func(c *fiber.Ctx) error {
 		return p.AddProduct(c, db)
 	})
 
-	app.Get("/ShopPlugin/admin/:page?", handlers.IsLoggedIn, handlers.IsAdmin, handlers.AuthStatusMiddleware(db), func(c *fiber.Ctx) error {
-		if !p.Enabled(db) {
-			return c.Status(fiber.StatusNotFound).SendString("Plugin not enabled")
-		}
-
-		pluginSettings := p.Settings(db)
+	app.Get("/ShopPlugin/admin/:page?", handlers.IsLoggedIn, handlers.RequirePermission(model.PermShopManage), func(c *fiber.Ctx) error {
 		// Pagination parameters
-		limit := 10
+		limit := p.productsPerPage(db)
 		page := c.Params("page")
 		pageInt, err := strconv.Atoi(page)
 		if err != nil {
@@ -207,63 +218,17 @@ func (p *ShopPlugin) Setup(app *fiber.App, db *gorm.DB, engine *html.Engine) err
 		c.Set("Cache-Control", "no-store, no-cache, must-revalidate, post-check=0, pre-check=0")
 
 		return c.Render("plugins/shop_plugin/admin", fiber.Map{
-			"Title":          "Shop Admin",
-			"Products":       products,
-			"Settings":       c.Locals("Settings"),
-			"TotalPages":     totalPages,
-			"CurrentPage":    pageInt,
-			"SearchQuery":    searchQuery,
-			"PluginSettings": pluginSettings,
+			"Title":       "Shop Admin",
+			"Products":    products,
+			"Settings":    c.Locals("Settings"),
+			"TotalPages":  totalPages,
+			"CurrentPage": pageInt,
+			"SearchQuery": searchQuery,
 		}, "main")
 	})
 
-	/// /ShopPlugin/update-settings endpoint
-	app.Post("/ShopPlugin/update-settings", handlers.IsAdmin, handlers.IsLoggedIn, handlers.AuthStatusMiddleware(db), func(c *fiber.Ctx) error {
-		if !p.Enabled(db) {
-			return c.Status(fiber.StatusNotFound).SendString("Plugin not enabled")
-		}
-		println("Updating settings ---- ")
-		/// print the form values to debug
-
-		println("Shop Name: ", c.FormValue("shop_name"))
-		println("Shop Description: ", c.FormValue("shop_description"))
-		println("Shop Address: ", c.FormValue("shop_address"))
-		println("Shop Phone: ", c.FormValue("shop_phone"))
-		println("Shop Email: ", c.FormValue("shop_email"))
-
-		shopName := c.FormValue("shop_name")
-		shopDescription := c.FormValue("shop_description")
-		shopAddress := c.FormValue("shop_address")
-		shopPhone := c.FormValue("shop_phone")
-		shopEmail := c.FormValue("shop_email")
-
-		settings := map[string]string{
-			"shop_name":        shopName,
-			"shop_description": shopDescription,
-			"shop_address":     shopAddress,
-			"shop_phone":       shopPhone,
-			"shop_email":       shopEmail,
-		}
-
-		settingsJSON, err := json.Marshal(settings)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString("Error updating settings")
-		}
-
-		plugin := &model.Plugin{}
-		db.Where("name = ?", PluginName).First(plugin)
-		plugin.Settings = string(settingsJSON)
-		db.Save(&plugin)
-
-		return c.Redirect("/ShopPlugin/admin")
-	})
-
 	app.Get("/shop/:page?/:search_query?", func(c *fiber.Ctx) error {
-		if !p.Enabled(db) {
-			return c.Status(fiber.StatusNotFound).SendString("Plugin not enabled")
-		}
-
-		limit := 10
+		limit := p.productsPerPage(db)
 		page := c.Params("page")
 		pageInt, err := strconv.Atoi(page)
 		if err != nil {
@@ -302,9 +267,6 @@ func (p *ShopPlugin) Setup(app *fiber.App, db *gorm.DB, engine *html.Engine) err
 
 	/// /search-products endpoint
 	app.Get("/search-products/:page?/:search_query?", func(c *fiber.Ctx) error {
-		if !p.Enabled(db) {
-			return c.Status(fiber.StatusNotFound).SendString("Plugin not enabled")
-		}
 		searchQuery := c.Params("search_query")
 		pageStr := c.Params("page")
 
@@ -317,7 +279,7 @@ func (p *ShopPlugin) Setup(app *fiber.App, db *gorm.DB, engine *html.Engine) err
 			searchQuery = ""
 		}
 
-		limit := 10
+		limit := p.productsPerPage(db)
 		offset := (page - 1) * limit
 		var products []Product
 		var totalProducts int64
@@ -343,9 +305,6 @@ func (p *ShopPlugin) Setup(app *fiber.App, db *gorm.DB, engine *html.Engine) err
 
 	/// addd search-products-json endpoint
 	app.Get("/search-products-json/:search_query?", func(c *fiber.Ctx) error {
-		if !p.Enabled(db) {
-			return c.Status(fiber.StatusNotFound).SendString("Plugin not enabled")
-		}
 		searchQuery := c.Params("search_query")
 
 		var products []Product
@@ -358,10 +317,6 @@ func (p *ShopPlugin) Setup(app *fiber.App, db *gorm.DB, engine *html.Engine) err
 	})
 
 	app.Get("/product/:id", func(c *fiber.Ctx) error {
-		if !p.Enabled(db) {
-			return c.Status(fiber.StatusNotFound).SendString("Plugin not enabled")
-		}
-
 		productID, _ := strconv.Atoi(c.Params("id"))
 		product := Product{}
 		if err := db.First(&product, productID).Error; err != nil {
@@ -383,6 +338,7 @@ func (p *ShopPlugin) Setup(app *fiber.App, db *gorm.DB, engine *html.Engine) err
 
 func (p *ShopPlugin) Teardown() error {
 	fmt.Println("ShopPlugin teardown")
+	search.UnregisterProvider("product")
 	return nil
 }
 
@@ -399,37 +355,19 @@ func (p *ShopPlugin) Version() string {
 }
 
 func (p *ShopPlugin) DefaultSettings() map[string]string {
-	return defaultSettings
+	return settingsSchema.Defaults()
 }
 
-func (p *ShopPlugin) Settings(db *gorm.DB) map[string]string {
-	plugin := &model.Plugin{}
-	db.Where("name = ?", PluginName).First(plugin)
-
-	fmt.Println(PluginName, "settings:", plugin.Settings)
-	settings := plugin.Settings
-
-	if len(settings) == 0 {
-		defaultSettingsJSON, err := json.Marshal(p.DefaultSettings())
-		if err != nil {
-			fmt.Println("Error marshaling default settings:", err)
-			return p.DefaultSettings()
-		}
-
-		plugin.Settings = string(defaultSettingsJSON)
-		db.Save(&plugin)
-
-		return p.DefaultSettings()
-	}
+func (p *ShopPlugin) SettingsSchema() plugin_settings.Schema {
+	return settingsSchema
+}
 
-	mappedSettings := make(map[string]string)
-	err := json.Unmarshal([]byte(settings), &mappedSettings)
-	if err != nil {
-		fmt.Println("Error unmarshaling settings:", err)
-		return p.DefaultSettings()
-	}
+func (p *ShopPlugin) Settings(db *gorm.DB) map[string]string {
+	return plugin_settings.Load(db, PluginName, settingsSchema)
+}
 
-	return mappedSettings
+func (p *ShopPlugin) productsPerPage(db *gorm.DB) int {
+	return plugin_settings.Load(db, PluginName, settingsSchema).Int("products_per_page")
 }
 
 func (p *ShopPlugin) Enabled(db *gorm.DB) bool {
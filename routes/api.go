@@ -0,0 +1,76 @@
+package routes
+
+import (
+	handlers "goxcms/handler"
+	"goxcms/model"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// apiHandler adapts a handler that needs the database to a fiber.Handler.
+func apiHandler(db *gorm.DB, handler func(*fiber.Ctx, *gorm.DB) error) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return handler(c, db)
+	}
+}
+
+// apiResource holds the handlers of one resource of the JSON API.
+type apiResource struct {
+	path                              string
+	read, write                       string // scopes
+	list, get, create, update, remove func(*fiber.Ctx, *gorm.DB) error
+}
+
+// setupAPIRoutes registers the versioned JSON API. Every request needs a
+// personal access token with the scope of the resource; the handlers then
+// check the permissions of the token's user as the admin panel does.
+func setupAPIRoutes(app *fiber.App, db *gorm.DB) {
+	api := app.Group("/api/v1", handlers.APITokenAuth(db))
+
+	api.Get("/users/me", handlers.RequireAPIScope(model.ScopeUsersRead), handlers.APICurrentUser)
+
+	resources := []apiResource{
+		{"/posts", model.ScopePostsRead, model.ScopePostsWrite,
+			handlers.APIListPosts, handlers.APIGetPost, handlers.APICreatePost, handlers.APIUpdatePost, handlers.APIDeletePost},
+		{"/pages", model.ScopePagesRead, model.ScopePagesWrite,
+			handlers.APIListPages, handlers.APIGetPage, handlers.APICreatePage, handlers.APIUpdatePage, handlers.APIDeletePage},
+		{"/categories", model.ScopeCategoriesRead, model.ScopeCategoriesWrite,
+			handlers.APIListCategories, handlers.APIGetCategory, handlers.APICreateCategory, handlers.APIUpdateCategory, handlers.APIDeleteCategory},
+		{"/tags", model.ScopeTagsRead, model.ScopeTagsWrite,
+			handlers.APIListTags, handlers.APIGetTag, handlers.APICreateTag, handlers.APIUpdateTag, handlers.APIDeleteTag},
+		{"/menus", model.ScopeMenusRead, model.ScopeMenusWrite,
+			handlers.APIListMenus, handlers.APIGetMenu, handlers.APICreateMenu, handlers.APIUpdateMenu, handlers.APIDeleteMenu},
+		{"/comments", model.ScopeCommentsRead, model.ScopeCommentsWrite,
+			handlers.APIListComments, handlers.APIGetComment, handlers.APICreateComment, handlers.APIUpdateComment, handlers.APIDeleteComment},
+		{"/users", model.ScopeUsersRead, model.ScopeUsersWrite,
+			handlers.APIListUsers, handlers.APIGetUser, handlers.APICreateUser, handlers.APIUpdateUser, handlers.APIDeleteUser},
+	}
+
+	for _, resource := range resources {
+		read, write := handlers.RequireAPIScope(resource.read), handlers.RequireAPIScope(resource.write)
+
+		api.Get(resource.path, read, apiHandler(db, resource.list))
+		api.Get(resource.path+"/:id<int>", read, apiHandler(db, resource.get))
+		api.Post(resource.path, write, apiHandler(db, resource.create))
+		api.Patch(resource.path+"/:id<int>", write, apiHandler(db, resource.update))
+		api.Delete(resource.path+"/:id<int>", write, apiHandler(db, resource.remove))
+	}
+
+	menusWrite := handlers.RequireAPIScope(model.ScopeMenusWrite)
+	api.Post("/menus/:id<int>/items", menusWrite, apiHandler(db, handlers.APICreateMenuItem))
+	api.Patch("/menus/:id<int>/items/:item_id<int>", menusWrite, apiHandler(db, handlers.APIUpdateMenuItem))
+	api.Delete("/menus/:id<int>/items/:item_id<int>", menusWrite, apiHandler(db, handlers.APIDeleteMenuItem))
+
+	/// files are uploaded and deleted, but not changed
+	filesRead, filesWrite := handlers.RequireAPIScope(model.ScopeFilesRead), handlers.RequireAPIScope(model.ScopeFilesWrite)
+	api.Get("/files", filesRead, apiHandler(db, handlers.APIListFiles))
+	api.Get("/files/:id<int>", filesRead, apiHandler(db, handlers.APIGetFile))
+	api.Post("/files", filesWrite, apiHandler(db, handlers.APIUploadFile))
+	api.Delete("/files/:id<int>", filesWrite, apiHandler(db, handlers.APIDeleteFile))
+
+	/// unknown API routes answer in JSON rather than with the HTML 404 page
+	api.Use(func(c *fiber.Ctx) error {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "not found"})
+	})
+}
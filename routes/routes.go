@@ -5,9 +5,11 @@ import (
 	"html/template"
 	"strconv"
 	"strings"
+	"time"
 
 	handlers "goxcms/handler"
 	"goxcms/model"
+	"goxcms/oidc"
 	"goxcms/plugin_system"
 
 	"github.com/gofiber/fiber/v2"
@@ -72,7 +74,7 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 			path = strings.TrimPrefix(path, "/")
 
 			var customPage model.CustomPage
-			if err := db.Where("slug = ?", path).First(&customPage).Error; err != nil {
+			if err := db.Where("slug = ?", path).First(&customPage).Error; err != nil || !customPage.IsVisible(time.Now()) {
 				return c.Next()
 			}
 			// Render the custom page with the custom page data
@@ -94,6 +96,9 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 			println("Custom Page Route Created:", customPage.Slug)
 			app.Get("/"+customPage.Slug, func(cp model.CustomPage) func(*fiber.Ctx) error {
 				return func(c *fiber.Ctx) error {
+					if !cp.IsVisible(time.Now()) {
+						return c.Next()
+					}
 					return c.Render("page/"+cp.Template, fiber.Map{
 						"Title":    cp.Title,
 						"Content":  template.HTML(cp.Content),
@@ -104,6 +109,8 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 		}
 	}
 
+	setupAPIRoutes(app, db)
+
 	app.Get("/", func(c *fiber.Ctx) error {
 
 		return c.Render("index", fiber.Map{
@@ -114,9 +121,10 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 		}, "main")
 	})
 
-	app.Post("/clear-cache", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Post("/clear-cache", handlers.IsLoggedIn, handlers.RequirePermission(model.PermCacheClear), func(c *fiber.Ctx) error {
 
 		store.Reset()
+		handlers.Audit(c, db, "cache.clear", "cache", nil, nil, nil)
 
 		handlers.ShowToast(c, "Cache cleared successfully")
 
@@ -124,16 +132,7 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 	})
 
 	app.Get("/register", func(c *fiber.Ctx) error {
-
-		if c.Locals("isLoggedin") == true {
-			c.Redirect("/")
-			return nil
-		}
-
-		return c.Render("register", fiber.Map{
-			"Title":    "Register",
-			"Settings": c.Locals("Settings"),
-		}, "main")
+		return handlers.RegisterPage(c, db)
 	})
 
 	app.Post("/register", handlers.Register(db))
@@ -146,19 +145,111 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 		}
 
 		return c.Render("login", fiber.Map{
-			"Title":    "Login",
-			"Settings": c.Locals("Settings"),
+			"Title":         "Login",
+			"Settings":      c.Locals("Settings"),
+			"OIDCProviders": oidc.Providers(),
 		}, "main")
 	})
 
 	app.Post("/login", handlers.Login(db, store))
 
+	app.Get("/auth/oidc/:provider", handlers.OIDCLogin)
+	app.Get("/auth/oidc/:provider/callback", handlers.OIDCCallback(db, store))
+
+	app.Get("/login/2fa", func(c *fiber.Ctx) error {
+		return handlers.TwoFactorLoginPage(c, db)
+	})
+
+	app.Post("/login/2fa", handlers.TwoFactorLogin(db, store))
+
+	app.Get("/account/2fa", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.TwoFactorPage(c, db)
+	})
+
+	app.Post("/account/2fa/enable", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.EnableTwoFactor(c, db)
+	})
+
+	app.Post("/account/2fa/disable", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.DisableTwoFactor(c, db)
+	})
+
+	app.Post("/account/2fa/recovery-codes", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.RegenerateRecoveryCodes(c, db)
+	})
+
+	app.Get("/account/sessions", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.SessionsPage(c, db)
+	})
+
+	app.Post("/account/sessions/revoke-all", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.RevokeAllSessions(c, db)
+	})
+
+	app.Post("/account/sessions/:id/revoke", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.RevokeSession(c, db)
+	})
+
+	app.Get("/account/profile", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.ProfilePage(c, db)
+	})
+
+	app.Post("/account/profile", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.UpdateProfile(c, db)
+	})
+
+	app.Get("/account/tokens", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.APITokensPage(c, db)
+	})
+
+	app.Post("/account/tokens", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.CreateAPIToken(c, db)
+	})
+
+	app.Delete("/account/tokens/:id", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.DeleteAPIToken(c, db)
+	})
+
+	app.Get("/account/privacy", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.PrivacyPage(c, db)
+	})
+
+	app.Get("/account/privacy/export", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.ExportPersonalData(c, db)
+	})
+
+	app.Post("/account/delete", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.DeleteAccount(c, db)
+	})
+
+	app.Get("/forgot-password", handlers.ForgotPasswordPage)
+
+	app.Post("/forgot-password", func(c *fiber.Ctx) error {
+		return handlers.ForgotPassword(c, db)
+	})
+
+	app.Get("/reset-password", func(c *fiber.Ctx) error {
+		return handlers.ResetPasswordPage(c, db)
+	})
+
+	app.Post("/reset-password", func(c *fiber.Ctx) error {
+		return handlers.ResetPassword(c, db)
+	})
+
+	app.Get("/verify-email", func(c *fiber.Ctx) error {
+		return handlers.VerifyEmail(c, db)
+	})
+
+	app.Post("/verify-email/resend", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.ResendVerificationEmail(c, db)
+	})
+
 	app.Post("/logout", func(c *fiber.Ctx) error {
 
-		return handlers.Logout(c)
+		return handlers.Logout(c, db)
 	})
 
-	app.Get("/admin-settings", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Get("/admin-settings", handlers.IsLoggedIn, handlers.RequirePermission(model.PermSettingsManage), func(c *fiber.Ctx) error {
 
 		settings_cms := model.BasicWebsiteInfo{}
 
@@ -178,84 +269,108 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 
 	})
 
-	app.Post("/update-settings", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Post("/update-settings", handlers.IsLoggedIn, handlers.RequirePermission(model.PermSettingsManage), func(c *fiber.Ctx) error {
 
 		return handlers.UpdateSettings(c, db)
 	})
 
-	app.Post("/toggle-post-status", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Post("/toggle-post-status", handlers.IsLoggedIn, handlers.RequirePermission(model.PermPostPublish), func(c *fiber.Ctx) error {
 
 		return handlers.TogglePostStatus(c, db)
 	})
 
-	app.Get("/search-posts", func(c *fiber.Ctx) error {
+	app.Get("/search-posts", handlers.IsLoggedIn, handlers.RequirePermission(model.PermPostCreate), func(c *fiber.Ctx) error {
 		return handlers.AdminSearchPosts(c, db)
 	})
 
-	app.Delete("/delete-post/:id", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Delete("/delete-post/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermAdminAccess), func(c *fiber.Ctx) error {
 		return handlers.AdminDeletePost(c, db)
 	})
 
-	app.Get("/search-tags", func(c *fiber.Ctx) error {
+	app.Get("/search-tags", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
 		return handlers.SearchTag(c, db)
 	})
 
-	app.Delete("/delete-tag", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Delete("/delete-tag", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
 		return handlers.DeleteTag(c, db)
 	})
 
 	/// add tag
-	app.Post("/add-tag", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Post("/add-tag", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
 		return handlers.AddTag(c, db)
 	})
 
+	app.Get("/edit-tag/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
+		return handlers.EditTagView(c, db)
+	})
+
+	app.Post("/edit-tag/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
+		return handlers.RenameTag(c, db)
+	})
+
+	app.Post("/merge-tags", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
+		return handlers.MergeTags(c, db)
+	})
+
+	app.Get("/bulk-tag-posts", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
+		return handlers.BulkTagPostsView(c, db)
+	})
+
+	app.Post("/bulk-tag-posts", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
+		return handlers.BulkTagPosts(c, db)
+	})
+
+	app.Get("/tag-report", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
+		return handlers.TagReport(c, db)
+	})
+
 	/// add menu
-	app.Post("/add-menu", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Post("/add-menu", handlers.IsLoggedIn, handlers.RequirePermission(model.PermMenuManage), func(c *fiber.Ctx) error {
 		return handlers.AddMenu(c, db)
 
 	})
 
 	// add menu item to menu
-	app.Post("/add-menu-item", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Post("/add-menu-item", handlers.IsLoggedIn, handlers.RequirePermission(model.PermMenuManage), func(c *fiber.Ctx) error {
 		return handlers.AddMenuItem(c, db)
 	})
 
 	// delete menu item
-	app.Delete("/delete-menu-item/:id", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Delete("/delete-menu-item/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermMenuManage), func(c *fiber.Ctx) error {
 		return handlers.DeleteMenuItem(c, db)
 	})
 
 	// delete menu
-	app.Delete("/delete-menu/:id", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Delete("/delete-menu/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermMenuManage), func(c *fiber.Ctx) error {
 		return handlers.DeleteMenu(c, db)
 	})
 
 	// edit menu
-	app.Post("/edit-menu/:id", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Post("/edit-menu/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermMenuManage), func(c *fiber.Ctx) error {
 		return handlers.EditMenu(c, db)
 	})
 
 	/// remove submenu from menu
-	app.Delete("/remove-submenu/:id", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Delete("/remove-submenu/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermMenuManage), func(c *fiber.Ctx) error {
 		return handlers.RemoveSubmenuFromMenu(c, db)
 	})
 
 	// edit menu item
-	app.Post("/edit-menu-item/:id", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Post("/edit-menu-item/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermMenuManage), func(c *fiber.Ctx) error {
 		return handlers.EditMenuItem(c, db)
 	})
 
 	/// create get view for edit menu and menu item return modal htmx view
-	app.Get("/edit-menu/:id", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Get("/edit-menu/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermMenuManage), func(c *fiber.Ctx) error {
 		return handlers.EditMenuView(c, db)
 	})
 
 	/// create get view for edit menu and menu item return modal htmx view
-	app.Get("/edit-menu-item/:id", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Get("/edit-menu-item/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermMenuManage), func(c *fiber.Ctx) error {
 		return handlers.EditMenuItemView(c, db)
 	})
 
-	app.Get("/search-menu", func(c *fiber.Ctx) error {
+	app.Get("/search-menu", handlers.IsLoggedIn, handlers.RequirePermission(model.PermMenuManage), func(c *fiber.Ctx) error {
 		return handlers.SearchMenuAdminTable(c, db)
 	})
 
@@ -263,63 +378,106 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 		return handlers.GetPrimaryMenuRender(c, db)
 	})
 
-	app.Get("/search-users", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Get("/search-users", handlers.IsLoggedIn, handlers.RequirePermission(model.PermUserManage), func(c *fiber.Ctx) error {
 		return handlers.SearchUsers(c, db)
 	})
 
-	app.Get("/search-comments", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
-		return handlers.SearchCommentsView(c, db)
+	app.Post("/logout-user/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermUserManage), func(c *fiber.Ctx) error {
+		return handlers.ForceLogoutUser(c, db)
+	})
+
+	app.Post("/unlock-user/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermUserManage), func(c *fiber.Ctx) error {
+		return handlers.UnlockUser(c, db)
+	})
+
+	app.Get("/search-registrations", handlers.IsLoggedIn, handlers.RequirePermission(model.PermUserManage), func(c *fiber.Ctx) error {
+		return handlers.SearchRegistrations(c, db)
+	})
+
+	app.Post("/approve-user/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermUserManage), func(c *fiber.Ctx) error {
+		return handlers.ApproveUser(c, db)
+	})
+
+	app.Delete("/reject-user/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermUserManage), func(c *fiber.Ctx) error {
+		return handlers.RejectUser(c, db)
+	})
+
+	app.Post("/admin/invitations", handlers.IsLoggedIn, handlers.RequirePermission(model.PermUserManage), func(c *fiber.Ctx) error {
+		return handlers.CreateInvitation(c, db)
+	})
+
+	app.Delete("/admin/invitations/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermUserManage), func(c *fiber.Ctx) error {
+		return handlers.DeleteInvitation(c, db)
+	})
+
+	app.Get("/search-security-events", handlers.IsLoggedIn, handlers.RequirePermission(model.PermUserManage), func(c *fiber.Ctx) error {
+		return handlers.SearchSecurityEvents(c, db)
+	})
+
+	app.Post("/unlock-login", handlers.IsLoggedIn, handlers.RequirePermission(model.PermUserManage), func(c *fiber.Ctx) error {
+		return handlers.UnlockLogin(c, db)
 	})
 
-	/// toggle comment status#
-	app.Post("/toggle-comment-status/:id", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
-		return handlers.ToggleCommentStatus(c, db)
+	app.Get("/search-audit-events", handlers.IsLoggedIn, handlers.RequirePermission(model.PermAuditView), func(c *fiber.Ctx) error {
+		return handlers.SearchAuditEvents(c, db)
 	})
 
-	/// delete comment
-	app.Delete("/delete-comment/:id", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
-		return handlers.DeleteComment(c, db)
+	app.Get("/admin/audit/export", handlers.IsLoggedIn, handlers.RequirePermission(model.PermAuditView), func(c *fiber.Ctx) error {
+		return handlers.ExportAuditEvents(c, db)
 	})
 
-	app.Delete("/delete-user/:id", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Get("/search-comments", handlers.IsLoggedIn, handlers.RequirePermission(model.PermCommentModerate), func(c *fiber.Ctx) error {
+		return handlers.SearchCommentsView(c, db)
+	})
+
+	app.Post("/comments/bulk", handlers.IsLoggedIn, handlers.RequirePermission(model.PermCommentModerate), func(c *fiber.Ctx) error {
+		return handlers.BulkModerateComments(c, db)
+	})
+
+	app.Delete("/delete-user/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermUserManage), func(c *fiber.Ctx) error {
 		return handlers.DeleteUser(c, db)
 	})
 
-	app.Get("/search-categories", func(c *fiber.Ctx) error {
+	app.Get("/search-categories", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
 		return handlers.SearchCategories(c, db)
 	})
 
-	app.Post("/add-category", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Get("/add-category", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
+		return handlers.CategoryFormView(c, db)
+	})
+
+	app.Post("/add-category", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
 		return handlers.AddCategory(c, db)
 	})
 
-	app.Delete("/delete-category", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Get("/edit-category/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
+		return handlers.CategoryFormView(c, db)
+	})
+
+	app.Post("/edit-category/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
+		return handlers.EditCategory(c, db)
+	})
+
+	app.Delete("/delete-category", handlers.IsLoggedIn, handlers.RequirePermission(model.PermTaxonomyManage), func(c *fiber.Ctx) error {
 		return handlers.DeleteCategory(c, db)
 	})
 
-	app.Get("/search-custompages", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Get("/search-custompages", handlers.IsLoggedIn, handlers.RequirePermission(model.PermPageManage), func(c *fiber.Ctx) error {
 		return handlers.SearchCustomPages(c, db)
 	})
 
-	app.Post("/add-custompage", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Post("/add-custompage", handlers.IsLoggedIn, handlers.RequirePermission(model.PermPageManage), func(c *fiber.Ctx) error {
 		return handlers.AddCustomPage(c, db, app, engine)
 	})
 
-	app.Get("/add-custompage", func(c *fiber.Ctx) error {
-		if c.Locals("isAdmin") == false {
-			return c.Redirect("/")
-		}
+	app.Get("/add-custompage", handlers.IsLoggedIn, handlers.RequirePermission(model.PermPageManage), func(c *fiber.Ctx) error {
 		return c.Render("page/page_add", fiber.Map{
 			"TitleView": "Add Custom Page",
 			"Settings":  c.Locals("Settings"),
 		}, "main")
 	})
 
-	app.Get("/edit-custompage/:id", func(c *fiber.Ctx) error {
-		if c.Locals("isAdmin") == false {
-			return c.Redirect("/")
-		}
-
+	app.Get("/edit-custompage/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermPageManage), func(c *fiber.Ctx) error {
 		id, err := c.ParamsInt("id")
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
@@ -331,40 +489,81 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 		}
 
 		return c.Render("page/page_edit", fiber.Map{
-			"Title":    customPage.Title,
-			"Content":  customPage.Content,
-			"ID":       customPage.ID,
-			"Slug":     customPage.Slug,
-			"Template": customPage.Template,
-			"Settings": c.Locals("Settings"),
+			"Title":       customPage.Title,
+			"Content":     customPage.Content,
+			"ID":          customPage.ID,
+			"Slug":        customPage.Slug,
+			"Template":    customPage.Template,
+			"PublishAt":   handlers.ScheduleValue(customPage.PublishAt),
+			"UnpublishAt": handlers.ScheduleValue(customPage.UnpublishAt),
+			"Settings":    c.Locals("Settings"),
 		}, "main")
 	})
 
-	app.Post("/edit-custompage", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Post("/edit-custompage", handlers.IsLoggedIn, handlers.RequirePermission(model.PermPageManage), func(c *fiber.Ctx) error {
 		return handlers.EditCustomPage(c, db)
 	})
 
-	app.Delete("/delete-custompage/:id", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Delete("/delete-custompage/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermPageManage), func(c *fiber.Ctx) error {
 		return handlers.DeleteCustomPage(c, db)
 	})
 
-	app.Get("/search-files", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Get("/search-files", handlers.IsLoggedIn, handlers.RequirePermission(model.PermMediaUpload), func(c *fiber.Ctx) error {
 
 		return handlers.SearchFiles(c, db)
 	})
 
-	app.Post("/add-comment", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+	app.Post("/add-comment", handlers.RequireCommentPermission(db), func(c *fiber.Ctx) error {
 		return handlers.AddComment(c, db)
 	})
 
-	app.Post("/upload-file", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Get("/identicon/:hash", handlers.Identicon)
+
+	app.Post("/comments/:id/edit", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.EditOwnComment(c, db)
+	})
+
+	app.Post("/comments/:id/delete", handlers.IsLoggedIn, func(c *fiber.Ctx) error {
+		return handlers.DeleteOwnComment(c, db)
+	})
+
+	app.Post("/upload-file", handlers.IsLoggedIn, handlers.RequirePermission(model.PermMediaUpload), func(c *fiber.Ctx) error {
 		return handlers.UploadFile(c, db)
 	})
 
-	app.Delete("/delete-file", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Delete("/delete-file", handlers.IsLoggedIn, handlers.RequirePermission(model.PermMediaDelete), func(c *fiber.Ctx) error {
 		return handlers.DeleteFile(c, db)
 	})
 
+	app.Get("/search", func(c *fiber.Ctx) error {
+		return handlers.SearchPage(c, db)
+	})
+
+	app.Post("/admin/search/rebuild", handlers.IsLoggedIn, handlers.RequirePermission(model.PermSettingsManage), func(c *fiber.Ctx) error {
+		return handlers.RebuildSearchIndex(c, db)
+	})
+
+	/// feeds are registered before the paginated routes so :page does not swallow them
+	for file, format := range map[string]string{"feed.xml": handlers.FeedRSS, "atom.xml": handlers.FeedAtom, "feed.json": handlers.FeedJSON} {
+		format := format
+
+		app.Get("/blog/"+file, func(c *fiber.Ctx) error {
+			return handlers.BlogFeed(c, db, format)
+		})
+
+		app.Get("/blog/category/:slug/"+file, func(c *fiber.Ctx) error {
+			return handlers.BlogCategoryFeed(c, db, format)
+		})
+
+		app.Get("/blog/tag/:slug/"+file, func(c *fiber.Ctx) error {
+			return handlers.BlogTagFeed(c, db, format)
+		})
+	}
+
+	app.Get("/user/:id/:page?", func(c *fiber.Ctx) error {
+		return handlers.UserProfilePage(c, db)
+	})
+
 	app.Get("/blog/:page?", func(c *fiber.Ctx) error {
 		return handlers.BlogPage(c, db)
 	})
@@ -381,15 +580,15 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 		return handlers.BlogTagPage(c, db)
 	})
 
-	app.Get("/admin/post/edit/:post_id", func(c *fiber.Ctx) error {
+	app.Get("/admin/post/edit/:post_id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermAdminAccess), func(c *fiber.Ctx) error {
 		return handlers.AdminEditBlogPost(c, db)
 	})
 
-	app.Post("/admin/post/edit", func(c *fiber.Ctx) error {
+	app.Post("/admin/post/edit", handlers.IsLoggedIn, handlers.RequirePermission(model.PermAdminAccess), func(c *fiber.Ctx) error {
 		return handlers.AdminUpdateBlogPost(c, db)
 	})
 
-	app.Get("/admin/post/add", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Get("/admin/post/add", handlers.IsLoggedIn, handlers.RequirePermission(model.PermPostCreate), func(c *fiber.Ctx) error {
 
 		var categories []model.Category
 		var tags []model.Tag
@@ -403,6 +602,7 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 
 		return c.Render("admin/post/post_add", fiber.Map{
 			"Title":      "Add Post",
+			"CanPublish": handlers.HasPermission(c, model.PermPostPublish),
 			"Categories": categories,
 			"Tags":       tags,
 			"Content":    template.HTML(html_basic_test),
@@ -412,21 +612,35 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 		}, "main")
 	})
 
-	app.Post("/admin/post/add", func(c *fiber.Ctx) error {
+	app.Post("/admin/post/add", handlers.IsLoggedIn, handlers.RequirePermission(model.PermPostCreate), func(c *fiber.Ctx) error {
 
 		return handlers.AdminAddBlogPost(c, db)
 	})
 
-	app.Get("/admin", handlers.IsLoggedIn, handlers.IsAdmin, func(c *fiber.Ctx) error {
+	app.Get("/admin/revisions/:kind/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermAdminAccess), func(c *fiber.Ctx) error {
+		return handlers.ListRevisions(c, db)
+	})
+
+	app.Get("/admin/revisions/:kind/:id/diff", handlers.IsLoggedIn, handlers.RequirePermission(model.PermAdminAccess), func(c *fiber.Ctx) error {
+		return handlers.RevisionDiff(c, db)
+	})
+
+	app.Post("/admin/revisions/:kind/:id/restore/:revision_id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermAdminAccess), func(c *fiber.Ctx) error {
+		return handlers.RestoreRevision(c, db)
+	})
+
+	app.Get("/admin", handlers.IsLoggedIn, handlers.RequirePermission(model.PermAdminAccess), func(c *fiber.Ctx) error {
 
 		plugins := plugin_system.GetPlugins()
 		pluginData := make([]map[string]interface{}, 0, len(plugins))
 		for _, plugin := range plugins {
+			_, configurable := plugin.(plugin_system.Configurable)
 			pluginData = append(pluginData, map[string]interface{}{
-				"Name":    plugin.Name(),
-				"Enabled": plugin.Enabled(db),
-				"Author":  plugin.Author(),
-				"Version": plugin.Version(),
+				"Name":        plugin.Name(),
+				"Enabled":     plugin.Enabled(db),
+				"Author":      plugin.Author(),
+				"Version":     plugin.Version(),
+				"HasSettings": configurable,
 			})
 		}
 
@@ -435,6 +649,7 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 
 		return c.Render("admin/admin", fiber.Map{
 			"Title":          "Admin Panel",
+			"Permissions":    c.Locals("permissions"),
 			"IsAdmin":        c.Locals("isAdmin"),
 			"IsLoggedIn":     c.Locals("isLoggedin"),
 			"Settings":       c.Locals("Settings"),
@@ -443,6 +658,26 @@ func SetupRoutes(app *fiber.App, db *gorm.DB, store *session.Store, engine *html
 		}, "main")
 	})
 
+	app.Get("/search-roles", handlers.IsLoggedIn, handlers.RequirePermission(model.PermRoleManage), func(c *fiber.Ctx) error {
+		return handlers.SearchRoles(c, db)
+	})
+
+	app.Post("/add-role", handlers.IsLoggedIn, handlers.RequirePermission(model.PermRoleManage), func(c *fiber.Ctx) error {
+		return handlers.AddRole(c, db)
+	})
+
+	app.Delete("/delete-role/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermRoleManage), func(c *fiber.Ctx) error {
+		return handlers.DeleteRole(c, db)
+	})
+
+	app.Post("/toggle-role-permission", handlers.IsLoggedIn, handlers.RequirePermission(model.PermRoleManage), func(c *fiber.Ctx) error {
+		return handlers.ToggleRolePermission(c, db)
+	})
+
+	app.Post("/set-user-role/:id", handlers.IsLoggedIn, handlers.RequirePermission(model.PermRoleManage), func(c *fiber.Ctx) error {
+		return handlers.SetUserRole(c, db)
+	})
+
 	app.Get("/sitemap.xml", func(c *fiber.Ctx) error {
 		return c.SendFile("./static/sitemap.xml")
 	})
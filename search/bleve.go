@@ -0,0 +1,235 @@
+package search
+
+import (
+	"html/template"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// Open visibility windows are stored as these bounds, because Bleve cannot
+// query for missing fields. Dates are indexed in nanoseconds, so the upper
+// bound has to stay below the year 2262.
+var (
+	visibleMin = time.Unix(0, 0).UTC()
+	visibleMax = time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// bleveEngine is an embedded index that works with every database. It lives
+// on disk, or in memory when path is empty.
+type bleveEngine struct {
+	mu    sync.RWMutex
+	path  string
+	index bleve.Index
+}
+
+type bleveDocument struct {
+	Type         string    `json:"type"`
+	DocID        string    `json:"doc_id"`
+	Title        string    `json:"title"`
+	Body         string    `json:"body"`
+	URL          string    `json:"url"`
+	VisibleFrom  time.Time `json:"visible_from"`
+	VisibleUntil time.Time `json:"visible_until"`
+}
+
+func newBleveEngine(path string) (*bleveEngine, error) {
+	index, err := bleve.Open(path)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		index, err = bleve.New(path, bleve.NewIndexMapping())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &bleveEngine{path: path, index: index}, nil
+}
+
+// newMemoryBleveEngine is used with prefork, where only one process could
+// hold the lock on an index on disk.
+func newMemoryBleveEngine() (*bleveEngine, error) {
+	index, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		return nil, err
+	}
+	return &bleveEngine{index: index}, nil
+}
+
+func (e *bleveEngine) Name() string {
+	if e.path == "" {
+		return "Bleve (in memory)"
+	}
+	return "Bleve (" + e.path + ")"
+}
+
+func (e *bleveEngine) Index(docs ...Document) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return indexBleve(e.index, docs)
+}
+
+func indexBleve(index bleve.Index, docs []Document) error {
+	batch := index.NewBatch()
+	for _, doc := range docs {
+		stored := bleveDocument{
+			Type:         doc.Type,
+			DocID:        doc.ID,
+			Title:        doc.Title,
+			Body:         doc.Body,
+			URL:          doc.URL,
+			VisibleFrom:  visibleMin,
+			VisibleUntil: visibleMax,
+		}
+		if doc.VisibleFrom != nil {
+			stored.VisibleFrom = doc.VisibleFrom.UTC()
+		}
+		if doc.VisibleUntil != nil {
+			stored.VisibleUntil = doc.VisibleUntil.UTC()
+		}
+		if err := batch.Index(doc.Key(), stored); err != nil {
+			return err
+		}
+	}
+	return index.Batch(batch)
+}
+
+func (e *bleveEngine) Remove(docType, id string) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.index.Delete(Document{Type: docType, ID: id}.Key())
+}
+
+// Clear replaces the index with an empty one.
+func (e *bleveEngine) Clear() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.index.Close(); err != nil {
+		return err
+	}
+
+	var index bleve.Index
+	var err error
+	if e.path == "" {
+		index, err = bleve.NewMemOnly(bleve.NewIndexMapping())
+	} else {
+		if err := os.RemoveAll(e.path); err != nil {
+			return err
+		}
+		index, err = bleve.New(e.path, bleve.NewIndexMapping())
+	}
+	if err != nil {
+		return err
+	}
+	e.index = index
+	return nil
+}
+
+// Swap builds an in-memory index next to the live one and switches over when
+// it is complete, so searches never see a half built index. Indexes on disk
+// are cleared and rebuilt in place.
+func (e *bleveEngine) Swap(build func(index func(docs ...Document) error) error) error {
+	if e.path != "" {
+		if err := e.Clear(); err != nil {
+			return err
+		}
+		return build(e.Index)
+	}
+
+	fresh, err := bleve.NewMemOnly(bleve.NewIndexMapping())
+	if err != nil {
+		return err
+	}
+	err = build(func(docs ...Document) error {
+		return indexBleve(fresh, docs)
+	})
+	if err != nil {
+		fresh.Close()
+		return err
+	}
+
+	e.mu.Lock()
+	old := e.index
+	e.index = fresh
+	e.mu.Unlock()
+	return old.Close()
+}
+
+func (e *bleveEngine) Count() (int, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	count, err := e.index.DocCount()
+	return int(count), err
+}
+
+func (e *bleveEngine) Search(q string, offset, limit int) (Results, error) {
+	var results Results
+	terms := Terms(q)
+	if len(terms) == 0 {
+		return results, nil
+	}
+	text := strings.Join(terms, " ")
+
+	title := bleve.NewMatchQuery(text)
+	title.SetField("title")
+	title.SetBoost(10)
+	body := bleve.NewMatchQuery(text)
+	body.SetField("body")
+
+	// the last word also matches as a prefix, like the SQLite engine
+	last := terms[len(terms)-1]
+	titlePrefix := bleve.NewPrefixQuery(last)
+	titlePrefix.SetField("title")
+	titlePrefix.SetBoost(5)
+	bodyPrefix := bleve.NewPrefixQuery(last)
+	bodyPrefix.SetField("body")
+	bodyPrefix.SetBoost(0.5)
+
+	now := time.Now().UTC()
+	inclusive, exclusive := true, false
+	from := bleve.NewDateRangeInclusiveQuery(visibleMin, now, &inclusive, &inclusive)
+	from.SetField("visible_from")
+	until := bleve.NewDateRangeInclusiveQuery(now, visibleMax, &exclusive, &inclusive)
+	until.SetField("visible_until")
+
+	request := bleve.NewSearchRequestOptions(
+		bleve.NewConjunctionQuery(bleve.NewDisjunctionQuery(title, body, titlePrefix, bodyPrefix), from, until),
+		limit, offset, false,
+	)
+	request.Fields = []string{"type", "doc_id", "title", "url", "body"}
+	request.Highlight = bleve.NewHighlightWithStyle("html")
+	request.Highlight.AddField("body")
+
+	e.mu.RLock()
+	response, err := e.index.Search(request)
+	e.mu.RUnlock()
+	if err != nil {
+		return results, err
+	}
+
+	results.Total = int(response.Total)
+	for _, match := range response.Hits {
+		hit := Hit{
+			Type:  fieldString(match.Fields, "type"),
+			ID:    fieldString(match.Fields, "doc_id"),
+			Title: fieldString(match.Fields, "title"),
+			URL:   fieldString(match.Fields, "url"),
+			Score: match.Score,
+		}
+		// the html highlighter escapes the text and wraps matches in <mark>
+		if fragments := match.Fragments["body"]; len(fragments) > 0 {
+			hit.Snippet = template.HTML(strings.Join(fragments, " &hellip; "))
+		} else {
+			hit.Snippet = Highlight(fieldString(match.Fields, "body"), text, 240)
+		}
+		results.Hits = append(results.Hits, hit)
+	}
+	return results, nil
+}
+
+func fieldString(fields map[string]interface{}, name string) string {
+	value, _ := fields[name].(string)
+	return value
+}
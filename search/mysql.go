@@ -0,0 +1,93 @@
+package search
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// mysqlEngine uses InnoDB FULLTEXT indexes in natural language mode. MySQL
+// has no snippet function, so highlighting is done in Go.
+type mysqlEngine struct {
+	sqlIndex
+}
+
+func newMySQLEngine(db *gorm.DB) (*mysqlEngine, error) {
+	err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + indexTable + ` (
+		doc_key varchar(191) NOT NULL PRIMARY KEY,
+		doc_type varchar(64) NOT NULL,
+		doc_id varchar(64) NOT NULL,
+		title text NOT NULL,
+		body mediumtext NOT NULL,
+		url text NOT NULL,
+		visible_from datetime NULL,
+		visible_until datetime NULL,
+		FULLTEXT KEY ft_` + indexTable + `_title (title),
+		FULLTEXT KEY ft_` + indexTable + ` (title, body)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`).Error
+	if err != nil {
+		return nil, err
+	}
+	return &mysqlEngine{sqlIndex{db}}, nil
+}
+
+func (e *mysqlEngine) Name() string {
+	return "MySQL FULLTEXT"
+}
+
+func (e *mysqlEngine) Index(docs ...Document) error {
+	return e.db.Transaction(func(tx *gorm.DB) error {
+		for _, doc := range docs {
+			err := tx.Exec("REPLACE INTO "+indexTable+" (doc_key, doc_type, doc_id, title, body, url, visible_from, visible_until) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+				doc.Key(), doc.Type, doc.ID, doc.Title, doc.Body, doc.URL, nullableTime(doc.VisibleFrom), nullableTime(doc.VisibleUntil)).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *mysqlEngine) Search(query string, offset, limit int) (Results, error) {
+	var results Results
+	terms := Terms(query)
+	if len(terms) == 0 {
+		return results, nil
+	}
+	against := strings.Join(terms, " ")
+	now := time.Now()
+
+	var total int64
+	err := e.db.Raw("SELECT COUNT(*) FROM "+indexTable+" WHERE MATCH(title, body) AGAINST (? IN NATURAL LANGUAGE MODE) AND "+visibleClause,
+		against, now, now).
+		Scan(&total).Error
+	if err != nil {
+		return results, err
+	}
+	results.Total = int(total)
+
+	var rows []sqlHit
+	err = e.db.Raw(`SELECT doc_type, doc_id, title, url, body,
+			MATCH(title) AGAINST (? IN NATURAL LANGUAGE MODE) * 2 + MATCH(title, body) AGAINST (? IN NATURAL LANGUAGE MODE) AS score
+		FROM `+indexTable+`
+		WHERE MATCH(title, body) AGAINST (? IN NATURAL LANGUAGE MODE) AND `+visibleClause+`
+		ORDER BY score DESC LIMIT ? OFFSET ?`,
+		against, against, against, now, now, limit, offset).
+		Scan(&rows).Error
+	if err != nil {
+		return results, err
+	}
+
+	for _, row := range rows {
+		results.Hits = append(results.Hits, Hit{
+			Type:    row.DocType,
+			ID:      row.DocID,
+			Title:   row.Title,
+			URL:     row.URL,
+			Score:   row.Score,
+			Snippet: Highlight(row.Body, against, 240),
+		})
+	}
+	return results, nil
+}
@@ -0,0 +1,108 @@
+package search
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// postgresEngine stores a weighted tsvector per document behind a GIN index.
+type postgresEngine struct {
+	sqlIndex
+	language string // text search configuration, e.g. "simple" or "english"
+}
+
+func newPostgresEngine(db *gorm.DB, language string) (*postgresEngine, error) {
+	if language == "" {
+		language = "simple"
+	}
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS ` + indexTable + ` (
+			doc_key varchar(191) PRIMARY KEY,
+			doc_type varchar(64) NOT NULL,
+			doc_id varchar(64) NOT NULL,
+			title text NOT NULL,
+			body text NOT NULL,
+			url text NOT NULL,
+			visible_from timestamptz NULL,
+			visible_until timestamptz NULL,
+			tsv tsvector NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_` + indexTable + `_tsv ON ` + indexTable + ` USING GIN (tsv)`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	return &postgresEngine{sqlIndex: sqlIndex{db}, language: language}, nil
+}
+
+func (e *postgresEngine) Name() string {
+	return "Postgres tsvector (" + e.language + ")"
+}
+
+func (e *postgresEngine) Index(docs ...Document) error {
+	return e.db.Transaction(func(tx *gorm.DB) error {
+		for _, doc := range docs {
+			err := tx.Exec(`INSERT INTO `+indexTable+` (doc_key, doc_type, doc_id, title, body, url, visible_from, visible_until, tsv)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?,
+					setweight(to_tsvector(?::regconfig, ?), 'A') || setweight(to_tsvector(?::regconfig, ?), 'B'))
+				ON CONFLICT (doc_key) DO UPDATE SET
+					title = EXCLUDED.title, body = EXCLUDED.body, url = EXCLUDED.url,
+					visible_from = EXCLUDED.visible_from, visible_until = EXCLUDED.visible_until, tsv = EXCLUDED.tsv`,
+				doc.Key(), doc.Type, doc.ID, doc.Title, doc.Body, doc.URL, nullableTime(doc.VisibleFrom), nullableTime(doc.VisibleUntil),
+				e.language, doc.Title, e.language, doc.Body).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *postgresEngine) Search(query string, offset, limit int) (Results, error) {
+	var results Results
+	if len(Terms(query)) == 0 {
+		return results, nil
+	}
+	now := time.Now()
+
+	var total int64
+	err := e.db.Raw("SELECT COUNT(*) FROM "+indexTable+" WHERE tsv @@ websearch_to_tsquery(?::regconfig, ?) AND "+visibleClause,
+		e.language, query, now, now).
+		Scan(&total).Error
+	if err != nil {
+		return results, err
+	}
+	results.Total = int(total)
+
+	headline := "StartSel=" + markStart + ", StopSel=" + markEnd + ", MaxFragments=2, MaxWords=30, MinWords=10, FragmentDelimiter=\" … \""
+
+	var rows []sqlHit
+	err = e.db.Raw(`SELECT doc_type, doc_id, title, url,
+			ts_rank(tsv, q) AS score,
+			ts_headline(?::regconfig, body, q, ?) AS snippet
+		FROM `+indexTable+`, websearch_to_tsquery(?::regconfig, ?) q
+		WHERE tsv @@ q AND `+visibleClause+`
+		ORDER BY score DESC LIMIT ? OFFSET ?`,
+		e.language, headline, e.language, query, now, now, limit, offset).
+		Scan(&rows).Error
+	if err != nil {
+		return results, err
+	}
+
+	for _, row := range rows {
+		results.Hits = append(results.Hits, Hit{
+			Type:    row.DocType,
+			ID:      row.DocID,
+			Title:   row.Title,
+			URL:     row.URL,
+			Score:   row.Score,
+			Snippet: markedSnippet(row.Snippet),
+		})
+	}
+	return results, nil
+}
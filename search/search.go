@@ -0,0 +1,358 @@
+// Package search keeps a full text index of posts, custom pages and documents
+// provided by plugins, and answers ranked queries against it. The index lives
+// behind the Engine interface so each database can use its native full text
+// support, with an embedded Bleve index as the fallback.
+package search
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"goxcms/model"
+
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// Built-in document types.
+const (
+	TypePost = "post"
+	TypePage = "page"
+)
+
+// ErrUnavailable is returned when no search engine could be started.
+var ErrUnavailable = errors.New("search is not available")
+
+// Document is a single searchable item. Body is plain text; use PlainText to
+// convert HTML content. A document is only returned while the current time is
+// inside its optional visibility window.
+type Document struct {
+	Type         string
+	ID           string
+	Title        string
+	Body         string
+	URL          string
+	VisibleFrom  *time.Time
+	VisibleUntil *time.Time
+}
+
+// Key identifies the document across all types.
+func (d Document) Key() string {
+	return d.Type + ":" + d.ID
+}
+
+// Hit is a single ranked search result.
+type Hit struct {
+	Type    string
+	ID      string
+	Title   string
+	URL     string
+	Score   float64
+	Snippet template.HTML // escaped text with matches wrapped in <mark>
+}
+
+// Label is the human readable name of the hit's document type.
+func (h Hit) Label() string {
+	return Label(h.Type)
+}
+
+// Results is one page of hits plus the total number of matches.
+type Results struct {
+	Hits  []Hit
+	Total int
+}
+
+// Engine is a full text index backend.
+type Engine interface {
+	Name() string
+	Index(docs ...Document) error
+	Remove(docType, id string) error
+	Clear() error
+	Count() (int, error)
+	Search(query string, offset, limit int) (Results, error)
+}
+
+// swapper is implemented by engines that can build a new index next to the
+// live one and switch over once it is complete.
+type swapper interface {
+	Swap(build func(index func(docs ...Document) error) error) error
+}
+
+// Provider returns every document of one type, for full rebuilds of the index.
+type Provider func(db *gorm.DB) ([]Document, error)
+
+type providerEntry struct {
+	label    string
+	provider Provider
+}
+
+var (
+	engine Engine
+
+	providersMu sync.RWMutex
+	providers   = map[string]providerEntry{}
+)
+
+// RegisterProvider lets a plugin add its own documents to the index. Plugins
+// call Index and Remove themselves when a single document changes.
+func RegisterProvider(docType, label string, provider Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[docType] = providerEntry{label: label, provider: provider}
+}
+
+// UnregisterProvider stops adding a plugin's documents to the index. They
+// stay searchable until the next rebuild.
+func UnregisterProvider(docType string) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	delete(providers, docType)
+}
+
+// Label returns the display name registered for a document type.
+func Label(docType string) string {
+	switch docType {
+	case TypePost:
+		return "Post"
+	case TypePage:
+		return "Page"
+	}
+
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	if entry, ok := providers[docType]; ok {
+		return entry.label
+	}
+	return docType
+}
+
+// New creates the engine selected by search.engine. With "auto" the database
+// driver decides, and SQLite builds without FTS5 fall back to Bleve.
+func New(db *gorm.DB) (Engine, error) {
+	switch viper.GetString("search.engine") {
+	case "bleve":
+		return newBleve()
+	case "sqlite":
+		return newSQLiteEngine(db)
+	case "postgres":
+		return newPostgresEngine(db, viper.GetString("search.language"))
+	case "mysql":
+		return newMySQLEngine(db)
+	}
+
+	switch db.Dialector.Name() {
+	case "sqlite":
+		e, err := newSQLiteEngine(db)
+		if err == nil {
+			return e, nil
+		}
+		log.Printf("SQLite FTS5 unavailable (%v), falling back to Bleve", err)
+	case "postgres":
+		return newPostgresEngine(db, viper.GetString("search.language"))
+	case "mysql":
+		return newMySQLEngine(db)
+	}
+
+	return newBleve()
+}
+
+// newBleve opens the Bleve index on disk, or keeps one in memory per process
+// when prefork is enabled.
+func newBleve() (*bleveEngine, error) {
+	if viper.GetBool("server.prefork") {
+		return newMemoryBleveEngine()
+	}
+	return newBleveEngine(viper.GetString("search.bleve_path"))
+}
+
+// Init starts the configured engine and builds the index in the background
+// when it is empty. Call it after the plugins registered their providers.
+func Init(db *gorm.DB) error {
+	e, err := New(db)
+	if err != nil {
+		return err
+	}
+	engine = e
+	log.Printf("Search engine: %s", e.Name())
+
+	if count, err := e.Count(); err == nil && count == 0 {
+		go func() {
+			if err := Rebuild(db); err != nil {
+				log.Printf("Error building search index: %v", err)
+			}
+		}()
+	}
+
+	/// in-memory indexes only see changes made by their own process, so
+	/// refresh them regularly
+	if b, ok := e.(*bleveEngine); ok && b.path == "" {
+		interval := time.Duration(viper.GetInt("search.refresh_minutes")) * time.Minute
+		if interval <= 0 {
+			interval = 10 * time.Minute
+		}
+		go func() {
+			for range time.Tick(interval) {
+				if err := Rebuild(db); err != nil {
+					log.Printf("Error refreshing search index: %v", err)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// Search runs a query against the active engine. Pages start at 1.
+func Search(query string, page, perPage int) (Results, error) {
+	if engine == nil {
+		return Results{}, ErrUnavailable
+	}
+	if page < 1 {
+		page = 1
+	}
+	return engine.Search(query, (page-1)*perPage, perPage)
+}
+
+// Index adds or replaces documents. Errors are logged, as a stale index must
+// not fail the request that changed the content.
+func Index(docs ...Document) {
+	if engine == nil || len(docs) == 0 {
+		return
+	}
+	if err := engine.Index(docs...); err != nil {
+		log.Printf("Error indexing documents: %v", err)
+	}
+}
+
+// Remove drops a document from the index.
+func Remove(docType, id string) {
+	if engine == nil {
+		return
+	}
+	if err := engine.Remove(docType, id); err != nil {
+		log.Printf("Error removing %s %s from the search index: %v", docType, id, err)
+	}
+}
+
+// Rebuild clears the index and indexes all posts, pages and provider documents.
+func Rebuild(db *gorm.DB) error {
+	if engine == nil {
+		return ErrUnavailable
+	}
+
+	build := func(index func(docs ...Document) error) error {
+		return eachDocument(db, index)
+	}
+	if s, ok := engine.(swapper); ok {
+		return s.Swap(build)
+	}
+
+	if err := engine.Clear(); err != nil {
+		return err
+	}
+	return build(engine.Index)
+}
+
+// eachDocument loads everything that belongs in the index and passes it to
+// index in batches.
+func eachDocument(db *gorm.DB, index func(docs ...Document) error) error {
+	var posts []model.Post
+	err := db.Where("published = ? OR publish_at IS NOT NULL", true).FindInBatches(&posts, 200, func(tx *gorm.DB, batch int) error {
+		docs := make([]Document, 0, len(posts))
+		for _, post := range posts {
+			docs = append(docs, PostDocument(post))
+		}
+		return index(docs...)
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	var pages []model.CustomPage
+	if err := db.Find(&pages).Error; err != nil {
+		return err
+	}
+	docs := make([]Document, 0, len(pages))
+	for _, page := range pages {
+		docs = append(docs, PageDocument(page))
+	}
+	if err := index(docs...); err != nil {
+		return err
+	}
+
+	providersMu.RLock()
+	entries := make(map[string]providerEntry, len(providers))
+	for docType, entry := range providers {
+		entries[docType] = entry
+	}
+	providersMu.RUnlock()
+
+	for docType, entry := range entries {
+		docs, err := entry.provider(db)
+		if err != nil {
+			log.Printf("Error loading %s documents for the search index: %v", docType, err)
+			continue
+		}
+		for start := 0; start < len(docs); start += 500 {
+			end := start + 500
+			if end > len(docs) {
+				end = len(docs)
+			}
+			if err := index(docs[start:end]...); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// PostDocument converts a post to a search document.
+func PostDocument(post model.Post) Document {
+	return Document{
+		Type:         TypePost,
+		ID:           strconv.FormatUint(uint64(post.ID), 10),
+		Title:        post.Title,
+		Body:         PlainText(post.Content),
+		URL:          "/blog/post/" + post.Slug,
+		VisibleFrom:  post.PublishAt,
+		VisibleUntil: post.UnpublishAt,
+	}
+}
+
+// PageDocument converts a custom page to a search document.
+func PageDocument(page model.CustomPage) Document {
+	return Document{
+		Type:         TypePage,
+		ID:           strconv.FormatUint(uint64(page.ID), 10),
+		Title:        page.Title,
+		Body:         PlainText(page.Content),
+		URL:          "/" + page.Slug,
+		VisibleFrom:  page.PublishAt,
+		VisibleUntil: page.UnpublishAt,
+	}
+}
+
+// SyncPost indexes the post if it is published or scheduled and removes it
+// from the index otherwise.
+func SyncPost(db *gorm.DB, id uint) {
+	var post model.Post
+	if err := db.First(&post, id).Error; err != nil || (!post.Published && post.PublishAt == nil) {
+		Remove(TypePost, strconv.FormatUint(uint64(id), 10))
+		return
+	}
+	Index(PostDocument(post))
+}
+
+// SyncPage indexes the custom page, or removes it if it no longer exists.
+func SyncPage(db *gorm.DB, id uint) {
+	var page model.CustomPage
+	if err := db.First(&page, id).Error; err != nil {
+		Remove(TypePage, strconv.FormatUint(uint64(id), 10))
+		return
+	}
+	Index(PageDocument(page))
+}
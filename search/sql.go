@@ -0,0 +1,50 @@
+package search
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// indexTable is the table the database engines keep their index in.
+const indexTable = "search_index"
+
+// sqlIndex holds what the SQLite, Postgres and MySQL engines share.
+type sqlIndex struct {
+	db *gorm.DB
+}
+
+func (s sqlIndex) Remove(docType, id string) error {
+	return s.db.Exec("DELETE FROM "+indexTable+" WHERE doc_key = ?", Document{Type: docType, ID: id}.Key()).Error
+}
+
+func (s sqlIndex) Clear() error {
+	return s.db.Exec("DELETE FROM " + indexTable).Error
+}
+
+func (s sqlIndex) Count() (int, error) {
+	var count int64
+	err := s.db.Raw("SELECT COUNT(*) FROM " + indexTable).Scan(&count).Error
+	return int(count), err
+}
+
+// visibleClause limits results to documents inside their visibility window.
+const visibleClause = "(visible_from IS NULL OR visible_from <= ?) AND (visible_until IS NULL OR visible_until > ?)"
+
+// sqlHit is a result row as the database engines select it.
+type sqlHit struct {
+	DocType string
+	DocID   string
+	Title   string
+	URL     string
+	Body    string
+	Score   float64
+	Snippet string
+}
+
+func nullableTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
@@ -0,0 +1,109 @@
+package search
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// sqliteEngine uses an FTS5 virtual table ranked with bm25.
+type sqliteEngine struct {
+	sqlIndex
+}
+
+func newSQLiteEngine(db *gorm.DB) (*sqliteEngine, error) {
+	err := db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS ` + indexTable + ` USING fts5(
+		doc_key UNINDEXED, doc_type UNINDEXED, doc_id UNINDEXED,
+		title, body,
+		url UNINDEXED, visible_from UNINDEXED, visible_until UNINDEXED,
+		tokenize = 'unicode61 remove_diacritics 2'
+	)`).Error
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteEngine{sqlIndex{db}}, nil
+}
+
+func (e *sqliteEngine) Name() string {
+	return "SQLite FTS5"
+}
+
+func (e *sqliteEngine) Index(docs ...Document) error {
+	return e.db.Transaction(func(tx *gorm.DB) error {
+		for _, doc := range docs {
+			if err := tx.Exec("DELETE FROM "+indexTable+" WHERE doc_key = ?", doc.Key()).Error; err != nil {
+				return err
+			}
+			err := tx.Exec("INSERT INTO "+indexTable+" (doc_key, doc_type, doc_id, title, body, url, visible_from, visible_until) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+				doc.Key(), doc.Type, doc.ID, doc.Title, doc.Body, doc.URL, unixTime(doc.VisibleFrom), unixTime(doc.VisibleUntil)).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (e *sqliteEngine) Search(query string, offset, limit int) (Results, error) {
+	match := ftsQuery(Terms(query))
+	if match == "" {
+		return Results{}, nil
+	}
+	now := time.Now().Unix()
+
+	var results Results
+	var total int64
+	err := e.db.Raw("SELECT COUNT(*) FROM "+indexTable+" WHERE "+indexTable+" MATCH ? AND "+visibleClause, match, now, now).
+		Scan(&total).Error
+	if err != nil {
+		return results, err
+	}
+	results.Total = int(total)
+
+	// bm25 takes one weight per column; titles count ten times as much as the body
+	var rows []sqlHit
+	err = e.db.Raw(`SELECT doc_type, doc_id, title, url,
+			-bm25(`+indexTable+`, 0, 0, 0, 10.0, 1.0, 0, 0, 0) AS score,
+			snippet(`+indexTable+`, 4, ?, ?, '…', 24) AS snippet
+		FROM `+indexTable+`
+		WHERE `+indexTable+` MATCH ? AND `+visibleClause+`
+		ORDER BY score DESC LIMIT ? OFFSET ?`,
+		markStart, markEnd, match, now, now, limit, offset).
+		Scan(&rows).Error
+	if err != nil {
+		return results, err
+	}
+
+	for _, row := range rows {
+		results.Hits = append(results.Hits, Hit{
+			Type:    row.DocType,
+			ID:      row.DocID,
+			Title:   row.Title,
+			URL:     row.URL,
+			Score:   row.Score,
+			Snippet: markedSnippet(row.Snippet),
+		})
+	}
+	return results, nil
+}
+
+// ftsQuery quotes every term so user input is never parsed as FTS5 syntax.
+// The last term matches as a prefix, for search-as-you-type.
+func ftsQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + term + `"`
+	}
+	if len(quoted) > 0 {
+		quoted[len(quoted)-1] += "*"
+	}
+	return strings.Join(quoted, " ")
+}
+
+func unixTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Unix()
+}
@@ -0,0 +1,117 @@
+package search
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Markers the database engines put around matches in their snippets. They
+// cannot appear in indexed text, so the snippet can be escaped safely first.
+const (
+	markStart = "\x02"
+	markEnd   = "\x03"
+)
+
+var (
+	tagRegex   = regexp.MustCompile(`<[^>]*>`)
+	blockRegex = regexp.MustCompile(`(?i)</(p|h[1-6]|li|div|blockquote|pre|tr)>|<br\s*/?>`)
+)
+
+// PlainText strips HTML tags and entities from content so only the readable
+// text gets indexed.
+func PlainText(content string) string {
+	content = blockRegex.ReplaceAllString(content, " ")
+	content = tagRegex.ReplaceAllString(content, "")
+	content = html.UnescapeString(content)
+	content = strings.NewReplacer(markStart, "", markEnd, "").Replace(content)
+	return strings.Join(strings.Fields(content), " ")
+}
+
+// Terms splits a query into lower case words, ignoring punctuation and any
+// query syntax of the underlying engines.
+func Terms(query string) []string {
+	words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	seen := make(map[string]bool, len(words))
+	terms := make([]string, 0, len(words))
+	for _, word := range words {
+		if !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// markedSnippet escapes an engine snippet and turns its markers into <mark>.
+func markedSnippet(snippet string) template.HTML {
+	escaped := template.HTMLEscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, markStart, "<mark>")
+	escaped = strings.ReplaceAll(escaped, markEnd, "</mark>")
+	return template.HTML(escaped)
+}
+
+// Highlight cuts a window of about size bytes around the first match of the
+// query in text and wraps every match in <mark>. It is used by engines that
+// cannot build snippets themselves.
+func Highlight(text, query string, size int) template.HTML {
+	terms := Terms(query)
+	if len(terms) == 0 || text == "" {
+		return template.HTML(template.HTMLEscapeString(truncate(text, size)))
+	}
+
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	re := regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+
+	start := 0
+	if loc := re.FindStringIndex(text); loc != nil && loc[0] > size/3 {
+		start = loc[0] - size/3
+		for start < len(text) && !utf8.RuneStart(text[start]) {
+			start++
+		}
+	}
+	end := start + size
+	if end >= len(text) {
+		end = len(text)
+	} else {
+		for end > start && !utf8.RuneStart(text[end]) {
+			end--
+		}
+	}
+	window := text[start:end]
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("&hellip;")
+	}
+	last := 0
+	for _, loc := range re.FindAllStringIndex(window, -1) {
+		b.WriteString(template.HTMLEscapeString(window[last:loc[0]]))
+		b.WriteString("<mark>" + template.HTMLEscapeString(window[loc[0]:loc[1]]) + "</mark>")
+		last = loc[1]
+	}
+	b.WriteString(template.HTMLEscapeString(window[last:]))
+	if end < len(text) {
+		b.WriteString("&hellip;")
+	}
+	return template.HTML(b.String())
+}
+
+func truncate(text string, size int) string {
+	if len(text) <= size {
+		return text
+	}
+	for size > 0 && !utf8.RuneStart(text[size]) {
+		size--
+	}
+	return text[:size] + "…"
+}
@@ -0,0 +1,145 @@
+package spam
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"goxcms/model"
+
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// tokenize returns the distinct lower case words of a text that are long
+// enough to tell something.
+func tokenize(text string) []string {
+	seen := map[string]bool{}
+	var words []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) < 3 || len(word) > 64 || seen[word] {
+			continue
+		}
+		seen[word] = true
+		words = append(words, word)
+	}
+	return words
+}
+
+// checkBayes scores with a naive Bayes classifier trained by the moderators.
+// It stays quiet until spam.bayes_min_trained comments were labeled each way,
+// and only scores comments it finds more likely spam than not.
+func checkBayes(db *gorm.DB, s Submission) (Verdict, error) {
+	words := tokenize(s.Comment.Content)
+	if len(words) == 0 {
+		return Verdict{}, nil
+	}
+
+	var rows []model.SpamWord
+	if err := db.Where("word IN ?", append(words, "")).Find(&rows).Error; err != nil {
+		return Verdict{}, err
+	}
+	counts := make(map[string]model.SpamWord, len(rows))
+	for _, row := range rows {
+		counts[row.Word] = row
+	}
+
+	docs := counts[""]
+	if min := viper.GetInt("spam.bayes_min_trained"); docs.Spam < min || docs.Ham < min {
+		return Verdict{}, nil
+	}
+
+	/// word probabilities are smoothed, so words seen in one class only never decide alone
+	logSpam := math.Log(float64(docs.Spam) / float64(docs.Spam+docs.Ham))
+	logHam := math.Log(float64(docs.Ham) / float64(docs.Spam+docs.Ham))
+	for _, word := range words {
+		count, ok := counts[word]
+		if !ok {
+			continue
+		}
+		logSpam += math.Log(float64(count.Spam+1) / float64(docs.Spam+2))
+		logHam += math.Log(float64(count.Ham+1) / float64(docs.Ham+2))
+	}
+	probability := 1 / (1 + math.Exp(logHam-logSpam))
+
+	if probability <= 0.5 {
+		return Verdict{}, nil
+	}
+	return Verdict{
+		Score:  2*probability - 1,
+		Reason: "looks like earlier spam (" + strconv.Itoa(int(probability*100)) + "%)",
+	}, nil
+}
+
+// Learn trains the classifier with a comment a moderator labeled spam or not
+// spam, and returns the class to keep on the comment. A comment that was
+// labeled the other way before is taken back out of that class first.
+func Learn(db *gorm.DB, comment model.Comment, isSpam bool) (string, error) {
+	class := model.SpamClassHam
+	if isSpam {
+		class = model.SpamClassSpam
+	}
+	if comment.SpamClass == class {
+		return class, nil
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		words := append(tokenize(comment.Content), "")
+		if comment.SpamClass != "" {
+			if err := count(tx, words, comment.SpamClass, -1); err != nil {
+				return err
+			}
+		}
+		if err := count(tx, words, class, 1); err != nil {
+			return err
+		}
+		return tx.Model(&comment).Update("spam_class", class).Error
+	})
+	if err != nil {
+		return comment.SpamClass, err
+	}
+	return class, nil
+}
+
+// Forget takes a trained comment back out of its class. It has to run before
+// the text of the comment changes, so the counts keep matching what was
+// learned.
+func Forget(db *gorm.DB, comment model.Comment) error {
+	if comment.SpamClass == "" {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := count(tx, append(tokenize(comment.Content), ""), comment.SpamClass, -1); err != nil {
+			return err
+		}
+		return tx.Model(&comment).Update("spam_class", "").Error
+	})
+}
+
+// count adds delta to the class column of the words.
+func count(tx *gorm.DB, words []string, class string, delta int) error {
+	column := "ham"
+	if class == model.SpamClassSpam {
+		column = "spam"
+	}
+	for _, word := range words {
+		row := model.SpamWord{Word: word}
+		if column == "spam" {
+			row.Spam = delta
+		} else {
+			row.Ham = delta
+		}
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "word"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{column: gorm.Expr("spam_words."+column+" + ?", delta)}),
+		}).Create(&row).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
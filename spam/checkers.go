@@ -0,0 +1,108 @@
+package spam
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"goxcms/model"
+
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+func checkHoneypot(db *gorm.DB, s Submission) (Verdict, error) {
+	if s.Form && s.Honeypot != "" {
+		return Verdict{Score: 1, Reason: "filled in the hidden field"}, nil
+	}
+	return Verdict{}, nil
+}
+
+// checkTiming flags forms sent back too fast for a person to have written a
+// comment, and forms that never showed a form token.
+func checkTiming(db *gorm.DB, s Submission) (Verdict, error) {
+	if !s.Form {
+		return Verdict{}, nil
+	}
+	shown, ok := formTokenTime(s.FormToken)
+	if !ok {
+		return Verdict{Score: 0.5, Reason: "no valid form token"}, nil
+	}
+	took := time.Since(shown)
+	if min := time.Duration(viper.GetInt("spam.min_seconds")) * time.Second; took < min {
+		return Verdict{Score: 1, Reason: "sent " + strconv.Itoa(int(took.Seconds())) + "s after the form was shown"}, nil
+	}
+	return Verdict{}, nil
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(https?://|www\.)`)
+
+// checkLinks adds half a point for every link above spam.max_links.
+func checkLinks(db *gorm.DB, s Submission) (Verdict, error) {
+	links := len(linkPattern.FindAllString(s.Comment.Content, -1))
+	if extra := links - viper.GetInt("spam.max_links"); extra > 0 {
+		return Verdict{Score: 0.5 * float64(extra), Reason: strconv.Itoa(links) + " links"}, nil
+	}
+	return Verdict{}, nil
+}
+
+func checkBlocklist(db *gorm.DB, s Submission) (Verdict, error) {
+	words := map[string]bool{}
+	for _, word := range tokenize(s.Comment.Content) {
+		words[word] = true
+	}
+
+	var found []string
+	for _, blocked := range viper.GetStringSlice("spam.blocklist") {
+		blocked = strings.ToLower(strings.TrimSpace(blocked))
+		if blocked == "" {
+			continue
+		}
+		/// phrases are matched in the text, single words against its words
+		if strings.Contains(blocked, " ") && strings.Contains(strings.ToLower(s.Comment.Content), blocked) || words[blocked] {
+			found = append(found, blocked)
+		}
+	}
+	if len(found) > 0 {
+		return Verdict{Score: float64(len(found)), Reason: "blocked words " + strings.Join(found, ", ")}, nil
+	}
+	return Verdict{}, nil
+}
+
+// checkRate flags users and IP addresses that comment more often than
+// spam.max_per_user and spam.max_per_ip allow.
+func checkRate(db *gorm.DB, s Submission) (Verdict, error) {
+	if s.Edit {
+		return Verdict{}, nil
+	}
+	window := viper.GetInt("spam.rate_window_minutes")
+	since := time.Now().Add(-time.Duration(window) * time.Minute)
+
+	var verdict Verdict
+	var reasons []string
+	limits := []struct {
+		column string
+		value  interface{}
+		max    int
+		skip   bool
+	}{
+		{"user_id", s.Comment.UserID, viper.GetInt("spam.max_per_user"), s.Comment.UserID == 0},
+		{"ip", s.IP, viper.GetInt("spam.max_per_ip"), s.IP == ""},
+	}
+	for _, limit := range limits {
+		if limit.skip || limit.max <= 0 {
+			continue
+		}
+		var count int64
+		if err := db.Model(&model.Comment{}).Where(limit.column+" = ? AND created_at > ?", limit.value, since).Count(&count).Error; err != nil {
+			return Verdict{}, err
+		}
+		if count >= int64(limit.max) {
+			verdict.Score = 1
+			reasons = append(reasons, strconv.FormatInt(count, 10)+" comments from this "+strings.TrimSuffix(limit.column, "_id")+" in "+strconv.Itoa(window)+" minutes")
+		}
+	}
+	verdict.Reason = strings.Join(reasons, ", ")
+	return verdict, nil
+}
@@ -0,0 +1,159 @@
+// Package spam scores new comments. Every registered checker looks at a
+// submission and the scores add up; a comment that reaches spam.threshold
+// goes straight to the spam folder. The built-in checkers run locally, and
+// plugins can register others, such as a hosted spam service.
+package spam
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"goxcms/model"
+
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// Submission is a comment about to be saved.
+type Submission struct {
+	Comment   model.Comment // with UserID, PostID, ParentID and Content set
+	IP        string
+	Form      bool   // sent from the comment form, which has the honeypot and the form token
+	Honeypot  string // a field hidden from people, so only bots fill it in
+	FormToken string // from NewFormToken when the form was shown
+	Edit      bool   // a saved comment its author changed, which the rate limits leave alone
+}
+
+// Verdict is what one checker thinks of a submission. A checker that is sure
+// it is spam scores 1, one that has no opinion scores 0.
+type Verdict struct {
+	Score  float64
+	Reason string // shown to moderators when Score is above 0
+}
+
+// Checker scores submissions.
+type Checker interface {
+	Check(db *gorm.DB, s Submission) (Verdict, error)
+}
+
+// CheckerFunc lets a function be used as a Checker.
+type CheckerFunc func(db *gorm.DB, s Submission) (Verdict, error)
+
+func (f CheckerFunc) Check(db *gorm.DB, s Submission) (Verdict, error) {
+	return f(db, s)
+}
+
+var (
+	mu       sync.RWMutex
+	checkers = map[string]Checker{
+		"honeypot":  CheckerFunc(checkHoneypot),
+		"timing":    CheckerFunc(checkTiming),
+		"links":     CheckerFunc(checkLinks),
+		"blocklist": CheckerFunc(checkBlocklist),
+		"rate":      CheckerFunc(checkRate),
+		"bayes":     CheckerFunc(checkBayes),
+	}
+)
+
+// Register adds a checker under a name, replacing one with the same name.
+func Register(name string, checker Checker) {
+	mu.Lock()
+	defer mu.Unlock()
+	checkers[name] = checker
+}
+
+// Unregister removes a checker, for Teardown.
+func Unregister(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(checkers, name)
+}
+
+// Result is the combined score of a submission.
+type Result struct {
+	Score   float64
+	Reasons []string
+}
+
+// IsSpam reports whether the score reaches spam.threshold.
+func (r Result) IsSpam() bool {
+	return r.Score >= viper.GetFloat64("spam.threshold")
+}
+
+// Summary joins the reasons, short enough for Comment.SpamReasons.
+func (r Result) Summary() string {
+	summary := strings.Join(r.Reasons, "; ")
+	for len(summary) > 512 {
+		_, size := utf8.DecodeLastRuneInString(summary)
+		summary = summary[:len(summary)-size]
+	}
+	return summary
+}
+
+// Check runs every checker on the submission. A checker that fails is logged
+// and left out, so a broken plugin never keeps comments from being posted.
+func Check(db *gorm.DB, s Submission) Result {
+	mu.RLock()
+	names := make([]string, 0, len(checkers))
+	for name := range checkers {
+		names = append(names, name)
+	}
+	mu.RUnlock()
+	sort.Strings(names)
+
+	var result Result
+	for _, name := range names {
+		mu.RLock()
+		checker, ok := checkers[name]
+		mu.RUnlock()
+		if !ok {
+			continue
+		}
+
+		verdict, err := checker.Check(db, s)
+		if err != nil {
+			log.Printf("Spam checker %s failed: %v", name, err)
+			continue
+		}
+		if verdict.Score > 0 {
+			result.Score += verdict.Score
+			result.Reasons = append(result.Reasons, name+": "+verdict.Reason)
+		}
+	}
+	return result
+}
+
+// NewFormToken returns the value of the form token field, which tells the
+// timing checker when the form was shown.
+func NewFormToken() string {
+	stamp := strconv.FormatInt(time.Now().Unix(), 10)
+	return stamp + "." + formTokenMAC(stamp)
+}
+
+// formTokenTime returns when a form token was made, or false if it was not
+// made by NewFormToken.
+func formTokenTime(token string) (time.Time, bool) {
+	stamp, mac, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(mac), []byte(formTokenMAC(stamp))) {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+func formTokenMAC(stamp string) string {
+	mac := hmac.New(sha256.New, []byte(viper.GetString("app.secret")))
+	mac.Write([]byte("comment-form:" + stamp))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cache"
+	"github.com/gofiber/storage/redis/v3"
+	"github.com/spf13/viper"
+)
+
+// cacheKeyPrefix sets cached responses apart from sessions, which share the
+// Redis database with them.
+const cacheKeyPrefix = "cache:"
+
+// cacheGeneration is part of every cache key. Bumping it makes the process
+// miss all earlier entries, which then expire on their own.
+var cacheGeneration atomic.Int64
+
+// newResponseCache caches whole responses in storage. Without Redis every
+// process keeps its own cache in memory, which ClearCache reaches through
+// the file set by cache.clear_file.
+func newResponseCache(storage fiber.Storage) fiber.Handler {
+	if !viper.GetBool("redis.enabled") {
+		watchCacheClearFile()
+	}
+
+	handler := cache.New(cache.Config{
+		Expiration: 30 * time.Minute,
+		Storage:    storage,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			return cacheKeyPrefix + strconv.FormatInt(cacheGeneration.Load(), 10) + ":" + c.Path()
+		},
+		// Redirects are not stored, a cached copy would lose its Location header
+		Next: func(c *fiber.Ctx) bool {
+			status := c.Response().StatusCode()
+			return status >= fiber.StatusMultipleChoices && status < fiber.StatusBadRequest
+		},
+	})
+
+	/// the middleware only asks Next before storing, it would still serve these requests a cached copy
+	return func(c *fiber.Ctx) error {
+		if skipCache(c) {
+			return c.Next()
+		}
+		return handler(c)
+	}
+}
+
+// ClearCache drops every cached response. With Redis the keys are deleted
+// right away; otherwise the running server processes are told to empty
+// their caches, which they do within a few seconds.
+func ClearCache() error {
+	if viper.GetBool("redis.enabled") {
+		storage := newRedisStorage()
+		defer storage.Close()
+
+		ctx := context.Background()
+		conn := storage.Conn()
+		iter := conn.Scan(ctx, 0, cacheKeyPrefix+"*", 500).Iterator()
+		for iter.Next(ctx) {
+			if err := conn.Del(ctx, iter.Val()).Err(); err != nil {
+				return err
+			}
+		}
+		return iter.Err()
+	}
+
+	path := viper.GetString("cache.clear_file")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strconv.FormatInt(time.Now().UnixNano(), 10)), 0o644)
+}
+
+// watchCacheClearFile starts a new cache generation whenever ClearCache
+// writes the clear file.
+func watchCacheClearFile() {
+	path := viper.GetString("cache.clear_file")
+	read := func() string {
+		data, _ := os.ReadFile(path)
+		return strings.TrimSpace(string(data))
+	}
+	last := read()
+
+	go func() {
+		for range time.Tick(5 * time.Second) {
+			if current := read(); current != last {
+				last = current
+				cacheGeneration.Add(1)
+				log.Println("Response cache cleared")
+			}
+		}
+	}()
+}
+
+func newRedisStorage() *redis.Storage {
+	return redis.New(redis.Config{
+		Host:     viper.GetString("redis.host"),
+		Port:     viper.GetInt("redis.port"),
+		Username: viper.GetString("redis.username"),
+		Password: viper.GetString("redis.password"),
+		Database: viper.GetInt("redis.database"),
+		PoolSize: viper.GetInt("redis.pool_size"),
+	})
+}
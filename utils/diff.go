@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"regexp"
+	"strings"
+)
+
+// DiffLine is one line of a line-level diff.
+type DiffLine struct {
+	Op   string // "equal", "insert" or "delete"
+	Text string
+}
+
+// maxDiffCells bounds the LCS table so huge documents cannot exhaust memory.
+const maxDiffCells = 4000000
+
+var blockEndRegex = regexp.MustCompile(`(?i)(</(p|h[1-6]|li|ul|ol|blockquote|pre|div|table|tr)>|<br\s*/?>)`)
+
+// SplitDiffLines splits HTML content into lines, breaking after block level
+// tags because editor content is usually stored on a single line.
+func SplitDiffLines(content string) []string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = blockEndRegex.ReplaceAllString(content, "$1\n")
+
+	lines := strings.Split(content, "\n")
+	result := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// DiffLines computes a line-level diff between two texts using the longest
+// common subsequence of their lines.
+func DiffLines(oldText, newText string) []DiffLine {
+	a, b := SplitDiffLines(oldText), SplitDiffLines(newText)
+
+	if len(a)*len(b) > maxDiffCells {
+		diff := make([]DiffLine, 0, len(a)+len(b))
+		for _, line := range a {
+			diff = append(diff, DiffLine{Op: "delete", Text: line})
+		}
+		for _, line := range b {
+			diff = append(diff, DiffLine{Op: "insert", Text: line})
+		}
+		return diff
+	}
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := make([]DiffLine, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			diff = append(diff, DiffLine{Op: "equal", Text: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, DiffLine{Op: "delete", Text: a[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{Op: "insert", Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, DiffLine{Op: "delete", Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, DiffLine{Op: "insert", Text: b[j]})
+	}
+
+	return diff
+}
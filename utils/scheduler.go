@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"goxcms/hooks"
+	"goxcms/model"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// StartScheduler publishes and unpublishes posts and pages when their
+// PublishAt and UnpublishAt times arrive, and keeps the sitemap up to date.
+// With prefork enabled only the parent process runs it.
+func StartScheduler(db *gorm.DB) {
+	if fiber.IsChild() {
+		return
+	}
+
+	interval := time.Duration(viper.GetInt("scheduler.interval_seconds")) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	go func() {
+		last := time.Now()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			RunScheduledPublishing(db, last, now)
+			last = now
+		}
+	}()
+
+	log.Printf("Publishing scheduler started, checking every %s", interval)
+}
+
+// RunScheduledPublishing applies every schedule that is due at now and
+// regenerates the sitemap when it changed the status of any row, or when
+// anything was edited or crossed a schedule boundary since the previous run.
+func RunScheduledPublishing(db *gorm.DB, since, now time.Time) {
+	var changed int64
+
+	publishDue := func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("published = ? AND publish_at IS NOT NULL AND publish_at <= ? AND (unpublish_at IS NULL OR unpublish_at > ?)", false, now, now)
+	}
+	unpublishDue := func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("published = ? AND unpublish_at IS NOT NULL AND unpublish_at <= ?", true, now)
+	}
+
+	/// load the posts that are about to change so their hooks can fire afterwards
+	var toPublish, toUnpublish []model.Post
+	if hooks.HasAction(hooks.PostPublished) {
+		db.Scopes(publishDue).Find(&toPublish)
+	}
+	if hooks.HasAction(hooks.PostUnpublished) {
+		db.Scopes(unpublishDue).Find(&toUnpublish)
+	}
+
+	for _, table := range []interface{}{&model.Post{}, &model.CustomPage{}} {
+		/// rows are stamped with now rather than the time of the write, so the edit check below never counts the scheduler's own updates and RowsAffected alone decides whether they changed anything
+		published := db.Model(table).Scopes(publishDue).Updates(map[string]interface{}{"published": true, "updated_at": now})
+		if published.Error != nil {
+			log.Printf("Scheduler failed to publish: %v", published.Error)
+		}
+
+		unpublished := db.Model(table).Scopes(unpublishDue).Updates(map[string]interface{}{"published": false, "updated_at": now})
+		if unpublished.Error != nil {
+			log.Printf("Scheduler failed to unpublish: %v", unpublished.Error)
+		}
+
+		changed += published.RowsAffected + unpublished.RowsAffected
+
+		/// content edited by hand since the previous run or a schedule boundary crossed without a status change
+		var touched int64
+		db.Model(table).
+			Where("(updated_at > ? AND updated_at < ?) OR (publish_at > ? AND publish_at <= ?) OR (unpublish_at > ? AND unpublish_at <= ?)", since, now, since, now, since, now).
+			Count(&touched)
+		changed += touched
+	}
+
+	/// profiles that were made private or public
+	var profiles int64
+	db.Model(&model.User{}).Where("updated_at > ?", since).Count(&profiles)
+	changed += profiles
+
+	for _, post := range toPublish {
+		post.Published = true
+		hooks.DoAction(hooks.PostPublished, post)
+	}
+	for _, post := range toUnpublish {
+		post.Published = false
+		hooks.DoAction(hooks.PostUnpublished, post)
+	}
+
+	if changed > 0 {
+		GenerateSiteMap(db)
+	}
+}
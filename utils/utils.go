@@ -14,10 +14,8 @@ import (
 	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cache"
 	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/gofiber/fiber/v2/middleware/session"
-	"github.com/gofiber/storage/redis/v3"
 	"github.com/gofiber/template/html/v2"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/bcrypt"
@@ -58,6 +56,48 @@ func InitConfig() {
 	viper.SetDefault("captcha.public_key", "")
 	viper.SetDefault("captcha.secret_key", "")
 	viper.SetDefault("captcha.enabled", false)
+	viper.SetDefault("login_throttle.enabled", true)
+	viper.SetDefault("login_throttle.free_attempts", 3)
+	viper.SetDefault("login_throttle.base_delay_seconds", 2)
+	viper.SetDefault("login_throttle.max_delay_seconds", 300)
+	viper.SetDefault("login_throttle.lockout_attempts", 10)
+	viper.SetDefault("login_throttle.ip_lockout_attempts", 50)
+	viper.SetDefault("login_throttle.lockout_minutes", 15)
+	viper.SetDefault("login_throttle.window_minutes", 30)
+	viper.SetDefault("scheduler.interval_seconds", 60)
+	viper.SetDefault("feed.items", 20)
+	viper.SetDefault("feed.full_content", true)
+	viper.SetDefault("search.engine", "auto")
+	viper.SetDefault("search.bleve_path", "./data/search.bleve")
+	viper.SetDefault("search.language", "simple")
+	viper.SetDefault("search.refresh_minutes", 10)
+	viper.SetDefault("plugins.sync_interval_seconds", 10)
+	viper.SetDefault("database.auto_migrate", true)
+	viper.SetDefault("cache.clear_file", "./data/cache.clear")
+	viper.SetDefault("comments.max_depth", 3)
+	viper.SetDefault("comments.edit_minutes", 15)
+	viper.SetDefault("spam.threshold", 1.0)
+	viper.SetDefault("spam.min_seconds", 3)
+	viper.SetDefault("spam.max_links", 2)
+	viper.SetDefault("spam.blocklist", []string{})
+	viper.SetDefault("spam.rate_window_minutes", 10)
+	viper.SetDefault("spam.max_per_user", 5)
+	viper.SetDefault("spam.max_per_ip", 10)
+	viper.SetDefault("spam.bayes_min_trained", 10)
+	viper.SetDefault("mail.driver", "log")
+	viper.SetDefault("mail.from", "GoX CMS <noreply@localhost>")
+	viper.SetDefault("mail.file_dir", "./data/mail")
+	viper.SetDefault("mail.smtp.host", "localhost")
+	viper.SetDefault("mail.smtp.port", 587)
+	viper.SetDefault("mail.smtp.username", "")
+	viper.SetDefault("mail.smtp.password", "")
+	viper.SetDefault("mail.smtp.encryption", "starttls")
+	viper.SetDefault("mail.smtp.timeout_seconds", 15)
+	viper.SetDefault("mail.reset_minutes", 60)
+	viper.SetDefault("mail.verification_hours", 48)
+	viper.SetDefault("mail.invitation_days", 7)
+	viper.SetDefault("auth.oidc.auto_provision", true)
+	viper.SetDefault("auth.oidc.default_role", "User")
 
 	if viper.GetBool("redis.enabled") {
 		log.Println("Redis enabled")
@@ -127,14 +167,7 @@ func SetupStore(app *fiber.App) *session.Store {
 	var store *session.Store
 
 	if viper.GetBool("redis.enabled") {
-		redisStorage := redis.New(redis.Config{
-			Host:     viper.GetString("redis.host"),
-			Port:     viper.GetInt("redis.port"),
-			Username: viper.GetString("redis.username"),
-			Password: viper.GetString("redis.password"),
-			Database: viper.GetInt("redis.database"),
-			PoolSize: viper.GetInt("redis.pool_size"),
-		})
+		redisStorage := newRedisStorage()
 
 		store = session.New(session.Config{
 			Expiration:     24 * time.Hour,
@@ -143,13 +176,7 @@ func SetupStore(app *fiber.App) *session.Store {
 			Storage:        redisStorage,
 		})
 
-		app.Use(cache.New(cache.Config{
-			Next: func(c *fiber.Ctx) bool {
-				return c.Get("X-No-Cache") == "true"
-			},
-			Expiration: 30 * time.Minute,
-			Storage:    redisStorage,
-		}))
+		app.Use(newResponseCache(redisStorage))
 	} else {
 		store = session.New(session.Config{
 			Expiration:     24 * time.Hour,
@@ -157,13 +184,7 @@ func SetupStore(app *fiber.App) *session.Store {
 			CookieSecure:   !isWindows(),
 		})
 
-		app.Use(cache.New(cache.Config{
-			Next: func(c *fiber.Ctx) bool {
-				return c.Get("X-No-Cache") == "true"
-			},
-			Expiration: 30 * time.Minute,
-			Storage:    store.Storage,
-		}))
+		app.Use(newResponseCache(store.Storage))
 	}
 
 	if store == nil {
@@ -182,6 +203,44 @@ func SetupStore(app *fiber.App) *session.Store {
 	return store
 }
 
+// skipCache leaves out the requests the cache, which keys responses by path
+// alone, must not answer:
+//   - requests that asked not to be cached with X-No-Cache
+//   - every request of a logged in user
+//   - search results, registration, the password reset and email verification
+//     links, the second login step and the audit export
+//   - account, admin, API, identity provider and user profile pages
+//   - posts seen by returning guests, whose comment forms are filled in
+//   - feeds, which answer conditional requests themselves with ETag and
+//     Last-Modified
+func skipCache(c *fiber.Ctx) bool {
+	if c.Get("X-No-Cache") == "true" {
+		return true
+	}
+	switch c.Path() {
+	case "/search", "/register", "/reset-password", "/verify-email", "/login/2fa", "/admin/audit/export":
+		return true
+	}
+	if c.Cookies("jwt") != "" {
+		return true
+	}
+	for _, prefix := range []string{"/account/", "/admin/", "/api/", "/auth/", "/user/"} {
+		if strings.HasPrefix(c.Path(), prefix) {
+			return true
+		}
+	}
+	/// the comment forms of returning guests are filled in for them
+	if strings.HasPrefix(c.Path(), "/blog/post/") && c.Cookies("comment_guest") != "" {
+		return true
+	}
+	for _, feed := range []string{"/feed.xml", "/atom.xml", "/feed.json"} {
+		if strings.HasSuffix(c.Path(), feed) {
+			return true
+		}
+	}
+	return false
+}
+
 func SetupRateLimiter(app *fiber.App, store *session.Store) {
 	if viper.GetBool("ratelimiter.enabled") {
 		log.Println("Rate limiter enabled")
@@ -208,19 +267,20 @@ func GenerateSiteMap(db *gorm.DB) {
 	// Use a single query to fetch all required data
 	var posts []model.Post
 	var users []model.User
-	var categories []model.Category
 	var tags []model.Tag
 	var customPages []model.CustomPage
 
-	db.Where("published = ?", true).Find(&posts)
-	db.Select("id").Find(&users)
-	db.Select("slug").Find(&categories)
+	db.Scopes(model.PublishedPosts).Find(&posts)
+	db.Select("id").Where("private_profile = ?", false).Find(&users)
+	/// categories are listed in tree order, every category before its subcategories
+	tree, _ := model.CategoryTree(db)
+	categories := model.FlattenCategoryTree(tree)
 	db.Select("slug").Find(&tags)
-	db.Where("published = ?", true).Select("slug").Find(&customPages)
+	db.Scopes(model.PublishedPages).Select("slug").Find(&customPages)
 
 	// Pre-allocate the urls slice
 	totalURLs := len(urls) + len(posts) + len(users) + len(categories) + len(tags) + len(customPages)
-	urls = make([]string, 0, totalURLs)
+	urls = append(make([]string, 0, totalURLs), urls...)
 
 	for _, post := range posts {
 		urls = append(urls, "/blog/post/"+post.Slug)
@@ -308,9 +368,72 @@ func CreateBasicWebsiteInfo(db *gorm.DB) {
 		log.Println("Basic website info created successfully")
 	}
 
+	CreateDefaultRoles(db)
 	createDefaultAdminUser(db)
 }
 
+// CreateDefaultRoles makes sure every permission and built-in role exists.
+func CreateDefaultRoles(db *gorm.DB) {
+	for _, permission := range model.DefaultPermissions {
+		p := permission
+		if err := db.Where("name = ?", p.Name).FirstOrCreate(&p).Error; err != nil {
+			log.Fatalf("Failed to create permission %s: %v", p.Name, err)
+		}
+	}
+
+	var allPermissions []model.Permission
+	db.Find(&allPermissions)
+
+	builtInRoles := []model.Role{
+		{ID: model.RoleUserID, Name: model.RoleUser},
+		{ID: model.RoleAdminID, Name: model.RoleAdmin},
+		{Name: model.RoleEditor},
+		{Name: model.RoleAuthor},
+		{Name: model.RoleModerator},
+		{Name: model.RoleShopManager},
+	}
+
+	for _, builtIn := range builtInRoles {
+		var role model.Role
+		query := db.Where("name = ?", builtIn.Name)
+		if builtIn.ID != 0 {
+			query = db.Where("id = ?", builtIn.ID)
+		}
+
+		if err := query.First(&role).Error; err == nil {
+			// Permissions of existing roles are managed from the admin panel,
+			// only the admin role is kept in sync with every known permission.
+			if role.ID == model.RoleAdminID {
+				db.Model(&role).Association("Permissions").Replace(allPermissions)
+			}
+			continue
+		}
+
+		role = builtIn
+		if err := db.Create(&role).Error; err != nil {
+			log.Fatalf("Failed to create role %s: %v", builtIn.Name, err)
+		}
+		/// Postgres does not move the id sequence past explicit IDs, so the next role would get the same ID, MySQL and SQLite do it themselves
+		if builtIn.ID != 0 && db.Dialector.Name() == "postgres" {
+			if err := db.Exec("SELECT setval(pg_get_serial_sequence('roles', 'id'), (SELECT MAX(id) FROM roles))").Error; err != nil {
+				log.Fatalf("Failed to advance the role ID sequence: %v", err)
+			}
+		}
+
+		var permissions []model.Permission
+		if role.ID == model.RoleAdminID {
+			permissions = allPermissions
+		} else {
+			db.Where("name IN ?", model.DefaultRolePermissions[role.Name]).Find(&permissions)
+		}
+
+		if len(permissions) > 0 {
+			db.Model(&role).Association("Permissions").Replace(permissions)
+		}
+		log.Printf("Role %s created successfully", role.Name)
+	}
+}
+
 func createDefaultAdminUser(db *gorm.DB) {
 	var count int64
 	db.Model(&model.User{}).Where("username = ?", "admin").Count(&count)
@@ -325,7 +448,7 @@ func createDefaultAdminUser(db *gorm.DB) {
 		newUser := model.User{
 			Username:  "admin",
 			Password:  string(hashedPassword),
-			RoleID:    2, // Assuming 2 is the admin role ID
+			RoleID:    model.RoleAdminID,
 			FirstName: "Admin",
 			LastName:  "User",
 			Email:     &email,